@@ -15,6 +15,7 @@ import (
 	"replicated-clob/pkg/api"
 	"replicated-clob/pkg/handlers"
 	"replicated-clob/pkg/obs"
+	"replicated-clob/pkg/orderbook"
 	"replicated-clob/pkg/replica"
 
 	"github.com/gofiber/fiber/v2"
@@ -24,14 +25,29 @@ import (
 func main() {
 	port := flag.Int("port", 0, "port for the HTTP server")
 	flag.IntVar(port, "p", 0, "shorthand for --port")
-	mode := flag.String("mode", string(replica.NodeRolePrimary), "node mode: primary or secondary")
+	mode := flag.String("mode", string(replica.NodeRolePrimary), "node mode: primary, secondary or learner")
 	flag.StringVar(mode, "m", string(replica.NodeRolePrimary), "shorthand for --mode")
 	peers := flag.String("peers", "", "comma-separated peer URLs for primary replication fanout")
 	primary := flag.String("primary", "", "primary URL for secondaries")
+	advertiseURL := flag.String("advertise-url", "", "this node's URL as its peers reach it; needed to transfer leadership away and for a learner to notice its promotion")
+	requireCollateral := flag.Bool("require-collateral", orderbook.DefaultRequireCollateral, "reject orders that exceed the user's available balance; must match across nodes, and /admin/collateral changes it on a running cluster")
+	orderHistoryLimit := flag.Int("order-history-limit", orderbook.DefaultOrderHistoryLimit, "finished orders kept for status lookups; must match across nodes")
+	clientOrderRetention := flag.Int("client-order-retention", orderbook.DefaultClientOrderRetention, "finished orders whose client order IDs are kept for duplicate detection; must match across nodes")
+	pipelineDepth := flag.Int("pipeline-depth", replica.DefaultPipelineDepth, "order writes replicated concurrently; must match across nodes")
+	groupCommitSize := flag.Int("group-commit-size", replica.DefaultGroupCommitSize, "max entries sent in one prepare request; batches never exceed --pipeline-depth")
+	groupCommitDelay := flag.Duration("group-commit-delay", 0, "how long a pipelined write may wait for others to join its batch")
+	heartbeatInterval := flag.Duration("heartbeat-interval", replica.DefaultHeartbeatInterval, "how often the primary sends its commit sequence to followers")
+	snapshotCatchUpLag := flag.Int64("snapshot-catch-up-lag", replica.DefaultSnapshotCatchUpLag, "entries a follower may lag before catch-up sends it a snapshot")
+	readMode := flag.String("read-mode", string(replica.ReadModeReadIndex), "how reads are made linearizable: read_index or lease")
+	leaseDuration := flag.Duration("lease-duration", replica.DefaultLeaseDuration, "how long a quorum acknowledgement lets the primary serve reads locally in lease mode")
 	flag.Parse()
 	if *port == 0 {
 		panic("missing required --port (or -p)")
 	}
+	parsedReadMode, err := replica.ParseReadMode(*readMode)
+	if err != nil {
+		panic(err)
+	}
 
 	parsedMode := replica.NodeRole(*mode)
 	obs := obs.New()
@@ -48,6 +64,7 @@ func main() {
 		}
 	}
 	replicaCoordinator := replica.NewCoordinator(parsedMode, peerURLs, *primary)
+	replicaCoordinator.SetSelf(*advertiseURL)
 	obs.LogNotice(
 		ctx,
 		"replica node startup: role=%s peers=%v required_peer_acks=%d can_accept_write=%t primary=%s",
@@ -88,6 +105,20 @@ func main() {
 	app.Use(cors.New())
 
 	handler := handlers.New(obs, replicaCoordinator)
+	// the book enforces collateral by default; only an explicit flag overrides it
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "require-collateral" {
+			handler.SetCollateralChecks(*requireCollateral)
+		}
+	})
+	handler.SetOrderHistoryLimit(*orderHistoryLimit)
+	handler.SetClientOrderRetention(*clientOrderRetention)
+	handler.SetPipelineDepth(*pipelineDepth)
+	handler.SetGroupCommit(*groupCommitSize, *groupCommitDelay)
+	handler.SetSnapshotCatchUpLag(*snapshotCatchUpLag)
+	handler.SetReadMode(parsedReadMode, *leaseDuration)
+	go handler.RunSessionMonitor(ctx)
+	go handler.RunReplicaHeartbeats(ctx, *heartbeatInterval)
 
 	var router fiber.Router = app
 
@@ -15,16 +15,76 @@ func New(router fiber.Router, handler *handlers.Handler, obs *obs.Client) {
 	writeOrders := orders.Group("")
 	writeOrders.Post("/post", handler.RequireWriteAccess(), handler.PostOrder)
 	writeOrders.Post("/cancel", handler.RequireWriteAccess(), handler.CancelOrder)
+	writeOrders.Post("/mass-cancel", handler.RequireWriteAccess(), handler.MassCancel)
+	writeOrders.Post("/trailing-stop", handler.RequireWriteAccess(), handler.PostTrailingStop)
+	writeOrders.Post("/batch", handler.RequireWriteAccess(), handler.PostBatch)
+	writeOrders.Post("/quote", handler.RequireWriteAccess(), handler.PostQuote)
 	orders.Get("/:userId", handler.GetOpenOrders)
+	orders.Get("/:userId/trailing-stops", handler.GetTrailingStops)
+	orders.Get("/:userId/client/:clientOrderId", handler.GetClientOrder)
+	orders.Get("/:userId/history", handler.GetOrderHistory)
+	orders.Get("/:userId/quote", handler.GetQuote)
+
+	router.Get("/order/:orderId", handler.GetOrderStatus)
+
+	accounts := router.Group("/accounts")
+	accounts.Post("/deposit", handler.RequireWriteAccess(), handler.Deposit)
+	accounts.Post("/withdraw", handler.RequireWriteAccess(), handler.Withdraw)
+	accounts.Get("/:userId", handler.GetAccount)
+
+	book := router.Group("/book")
+	book.Get("/depth", handler.GetDepth)
+
+	sessions := router.Group("/sessions")
+	sessions.Post("/start", handler.RequireWriteAccess(), handler.StartSession)
+	sessions.Post("/heartbeat", handler.RequireWriteAccess(), handler.Heartbeat)
+	sessions.Post("/end", handler.RequireWriteAccess(), handler.EndSession)
 
 	fills := router.Group("/fills")
 	fills.Get("/:userId", handler.GetFillsForUser)
 
+	positions := router.Group("/positions")
+	positions.Get("/:userId", handler.GetPosition)
+
+	fees := router.Group("/fees")
+	fees.Get("/:userId", handler.GetFeeSummary)
+
+	// should sit behind operator auth, same as internal routes
+	admin := router.Group("/admin")
+	admin.Post("/risk-limits", handler.RequireWriteAccess(), handler.SetRiskLimits)
+	admin.Post("/kill-switch", handler.RequireWriteAccess(), handler.KillSwitch)
+	admin.Get("/risk/:userId", handler.GetRiskState)
+	admin.Post("/market-phase", handler.RequireWriteAccess(), handler.SetMarketPhase)
+	admin.Post("/auction/uncross", handler.RequireWriteAccess(), handler.UncrossAuction)
+	admin.Post("/price-bands", handler.RequireWriteAccess(), handler.SetPriceBands)
+	admin.Get("/price-bands", handler.GetPriceBands)
+	admin.Post("/matching", handler.RequireWriteAccess(), handler.SetMatching)
+	admin.Get("/matching", handler.GetMatching)
+	admin.Post("/collateral", handler.RequireWriteAccess(), handler.SetCollateral)
+	admin.Get("/collateral", handler.GetCollateral)
+	admin.Post("/instrument", handler.RequireWriteAccess(), handler.SetInstrumentRules)
+	admin.Get("/instrument", handler.GetInstrumentRules)
+	admin.Post("/fee-tiers", handler.RequireWriteAccess(), handler.SetFeeTier)
+	admin.Post("/fee-tiers/assign", handler.RequireWriteAccess(), handler.AssignFeeTier)
+	admin.Get("/fee-tiers", handler.GetFeeTiers)
+	admin.Get("/cluster", handler.GetClusterMembership)
+	admin.Post("/cluster/add-node", handler.RequireWriteAccess(), handler.AddClusterNode)
+	admin.Post("/cluster/add-learner", handler.RequireWriteAccess(), handler.AddClusterLearner)
+	admin.Post("/cluster/promote", handler.RequireWriteAccess(), handler.PromoteClusterLearner)
+	admin.Post("/cluster/remove-node", handler.RequireWriteAccess(), handler.RemoveClusterNode)
+	admin.Post("/cluster/transfer-leadership", handler.RequireWriteAccess(), handler.TransferLeadership)
+
 	// should block requests outside of this cluster + have some secret key for this
 	internal := router.Group("/internal")
 	replicaRoutes := internal.Group("/replica")
 	replicaRoutes.Post("/prepare", handler.PrepareEntries)
 	replicaRoutes.Post("/commit", handler.CommitEntries)
+	replicaRoutes.Post("/heartbeat", handler.ReplicaHeartbeat)
 	replicaRoutes.Get("/state", handler.GetReplicaState)
+	replicaRoutes.Get("/peers", handler.GetReplicaPeers)
+	replicaRoutes.Get("/read-index", handler.GetReadIndex)
+	replicaRoutes.Post("/take-leadership", handler.TakeLeadership)
 	replicaRoutes.Get("/sync", handler.GetReplicaSync)
+	replicaRoutes.Get("/snapshot", handler.GetReplicaSnapshot)
+	replicaRoutes.Post("/install-snapshot", handler.InstallSnapshot)
 }
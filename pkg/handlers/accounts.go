@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"replicated-clob/pkg/orderbook"
+	"replicated-clob/pkg/replica"
+	"replicated-clob/schemas"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func (h *Handler) Deposit(c *fiber.Ctx) error {
+	return h.postBalanceChange(c, "account.deposit", replica.ReplicationWriteDeposit)
+}
+
+func (h *Handler) Withdraw(c *fiber.Ctx) error {
+	return h.postBalanceChange(c, "account.withdraw", replica.ReplicationWriteWithdraw)
+}
+
+func (h *Handler) GetAccount(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if userID == "" {
+		h.obs.LogErr(c.UserContext(), "account.query: missing userId")
+		return badRequest(c, errors.New("userId is required"))
+	}
+
+	ctx := c.UserContext()
+	h.obs.LogInfo(ctx, "account.query: user=%s", userID)
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "account.query: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	account := h.orderbook.AccountForUser(ctx, userID)
+	return jsonResponse(c, fiber.StatusOK, accountResponse(userID, account))
+}
+
+// SetCollateral turns collateral enforcement on or off through the log, so every node checks
+// orders the same way when they apply.
+func (h *Handler) SetCollateral(c *fiber.Ctx) error {
+	var req schemas.CollateralConfig
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "account.collateral: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+
+	h.obs.LogNotice(ctx, "account.collateral: require_collateral=%t", req.RequireCollateral)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:        h.replica.NextSequence(),
+		OpID:       uuid.NewString(),
+		Type:       replica.ReplicationWriteCollateral,
+		Collateral: &req,
+	}
+	if err := h.replicateWrite(ctx, "account.collateral", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	if _, err := h.replication.ApplyRemoteEntry(ctx, replicaEntry, h.applyReplicationSideEffect); err != nil {
+		h.obs.LogErr(ctx, "account.collateral commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, schemas.CollateralConfig{RequireCollateral: h.orderbook.CollateralChecks()})
+}
+
+func (h *Handler) GetCollateral(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "account.collateral: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, schemas.CollateralConfig{RequireCollateral: h.orderbook.CollateralChecks()})
+}
+
+func (h *Handler) postBalanceChange(c *fiber.Ctx, op string, writeType replica.ReplicationWriteType) error {
+	var req schemas.BalanceRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "%s: invalid request body", op)
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.User == "" {
+		h.obs.LogErr(ctx, "%s: user missing", op)
+		return badRequest(c, errors.New("user is required"))
+	}
+	if req.Base < 0 || req.Quote < 0 || (req.Base == 0 && req.Quote == 0) {
+		h.obs.LogErr(ctx, "%s: invalid amounts user=%s base=%d quote=%d", op, req.User, req.Base, req.Quote)
+		return badRequest(c, errors.New("base and quote must be non-negative and at least one greater than 0"))
+	}
+
+	h.obs.LogInfo(ctx, "%s: user=%s base=%d quote=%d", op, req.User, req.Base, req.Quote)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	if writeType == replica.ReplicationWriteWithdraw {
+		if err := h.orderbook.CheckWithdrawal(req.User, req.Base, req.Quote); err != nil {
+			h.obs.LogErr(ctx, "%s: rejected user=%s err=%v", op, req.User, err)
+			return rejected(c, err)
+		}
+	}
+
+	opID := uuid.New()
+	replicaEntry := replica.ReplicationEntry{
+		Seq:         h.replica.NextSequence(),
+		OpID:        opID.String(),
+		Type:        writeType,
+		User:        req.User,
+		BaseAmount:  req.Base,
+		QuoteAmount: req.Quote,
+	}
+
+	if err := h.replicateWrite(ctx, op, &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+
+	account, err := h.applyBalanceReplication(ctx, replicaEntry)
+	if err != nil {
+		h.obs.LogErr(ctx, "%s commit failed: seq=%d err=%v", op, replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	h.obs.LogInfo(ctx, "%s done: user=%s base=%d quote=%d", op, req.User, account.Base, account.Quote)
+	return jsonResponse(c, fiber.StatusOK, accountResponse(req.User, account))
+}
+
+func (h *Handler) applyBalanceReplication(ctx context.Context, entry replica.ReplicationEntry) (orderbook.Account, error) {
+	seqApplied, err := h.replica.ApplyRemote(entry)
+	if err != nil {
+		return orderbook.Account{}, err
+	}
+	if !seqApplied {
+		return h.orderbook.AccountForUser(ctx, entry.User), nil
+	}
+
+	switch entry.Type {
+	case replica.ReplicationWriteDeposit:
+		return h.orderbook.Deposit(ctx, entry.User, entry.BaseAmount, entry.QuoteAmount), nil
+	case replica.ReplicationWriteWithdraw:
+		return h.orderbook.Withdraw(ctx, entry.User, entry.BaseAmount, entry.QuoteAmount)
+	default:
+		return orderbook.Account{}, fmt.Errorf("replication entry is not a balance change: %s", entry.Type)
+	}
+}
+
+func accountResponse(user string, account orderbook.Account) schemas.AccountResponse {
+	return schemas.AccountResponse{
+		User:           user,
+		Base:           account.Base,
+		Quote:          account.Quote,
+		BaseHold:       account.BaseHold,
+		QuoteHold:      account.QuoteHold,
+		AvailableBase:  account.AvailableBase(),
+		AvailableQuote: account.AvailableQuote(),
+	}
+}
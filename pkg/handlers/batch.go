@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"replicated-clob/pkg/orderbook"
+	"replicated-clob/pkg/replica"
+	"replicated-clob/schemas"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const maxBatchOperations = 100
+
+// batchState is what the operations already accepted in a batch will do once applied, so later
+// operations in the same batch are checked against it.
+type batchState struct {
+	book         *orderbook.OrderBook
+	holds        map[string]orderbook.Account
+	pending      map[string]orderbook.PendingOrders
+	targeted     map[uuid.UUID]struct{}
+	clientOrders map[string]map[string]struct{}
+	// resting holds the prices of accepted orders by side, keyed by isBid.
+	resting map[bool][]int64
+	// allOrNothing batches also check the price bands against prints range, the prices earlier
+	// operations could trade at.
+	allOrNothing bool
+	prints       orderbook.PrintRange
+}
+
+func newBatchState(book *orderbook.OrderBook) *batchState {
+	return &batchState{
+		book:         book,
+		holds:        map[string]orderbook.Account{},
+		pending:      map[string]orderbook.PendingOrders{},
+		targeted:     map[uuid.UUID]struct{}{},
+		clientOrders: map[string]map[string]struct{}{},
+		resting:      map[bool][]int64{},
+	}
+}
+
+// addOrder records an accepted order. It may fill in full, so it counts toward the position on
+// its side as well as holding collateral and possibly an open order slot.
+func (s *batchState) addOrder(user string, priceLevel int64, amount int64, isBid bool, opensOrder bool) {
+	s.addHold(user, priceLevel, amount, isBid)
+	pending := s.pending[user]
+	if opensOrder {
+		pending.OpenOrders++
+	}
+	if isBid {
+		pending.Bought += amount
+	} else {
+		pending.Sold += amount
+	}
+	s.pending[user] = pending
+	s.resting[isBid] = append(s.resting[isBid], priceLevel)
+}
+
+// cancelOrder releases the hold and open order slot of a resting order the batch cancels.
+func (s *batchState) cancelOrder(user string, priceLevel int64, remaining int64, isBid bool) {
+	s.addHold(user, priceLevel, -remaining, isBid)
+	pending := s.pending[user]
+	pending.OpenOrders--
+	s.pending[user] = pending
+}
+
+// addHold counts a bid at the user's current hold price, which includes the worst fee it can pay.
+func (s *batchState) addHold(user string, priceLevel int64, amount int64, isBid bool) {
+	hold := s.holds[user]
+	if isBid {
+		hold.QuoteHold += s.book.BidHoldPrice(user, priceLevel) * amount
+	} else {
+		hold.BaseHold += amount
+	}
+	s.holds[user] = hold
+}
+
+// PostBatch posts, cancels and amends many orders with a single prepare and commit round trip.
+// Each operation is checked against the book as it stands plus the operations before it, and
+// gets its own result.
+func (h *Handler) PostBatch(c *fiber.Ctx) error {
+	var req schemas.BatchRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "order.batch: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if len(req.Operations) == 0 {
+		h.obs.LogErr(ctx, "order.batch: no operations")
+		return badRequest(c, errors.New("operations are required"))
+	}
+	if len(req.Operations) > maxBatchOperations {
+		h.obs.LogErr(ctx, "order.batch: too many operations count=%d", len(req.Operations))
+		return badRequest(c, fmt.Errorf("at most %d operations per batch", maxBatchOperations))
+	}
+
+	h.obs.LogInfo(ctx, "order.batch: operations=%d all_or_nothing=%v", len(req.Operations), req.AllOrNothing)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	state := newBatchState(h.orderbook)
+	state.allOrNothing = req.AllOrNothing
+	results := make([]schemas.BatchResult, len(req.Operations))
+	planned := make([]*replica.ReplicationEntry, len(req.Operations))
+	rejectedCount := 0
+	for i, op := range req.Operations {
+		planned[i], results[i] = h.checkBatchOperation(op, state)
+		if results[i].Status == schemas.BatchStatusRejected {
+			rejectedCount++
+		}
+	}
+
+	if rejectedCount > 0 && req.AllOrNothing {
+		for i := range results {
+			if results[i].Status != schemas.BatchStatusRejected {
+				results[i] = schemas.BatchResult{
+					Type:          results[i].Type,
+					Status:        schemas.BatchStatusSkipped,
+					ClientOrderID: results[i].ClientOrderID,
+				}
+			}
+			if results[i].Type == schemas.BatchOperationPost {
+				results[i].OrderID = ""
+			}
+		}
+		h.obs.LogErr(ctx, "order.batch: rejected all_or_nothing rejected=%d", rejectedCount)
+		return jsonResponse(c, fiber.StatusBadRequest, schemas.BatchResponse{
+			Results: results,
+		})
+	}
+
+	for i, op := range req.Operations {
+		if planned[i] != nil || results[i].Type != schemas.BatchOperationPost || results[i].Reason == "" {
+			continue
+		}
+		orderID, err := uuid.Parse(results[i].OrderID)
+		if err != nil {
+			continue
+		}
+		h.recordRejectedOrder(ctx, orderbook.Order{
+			User:          op.User,
+			ID:            orderID,
+			ClientOrderID: op.ClientOrderID,
+			PriceLevel:    op.PriceLevel,
+			Amount:        op.Amount,
+			IsBid:         op.IsBid,
+		}, &orderbook.OrderRejectError{Reason: orderbook.RejectReason(results[i].Reason), Message: results[i].Error})
+	}
+
+	entries := make([]replica.ReplicationEntry, 0, len(planned))
+	entryResults := make([]int, 0, len(planned))
+	for i, entry := range planned {
+		if entry == nil {
+			continue
+		}
+		entry.Seq = h.replica.NextSequence()
+		entries = append(entries, *entry)
+		entryResults = append(entryResults, i)
+	}
+
+	if len(entries) > 0 {
+		// Every entry travels in one prepare and one commit request.
+		if err := h.replicateWrites(ctx, "order.batch", entries); err != nil {
+			return temporaryUnavailable(c, err)
+		}
+	}
+
+	for i, entry := range entries {
+		if err := h.applyBatchEntry(ctx, entry, &results[entryResults[i]]); err != nil {
+			h.obs.LogErr(ctx, "order.batch commit failed: seq=%d err=%v", entry.Seq, err)
+			return internalServerError(c)
+		}
+	}
+
+	h.obs.LogInfo(ctx, "order.batch done: operations=%d entries=%d rejected=%d", len(req.Operations), len(entries), rejectedCount)
+	return jsonResponse(c, fiber.StatusOK, schemas.BatchResponse{
+		Results: results,
+	})
+}
+
+// checkBatchOperation runs the same checks as the single order endpoints and returns the entry
+// to replicate, if any. A post that fails its pre-trade checks still gets an order ID, so the
+// reject can be recorded on this node when the rest of the batch goes ahead.
+func (h *Handler) checkBatchOperation(op schemas.BatchOperation, state *batchState) (*replica.ReplicationEntry, schemas.BatchResult) {
+	result := schemas.BatchResult{
+		Type:          op.Type,
+		Status:        schemas.BatchStatusAccepted,
+		ClientOrderID: op.ClientOrderID,
+	}
+	reject := func(err error) (*replica.ReplicationEntry, schemas.BatchResult) {
+		result.Status = schemas.BatchStatusRejected
+		result.Error = err.Error()
+		var rejectErr *orderbook.OrderRejectError
+		if errors.As(err, &rejectErr) {
+			result.Reason = string(rejectErr.Reason)
+		}
+		return nil, result
+	}
+
+	if op.User == "" {
+		return reject(errors.New("user is required"))
+	}
+
+	switch op.Type {
+	case schemas.BatchOperationPost:
+		if err := orderbook.ValidateOrderShape(op.PriceLevel, op.Amount, true); err != nil {
+			return reject(err)
+		}
+		if err := orderbook.ValidateClientOrderID(op.ClientOrderID); err != nil {
+			return reject(err)
+		}
+		if op.ClientOrderID != "" {
+			if _, dup := state.clientOrders[op.User][op.ClientOrderID]; dup {
+				return reject(&orderbook.OrderRejectError{
+					Reason:  orderbook.RejectClientOrderIDReused,
+					Message: fmt.Sprintf("clientOrderId %q is used twice in this batch", op.ClientOrderID),
+				})
+			}
+			original, replayed, err := h.orderbook.CheckClientOrderReplay(op.User, op.ClientOrderID, op.PriceLevel, op.Amount, op.IsBid)
+			if err != nil {
+				return reject(err)
+			}
+			if replayed {
+				result.OrderID = original.OrderID
+				result.Fills = original.Fills
+				return nil, result
+			}
+		}
+
+		orderID := uuid.New()
+		result.OrderID = orderID.String()
+		entry := &replica.ReplicationEntry{
+			OpID:          orderID.String(),
+			Type:          replica.ReplicationWritePost,
+			User:          op.User,
+			OrderID:       orderID.String(),
+			ClientOrderID: op.ClientOrderID,
+			PriceLevel:    op.PriceLevel,
+			Amount:        op.Amount,
+			IsBid:         op.IsBid,
+		}
+		if err := h.checkBatchPreTrade(op.User, op.PriceLevel, op.Amount, op.IsBid, state, true); err != nil {
+			return reject(err)
+		}
+
+		if op.ClientOrderID != "" {
+			if _, ok := state.clientOrders[op.User]; !ok {
+				state.clientOrders[op.User] = map[string]struct{}{}
+			}
+			state.clientOrders[op.User][op.ClientOrderID] = struct{}{}
+		}
+		state.addOrder(op.User, op.PriceLevel, op.Amount, op.IsBid, true)
+		return entry, result
+	case schemas.BatchOperationCancel, schemas.BatchOperationAmend:
+		orderID, err := h.resolveBatchOrderID(op)
+		if err != nil {
+			return reject(err)
+		}
+		result.OrderID = orderID.String()
+		if _, dup := state.targeted[orderID]; dup {
+			return reject(errors.New("order is already targeted earlier in this batch"))
+		}
+
+		status, ok := h.orderbook.OrderStatus(orderID)
+		if !ok || !status.Open() || status.User != op.User {
+			return reject(&orderbook.OrderRejectError{
+				Reason:  orderbook.RejectUnknownOrder,
+				Message: fmt.Sprintf("no open order %s for user %s", orderID, op.User),
+			})
+		}
+		result.ClientOrderID = status.ClientOrderID
+
+		entry := &replica.ReplicationEntry{
+			OpID:    uuid.NewString(),
+			Type:    replica.ReplicationWriteCancel,
+			User:    op.User,
+			OrderID: orderID.String(),
+		}
+		if op.Type == schemas.BatchOperationAmend {
+			if _, err := h.orderbook.CheckAmend(op.User, orderID); err != nil {
+				return reject(err)
+			}
+			if err := orderbook.ValidateOrderShape(op.PriceLevel, op.Amount, true); err != nil {
+				return reject(err)
+			}
+			// the amended order replaces the old hold rather than adding to it
+			state.addHold(op.User, status.PriceLevel, -status.Remaining(), status.IsBid)
+			if err := h.checkBatchPreTrade(op.User, op.PriceLevel, op.Amount, status.IsBid, state, false); err != nil {
+				state.addHold(op.User, status.PriceLevel, status.Remaining(), status.IsBid)
+				return reject(err)
+			}
+			state.addOrder(op.User, op.PriceLevel, op.Amount, status.IsBid, false)
+			entry.Type = replica.ReplicationWriteAmend
+			entry.PriceLevel = op.PriceLevel
+			entry.Amount = op.Amount
+			entry.IsBid = status.IsBid
+		} else if status.Kind == orderbook.OrderKindLimit {
+			state.cancelOrder(op.User, status.PriceLevel, status.Remaining(), status.IsBid)
+		}
+
+		state.targeted[orderID] = struct{}{}
+		return entry, result
+	default:
+		return reject(fmt.Errorf("unsupported operation type %q", op.Type))
+	}
+}
+
+// checkBatchPreTrade is checkPreTrade with pre-open crossing, risk limits and collateral counted
+// net of the batch so far. An amend does not open a new order, so it skips the open order cap.
+// In an all-or-nothing batch a passing order widens the batch's prints range.
+func (h *Handler) checkBatchPreTrade(user string, priceLevel int64, amount int64, isBid bool, state *batchState, opensOrder bool) error {
+	if err := h.orderbook.CheckBatchOrderEntry(priceLevel, isBid, state.resting[!isBid]); err != nil {
+		return err
+	}
+	if err := h.orderbook.CheckOrderRules(priceLevel, amount); err != nil {
+		return err
+	}
+	if err := h.orderbook.CheckPriceCollar(priceLevel); err != nil {
+		return err
+	}
+	if err := h.orderbook.CheckBatchRiskLimits(user, priceLevel, amount, isBid, opensOrder, state.pending[user]); err != nil {
+		return err
+	}
+	if h.orderbook.CollateralChecks() {
+		if err := h.orderbook.CheckBatchCollateral(user, state.holds[user], priceLevel, amount, isBid); err != nil {
+			return err
+		}
+	}
+	if !state.allOrNothing {
+		return nil
+	}
+	prints, err := h.orderbook.CheckBatchBands(priceLevel, isBid, state.resting[!isBid], state.prints)
+	if err != nil {
+		return err
+	}
+	state.prints = prints
+	return nil
+}
+
+func (h *Handler) resolveBatchOrderID(op schemas.BatchOperation) (uuid.UUID, error) {
+	if op.OrderID == "" && op.ClientOrderID != "" {
+		return h.orderbook.OrderIDForClient(op.User, op.ClientOrderID)
+	}
+	if op.OrderID == "" {
+		return uuid.Nil, errors.New("orderId or clientOrderId is required")
+	}
+	orderID, err := uuid.Parse(op.OrderID)
+	if err != nil {
+		return uuid.Nil, errors.New("orderId must be a UUID")
+	}
+	return orderID, nil
+}
+
+// applyBatchEntry applies one committed batch entry and fills in the operation's result. Cancels
+// and amends can still miss when an earlier operation in the batch filled the order.
+func (h *Handler) applyBatchEntry(ctx context.Context, entry replica.ReplicationEntry, result *schemas.BatchResult) error {
+	seqApplied, err := h.replica.ApplyRemote(entry)
+	if err != nil {
+		return err
+	}
+	if !seqApplied {
+		return nil
+	}
+
+	orderID, err := uuid.Parse(entry.OrderID)
+	if err != nil {
+		return fmt.Errorf("replication entry invalid orderId: %w", err)
+	}
+
+	switch entry.Type {
+	case replica.ReplicationWritePost:
+		resp, err := h.postCommittedLimit(ctx, entry)
+		if err != nil {
+			var rejectErr *orderbook.OrderRejectError
+			if !errors.As(err, &rejectErr) {
+				return err
+			}
+			result.Status = schemas.BatchStatusRejected
+			result.Error = err.Error()
+			result.Reason = string(rejectErr.Reason)
+			return nil
+		}
+		result.Fills = resp.Fills
+	case replica.ReplicationWriteAmend:
+		resp, err := h.orderbook.AmendLimitOrder(ctx, orderID, entry.PriceLevel, entry.Amount)
+		if err != nil {
+			result.Status = schemas.BatchStatusRejected
+			result.Error = err.Error()
+			return nil
+		}
+		result.Fills = resp.Fills
+	case replica.ReplicationWriteCancel:
+		resp, err := h.orderbook.CancelLimitOrder(ctx, orderID)
+		if err != nil {
+			result.Status = schemas.BatchStatusRejected
+			result.Error = err.Error()
+			return nil
+		}
+		result.SizeCancelled = resp.SizeCancelled
+	default:
+		return fmt.Errorf("unsupported batch entry type: %s", entry.Type)
+	}
+	return nil
+}
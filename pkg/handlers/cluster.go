@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"replicated-clob/pkg/replica"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// addNodeSyncTimeout bounds how long adding a node or transferring leadership waits for the node
+// to catch up.
+const addNodeSyncTimeout = 30 * time.Second
+
+const (
+	announceMinBackoff = 50 * time.Millisecond
+	announceMaxBackoff = 5 * time.Second
+)
+
+func (h *Handler) GetClusterMembership(c *fiber.Ctx) error {
+	return jsonResponse(c, fiber.StatusOK, h.clusterMembership())
+}
+
+// AddClusterNode catches a running secondary up and then adds it to the voting configuration.
+func (h *Handler) AddClusterNode(c *fiber.Ctx) error {
+	return h.changeMembership(c, "cluster.add_node", replica.MembershipAddVoter)
+}
+
+// AddClusterLearner catches a running node up and then adds it as a learner, which receives every
+// entry without counting toward the quorum.
+func (h *Handler) AddClusterLearner(c *fiber.Ctx) error {
+	return h.changeMembership(c, "cluster.add_learner", replica.MembershipAddLearner)
+}
+
+// PromoteClusterLearner makes a learner a voter once it has caught up.
+func (h *Handler) PromoteClusterLearner(c *fiber.Ctx) error {
+	return h.changeMembership(c, "cluster.promote", replica.MembershipPromote)
+}
+
+// RemoveClusterNode takes a voter or learner out of the cluster. The node itself keeps running but
+// no longer receives entries.
+func (h *Handler) RemoveClusterNode(c *fiber.Ctx) error {
+	return h.changeMembership(c, "cluster.remove_node", replica.MembershipRemove)
+}
+
+func (h *Handler) changeMembership(c *fiber.Ctx, op string, action replica.MembershipAction) error {
+	var req replica.ClusterNodeRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "%s: invalid request body", op)
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	// a node is caught up before it starts counting toward, or receiving, new entries
+	needsSync := action != replica.MembershipRemove
+	peer, _, err := h.replica.MembershipChange(req.Peer, action)
+	if err != nil {
+		h.obs.LogErr(ctx, "%s: rejected peer=%s err=%v", op, req.Peer, err)
+		return badRequest(c, err)
+	}
+
+	// most of the catch-up happens before taking the write lock, so writes keep flowing
+	if needsSync {
+		if err := h.syncNewPeer(ctx, peer); err != nil {
+			h.obs.LogErr(ctx, "%s: peer=%s could not catch up: %v", op, peer, err)
+			return temporaryUnavailable(c, err)
+		}
+	}
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	// another change may have landed while the new node was catching up
+	peer, config, err := h.replica.MembershipChange(peer, action)
+	if err != nil {
+		h.obs.LogErr(ctx, "%s: rejected peer=%s err=%v", op, req.Peer, err)
+		return badRequest(c, err)
+	}
+	if needsSync {
+		if err := h.syncNewPeer(ctx, peer); err != nil {
+			h.obs.LogErr(ctx, "%s: peer=%s could not catch up: %v", op, peer, err)
+			return temporaryUnavailable(c, err)
+		}
+	}
+
+	h.obs.LogNotice(ctx, "%s: peer=%s members=%v learners=%v", op, peer, config.Members, config.Learners)
+	if err := h.replicateMembershipLocked(ctx, op, config); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, h.clusterMembership())
+}
+
+func (h *Handler) syncNewPeer(ctx context.Context, peer string) error {
+	syncCtx, cancel := context.WithTimeout(ctx, addNodeSyncTimeout)
+	defer cancel()
+
+	return h.replication.SyncPeer(syncCtx, peer)
+}
+
+func (h *Handler) clusterMembership() replica.ClusterMembershipResponse {
+	return replica.ClusterMembershipResponse{
+		Primary:          h.replica.Primary(),
+		Members:          h.replica.Members(),
+		Learners:         h.replica.Learners(),
+		RequiredPeerAcks: h.replica.RequiredPeerAcks(),
+		AppliedSeq:       h.replica.GetAppliedSeq(),
+	}
+}
+
+// TransferLeadership moves the primary role to a voting member, or to the most caught up one when
+// no peer is named. Writes wait for the transfer and are then redirected to the new primary; no
+// write is acknowledged that the new primary does not have.
+func (h *Handler) TransferLeadership(c *fiber.Ctx) error {
+	var req replica.ClusterNodeRequest
+	ctx := c.UserContext()
+
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			h.obs.LogErr(ctx, "cluster.transfer: invalid request body")
+			return badRequest(c, errors.New("invalid request body"))
+		}
+	}
+	target := strings.TrimRight(strings.TrimSpace(req.Peer), "/")
+	if target == "" {
+		target = h.mostCaughtUpMember()
+	}
+	if target == "" {
+		h.obs.LogErr(ctx, "cluster.transfer: no voting member to transfer to")
+		return badRequest(c, errors.New("no voting member to transfer to"))
+	}
+	if !slices.Contains(h.replica.Members(), target) {
+		h.obs.LogErr(ctx, "cluster.transfer: rejected peer=%s is not a voting member", target)
+		return badRequest(c, fmt.Errorf("peer %s is not a voting member", target))
+	}
+
+	h.obs.LogNotice(ctx, "cluster.transfer: moving primary to %s", target)
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	syncCtx, cancel := context.WithTimeout(ctx, addNodeSyncTimeout)
+	defer cancel()
+	if err := h.replication.TransferLeadership(syncCtx, target); err != nil {
+		h.obs.LogErr(ctx, "cluster.transfer: peer=%s failed: %v", target, err)
+		return temporaryUnavailable(c, err)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, replica.TransferLeadershipResponse{
+		Primary:    h.replica.Primary(),
+		AppliedSeq: h.replica.GetAppliedSeq(),
+	})
+}
+
+// TakeLeadership makes this follower primary at the outgoing primary's request, then tells the
+// rest of the cluster through a configuration entry naming it primary.
+func (h *Handler) TakeLeadership(c *fiber.Ctx) error {
+	var req replica.TakeLeadershipRequest
+	ctx := c.UserContext()
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "replica.take_leadership: invalid request body: %v", err)
+		return badRequest(c, errors.New("invalid request body"))
+	}
+
+	// everything up to the outgoing primary's applied sequence is committed
+	h.applyCommitted(ctx, req.AppliedSeq, req.AppliedOpID)
+
+	h.lockWritePipeline()
+	err := h.replica.AcceptLeadership(req)
+	h.replica.UnlockWritePipeline()
+	if err != nil {
+		h.obs.LogErr(ctx, "replica.take_leadership: refused previous=%s err=%v", req.Previous, err)
+		return jsonResponse(c, fiber.StatusConflict, fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	h.obs.LogNotice(ctx, "replica.take_leadership: now primary previous=%s applied=%d", req.Previous, req.AppliedSeq)
+	go h.announceLeadership(context.WithoutCancel(ctx))
+	return jsonResponse(c, fiber.StatusOK, replica.ReplicationResponse{
+		Accepted: true,
+		LastSeq:  h.replica.GetAppliedSeq(),
+	})
+}
+
+// announceLeadership replicates the configuration as this primary sees it, which also points the
+// followers' redirects here. It retries until it commits or this node stops being primary.
+func (h *Handler) announceLeadership(ctx context.Context) {
+	backoff := announceMinBackoff
+	for h.replica.CanAcceptWrite() {
+		err := h.replicateMembership(ctx, replica.ClusterConfig{
+			Primary:  h.replica.Self(),
+			Members:  h.replica.Members(),
+			Learners: h.replica.Learners(),
+		})
+		if err == nil {
+			return
+		}
+		h.obs.LogErr(ctx, "replica.take_leadership: announce failed retry_in=%s err=%v", backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, announceMaxBackoff)
+	}
+}
+
+func (h *Handler) replicateMembership(ctx context.Context, config replica.ClusterConfig) error {
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	return h.replicateMembershipLocked(ctx, "replica.take_leadership", config)
+}
+
+// replicateMembershipLocked commits and applies a configuration entry. Callers hold the write lock.
+func (h *Handler) replicateMembershipLocked(ctx context.Context, op string, config replica.ClusterConfig) error {
+	replicaEntry := replica.ReplicationEntry{
+		Seq:      h.replica.NextSequence(),
+		OpID:     uuid.NewString(),
+		Type:     replica.ReplicationWriteMembership,
+		Members:  config.Members,
+		Learners: config.Learners,
+		Primary:  config.Primary,
+	}
+	if err := h.replication.PrepareMembership(ctx, replicaEntry); err != nil {
+		h.obs.LogAlert(ctx, "%s replication failed: seq=%d err=%v", op, replicaEntry.Seq, err)
+		return err
+	}
+	if _, err := h.replication.ApplyRemoteEntry(ctx, replicaEntry, h.applyReplicationSideEffect); err != nil {
+		h.obs.LogErr(ctx, "%s commit failed: seq=%d err=%v", op, replicaEntry.Seq, err)
+		return err
+	}
+	return nil
+}
+
+// mostCaughtUpMember picks the voting member with the highest acknowledged sequence.
+func (h *Handler) mostCaughtUpMember() string {
+	members := h.replica.Members()
+	best, bestSeq := "", int64(-1)
+	for _, progress := range h.replication.PeerProgress() {
+		if slices.Contains(members, progress.Peer) && progress.MatchSeq > bestSeq {
+			best, bestSeq = progress.Peer, progress.MatchSeq
+		}
+	}
+	return best
+}
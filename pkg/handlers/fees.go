@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"errors"
+
+	"replicated-clob/pkg/orderbook"
+	"replicated-clob/pkg/replica"
+	"replicated-clob/schemas"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func (h *Handler) SetFeeTier(c *fiber.Ctx) error {
+	var req schemas.FeeTierRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "fees.tier: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if err := orderbook.CheckFeeTier(req.Tier, req.FeeSchedule); err != nil {
+		h.obs.LogErr(ctx, "fees.tier: rejected tier=%s err=%v", req.Tier, err)
+		return rejected(c, err)
+	}
+
+	h.obs.LogInfo(ctx, "fees.tier: tier=%s maker_bps=%d taker_bps=%d", req.Tier, req.MakerBps, req.TakerBps)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	schedule := req.FeeSchedule
+	replicaEntry := replica.ReplicationEntry{
+		Seq:     h.replica.NextSequence(),
+		OpID:    uuid.NewString(),
+		Type:    replica.ReplicationWriteFeeTier,
+		FeeTier: req.Tier,
+		Fees:    &schedule,
+	}
+	if err := h.replicateWrite(ctx, "fees.tier", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	if _, err := h.replication.ApplyRemoteEntry(ctx, replicaEntry, h.applyReplicationSideEffect); err != nil {
+		h.obs.LogErr(ctx, "fees.tier commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, schemas.FeeTiersResponse{
+		Tiers: h.orderbook.FeeTiers(),
+	})
+}
+
+func (h *Handler) AssignFeeTier(c *fiber.Ctx) error {
+	var req schemas.FeeTierAssignRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "fees.assign: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.User == "" || req.Tier == "" {
+		h.obs.LogErr(ctx, "fees.assign: user or tier missing")
+		return badRequest(c, errors.New("user and tier are required"))
+	}
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	if err := h.orderbook.CheckFeeTierExists(req.Tier); err != nil {
+		h.obs.LogErr(ctx, "fees.assign: rejected user=%s tier=%s err=%v", req.User, req.Tier, err)
+		return rejected(c, err)
+	}
+
+	h.obs.LogInfo(ctx, "fees.assign: user=%s tier=%s", req.User, req.Tier)
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:     h.replica.NextSequence(),
+		OpID:    uuid.NewString(),
+		Type:    replica.ReplicationWriteFeeAssign,
+		User:    req.User,
+		FeeTier: req.Tier,
+	}
+	if err := h.replicateWrite(ctx, "fees.assign", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	if _, err := h.replication.ApplyRemoteEntry(ctx, replicaEntry, h.applyReplicationSideEffect); err != nil {
+		h.obs.LogErr(ctx, "fees.assign commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, feeSummaryResponse(req.User, h.orderbook.FeeSummaryForUser(ctx, req.User)))
+}
+
+func (h *Handler) GetFeeTiers(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "fees.tiers: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, schemas.FeeTiersResponse{
+		Tiers: h.orderbook.FeeTiers(),
+	})
+}
+
+func (h *Handler) GetFeeSummary(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if userID == "" {
+		h.obs.LogErr(c.UserContext(), "fees.query: missing userId")
+		return badRequest(c, errors.New("userId is required"))
+	}
+
+	ctx := c.UserContext()
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "fees.query: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, feeSummaryResponse(userID, h.orderbook.FeeSummaryForUser(ctx, userID)))
+}
+
+func feeSummaryResponse(user string, summary orderbook.FeeSummary) schemas.FeeSummaryResponse {
+	return schemas.FeeSummaryResponse{
+		User:          user,
+		Tier:          summary.Tier,
+		Schedule:      summary.Schedule,
+		MakerVolume:   summary.MakerVolume,
+		TakerVolume:   summary.TakerVolume,
+		FeesPaid:      summary.FeesPaid,
+		RebatesEarned: summary.RebatesEarned,
+		NetFees:       summary.FeesPaid - summary.RebatesEarned,
+	}
+}
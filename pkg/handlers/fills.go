@@ -18,7 +18,12 @@ func (h *Handler) GetFillsForUser(c *fiber.Ctx) error {
 	ctx := c.UserContext()
 	h.obs.LogInfo(ctx, "fills.query: user=%s", userID)
 
-	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+	consistency, err := readConsistency(c)
+	if err != nil {
+		h.obs.LogErr(ctx, "fills.query: invalid read consistency: %v", err)
+		return badRequest(c, err)
+	}
+	if err := h.ensureReadConsistency(ctx, consistency); err != nil {
 		h.obs.LogErr(ctx, "fills.query: read freshness check failed: %v", err)
 		return temporaryUnavailable(c, err)
 	}
@@ -32,6 +37,8 @@ func (h *Handler) GetFillsForUser(c *fiber.Ctx) error {
 			Size:         fill.Size,
 			PriceLevel:   fill.PriceLevel,
 			IsMaker:      fill.IsMaker,
+			Fee:          fill.Fee,
+			FeeBps:       fill.FeeBps,
 		})
 	}
 
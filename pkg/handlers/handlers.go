@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"context"
+	"time"
+
 	"replicated-clob/pkg/obs"
 	"replicated-clob/pkg/orderbook"
 	"replicated-clob/pkg/replica"
@@ -9,20 +12,78 @@ import (
 )
 
 type Handler struct {
-	orderbook *orderbook.OrderBook
-	obs       *obs.Client
-	replica   *replica.Coordinator
+	orderbook   *orderbook.OrderBook
+	obs         *obs.Client
+	replica     *replica.Coordinator
 	replication *replica.ReplicationManager
+	pipeline    *replica.Pipeline
+	// userWrites tracks users with pipelined orders that have not applied yet.
+	userWrites *userWrites
+	sessions   *sessionTracker
 }
 
 func New(obs *obs.Client, coordinator *replica.Coordinator) *Handler {
 	orderbook := orderbook.New(obs)
-	return &Handler{
-		obs:       obs,
-		orderbook: orderbook,
-		replica:   coordinator,
-		replication: replica.NewReplicationManager(coordinator, obs),
+	replication := replica.NewReplicationManager(coordinator, obs)
+	h := &Handler{
+		obs:         obs,
+		orderbook:   orderbook,
+		replica:     coordinator,
+		replication: replication,
+		pipeline:    replica.NewPipeline(replication),
+		userWrites:  newUserWrites(),
+		sessions:    newSessionTracker(),
 	}
+	replication.SetSnapshotSource(h.replicaSnapshot, replica.DefaultSnapshotCatchUpLag)
+	return h
+}
+
+// SetReadMode chooses how reads are made linearizable. The lease duration only applies in lease
+// mode and should stay well above the heartbeat interval.
+func (h *Handler) SetReadMode(mode replica.ReadMode, leaseDuration time.Duration) {
+	h.replication.SetReadMode(mode, leaseDuration)
+}
+
+// SetSnapshotCatchUpLag sets how far behind a follower must be before catch-up sends it a
+// snapshot instead of log entries.
+func (h *Handler) SetSnapshotCatchUpLag(lag int64) {
+	h.replication.SetSnapshotSource(h.replicaSnapshot, lag)
+}
+
+// SetPipelineDepth lets up to depth order writes be in flight at once. Every node must use the
+// same depth, since followers accept prepares that far ahead of their applied sequence.
+func (h *Handler) SetPipelineDepth(depth int) {
+	h.pipeline.SetDepth(depth)
+	h.replica.SetPrepareWindow(int64(depth))
+}
+
+// SetGroupCommit bounds how many entries share one replication round trip and how long a
+// pipelined write may wait for others to join it. Batches never exceed the pipeline depth.
+func (h *Handler) SetGroupCommit(maxEntries int, maxDelay time.Duration) {
+	h.replication.SetGroupCommit(maxEntries, maxDelay)
+}
+
+// lockWritePipeline takes the write lock and waits for pipelined writes to land, for writes that
+// check and apply against fully up to date state.
+func (h *Handler) lockWritePipeline() {
+	h.replica.LockWritePipeline()
+	h.pipeline.Drain()
+}
+
+// SetCollateralChecks sets whether orders must be funded when the node starts. It is replicated
+// state, so it must match on every node; /admin/collateral changes it on a running cluster.
+func (h *Handler) SetCollateralChecks(enabled bool) {
+	h.orderbook.SetCollateralChecks(context.Background(), enabled)
+}
+
+// SetOrderHistoryLimit must match on every node, since retention decides which orders lookups see.
+func (h *Handler) SetOrderHistoryLimit(limit int) {
+	h.orderbook.SetOrderHistoryLimit(limit)
+}
+
+// SetClientOrderRetention must match on every node, since it decides which retries are recognised.
+func (h *Handler) SetClientOrderRetention(limit int) {
+	h.orderbook.SetClientOrderRetention(limit)
 }
 
 func (h *Handler) RequireWriteAccess() fiber.Handler {
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"replicated-clob/pkg/orderbook"
+	"replicated-clob/pkg/replica"
+	"replicated-clob/schemas"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultDepthLevels = 10
+	maxDepthLevels     = 500
+)
+
+func (h *Handler) SetMarketPhase(c *fiber.Ctx) error {
+	var req schemas.MarketPhaseRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "market.phase: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	if err := h.orderbook.CheckPhaseTransition(req.Phase); err != nil {
+		h.obs.LogErr(ctx, "market.phase: rejected phase=%s err=%v", req.Phase, err)
+		return rejected(c, err)
+	}
+
+	h.obs.LogNotice(ctx, "market.phase: moving market to %s", req.Phase)
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:   h.replica.NextSequence(),
+		OpID:  uuid.NewString(),
+		Type:  replica.ReplicationWriteMarketPhase,
+		Phase: req.Phase,
+	}
+	if err := h.replicateWrite(ctx, "market.phase", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	if _, err := h.replication.ApplyRemoteEntry(ctx, replicaEntry, h.applyReplicationSideEffect); err != nil {
+		h.obs.LogErr(ctx, "market.phase commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, schemas.MarketPhaseResponse{
+		Phase: h.orderbook.MarketPhase(),
+	})
+}
+
+func (h *Handler) UncrossAuction(c *fiber.Ctx) error {
+	var req schemas.UncrossRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "market.uncross: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.NextPhase == "" {
+		req.NextPhase = schemas.MarketPhaseContinuous
+	}
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	if err := h.orderbook.CheckUncross(req.NextPhase); err != nil {
+		h.obs.LogErr(ctx, "market.uncross: rejected next_phase=%s err=%v", req.NextPhase, err)
+		return rejected(c, err)
+	}
+
+	h.obs.LogNotice(ctx, "market.uncross: next_phase=%s", req.NextPhase)
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:   h.replica.NextSequence(),
+		OpID:  uuid.NewString(),
+		Type:  replica.ReplicationWriteUncross,
+		Phase: req.NextPhase,
+	}
+	if err := h.replicateWrite(ctx, "market.uncross", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+
+	result, err := h.applyUncrossReplication(ctx, replicaEntry)
+	if err != nil {
+		h.obs.LogErr(ctx, "market.uncross commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	h.obs.LogNotice(ctx, "market.uncross done: price=%d volume=%d imbalance=%d", result.Price, result.Volume, result.Imbalance)
+	return jsonResponse(c, fiber.StatusOK, schemas.UncrossResponse{
+		Phase:          h.orderbook.MarketPhase(),
+		ClearingPrice:  result.Price,
+		ExecutedVolume: result.Volume,
+		Imbalance:      result.Imbalance,
+	})
+}
+
+func (h *Handler) SetPriceBands(c *fiber.Ctx) error {
+	var req schemas.PriceBands
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "market.bands: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if err := orderbook.CheckPriceBands(req); err != nil {
+		h.obs.LogErr(ctx, "market.bands: rejected bands=%+v err=%v", req, err)
+		return rejected(c, err)
+	}
+
+	h.obs.LogNotice(ctx, "market.bands: bands=%+v", req)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:        h.replica.NextSequence(),
+		OpID:       uuid.NewString(),
+		Type:       replica.ReplicationWritePriceBands,
+		PriceBands: &req,
+	}
+	if err := h.replicateWrite(ctx, "market.bands", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	if _, err := h.replication.ApplyRemoteEntry(ctx, replicaEntry, h.applyReplicationSideEffect); err != nil {
+		h.obs.LogErr(ctx, "market.bands commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, h.orderbook.PriceBands())
+}
+
+func (h *Handler) GetPriceBands(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "market.bands: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, h.orderbook.PriceBands())
+}
+
+func (h *Handler) SetMatching(c *fiber.Ctx) error {
+	var req schemas.MatchingConfig
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "market.matching: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if err := orderbook.CheckMatchingConfig(req); err != nil {
+		h.obs.LogErr(ctx, "market.matching: rejected config=%+v err=%v", req, err)
+		return rejected(c, err)
+	}
+
+	h.obs.LogNotice(ctx, "market.matching: algorithm=%s min_allocation=%d", req.Algorithm, req.MinAllocation)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:      h.replica.NextSequence(),
+		OpID:     uuid.NewString(),
+		Type:     replica.ReplicationWriteMatching,
+		Matching: &req,
+	}
+	if err := h.replicateWrite(ctx, "market.matching", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	if _, err := h.replication.ApplyRemoteEntry(ctx, replicaEntry, h.applyReplicationSideEffect); err != nil {
+		h.obs.LogErr(ctx, "market.matching commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, h.orderbook.MatchingConfig())
+}
+
+func (h *Handler) GetMatching(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "market.matching: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, h.orderbook.MatchingConfig())
+}
+
+func (h *Handler) SetInstrumentRules(c *fiber.Ctx) error {
+	var req schemas.InstrumentRules
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "market.instrument: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if err := orderbook.CheckInstrumentRules(req); err != nil {
+		h.obs.LogErr(ctx, "market.instrument: rejected rules=%+v err=%v", req, err)
+		return rejected(c, err)
+	}
+
+	h.obs.LogNotice(ctx, "market.instrument: rules=%+v", req)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:        h.replica.NextSequence(),
+		OpID:       uuid.NewString(),
+		Type:       replica.ReplicationWriteInstrument,
+		Instrument: &req,
+	}
+	if err := h.replicateWrite(ctx, "market.instrument", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	if _, err := h.replication.ApplyRemoteEntry(ctx, replicaEntry, h.applyReplicationSideEffect); err != nil {
+		h.obs.LogErr(ctx, "market.instrument commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, h.orderbook.InstrumentRules())
+}
+
+func (h *Handler) GetInstrumentRules(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "market.instrument: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, h.orderbook.InstrumentRules())
+}
+
+func (h *Handler) GetDepth(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	levels, err := strconv.Atoi(c.Query("levels", strconv.Itoa(defaultDepthLevels)))
+	if err != nil || levels <= 0 || levels > maxDepthLevels {
+		h.obs.LogErr(ctx, "book.depth: invalid levels %q", c.Query("levels"))
+		return badRequest(c, errors.New("levels must be between 1 and 500"))
+	}
+
+	consistency, err := readConsistency(c)
+	if err != nil {
+		h.obs.LogErr(ctx, "book.depth: invalid read consistency: %v", err)
+		return badRequest(c, err)
+	}
+	if err := h.ensureReadConsistency(ctx, consistency); err != nil {
+		h.obs.LogErr(ctx, "book.depth: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	return jsonResponse(c, fiber.StatusOK, h.orderbook.Depth(ctx, levels))
+}
+
+func (h *Handler) applyUncrossReplication(ctx context.Context, entry replica.ReplicationEntry) (orderbook.AuctionResult, error) {
+	seqApplied, err := h.replica.ApplyRemote(entry)
+	if err != nil {
+		return orderbook.AuctionResult{}, err
+	}
+	if !seqApplied {
+		return orderbook.AuctionResult{}, nil
+	}
+
+	return h.orderbook.UncrossAuction(ctx, entry.Phase)
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 
+	"replicated-clob/pkg/orderbook"
 	"replicated-clob/pkg/replica"
 	"replicated-clob/schemas"
 
@@ -12,6 +14,11 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
 func (h *Handler) PostOrder(c *fiber.Ctx) error {
 	var req schemas.PostLimitRequest
 	ctx := c.UserContext()
@@ -24,45 +31,88 @@ func (h *Handler) PostOrder(c *fiber.Ctx) error {
 		h.obs.LogErr(ctx, "order.post: user missing")
 		return badRequest(c, errors.New("user is required"))
 	}
-	if req.Amount <= 0 {
-		h.obs.LogErr(ctx, "order.post: invalid amount user=%s amount=%d", req.User, req.Amount)
-		return badRequest(c, errors.New("amount must be greater than 0"))
+	if err := orderbook.ValidateOrderShape(req.PriceLevel, req.Amount, true); err != nil {
+		h.obs.LogErr(ctx, "order.post: invalid order user=%s price=%d amount=%d", req.User, req.PriceLevel, req.Amount)
+		return rejected(c, err)
 	}
 
-	h.obs.LogInfo(ctx, "order.post: user=%s is_bid=%v price=%d amount=%d", req.User, req.IsBid, req.PriceLevel, req.Amount)
+	if err := orderbook.ValidateClientOrderID(req.ClientOrderID); err != nil {
+		h.obs.LogErr(ctx, "order.post: invalid client order id user=%s", req.User)
+		return rejected(c, err)
+	}
 
-	h.replica.LockWritePipeline()
-	defer h.replica.UnlockWritePipeline()
+	h.obs.LogInfo(ctx, "order.post: user=%s client_order_id=%s is_bid=%v price=%d amount=%d", req.User, req.ClientOrderID, req.IsBid, req.PriceLevel, req.Amount)
 
 	orderId := uuid.New()
-	replicaEntry := replica.ReplicationEntry{
-		Seq:        h.replica.NextSequence(),
-		OpID:       orderId.String(),
-		Type:       replica.ReplicationWritePost,
-		User:       req.User,
-		OrderID:    orderId.String(),
-		PriceLevel: req.PriceLevel,
-		Amount:     req.Amount,
-		IsBid:      req.IsBid,
+
+	// Only this user's earlier writes must land first; other users' orders stay in flight.
+	h.pipeline.Reserve()
+	h.lockWriteForUser(req.User)
+
+	// A retry with a known client order ID gets the original result instead of a second order.
+	if req.ClientOrderID != "" {
+		original, replayed, err := h.orderbook.CheckClientOrderReplay(req.User, req.ClientOrderID, req.PriceLevel, req.Amount, req.IsBid)
+		if err != nil {
+			h.replica.UnlockWritePipeline()
+			h.pipeline.Release()
+			h.obs.LogErr(ctx, "order.post: rejected user=%s err=%v", req.User, err)
+			return rejected(c, err)
+		}
+		if replayed {
+			h.replica.UnlockWritePipeline()
+			h.pipeline.Release()
+			h.obs.LogInfo(ctx, "order.post: duplicate user=%s client_order_id=%s order_id=%s", req.User, req.ClientOrderID, original.OrderID)
+			return jsonResponse(c, fiber.StatusOK, original)
+		}
 	}
 
-	// Prepare on primary and quorum peers before commit.
-	if err := h.replication.PrepareEntry(ctx, replicaEntry); err != nil {
-		h.obs.LogAlert(ctx, "order.post replication failed: seq=%d err=%v", replicaEntry.Seq, err)
-		h.replica.RevertSequence(replicaEntry.Seq)
-		return temporaryUnavailable(c, err)
+	// Checked under the write pipeline so no other write can spend the same balance first.
+	if err := h.checkPreTrade(req.User, req.PriceLevel, req.Amount, req.IsBid); err != nil {
+		h.obs.LogErr(ctx, "order.post: rejected user=%s err=%v", req.User, err)
+		h.replica.UnlockWritePipeline()
+		h.pipeline.Release()
+		h.recordRejectedOrder(ctx, orderbook.Order{
+			User:          req.User,
+			ID:            orderId,
+			ClientOrderID: req.ClientOrderID,
+			PriceLevel:    req.PriceLevel,
+			Amount:        req.Amount,
+			IsBid:         req.IsBid,
+		}, err)
+		return rejectedOrder(c, err, orderId.String())
 	}
 
-	if err := h.replication.CommitEntry(ctx, replicaEntry); err != nil {
-		h.obs.LogAlert(ctx, "order.post commit replication failed: seq=%d err=%v", replicaEntry.Seq, err)
-		h.replica.RevertSequence(replicaEntry.Seq)
-		return temporaryUnavailable(c, err)
+	replicaEntry := replica.ReplicationEntry{
+		OpID:          orderId.String(),
+		Type:          replica.ReplicationWritePost,
+		User:          req.User,
+		OrderID:       orderId.String(),
+		ClientOrderID: req.ClientOrderID,
+		PriceLevel:    req.PriceLevel,
+		Amount:        req.Amount,
+		IsBid:         req.IsBid,
 	}
 
-	resp, err := h.applyPostReplication(ctx, replicaEntry)
+	// The lock only orders sequencing; the quorum round trips happen after it is released.
+	var resp schemas.PostLimitResponse
+	var rejectErr error
+	finished := h.userWrites.begin(req.User)
+	done := h.submitWrite(ctx, replicaEntry, func(ctx context.Context, entry replica.ReplicationEntry) error {
+		resp, rejectErr = h.postCommittedLimit(ctx, entry)
+		return nil
+	})
+	h.replica.UnlockWritePipeline()
+
+	err := <-done
+	finished()
 	if err != nil {
-		h.obs.LogErr(ctx, "order.post commit failed: seq=%d err=%v", replicaEntry.Seq, err)
-		return internalServerError(c)
+		h.obs.LogAlert(ctx, "order.post replication failed: order_id=%s err=%v", orderId, err)
+		return temporaryUnavailable(c, err)
+	}
+	// another user's write that committed first can have made the order invalid
+	if rejectErr != nil {
+		h.obs.LogErr(ctx, "order.post: rejected on commit user=%s err=%v", req.User, rejectErr)
+		return rejectedOrder(c, rejectErr, orderId.String())
 	}
 
 	h.obs.LogInfo(ctx, "order.post done: user=%s fills=%d", req.User, len(resp.Fills))
@@ -76,9 +126,21 @@ func (h *Handler) CancelOrder(c *fiber.Ctx) error {
 		h.obs.LogErr(ctx, "order.cancel: invalid request body")
 		return badRequest(c, errors.New("invalid request body"))
 	}
+	if req.OrderID == "" && req.ClientOrderID != "" {
+		if req.User == "" {
+			h.obs.LogErr(ctx, "order.cancel: user missing for client_order_id=%s", req.ClientOrderID)
+			return badRequest(c, errors.New("user is required with clientOrderId"))
+		}
+		orderID, err := h.orderbook.OrderIDForClient(req.User, req.ClientOrderID)
+		if err != nil {
+			h.obs.LogErr(ctx, "order.cancel failed: user=%s client_order_id=%s", req.User, req.ClientOrderID)
+			return notFound(c, errors.New("order not found"))
+		}
+		req.OrderID = orderID.String()
+	}
 	if req.OrderID == "" {
 		h.obs.LogErr(ctx, "order.cancel: order_id missing")
-		return badRequest(c, errors.New("order_id is required"))
+		return badRequest(c, errors.New("order_id or clientOrderId is required"))
 	}
 	orderID, err := uuid.Parse(req.OrderID)
 	if err != nil {
@@ -90,37 +152,89 @@ func (h *Handler) CancelOrder(c *fiber.Ctx) error {
 		return notFound(c, errors.New("order not found"))
 	}
 
-	h.replica.LockWritePipeline()
-	defer h.replica.UnlockWritePipeline()
-
 	h.obs.LogInfo(ctx, "order.cancel: order_id=%s", req.OrderID)
 
 	replicaEntry := replica.ReplicationEntry{
-		Seq:     h.replica.NextSequence(),
-		OpID:    req.OrderID,
+		OpID:    uuid.NewString(),
 		Type:    replica.ReplicationWriteCancel,
 		OrderID: req.OrderID,
 	}
 
-	// Cancel validation happens before the local state change, and side effects are committed after quorum replication.
-	if err := h.replication.PrepareEntry(ctx, replicaEntry); err != nil {
-		h.obs.LogAlert(ctx, "order.cancel replication failed: seq=%d err=%v", replicaEntry.Seq, err)
-		h.replica.RevertSequence(replicaEntry.Seq)
+	// Cancel validation happens before the local state change, and side effects are applied once the entry commits.
+	var resp schemas.CancelLimitResponse
+	var cancelErr error
+	h.pipeline.Reserve()
+	h.replica.LockWritePipeline()
+	done := h.submitWrite(ctx, replicaEntry, func(ctx context.Context, entry replica.ReplicationEntry) error {
+		resp, cancelErr = h.orderbook.CancelLimitOrder(ctx, orderID)
+		return nil
+	})
+	h.replica.UnlockWritePipeline()
+
+	if err := <-done; err != nil {
+		h.obs.LogAlert(ctx, "order.cancel replication failed: order_id=%s err=%v", req.OrderID, err)
 		return temporaryUnavailable(c, err)
 	}
-	if err := h.replication.CommitEntry(ctx, replicaEntry); err != nil {
-		h.obs.LogAlert(ctx, "order.cancel commit replication failed: seq=%d err=%v", replicaEntry.Seq, err)
-		h.replica.RevertSequence(replicaEntry.Seq)
+	// the order can fill or be cancelled by an earlier write still in the pipeline
+	if cancelErr != nil {
+		h.obs.LogErr(ctx, "order.cancel failed: order_id=%s err=%v", req.OrderID, cancelErr)
+		return notFound(c, errors.New("order not found"))
+	}
+
+	h.obs.LogInfo(ctx, "order.cancel done: order_id=%s size_cancelled=%d", req.OrderID, resp.SizeCancelled)
+	return jsonResponse(c, fiber.StatusOK, resp)
+}
+
+func (h *Handler) MassCancel(c *fiber.Ctx) error {
+	var req schemas.MassCancelRequest
+	ctx := c.UserContext()
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "order.mass_cancel: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.User == "" {
+		h.obs.LogErr(ctx, "order.mass_cancel: user missing")
+		return badRequest(c, errors.New("user is required"))
+	}
+	filter := req.MassCancelFilter
+	if filter.Side != "" && filter.Side != "bid" && filter.Side != "ask" {
+		h.obs.LogErr(ctx, "order.mass_cancel: invalid side %q", filter.Side)
+		return badRequest(c, errors.New("side must be bid, ask or empty"))
+	}
+	if filter.MinPrice < 0 || filter.MaxPrice < 0 || (filter.MaxPrice > 0 && filter.MinPrice > filter.MaxPrice) {
+		h.obs.LogErr(ctx, "order.mass_cancel: invalid price band min=%d max=%d", filter.MinPrice, filter.MaxPrice)
+		return badRequest(c, errors.New("invalid price band"))
+	}
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	h.obs.LogInfo(ctx, "order.mass_cancel: user=%s side=%s min_price=%d max_price=%d", req.User, filter.Side, filter.MinPrice, filter.MaxPrice)
+
+	opID := uuid.New()
+	replicaEntry := replica.ReplicationEntry{
+		Seq:        h.replica.NextSequence(),
+		OpID:       opID.String(),
+		Type:       replica.ReplicationWriteMassCancel,
+		User:       req.User,
+		MassCancel: &filter,
+	}
+
+	// One entry cancels the whole set so replicas never observe a partially applied mass cancel.
+	if err := h.replicateWrite(ctx, "order.mass_cancel", &replicaEntry); err != nil {
 		return temporaryUnavailable(c, err)
 	}
-	resp, err := h.applyCancelReplication(ctx, replicaEntry)
+	cancelled, err := h.applyMassCancelReplication(ctx, replicaEntry)
 	if err != nil {
-		h.obs.LogErr(ctx, "order.cancel commit failed: order_id=%s err=%v", req.OrderID, err)
+		h.obs.LogErr(ctx, "order.mass_cancel commit failed: seq=%d err=%v", replicaEntry.Seq, err)
 		return internalServerError(c)
 	}
 
-	h.obs.LogInfo(ctx, "order.cancel done: order_id=%s size_cancelled=%d", req.OrderID, resp.SizeCancelled)
-	return jsonResponse(c, fiber.StatusOK, resp)
+	h.obs.LogInfo(ctx, "order.mass_cancel done: user=%s cancelled=%d size_cancelled=%d", req.User, len(cancelled.OrderIDs), cancelled.SizeCancelled)
+	return jsonResponse(c, fiber.StatusOK, schemas.MassCancelResponse{
+		CancelledOrderIDs: orderIDStrings(cancelled.OrderIDs),
+		SizeCancelled:     cancelled.SizeCancelled,
+	})
 }
 
 func (h *Handler) GetOpenOrders(c *fiber.Ctx) error {
@@ -134,7 +248,12 @@ func (h *Handler) GetOpenOrders(c *fiber.Ctx) error {
 	ctx = context.WithValue(ctx, "user", userID)
 	h.obs.LogInfo(ctx, "orders.query: user=%s", userID)
 
-	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+	consistency, err := readConsistency(c)
+	if err != nil {
+		h.obs.LogErr(ctx, "orders.query: invalid read consistency: %v", err)
+		return badRequest(c, err)
+	}
+	if err := h.ensureReadConsistency(ctx, consistency); err != nil {
 		h.obs.LogErr(ctx, "orders.query: read freshness check failed: %v", err)
 		return temporaryUnavailable(c, err)
 	}
@@ -144,11 +263,12 @@ func (h *Handler) GetOpenOrders(c *fiber.Ctx) error {
 	orders := make([]schemas.OpenOrder, 0, len(resp))
 	for _, order := range resp {
 		orders = append(orders, schemas.OpenOrder{
-			User:       order.User,
-			OrderID:    order.ID.String(),
-			PriceLevel: order.PriceLevel,
-			Amount:     order.Amount,
-			IsBid:      order.IsBid,
+			User:          order.User,
+			OrderID:       order.ID.String(),
+			ClientOrderID: order.ClientOrderID,
+			PriceLevel:    order.PriceLevel,
+			Amount:        order.Amount,
+			IsBid:         order.IsBid,
 		})
 	}
 
@@ -158,58 +278,155 @@ func (h *Handler) GetOpenOrders(c *fiber.Ctx) error {
 	})
 }
 
-func (h *Handler) applyPostReplication(ctx context.Context, entry replica.ReplicationEntry) (schemas.PostLimitResponse, error) {
-	if entry.Type != replica.ReplicationWritePost {
-		return schemas.PostLimitResponse{}, errors.New("replication entry is not post")
-	}
-	response := schemas.PostLimitResponse{
-		OrderID: entry.OrderID,
+func (h *Handler) applyMassCancelReplication(ctx context.Context, entry replica.ReplicationEntry) (orderbook.CancelledOrders, error) {
+	if entry.MassCancel == nil {
+		return orderbook.CancelledOrders{}, errors.New("replication entry missing mass cancel filter")
 	}
 	seqApplied, err := h.replica.ApplyRemote(entry)
 	if err != nil {
-		return schemas.PostLimitResponse{}, err
+		return orderbook.CancelledOrders{}, err
 	}
 	if !seqApplied {
-		return response, nil
+		return orderbook.CancelledOrders{}, nil
+	}
+
+	return h.orderbook.MassCancel(ctx, entry.User, *entry.MassCancel), nil
+}
+
+func (h *Handler) GetClientOrder(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	clientOrderID := c.Params("clientOrderId")
+	ctx := c.UserContext()
+	if userID == "" || clientOrderID == "" {
+		h.obs.LogErr(ctx, "orders.client_query: missing userId or clientOrderId")
+		return badRequest(c, errors.New("userId and clientOrderId are required"))
 	}
 
-	if entry.User == "" {
-		return schemas.PostLimitResponse{}, errors.New("replication entry missing user")
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "orders.client_query: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
 	}
-	if entry.OrderID == "" {
-		return schemas.PostLimitResponse{}, errors.New("replication entry missing orderId")
+
+	order, remaining, ok := h.orderbook.ClientOrder(userID, clientOrderID)
+	if !ok {
+		return notFound(c, errors.New("order not found"))
 	}
 
+	return jsonResponse(c, fiber.StatusOK, schemas.ClientOrderResponse{
+		User:          userID,
+		ClientOrderID: order.ClientOrderID,
+		OrderID:       order.OrderID.String(),
+		Open:          remaining > 0,
+		Remaining:     remaining,
+		Fills:         order.Result.Fills,
+	})
+}
+
+// recordRejectedOrder keeps a pre-trade reject on this node so the order ID in the reject can be
+// looked up here. Rejects never take a sequence, so they cost no replication round trip and
+// other nodes do not know them.
+func (h *Handler) recordRejectedOrder(ctx context.Context, order orderbook.Order, err error) {
+	var rejectErr *orderbook.OrderRejectError
+	if !errors.As(err, &rejectErr) {
+		return
+	}
+	h.orderbook.RecordLocalReject(ctx, order, rejectErr.Reason)
+}
+
+// postCommittedLimit posts a committed order after checking it again against the book as it
+// stands when the entry applies. Every node applies entries in the same order against the same
+// state, so an order that writes committed ahead of it made invalid is rejected the same way on
+// all of them.
+func (h *Handler) postCommittedLimit(ctx context.Context, entry replica.ReplicationEntry) (schemas.PostLimitResponse, error) {
 	orderID, err := uuid.Parse(entry.OrderID)
 	if err != nil {
 		return schemas.PostLimitResponse{}, fmt.Errorf("replication entry invalid orderId: %w", err)
 	}
+	order := orderbook.Order{
+		User:          entry.User,
+		ID:            orderID,
+		ClientOrderID: entry.ClientOrderID,
+		PriceLevel:    entry.PriceLevel,
+		Amount:        entry.Amount,
+		IsBid:         entry.IsBid,
+	}
 
-	response = h.orderbook.PostLimit(
-		ctx,
-		entry.User,
-		orderID,
-		entry.PriceLevel,
-		entry.Amount,
-		entry.IsBid,
-	)
-
-	return response, nil
+	// a replayed client order ID answers with the stored result and never reaches the book
+	_, replayed, _ := h.orderbook.CheckClientOrderReplay(entry.User, entry.ClientOrderID, entry.PriceLevel, entry.Amount, entry.IsBid)
+	if !replayed {
+		if err := h.checkPreTrade(entry.User, entry.PriceLevel, entry.Amount, entry.IsBid); err != nil {
+			var rejectErr *orderbook.OrderRejectError
+			if errors.As(err, &rejectErr) {
+				h.orderbook.RecordRejectedOrder(ctx, order, rejectErr.Reason)
+			}
+			return schemas.PostLimitResponse{}, err
+		}
+	}
+	return h.orderbook.PostClientLimit(ctx, entry.User, entry.ClientOrderID, orderID, entry.PriceLevel, entry.Amount, entry.IsBid), nil
 }
 
-func (h *Handler) applyCancelReplication(ctx context.Context, entry replica.ReplicationEntry) (schemas.CancelLimitResponse, error) {
-	response := schemas.CancelLimitResponse{}
-	seqApplied, err := h.replica.ApplyRemote(entry)
+func (h *Handler) GetOrderStatus(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	orderID, err := uuid.Parse(c.Params("orderId"))
 	if err != nil {
-		return schemas.CancelLimitResponse{}, err
+		h.obs.LogErr(ctx, "order.status: invalid order_id %q", c.Params("orderId"))
+		return badRequest(c, errors.New("order_id must be a UUID"))
 	}
-	if !seqApplied {
-		return response, nil
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "order.status: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
 	}
 
-	orderID, err := uuid.Parse(entry.OrderID)
-	if err != nil {
-		return schemas.CancelLimitResponse{}, fmt.Errorf("replication entry invalid orderId: %w", err)
+	status, ok := h.orderbook.OrderStatus(orderID)
+	if !ok {
+		return notFound(c, errors.New("order not found"))
+	}
+	return jsonResponse(c, fiber.StatusOK, orderStatusResponse(status))
+}
+
+func (h *Handler) GetOrderHistory(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	ctx := c.UserContext()
+	if userID == "" {
+		h.obs.LogErr(ctx, "orders.history: missing userId")
+		return badRequest(c, errors.New("userId is required"))
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(defaultHistoryLimit)))
+	if err != nil || limit <= 0 || limit > maxHistoryLimit {
+		h.obs.LogErr(ctx, "orders.history: invalid limit %q", c.Query("limit"))
+		return badRequest(c, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit))
+	}
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "orders.history: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	history := h.orderbook.OrderHistoryForUser(ctx, userID, limit)
+	orders := make([]schemas.OrderStatusResponse, 0, len(history))
+	for _, status := range history {
+		orders = append(orders, orderStatusResponse(status))
+	}
+	return jsonResponse(c, fiber.StatusOK, schemas.OrderHistoryResponse{
+		Orders: orders,
+	})
+}
+
+func orderStatusResponse(status orderbook.OrderStatus) schemas.OrderStatusResponse {
+	return schemas.OrderStatusResponse{
+		OrderID:       status.OrderID.String(),
+		ClientOrderID: status.ClientOrderID,
+		User:          status.User,
+		Kind:          status.Kind,
+		State:         string(status.State),
+		PriceLevel:    status.PriceLevel,
+		Amount:        status.Amount,
+		Filled:        status.Filled,
+		IsBid:         status.IsBid,
+		RejectReason:  string(status.RejectReason),
+		CreatedAtMs:   status.CreatedAtMs,
+		UpdatedAtMs:   status.UpdatedAtMs,
 	}
-	return h.orderbook.CancelLimitOrder(ctx, orderID)
 }
@@ -2,29 +2,67 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"replicated-clob/pkg/obs"
 	"replicated-clob/pkg/orderbook"
 	"replicated-clob/pkg/replica"
+	"replicated-clob/schemas"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
 func newTestHandlerApp() (*fiber.App, *orderbook.OrderBook, *obs.Client) {
+	h, obsClient := newTestHandler()
+	return newTestApp(h), h.orderbook, obsClient
+}
+
+func newTestHandler() (*Handler, *obs.Client) {
 	obsClient := &obs.Client{}
 	// test without replicating
 	rep := replica.NewCoordinator(replica.NodeRolePrimary, []string{}, "test-cluster")
-	h := New(obsClient, rep)
+	return newTestNode(obsClient, rep), obsClient
+}
+
+// newTestNode builds a handler without collateral checks, so tests that are not about balances
+// need not fund their users. Every node in a test cluster must agree on the setting.
+func newTestNode(obsClient *obs.Client, coordinator *replica.Coordinator) *Handler {
+	h := New(obsClient, coordinator)
+	h.SetCollateralChecks(false)
+	return h
+}
+
+func newTestApp(h *Handler) *fiber.App {
 	app := fiber.New()
 	app.Post("/order/post", h.PostOrder)
 	app.Post("/order/cancel", h.CancelOrder)
+	app.Post("/order/mass-cancel", h.MassCancel)
 	app.Get("/orders/:userId", h.GetOpenOrders)
 	app.Get("/fills/:userId", h.GetFillsForUser)
-	return app, h.orderbook, obsClient
+	app.Post("/order/trailing-stop", h.PostTrailingStop)
+	app.Get("/orders/:userId/trailing-stops", h.GetTrailingStops)
+	app.Post("/accounts/deposit", h.Deposit)
+	app.Post("/accounts/withdraw", h.Withdraw)
+	app.Get("/accounts/:userId", h.GetAccount)
+	app.Post("/admin/risk-limits", h.SetRiskLimits)
+	app.Post("/admin/kill-switch", h.KillSwitch)
+	app.Get("/admin/risk/:userId", h.GetRiskState)
+	app.Post("/sessions/start", h.StartSession)
+	app.Post("/sessions/heartbeat", h.Heartbeat)
+	app.Get("/order/:orderId", h.GetOrderStatus)
+	app.Get("/orders/:userId/history", h.GetOrderHistory)
+	return app
 }
 
 func TestPostOrderEndpoint(t *testing.T) {
@@ -320,3 +358,1698 @@ func TestGetFillsEndpointReturnsHistoricalFills(t *testing.T) {
 		t.Fatalf("unexpected maker fill: %+v", makerFillsResp.Fills[0])
 	}
 }
+
+func TestPostTrailingStopEndpoint(t *testing.T) {
+	app, _, _ := newTestHandlerApp()
+
+	badReq := httptest.NewRequest(
+		"POST",
+		"/order/trailing-stop",
+		bytes.NewReader([]byte(`{"user":"alice","amount":2,"isBid":false,"trailOffset":5,"trailBps":50}`)),
+	)
+	badReq.Header.Set("Content-Type", "application/json")
+	badRes, err := app.Test(badReq)
+	if err != nil {
+		t.Fatalf("failed to call endpoint: %v", err)
+	}
+	if badRes.StatusCode != 400 {
+		t.Fatalf("expected 400 when both trail modes are set, got %d", badRes.StatusCode)
+	}
+
+	req := httptest.NewRequest(
+		"POST",
+		"/order/trailing-stop",
+		bytes.NewReader([]byte(`{"user":"alice","amount":2,"isBid":false,"trailOffset":5}`)),
+	)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("failed to call endpoint: %v", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	var posted struct {
+		StopID string `json:"stopId"`
+		Armed  bool   `json:"armed"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&posted); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if _, err := uuid.Parse(posted.StopID); err != nil {
+		t.Fatalf("expected valid UUID stopId, got %q", posted.StopID)
+	}
+	if posted.Armed {
+		t.Fatalf("expected stop to be unarmed without a last trade")
+	}
+
+	res, err = app.Test(httptest.NewRequest("GET", "/orders/alice/trailing-stops", nil))
+	if err != nil {
+		t.Fatalf("failed to request trailing stops: %v", err)
+	}
+	var stopsResp struct {
+		Stops []struct {
+			StopID string `json:"stopId"`
+		} `json:"stops"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stopsResp); err != nil {
+		t.Fatalf("failed to decode trailing stops: %v", err)
+	}
+	if len(stopsResp.Stops) != 1 || stopsResp.Stops[0].StopID != posted.StopID {
+		t.Fatalf("unexpected trailing stops: %+v", stopsResp.Stops)
+	}
+}
+
+func TestPostOrderEndpointRejectsUnfundedOrderWithCollateralChecks(t *testing.T) {
+	// collateral checks are on by default
+	h := New(&obs.Client{}, replica.NewCoordinator(replica.NodeRolePrimary, []string{}, "test-cluster"))
+	app := newTestApp(h)
+
+	postOrder := func() *http.Response {
+		req := httptest.NewRequest(
+			"POST",
+			"/order/post",
+			bytes.NewReader([]byte(`{"user":"alice","priceLevel":100,"amount":5,"isBid":true}`)),
+		)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("failed to post order: %v", err)
+		}
+		return res
+	}
+
+	res := postOrder()
+	if res.StatusCode != 400 {
+		t.Fatalf("expected 400 for unfunded order, got %d", res.StatusCode)
+	}
+	var rejectResp struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rejectResp); err != nil {
+		t.Fatalf("failed to decode reject response: %v", err)
+	}
+	if rejectResp.Reason != string(orderbook.RejectInsufficientBalance) {
+		t.Fatalf("expected insufficient balance reason, got %q", rejectResp.Reason)
+	}
+	if h.replica.GetAppliedSeq() != 0 {
+		t.Fatalf("expected rejected order not to consume a sequence")
+	}
+
+	depositReq := httptest.NewRequest(
+		"POST",
+		"/accounts/deposit",
+		bytes.NewReader([]byte(`{"user":"alice","quote":500}`)),
+	)
+	depositReq.Header.Set("Content-Type", "application/json")
+	depositRes, err := app.Test(depositReq)
+	if err != nil {
+		t.Fatalf("failed to deposit: %v", err)
+	}
+	if depositRes.StatusCode != 200 {
+		t.Fatalf("expected deposit status 200, got %d", depositRes.StatusCode)
+	}
+
+	if res := postOrder(); res.StatusCode != 200 {
+		t.Fatalf("expected funded order to be accepted, got %d", res.StatusCode)
+	}
+
+	res, err = app.Test(httptest.NewRequest("GET", "/accounts/alice", nil))
+	if err != nil {
+		t.Fatalf("failed to request account: %v", err)
+	}
+	var account struct {
+		Quote          int64 `json:"quote"`
+		QuoteHold      int64 `json:"quoteHold"`
+		AvailableQuote int64 `json:"availableQuote"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&account); err != nil {
+		t.Fatalf("failed to decode account: %v", err)
+	}
+	if account.Quote != 500 || account.QuoteHold != 500 || account.AvailableQuote != 0 {
+		t.Fatalf("unexpected account after resting bid: %+v", account)
+	}
+}
+
+func TestKillSwitchEndpointCancelsAndBlocksUser(t *testing.T) {
+	app, _, _ := newTestHandlerApp()
+
+	postReq := httptest.NewRequest(
+		"POST",
+		"/order/post",
+		bytes.NewReader([]byte(`{"user":"mallory","priceLevel":100,"amount":3,"isBid":true}`)),
+	)
+	postReq.Header.Set("Content-Type", "application/json")
+	if _, err := app.Test(postReq); err != nil {
+		t.Fatalf("failed to post order: %v", err)
+	}
+
+	killReq := httptest.NewRequest(
+		"POST",
+		"/admin/kill-switch",
+		bytes.NewReader([]byte(`{"user":"mallory","blocked":true}`)),
+	)
+	killReq.Header.Set("Content-Type", "application/json")
+	killRes, err := app.Test(killReq)
+	if err != nil {
+		t.Fatalf("failed to call kill switch: %v", err)
+	}
+	if killRes.StatusCode != 200 {
+		t.Fatalf("expected kill switch status 200, got %d", killRes.StatusCode)
+	}
+	var killResp struct {
+		CancelledOrderIDs []string `json:"cancelledOrderIds"`
+		SizeCancelled     int64    `json:"sizeCancelled"`
+	}
+	if err := json.NewDecoder(killRes.Body).Decode(&killResp); err != nil {
+		t.Fatalf("failed to decode kill switch response: %v", err)
+	}
+	if len(killResp.CancelledOrderIDs) != 1 || killResp.SizeCancelled != 3 {
+		t.Fatalf("unexpected kill switch response: %+v", killResp)
+	}
+
+	retryReq := httptest.NewRequest(
+		"POST",
+		"/order/post",
+		bytes.NewReader([]byte(`{"user":"mallory","priceLevel":100,"amount":3,"isBid":true}`)),
+	)
+	retryReq.Header.Set("Content-Type", "application/json")
+	retryRes, err := app.Test(retryReq)
+	if err != nil {
+		t.Fatalf("failed to post order: %v", err)
+	}
+	if retryRes.StatusCode != 400 {
+		t.Fatalf("expected blocked user order to be rejected, got %d", retryRes.StatusCode)
+	}
+}
+
+func TestMassCancelEndpointCancelsMatchingOrders(t *testing.T) {
+	app, _, _ := newTestHandlerApp()
+
+	for _, body := range []string{
+		`{"user":"mm","priceLevel":99,"amount":2,"isBid":true}`,
+		`{"user":"mm","priceLevel":101,"amount":3,"isBid":false}`,
+	} {
+		req := httptest.NewRequest("POST", "/order/post", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		if _, err := app.Test(req); err != nil {
+			t.Fatalf("failed to post order: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(
+		"POST",
+		"/order/mass-cancel",
+		bytes.NewReader([]byte(`{"user":"mm","side":"ask"}`)),
+	)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("failed to mass cancel: %v", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	var response struct {
+		CancelledOrderIDs []string `json:"cancelledOrderIds"`
+		SizeCancelled     int64    `json:"sizeCancelled"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode mass cancel response: %v", err)
+	}
+	if len(response.CancelledOrderIDs) != 1 || response.SizeCancelled != 3 {
+		t.Fatalf("unexpected mass cancel response: %+v", response)
+	}
+
+	badReq := httptest.NewRequest(
+		"POST",
+		"/order/mass-cancel",
+		bytes.NewReader([]byte(`{"user":"mm","side":"both"}`)),
+	)
+	badReq.Header.Set("Content-Type", "application/json")
+	badRes, err := app.Test(badReq)
+	if err != nil {
+		t.Fatalf("failed to mass cancel: %v", err)
+	}
+	if badRes.StatusCode != 400 {
+		t.Fatalf("expected 400 for invalid side, got %d", badRes.StatusCode)
+	}
+}
+
+func TestSessionExpiryCancelsOrders(t *testing.T) {
+	h, _ := newTestHandler()
+	app := newTestApp(h)
+	ctx := context.Background()
+
+	startReq := httptest.NewRequest(
+		"POST",
+		"/sessions/start",
+		bytes.NewReader([]byte(`{"user":"mm","timeoutMs":500}`)),
+	)
+	startReq.Header.Set("Content-Type", "application/json")
+	startRes, err := app.Test(startReq)
+	if err != nil {
+		t.Fatalf("failed to start session: %v", err)
+	}
+	if startRes.StatusCode != 200 {
+		t.Fatalf("expected session start 200, got %d", startRes.StatusCode)
+	}
+
+	postReq := httptest.NewRequest(
+		"POST",
+		"/order/post",
+		bytes.NewReader([]byte(`{"user":"mm","priceLevel":100,"amount":3,"isBid":true}`)),
+	)
+	postReq.Header.Set("Content-Type", "application/json")
+	if _, err := app.Test(postReq); err != nil {
+		t.Fatalf("failed to post order: %v", err)
+	}
+
+	h.expireStaleSessions(ctx, time.Now().Add(100*time.Millisecond))
+	if len(h.orderbook.OpenOrdersForUser(ctx, "mm")) != 1 {
+		t.Fatalf("expected order to survive within the session timeout")
+	}
+
+	h.expireStaleSessions(ctx, time.Now().Add(time.Second))
+	if len(h.orderbook.OpenOrdersForUser(ctx, "mm")) != 0 {
+		t.Fatalf("expected session expiry to cancel resting orders")
+	}
+	if _, ok := h.orderbook.Session("mm"); ok {
+		t.Fatalf("expected expired session to be removed")
+	}
+
+	heartbeatReq := httptest.NewRequest(
+		"POST",
+		"/sessions/heartbeat",
+		bytes.NewReader([]byte(`{"user":"mm"}`)),
+	)
+	heartbeatReq.Header.Set("Content-Type", "application/json")
+	heartbeatRes, err := app.Test(heartbeatReq)
+	if err != nil {
+		t.Fatalf("failed to heartbeat: %v", err)
+	}
+	if heartbeatRes.StatusCode != 404 {
+		t.Fatalf("expected heartbeat on expired session to 404, got %d", heartbeatRes.StatusCode)
+	}
+}
+
+func TestMarketPhaseEndpointsRunAuction(t *testing.T) {
+	h, _ := newTestHandler()
+	app := newTestApp(h)
+	app.Post("/admin/market-phase", h.SetMarketPhase)
+	app.Post("/admin/auction/uncross", h.UncrossAuction)
+	app.Get("/book/depth", h.GetDepth)
+
+	post := func(path string, body string) *http.Response {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("failed to call %s: %v", path, err)
+		}
+		return res
+	}
+
+	if res := post("/admin/market-phase", `{"phase":"halted"}`); res.StatusCode != 200 {
+		t.Fatalf("expected 200 halting market, got %d", res.StatusCode)
+	}
+	if res := post("/order/post", `{"user":"alice","priceLevel":100,"amount":1,"isBid":true}`); res.StatusCode != 400 {
+		t.Fatalf("expected 400 posting into halted market, got %d", res.StatusCode)
+	}
+	// pre-open collects orders that rest without crossing
+	if res := post("/admin/market-phase", `{"phase":"pre_open"}`); res.StatusCode != 200 {
+		t.Fatalf("expected 200 entering pre-open, got %d", res.StatusCode)
+	}
+	if res := post("/order/post", `{"user":"bob","priceLevel":99,"amount":2,"isBid":false}`); res.StatusCode != 200 {
+		t.Fatalf("expected 200 posting a resting ask in pre-open, got %d", res.StatusCode)
+	}
+	if res := post("/order/post", `{"user":"alice","priceLevel":101,"amount":2,"isBid":true}`); res.StatusCode != 400 {
+		t.Fatalf("expected 400 posting a crossing bid in pre-open, got %d", res.StatusCode)
+	}
+	if res := post("/admin/market-phase", `{"phase":"auction"}`); res.StatusCode != 200 {
+		t.Fatalf("expected 200 opening auction, got %d", res.StatusCode)
+	}
+	post("/order/post", `{"user":"alice","priceLevel":101,"amount":2,"isBid":true}`)
+
+	depthRes, err := app.Test(httptest.NewRequest("GET", "/book/depth?levels=5", nil))
+	if err != nil {
+		t.Fatalf("failed to fetch depth: %v", err)
+	}
+	var depth struct {
+		Phase            string `json:"phase"`
+		IndicativeVolume int64  `json:"indicativeVolume"`
+	}
+	if err := json.NewDecoder(depthRes.Body).Decode(&depth); err != nil {
+		t.Fatalf("failed to decode depth: %v", err)
+	}
+	if depth.Phase != "auction" || depth.IndicativeVolume != 2 {
+		t.Fatalf("unexpected depth during auction: %+v", depth)
+	}
+
+	res := post("/admin/auction/uncross", `{}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected 200 uncrossing, got %d", res.StatusCode)
+	}
+	var uncross struct {
+		Phase          string `json:"phase"`
+		ExecutedVolume int64  `json:"executedVolume"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&uncross); err != nil {
+		t.Fatalf("failed to decode uncross response: %v", err)
+	}
+	if uncross.Phase != "continuous" || uncross.ExecutedVolume != 2 {
+		t.Fatalf("unexpected uncross response: %+v", uncross)
+	}
+	if len(h.orderbook.FillsForUser(context.Background(), "alice")) != 1 {
+		t.Fatalf("expected alice to be filled by the uncross")
+	}
+}
+
+func TestPostOrderEndpointRejectsPriceOutsideCollar(t *testing.T) {
+	h, _ := newTestHandler()
+	app := newTestApp(h)
+	app.Post("/admin/price-bands", h.SetPriceBands)
+
+	post := func(path string, body string) *http.Response {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("failed to call %s: %v", path, err)
+		}
+		return res
+	}
+
+	if res := post("/admin/price-bands", `{"collarBps":500,"breakerBps":-1}`); res.StatusCode != 400 {
+		t.Fatalf("expected 400 for negative bands, got %d", res.StatusCode)
+	}
+	if res := post("/admin/price-bands", `{"collarBps":500}`); res.StatusCode != 200 {
+		t.Fatalf("expected 200 setting bands, got %d", res.StatusCode)
+	}
+	post("/order/post", `{"user":"alice","priceLevel":100,"amount":1,"isBid":false}`)
+	post("/order/post", `{"user":"bob","priceLevel":100,"amount":1,"isBid":true}`)
+
+	res := post("/order/post", `{"user":"bob","priceLevel":200,"amount":1,"isBid":true}`)
+	if res.StatusCode != 400 {
+		t.Fatalf("expected 400 for fat-fingered price, got %d", res.StatusCode)
+	}
+	var response struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode reject: %v", err)
+	}
+	if response.Reason != "PRICE_COLLAR" {
+		t.Fatalf("expected PRICE_COLLAR reason, got %q", response.Reason)
+	}
+}
+
+func TestFeeEndpointsReportFeesOnFills(t *testing.T) {
+	h, _ := newTestHandler()
+	app := newTestApp(h)
+	app.Post("/admin/fee-tiers", h.SetFeeTier)
+	app.Post("/admin/fee-tiers/assign", h.AssignFeeTier)
+	app.Get("/fees/:userId", h.GetFeeSummary)
+
+	post := func(path string, body string) *http.Response {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("failed to call %s: %v", path, err)
+		}
+		return res
+	}
+
+	if res := post("/admin/fee-tiers", `{"tier":"mm","makerBps":-1,"takerBps":4}`); res.StatusCode != 200 {
+		t.Fatalf("expected 200 setting tier, got %d", res.StatusCode)
+	}
+	if res := post("/admin/fee-tiers/assign", `{"user":"alice","tier":"nope"}`); res.StatusCode != 400 {
+		t.Fatalf("expected 400 assigning unknown tier, got %d", res.StatusCode)
+	}
+	if res := post("/admin/fee-tiers/assign", `{"user":"alice","tier":"mm"}`); res.StatusCode != 200 {
+		t.Fatalf("expected 200 assigning tier, got %d", res.StatusCode)
+	}
+	post("/order/post", `{"user":"alice","priceLevel":100,"amount":100,"isBid":false}`)
+	post("/order/post", `{"user":"bob","priceLevel":100,"amount":100,"isBid":true}`)
+
+	fillsRes, err := app.Test(httptest.NewRequest("GET", "/fills/alice", nil))
+	if err != nil {
+		t.Fatalf("failed to fetch fills: %v", err)
+	}
+	var fills struct {
+		Fills []struct {
+			Fee    int64 `json:"fee"`
+			FeeBps int64 `json:"feeBps"`
+		} `json:"fills"`
+	}
+	if err := json.NewDecoder(fillsRes.Body).Decode(&fills); err != nil {
+		t.Fatalf("failed to decode fills: %v", err)
+	}
+	if len(fills.Fills) != 1 || fills.Fills[0].Fee != -1 || fills.Fills[0].FeeBps != -1 {
+		t.Fatalf("unexpected fills: %+v", fills)
+	}
+
+	summaryRes, err := app.Test(httptest.NewRequest("GET", "/fees/alice", nil))
+	if err != nil {
+		t.Fatalf("failed to fetch fee summary: %v", err)
+	}
+	var summary struct {
+		Tier          string `json:"tier"`
+		MakerVolume   int64  `json:"makerVolume"`
+		RebatesEarned int64  `json:"rebatesEarned"`
+		NetFees       int64  `json:"netFees"`
+	}
+	if err := json.NewDecoder(summaryRes.Body).Decode(&summary); err != nil {
+		t.Fatalf("failed to decode fee summary: %v", err)
+	}
+	if summary.Tier != "mm" || summary.MakerVolume != 10_000 || summary.RebatesEarned != 1 || summary.NetFees != -1 {
+		t.Fatalf("unexpected fee summary: %+v", summary)
+	}
+}
+
+func TestPositionEndpointAndSnapshot(t *testing.T) {
+	h, _ := newTestHandler()
+	app := newTestApp(h)
+	app.Get("/positions/:userId", h.GetPosition)
+	app.Get("/internal/replica/snapshot", h.GetReplicaSnapshot)
+
+	for _, body := range []string{
+		`{"user":"alice","priceLevel":100,"amount":4,"isBid":false}`,
+		`{"user":"bob","priceLevel":100,"amount":4,"isBid":true}`,
+	} {
+		req := httptest.NewRequest("POST", "/order/post", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		if _, err := app.Test(req); err != nil {
+			t.Fatalf("failed to post order: %v", err)
+		}
+	}
+
+	res, err := app.Test(httptest.NewRequest("GET", "/positions/bob", nil))
+	if err != nil {
+		t.Fatalf("failed to fetch position: %v", err)
+	}
+	var position struct {
+		NetPosition   int64 `json:"netPosition"`
+		AvgEntryPrice int64 `json:"avgEntryPrice"`
+		MarkPrice     int64 `json:"markPrice"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&position); err != nil {
+		t.Fatalf("failed to decode position: %v", err)
+	}
+	if position.NetPosition != 4 || position.AvgEntryPrice != 100 || position.MarkPrice != 100 {
+		t.Fatalf("unexpected position: %+v", position)
+	}
+
+	snapRes, err := app.Test(httptest.NewRequest("GET", "/internal/replica/snapshot", nil))
+	if err != nil {
+		t.Fatalf("failed to fetch snapshot: %v", err)
+	}
+	var snapshot struct {
+		AppliedSeq int64 `json:"appliedSeq"`
+		State      struct {
+			Positions map[string]orderbook.Position `json:"positions"`
+		} `json:"state"`
+	}
+	if err := json.NewDecoder(snapRes.Body).Decode(&snapshot); err != nil {
+		t.Fatalf("failed to decode snapshot: %v", err)
+	}
+	if snapshot.AppliedSeq != 2 || snapshot.State.Positions["alice"].Net != -4 {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+}
+
+func TestPostOrderEndpointReturnsInstrumentRejectReasons(t *testing.T) {
+	h, _ := newTestHandler()
+	app := newTestApp(h)
+	app.Post("/admin/instrument", h.SetInstrumentRules)
+
+	post := func(path string, body string) (*http.Response, string) {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("failed to call %s: %v", path, err)
+		}
+		var response struct {
+			Reason string `json:"reason"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&response)
+		return res, response.Reason
+	}
+
+	if res, reason := post("/order/post", `{"user":"alice","priceLevel":-5,"amount":1,"isBid":true}`); res.StatusCode != 400 || reason != "INVALID_PRICE" {
+		t.Fatalf("expected INVALID_PRICE, got %d %q", res.StatusCode, reason)
+	}
+	if res, _ := post("/admin/instrument", `{"tickSize":5,"lotSize":1}`); res.StatusCode != 200 {
+		t.Fatalf("expected 200 setting instrument rules, got %d", res.StatusCode)
+	}
+	if res, reason := post("/order/post", `{"user":"alice","priceLevel":102,"amount":1,"isBid":true}`); res.StatusCode != 400 || reason != "TICK_SIZE" {
+		t.Fatalf("expected TICK_SIZE, got %d %q", res.StatusCode, reason)
+	}
+	if res, _ := post("/order/post", `{"user":"alice","priceLevel":105,"amount":1,"isBid":true}`); res.StatusCode != 200 {
+		t.Fatalf("expected on-tick order to be accepted, got %d", res.StatusCode)
+	}
+}
+
+func TestPostOrderEndpointDeduplicatesClientOrderID(t *testing.T) {
+	h, _ := newTestHandler()
+	app := newTestApp(h)
+	app.Get("/orders/:userId/client/:clientOrderId", h.GetClientOrder)
+
+	post := func(path string, body string) (*http.Response, schemas.PostLimitResponse) {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("failed to call %s: %v", path, err)
+		}
+		var response schemas.PostLimitResponse
+		_ = json.NewDecoder(res.Body).Decode(&response)
+		return res, response
+	}
+
+	order := `{"user":"alice","clientOrderId":"c-1","priceLevel":100,"amount":3,"isBid":true}`
+	_, first := post("/order/post", order)
+	res, retry := post("/order/post", order)
+	if res.StatusCode != 200 || retry.OrderID != first.OrderID || retry.ClientOrderID != "c-1" {
+		t.Fatalf("expected retry to return original order %s, got %d %+v", first.OrderID, res.StatusCode, retry)
+	}
+	if open := h.orderbook.OpenOrdersForUser(context.Background(), "alice"); len(open) != 1 {
+		t.Fatalf("expected a single resting order after retry, got %d", len(open))
+	}
+	if res, _ := post("/order/post", `{"user":"alice","clientOrderId":"c-1","priceLevel":101,"amount":3,"isBid":true}`); res.StatusCode != 400 {
+		t.Fatalf("expected reused client order id to be rejected, got %d", res.StatusCode)
+	}
+
+	lookup, err := app.Test(httptest.NewRequest("GET", "/orders/alice/client/c-1", nil))
+	if err != nil {
+		t.Fatalf("failed to look up client order: %v", err)
+	}
+	var found schemas.ClientOrderResponse
+	if err := json.NewDecoder(lookup.Body).Decode(&found); err != nil {
+		t.Fatalf("failed to decode client order: %v", err)
+	}
+	if found.OrderID != first.OrderID || !found.Open || found.Remaining != 3 {
+		t.Fatalf("unexpected client order lookup: %+v", found)
+	}
+
+	res, _ = post("/order/cancel", `{"user":"alice","clientOrderId":"c-1"}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected cancel by client order id to succeed, got %d", res.StatusCode)
+	}
+	if open := h.orderbook.OpenOrdersForUser(context.Background(), "alice"); len(open) != 0 {
+		t.Fatalf("expected order cancelled, got %+v", open)
+	}
+	if res, _ := post("/order/cancel", `{"user":"bob","clientOrderId":"c-1"}`); res.StatusCode != 404 {
+		t.Fatalf("expected 404 for another user's client order id, got %d", res.StatusCode)
+	}
+}
+
+func TestOrderStatusAndHistoryEndpoints(t *testing.T) {
+	app, _, _ := newTestHandlerApp()
+
+	post := func(body string) (*http.Response, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/order/post", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("failed to post order: %v", err)
+		}
+		var response map[string]interface{}
+		_ = json.NewDecoder(res.Body).Decode(&response)
+		return res, response
+	}
+	getStatus := func(orderID string) (*http.Response, schemas.OrderStatusResponse) {
+		res, err := app.Test(httptest.NewRequest("GET", "/order/"+orderID, nil))
+		if err != nil {
+			t.Fatalf("failed to get order status: %v", err)
+		}
+		var status schemas.OrderStatusResponse
+		_ = json.NewDecoder(res.Body).Decode(&status)
+		return res, status
+	}
+
+	_, resting := post(`{"user":"alice","priceLevel":100,"amount":4,"isBid":false}`)
+	post(`{"user":"bob","priceLevel":100,"amount":4,"isBid":true}`)
+	res, status := getStatus(resting["orderId"].(string))
+	if res.StatusCode != 200 || status.State != "filled" || status.Filled != 4 {
+		t.Fatalf("expected filled order status, got %d %+v", res.StatusCode, status)
+	}
+
+	// risk limits cap bob's order size so the next post is rejected before it reaches the book
+	limitReq := httptest.NewRequest("POST", "/admin/risk-limits", bytes.NewReader([]byte(`{"user":"bob","limits":{"maxOrderSize":1}}`)))
+	limitReq.Header.Set("Content-Type", "application/json")
+	if _, err := app.Test(limitReq); err != nil {
+		t.Fatalf("failed to set risk limits: %v", err)
+	}
+	res, rejectedResp := post(`{"user":"bob","priceLevel":100,"amount":2,"isBid":true}`)
+	if res.StatusCode != 400 || rejectedResp["orderId"] == nil {
+		t.Fatalf("expected reject with an order id, got %d %+v", res.StatusCode, rejectedResp)
+	}
+	_, status = getStatus(rejectedResp["orderId"].(string))
+	if status.State != "rejected" || status.RejectReason == "" {
+		t.Fatalf("expected rejected status with reason, got %+v", status)
+	}
+
+	historyRes, err := app.Test(httptest.NewRequest("GET", "/orders/bob/history?limit=1", nil))
+	if err != nil {
+		t.Fatalf("failed to get history: %v", err)
+	}
+	var history schemas.OrderHistoryResponse
+	if err := json.NewDecoder(historyRes.Body).Decode(&history); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+	if len(history.Orders) != 1 || history.Orders[0].State != "rejected" {
+		t.Fatalf("expected newest order first, got %+v", history.Orders)
+	}
+
+	if res, _ := getStatus(uuid.New().String()); res.StatusCode != 404 {
+		t.Fatalf("expected 404 for unknown order, got %d", res.StatusCode)
+	}
+	if res, err := app.Test(httptest.NewRequest("GET", "/orders/bob/history?limit=0", nil)); err != nil || res.StatusCode != 400 {
+		t.Fatalf("expected 400 for invalid limit")
+	}
+}
+
+func TestBatchEndpointAppliesOperationsInOrder(t *testing.T) {
+	h, _ := newTestHandler()
+	app := newTestApp(h)
+	app.Post("/order/batch", h.PostBatch)
+	ctx := context.Background()
+
+	postBatch := func(body string) (*http.Response, schemas.BatchResponse) {
+		req := httptest.NewRequest("POST", "/order/batch", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("failed to post batch: %v", err)
+		}
+		var response schemas.BatchResponse
+		_ = json.NewDecoder(res.Body).Decode(&response)
+		return res, response
+	}
+
+	res, quotes := postBatch(`{"operations":[
+		{"type":"post","user":"mm","clientOrderId":"bid-1","priceLevel":99,"amount":5,"isBid":true},
+		{"type":"post","user":"mm","clientOrderId":"ask-1","priceLevel":101,"amount":5}
+	]}`)
+	if res.StatusCode != 200 || len(quotes.Results) != 2 || quotes.Results[0].Status != schemas.BatchStatusAccepted {
+		t.Fatalf("expected both quotes accepted, got %d %+v", res.StatusCode, quotes.Results)
+	}
+	if h.replica.GetAppliedSeq() != 2 {
+		t.Fatalf("expected one entry per operation, got seq %d", h.replica.GetAppliedSeq())
+	}
+
+	res, requote := postBatch(`{"operations":[
+		{"type":"amend","user":"mm","clientOrderId":"bid-1","priceLevel":100,"amount":4},
+		{"type":"cancel","user":"mm","clientOrderId":"ask-1"},
+		{"type":"cancel","user":"mm","orderId":"` + uuid.NewString() + `"},
+		{"type":"post","user":"mm","clientOrderId":"ask-2","priceLevel":102,"amount":3}
+	]}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected partial batch to succeed, got %d", res.StatusCode)
+	}
+	results := requote.Results
+	if results[0].Status != schemas.BatchStatusAccepted || results[1].SizeCancelled != 5 {
+		t.Fatalf("unexpected amend/cancel results: %+v", results[:2])
+	}
+	if results[2].Status != schemas.BatchStatusRejected || results[2].Reason != string(orderbook.RejectUnknownOrder) {
+		t.Fatalf("expected unknown order reject, got %+v", results[2])
+	}
+	open := h.orderbook.OpenOrdersForUser(ctx, "mm")
+	if len(open) != 2 {
+		t.Fatalf("expected amended bid and new ask resting, got %+v", open)
+	}
+	for _, order := range open {
+		if order.IsBid && (order.PriceLevel != 100 || order.Amount != 4) {
+			t.Fatalf("expected bid amended to 4@100, got %+v", order)
+		}
+	}
+
+	seq := h.replica.GetAppliedSeq()
+	res, atomic := postBatch(`{"allOrNothing":true,"operations":[
+		{"type":"post","user":"mm","priceLevel":98,"amount":1,"isBid":true},
+		{"type":"post","user":"mm","priceLevel":98,"amount":0,"isBid":true}
+	]}`)
+	if res.StatusCode != 400 {
+		t.Fatalf("expected all-or-nothing batch to be rejected, got %d", res.StatusCode)
+	}
+	if atomic.Results[0].Status != schemas.BatchStatusSkipped || atomic.Results[1].Status != schemas.BatchStatusRejected {
+		t.Fatalf("unexpected all-or-nothing results: %+v", atomic.Results)
+	}
+	if h.replica.GetAppliedSeq() != seq || len(h.orderbook.OpenOrdersForUser(ctx, "mm")) != 2 {
+		t.Fatalf("expected rejected batch to leave no trace")
+	}
+}
+
+func TestBatchEndpointCountsCollateralAcrossOperations(t *testing.T) {
+	h, _ := newTestHandler()
+	h.SetCollateralChecks(true)
+	app := newTestApp(h)
+	app.Post("/order/batch", h.PostBatch)
+	h.orderbook.Deposit(context.Background(), "mm", 0, 1000)
+
+	req := httptest.NewRequest("POST", "/order/batch", bytes.NewReader([]byte(`{"operations":[
+		{"type":"post","user":"mm","priceLevel":100,"amount":6,"isBid":true},
+		{"type":"post","user":"mm","priceLevel":100,"amount":6,"isBid":true}
+	]}`)))
+	req.Header.Set("Content-Type", "application/json")
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("failed to post batch: %v", err)
+	}
+	var response schemas.BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode batch: %v", err)
+	}
+	if response.Results[0].Status != schemas.BatchStatusAccepted || response.Results[1].Reason != string(orderbook.RejectInsufficientBalance) {
+		t.Fatalf("expected second bid to exceed the balance left by the first, got %+v", response.Results)
+	}
+	if status, ok := h.orderbook.OrderStatus(uuid.MustParse(response.Results[1].OrderID)); !ok || status.State != orderbook.OrderStateRejected {
+		t.Fatalf("expected rejected batch post to be recorded, got %+v", status)
+	}
+}
+
+func TestAllOrNothingBatchRejectsWhatOnlyFailsInAggregate(t *testing.T) {
+	ctx := context.Background()
+	postBatch := func(h *Handler, body string) (*http.Response, schemas.BatchResponse) {
+		app := newTestApp(h)
+		app.Post("/order/batch", h.PostBatch)
+		req := httptest.NewRequest("POST", "/order/batch", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("failed to post batch: %v", err)
+		}
+		var response schemas.BatchResponse
+		_ = json.NewDecoder(res.Body).Decode(&response)
+		return res, response
+	}
+	expectRejected := func(h *Handler, res *http.Response, response schemas.BatchResponse, reason orderbook.RejectReason) {
+		t.Helper()
+		if res.StatusCode != 400 || response.Results[0].Status != schemas.BatchStatusSkipped || response.Results[1].Reason != string(reason) {
+			t.Fatalf("expected %s to reject the whole batch, got %d %+v", reason, res.StatusCode, response.Results)
+		}
+		if h.replica.GetAppliedSeq() != 0 {
+			t.Fatalf("expected rejected batch to replicate nothing, got seq %d", h.replica.GetAppliedSeq())
+		}
+	}
+
+	// each post fits under the open order cap on its own, but not both together
+	h, _ := newTestHandler()
+	h.orderbook.SetRiskLimits(ctx, "mm", schemas.RiskLimits{MaxOpenOrders: 1, MaxPosition: 5})
+	res, response := postBatch(h, `{"allOrNothing":true,"operations":[
+		{"type":"post","user":"mm","priceLevel":99,"amount":3,"isBid":true},
+		{"type":"post","user":"mm","priceLevel":98,"amount":3,"isBid":true}
+	]}`)
+	expectRejected(h, res, response, orderbook.RejectMaxOpenOrders)
+
+	h.orderbook.SetRiskLimits(ctx, "mm", schemas.RiskLimits{MaxPosition: 5})
+	res, response = postBatch(h, `{"allOrNothing":true,"operations":[
+		{"type":"post","user":"mm","priceLevel":99,"amount":3,"isBid":true},
+		{"type":"post","user":"mm","priceLevel":98,"amount":3,"isBid":true}
+	]}`)
+	expectRejected(h, res, response, orderbook.RejectMaxPosition)
+
+	// in pre-open the second post would cross the first once it rests
+	h, _ = newTestHandler()
+	if err := h.orderbook.SetMarketPhase(ctx, schemas.MarketPhasePreOpen); err != nil {
+		t.Fatalf("failed to enter pre-open: %v", err)
+	}
+	res, response = postBatch(h, `{"allOrNothing":true,"operations":[
+		{"type":"post","user":"alice","priceLevel":100,"amount":1,"isBid":true},
+		{"type":"post","user":"bob","priceLevel":99,"amount":1}
+	]}`)
+	expectRejected(h, res, response, orderbook.RejectWouldCross)
+
+	// the second post can reach the 108 ask, which would trip the breaker part way through
+	h, _ = newTestHandler()
+	if err := h.orderbook.SetPriceBands(ctx, schemas.PriceBands{BreakerBps: 500, BreakerWindowMs: 60_000, BreakerPhase: schemas.MarketPhaseHalted}); err != nil {
+		t.Fatalf("failed to set price bands: %v", err)
+	}
+	h.orderbook.PostLimit(ctx, "seller", uuid.New(), 100, 1, false)
+	h.orderbook.PostLimit(ctx, "buyer", uuid.New(), 100, 1, true)
+	h.orderbook.PostLimit(ctx, "seller", uuid.New(), 101, 1, false)
+	h.orderbook.PostLimit(ctx, "seller", uuid.New(), 108, 1, false)
+	res, response = postBatch(h, `{"allOrNothing":true,"operations":[
+		{"type":"post","user":"buyer","priceLevel":102,"amount":1,"isBid":true},
+		{"type":"post","user":"buyer","priceLevel":110,"amount":1,"isBid":true}
+	]}`)
+	expectRejected(h, res, response, orderbook.RejectWouldTripBreaker)
+	if h.orderbook.MarketPhase() != schemas.MarketPhaseContinuous {
+		t.Fatalf("expected the market to stay open, got %s", h.orderbook.MarketPhase())
+	}
+}
+
+func TestQuoteEndpointReplacesBothSides(t *testing.T) {
+	h, _ := newTestHandler()
+	h.SetCollateralChecks(true)
+	app := newTestApp(h)
+	app.Post("/order/quote", h.PostQuote)
+	app.Get("/orders/:userId/quote", h.GetQuote)
+	h.orderbook.Deposit(context.Background(), "mm", 10, 1000)
+
+	postQuote := func(body string) (*http.Response, schemas.QuoteResponse) {
+		req := httptest.NewRequest("POST", "/order/quote", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("failed to post quote: %v", err)
+		}
+		var response schemas.QuoteResponse
+		_ = json.NewDecoder(res.Body).Decode(&response)
+		return res, response
+	}
+
+	res, first := postQuote(`{"user":"mm","quoteId":"q1","bidPrice":99,"bidSize":10,"askPrice":101,"askSize":10}`)
+	if res.StatusCode != 200 || first.BidOrderID == "" || first.AskOrderID == "" {
+		t.Fatalf("expected quote accepted, got %d %+v", res.StatusCode, first)
+	}
+
+	// the new legs would not fit next to the old ones, but the old ones are released first
+	res, second := postQuote(`{"user":"mm","quoteId":"q2","bidPrice":100,"bidSize":9,"askPrice":102,"askSize":10}`)
+	if res.StatusCode != 200 || second.ReplacedQuoteID != "q1" || second.SizeCancelled != 20 {
+		t.Fatalf("expected q1 replaced, got %d %+v", res.StatusCode, second)
+	}
+	if h.replica.GetAppliedSeq() != 2 {
+		t.Fatalf("expected one entry per quote, got seq %d", h.replica.GetAppliedSeq())
+	}
+
+	if res, _ := postQuote(`{"user":"mm","bidPrice":103,"bidSize":1,"askPrice":102,"askSize":1}`); res.StatusCode != 400 {
+		t.Fatalf("expected crossed quote to be rejected, got %d", res.StatusCode)
+	}
+
+	res, err := app.Test(httptest.NewRequest("GET", "/orders/mm/quote", nil))
+	if err != nil {
+		t.Fatalf("failed to get quote: %v", err)
+	}
+	var state schemas.QuoteStateResponse
+	if err := json.NewDecoder(res.Body).Decode(&state); err != nil {
+		t.Fatalf("failed to decode quote: %v", err)
+	}
+	if state.QuoteID != "q2" || state.BidRemaining != 9 || state.AskRemaining != 10 {
+		t.Fatalf("unexpected quote state: %+v", state)
+	}
+}
+
+func TestPipelinedPostsKeepPerUserCollateralChecks(t *testing.T) {
+	h, _ := newTestHandler()
+	h.SetCollateralChecks(true)
+	h.SetPipelineDepth(8)
+	app := newTestApp(h)
+
+	users := []string{"alice", "bob", "carol"}
+	for _, user := range users {
+		req := httptest.NewRequest(
+			"POST",
+			"/accounts/deposit",
+			bytes.NewReader([]byte(`{"user":"`+user+`","quote":1000}`)),
+		)
+		req.Header.Set("Content-Type", "application/json")
+		if res, err := app.Test(req); err != nil || res.StatusCode != 200 {
+			t.Fatalf("failed to deposit for %s: %v", user, err)
+		}
+	}
+
+	// each user can fund two of their four bids, whichever order they are sequenced in
+	type result struct {
+		user   string
+		status int
+	}
+	results := make(chan result, len(users)*4)
+	var wg sync.WaitGroup
+	for _, user := range users {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(user string) {
+				defer wg.Done()
+				req := httptest.NewRequest(
+					"POST",
+					"/order/post",
+					bytes.NewReader([]byte(`{"user":"`+user+`","priceLevel":100,"amount":5,"isBid":true}`)),
+				)
+				req.Header.Set("Content-Type", "application/json")
+				res, err := app.Test(req, -1)
+				if err != nil {
+					t.Errorf("failed to post order: %v", err)
+					return
+				}
+				results <- result{user: user, status: res.StatusCode}
+			}(user)
+		}
+	}
+	wg.Wait()
+	close(results)
+
+	accepted := map[string]int{}
+	for res := range results {
+		if res.status == 200 {
+			accepted[res.user]++
+		} else if res.status != 400 {
+			t.Fatalf("unexpected status %d for %s", res.status, res.user)
+		}
+	}
+	for _, user := range users {
+		if accepted[user] != 2 {
+			t.Fatalf("expected 2 funded orders for %s, got %d", user, accepted[user])
+		}
+		if orders := h.orderbook.OpenOrdersForUser(context.Background(), user); len(orders) != 2 {
+			t.Fatalf("expected 2 resting orders for %s, got %d", user, len(orders))
+		}
+	}
+	// 3 deposits and 6 accepted orders; rejects never take a sequence
+	if h.replica.GetAppliedSeq() != 9 {
+		t.Fatalf("expected applied seq 9, got %d", h.replica.GetAppliedSeq())
+	}
+}
+
+func TestPipelinedOrderIsCheckedAgainWhenItApplies(t *testing.T) {
+	obsClient := &obs.Client{}
+	follower := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+	follower.SetPipelineDepth(8)
+	var held atomic.Bool
+	var heldPrepares atomic.Int32
+	release := make(chan struct{})
+	followerURL := startTestReplicaWith(t, follower, func(c *fiber.Ctx) error {
+		if held.Load() && strings.HasSuffix(c.Path(), "/prepare") {
+			heldPrepares.Add(1)
+			<-release
+		}
+		return c.Next()
+	})
+	primary := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRolePrimary, []string{followerURL}, ""))
+	primary.SetPipelineDepth(8)
+	app := newTestApp(primary)
+
+	post := func(path string, body string) (int, map[string]any) {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Errorf("failed to call %s: %v", path, err)
+			return 0, nil
+		}
+		var decoded map[string]any
+		_ = json.NewDecoder(res.Body).Decode(&decoded)
+		return res.StatusCode, decoded
+	}
+	waitForHeldPrepares := func(n int32) {
+		deadline := time.Now().Add(time.Second)
+		for heldPrepares.Load() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d prepares in flight, got %d", n, heldPrepares.Load())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if status, _ := post("/admin/risk-limits", `{"user":"bob","limits":{"maxPosition":5}}`); status != 200 {
+		t.Fatalf("expected risk limits status 200, got %d", status)
+	}
+	if status, _ := post("/order/post", `{"user":"bob","priceLevel":100,"amount":5,"isBid":false}`); status != 200 {
+		t.Fatalf("expected bob's ask status 200, got %d", status)
+	}
+
+	// alice's bid will fill bob's ask and take bob to his position limit, but it is still in
+	// flight when bob's next ask is checked
+	held.Store(true)
+	aliceStatus := make(chan int, 1)
+	go func() {
+		status, _ := post("/order/post", `{"user":"alice","priceLevel":100,"amount":5,"isBid":true}`)
+		aliceStatus <- status
+	}()
+	waitForHeldPrepares(1)
+	type response struct {
+		status int
+		body   map[string]any
+	}
+	bobResponse := make(chan response, 1)
+	go func() {
+		status, body := post("/order/post", `{"user":"bob","priceLevel":200,"amount":1,"isBid":false}`)
+		bobResponse <- response{status: status, body: body}
+	}()
+	waitForHeldPrepares(2)
+	held.Store(false)
+	close(release)
+
+	if status := <-aliceStatus; status != 200 {
+		t.Fatalf("expected alice's bid status 200, got %d", status)
+	}
+	bob := <-bobResponse
+	if bob.status != 400 || bob.body["reason"] != string(orderbook.RejectMaxPosition) {
+		t.Fatalf("expected bob's ask to be rejected for max position when it applied, got %d %v", bob.status, bob.body)
+	}
+	bobOrderID, err := uuid.Parse(fmt.Sprint(bob.body["orderId"]))
+	if err != nil {
+		t.Fatalf("expected reject to carry the order id: %v", err)
+	}
+
+	// the next write tells the follower everything before it committed
+	if status, _ := post("/order/post", `{"user":"carol","priceLevel":50,"amount":1,"isBid":true}`); status != 200 {
+		t.Fatalf("expected carol's bid status 200, got %d", status)
+	}
+	if follower.replica.GetAppliedSeq() != 4 {
+		t.Fatalf("expected follower applied seq 4, got %d", follower.replica.GetAppliedSeq())
+	}
+	for name, h := range map[string]*Handler{"primary": primary, "follower": follower} {
+		status, ok := h.orderbook.OrderStatus(bobOrderID)
+		if !ok || status.State != orderbook.OrderStateRejected || status.RejectReason != orderbook.RejectMaxPosition {
+			t.Fatalf("expected %s to record bob's ask as rejected, got %+v", name, status)
+		}
+		if orders := h.orderbook.OpenOrdersForUser(context.Background(), "bob"); len(orders) != 0 {
+			t.Fatalf("expected %s to rest none of bob's orders, got %d", name, len(orders))
+		}
+	}
+}
+
+func TestCollateralChecksAreReplicated(t *testing.T) {
+	obsClient := &obs.Client{}
+	follower := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+	var down atomic.Bool
+	followerURL := startTestReplica(t, follower, &down)
+	primary := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRolePrimary, []string{followerURL}, ""))
+	app := newTestApp(primary)
+	app.Post("/admin/collateral", primary.SetCollateral)
+
+	post := func(path string, body string) int {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("failed to call %s: %v", path, err)
+		}
+		return res.StatusCode
+	}
+
+	if status := post("/admin/collateral", `{"requireCollateral":true}`); status != 200 {
+		t.Fatalf("expected collateral status 200, got %d", status)
+	}
+	// the next write tells the follower the setting committed
+	if status := post("/accounts/deposit", `{"user":"alice","quote":100}`); status != 200 {
+		t.Fatalf("expected deposit status 200, got %d", status)
+	}
+	if !follower.orderbook.CollateralChecks() {
+		t.Fatalf("expected follower to enforce collateral from the log, not its own default")
+	}
+	if status := post("/order/post", `{"user":"alice","priceLevel":100,"amount":2,"isBid":true}`); status != 400 {
+		t.Fatalf("expected unfunded order to be rejected, got %d", status)
+	}
+}
+
+func TestFollowerAppliesPreparedEntriesOnlyOnceCommitted(t *testing.T) {
+	obsClient := &obs.Client{}
+	h := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, "http://primary"))
+	app := fiber.New()
+	app.Post("/internal/replica/prepare", h.PrepareEntries)
+	app.Post("/internal/replica/heartbeat", h.ReplicaHeartbeat)
+
+	send := func(path string, req replica.ReplicationRequest) {
+		payload, err := json.Marshal(req)
+		if err != nil {
+			t.Fatalf("failed to marshal replication request: %v", err)
+		}
+		httpReq := httptest.NewRequest("POST", path, bytes.NewReader(payload))
+		httpReq.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(httpReq)
+		if err != nil {
+			t.Fatalf("failed to send %s: %v", path, err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected %s status 200, got %d", path, res.StatusCode)
+		}
+	}
+
+	post := func(seq int64) replica.ReplicationEntry {
+		orderID := uuid.NewString()
+		return replica.ReplicationEntry{
+			Seq:        seq,
+			OpID:       orderID,
+			Type:       replica.ReplicationWritePost,
+			User:       "alice",
+			OrderID:    orderID,
+			PriceLevel: 100,
+			Amount:     int64(seq),
+			IsBid:      true,
+		}
+	}
+
+	first, second := post(1), post(2)
+	send("/internal/replica/prepare", replica.ReplicationRequest{Entries: []replica.ReplicationEntry{first}})
+	if orders := h.orderbook.OpenOrdersForUser(context.Background(), "alice"); len(orders) != 0 {
+		t.Fatalf("expected prepared entry to stay off the book, got %d orders", len(orders))
+	}
+
+	// the next prepare carries the commit sequence for the previous one
+	send("/internal/replica/prepare", replica.ReplicationRequest{
+		Entries:    []replica.ReplicationEntry{second},
+		PrevOpID:   first.OpID,
+		CommitSeq:  1,
+		CommitOpID: first.OpID,
+	})
+	if orders := h.orderbook.OpenOrdersForUser(context.Background(), "alice"); len(orders) != 1 || orders[0].Amount != 1 {
+		t.Fatalf("expected only seq 1 on the book, got %+v", orders)
+	}
+
+	send("/internal/replica/heartbeat", replica.ReplicationRequest{CommitSeq: 2, CommitOpID: second.OpID})
+	if orders := h.orderbook.OpenOrdersForUser(context.Background(), "alice"); len(orders) != 2 {
+		t.Fatalf("expected both committed orders on the book, got %d", len(orders))
+	}
+	if h.replica.GetAppliedSeq() != 2 {
+		t.Fatalf("expected applied seq 2, got %d", h.replica.GetAppliedSeq())
+	}
+}
+
+// startTestReplica serves a node's replica routes on a local port. While down is set the node
+// answers every replica request with a 503.
+func startTestReplica(t *testing.T, h *Handler, down *atomic.Bool) string {
+	t.Helper()
+
+	return startTestReplicaWith(t, h, func(c *fiber.Ctx) error {
+		if down.Load() {
+			return c.SendStatus(fiber.StatusServiceUnavailable)
+		}
+		return c.Next()
+	})
+}
+
+// startTestReplicaWith serves a node's replica routes behind middleware.
+func startTestReplicaWith(t *testing.T, h *Handler, middleware fiber.Handler) string {
+	t.Helper()
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	replicaRoutes := app.Group("/internal/replica", middleware)
+	replicaRoutes.Post("/prepare", h.PrepareEntries)
+	replicaRoutes.Post("/commit", h.CommitEntries)
+	replicaRoutes.Post("/heartbeat", h.ReplicaHeartbeat)
+	replicaRoutes.Get("/state", h.GetReplicaState)
+	replicaRoutes.Get("/sync", h.GetReplicaSync)
+	replicaRoutes.Post("/install-snapshot", h.InstallSnapshot)
+	replicaRoutes.Get("/read-index", h.GetReadIndex)
+	replicaRoutes.Post("/take-leadership", h.TakeLeadership)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		_ = app.Listener(ln)
+	}()
+	t.Cleanup(func() {
+		_ = app.ShutdownWithTimeout(time.Second)
+	})
+	return "http://" + ln.Addr().String()
+}
+
+func TestPrimaryCatchesUpLaggingFollower(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		snapshotLag int64
+	}{
+		{name: "log entries", snapshotLag: replica.DefaultSnapshotCatchUpLag},
+		{name: "snapshot", snapshotLag: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			obsClient := &obs.Client{}
+			up, lagging := &atomic.Bool{}, &atomic.Bool{}
+			lagging.Store(true)
+
+			followerA := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+			followerB := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+			peers := []string{startTestReplica(t, followerA, up), startTestReplica(t, followerB, lagging)}
+			primary := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRolePrimary, peers, ""))
+			primary.SetSnapshotCatchUpLag(tc.snapshotLag)
+			app := newTestApp(primary)
+
+			postOrder := func(amount int) {
+				req := httptest.NewRequest(
+					"POST",
+					"/order/post",
+					bytes.NewReader([]byte(fmt.Sprintf(`{"user":"alice","priceLevel":100,"amount":%d,"isBid":true}`, amount))),
+				)
+				req.Header.Set("Content-Type", "application/json")
+				res, err := app.Test(req, -1)
+				if err != nil {
+					t.Fatalf("failed to post order: %v", err)
+				}
+				if res.StatusCode != 200 {
+					t.Fatalf("expected post status 200, got %d", res.StatusCode)
+				}
+			}
+
+			// follower B misses the first three writes; A alone makes quorum
+			for i := 1; i <= 3; i++ {
+				postOrder(i)
+			}
+			lagging.Store(false)
+			// B reports a sequence gap on this prepare, which starts catch-up
+			postOrder(4)
+
+			deadline := time.Now().Add(3 * time.Second)
+			for followerB.replica.GetAppliedSeq() < 4 {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected follower to catch up to seq 4, got %d", followerB.replica.GetAppliedSeq())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if orders := followerB.orderbook.OpenOrdersForUser(context.Background(), "alice"); len(orders) != 4 {
+				t.Fatalf("expected 4 resting orders on caught up follower, got %d", len(orders))
+			}
+		})
+	}
+}
+
+func TestPrimaryReplicatesToRecoveredFollowerWithoutNewWrites(t *testing.T) {
+	obsClient := &obs.Client{}
+	up, down := &atomic.Bool{}, &atomic.Bool{}
+	down.Store(true)
+
+	followerA := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+	followerB := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+	peers := []string{startTestReplica(t, followerA, up), startTestReplica(t, followerB, down)}
+	primary := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRolePrimary, peers, ""))
+	app := newTestApp(primary)
+	app.Get("/internal/replica/peers", primary.GetReplicaPeers)
+
+	for i := 1; i <= 3; i++ {
+		req := httptest.NewRequest(
+			"POST",
+			"/order/post",
+			bytes.NewReader([]byte(fmt.Sprintf(`{"user":"alice","priceLevel":100,"amount":%d,"isBid":true}`, i))),
+		)
+		req.Header.Set("Content-Type", "application/json")
+		if res, err := app.Test(req, -1); err != nil || res.StatusCode != 200 {
+			t.Fatalf("failed to post order %d: %v", i, err)
+		}
+	}
+
+	// the failed prepares started B's replication loop, which keeps retrying until B is back
+	down.Store(false)
+	deadline := time.Now().Add(3 * time.Second)
+	for followerB.replica.GetAppliedSeq() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected recovered follower to reach seq 3, got %d", followerB.replica.GetAppliedSeq())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res, err := app.Test(httptest.NewRequest("GET", "/internal/replica/peers", nil))
+	if err != nil {
+		t.Fatalf("failed to request peers: %v", err)
+	}
+	var peersResp replica.ReplicaPeersResponse
+	if err := json.NewDecoder(res.Body).Decode(&peersResp); err != nil {
+		t.Fatalf("failed to decode peers response: %v", err)
+	}
+	if peersResp.AppliedSeq != 3 || len(peersResp.Peers) != 2 {
+		t.Fatalf("unexpected peers response: %+v", peersResp)
+	}
+	laggingPeer := peersResp.Peers[1]
+	if laggingPeer.Peer != peers[1] || laggingPeer.MatchSeq != 3 || laggingPeer.Lag != 0 {
+		t.Fatalf("expected recovered peer to be fully acked, got %+v", laggingPeer)
+	}
+}
+
+// newFollowerWithUncommittedOrders starts a primary holding two of alice's orders and a follower
+// that has both prepared but has not heard they committed.
+func newFollowerWithUncommittedOrders(t *testing.T, primaryDown *atomic.Bool) (*Handler, *Handler, *fiber.App) {
+	t.Helper()
+
+	primary, _ := newTestHandler()
+	primaryURL := startTestReplica(t, primary, primaryDown)
+	primaryApp := newTestApp(primary)
+	for i := 1; i <= 2; i++ {
+		req := httptest.NewRequest(
+			"POST",
+			"/order/post",
+			bytes.NewReader([]byte(fmt.Sprintf(`{"user":"alice","priceLevel":100,"amount":%d,"isBid":true}`, i))),
+		)
+		req.Header.Set("Content-Type", "application/json")
+		if res, err := primaryApp.Test(req, -1); err != nil || res.StatusCode != 200 {
+			t.Fatalf("failed to post order %d: %v", i, err)
+		}
+	}
+
+	follower := newTestNode(&obs.Client{}, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, primaryURL))
+	followerApp := newTestApp(follower)
+	followerApp.Post("/internal/replica/prepare", follower.PrepareEntries)
+	payload, err := json.Marshal(replica.ReplicationRequest{Entries: primary.replica.EntriesAfter(0, 10)})
+	if err != nil {
+		t.Fatalf("failed to marshal replication request: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/internal/replica/prepare", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if res, err := followerApp.Test(req, -1); err != nil || res.StatusCode != 200 {
+		t.Fatalf("failed to prepare on follower: %v", err)
+	}
+	if follower.replica.GetAppliedSeq() != 0 {
+		t.Fatalf("expected follower to hold prepares unapplied, got applied seq %d", follower.replica.GetAppliedSeq())
+	}
+	return primary, follower, followerApp
+}
+
+// readOpenOrders returns the read's status and, on success, how many open orders alice has.
+func readOpenOrders(t *testing.T, app *fiber.App, req *http.Request) (int, int) {
+	t.Helper()
+
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("failed to read orders: %v", err)
+	}
+	if res.StatusCode != 200 {
+		return res.StatusCode, 0
+	}
+	var ordersResp struct {
+		Orders []struct {
+			OrderID string `json:"orderId"`
+		} `json:"orders"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&ordersResp); err != nil {
+		t.Fatalf("failed to decode orders: %v", err)
+	}
+	return res.StatusCode, len(ordersResp.Orders)
+}
+
+func TestFollowerReadWaitsForPrimaryReadIndex(t *testing.T) {
+	_, _, followerApp := newFollowerWithUncommittedOrders(t, &atomic.Bool{})
+
+	status, count := readOpenOrders(t, followerApp, httptest.NewRequest("GET", "/orders/alice", nil))
+	if status != 200 {
+		t.Fatalf("expected read status 200, got %d", status)
+	}
+	if count != 2 {
+		t.Fatalf("expected follower read to see both committed orders, got %d", count)
+	}
+}
+
+func TestFollowerReadConsistencyLevels(t *testing.T) {
+	primaryDown := &atomic.Bool{}
+	primaryDown.Store(true)
+	primary, follower, followerApp := newFollowerWithUncommittedOrders(t, primaryDown)
+	// the last the follower heard before the primary went away is that the first order committed
+	first := primary.replica.EntriesAfter(0, 1)[0]
+	follower.applyCommitted(context.Background(), first.Seq, first.OpID)
+
+	// with the primary unreachable only reads that accept staleness are served
+	for _, tc := range []struct {
+		name   string
+		query  string
+		header string
+		status int
+	}{
+		{name: "local query", query: "?consistency=local", status: 200},
+		{name: "bounded staleness by age header", header: "bounded-staleness=1m", status: 200},
+		{name: "bounded staleness by sequence", query: "?consistency=bounded-staleness=0", status: 200},
+		{name: "linearizable default", status: 503},
+		{name: "invalid level", query: "?consistency=eventual", status: 400},
+		{name: "invalid bound", header: "bounded-staleness=soon", status: 400},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/orders/alice"+tc.query, nil)
+			if tc.header != "" {
+				req.Header.Set("X-Read-Consistency", tc.header)
+			}
+			status, count := readOpenOrders(t, followerApp, req)
+			if status != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, status)
+			}
+			if status == 200 && count != 1 {
+				t.Fatalf("expected stale read to see the one order it heard committed, got %d", count)
+			}
+		})
+	}
+
+	// a follower that has not heard from the primary cannot vouch for any sequence bound
+	stranded := newTestNode(&obs.Client{}, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, follower.replica.Primary()))
+	strandedApp := newTestApp(stranded)
+	if lag, _ := stranded.replica.Staleness(); lag != 0 {
+		t.Fatalf("expected a follower that never heard a commit seq to report no lag, got %d", lag)
+	}
+	status, _ := readOpenOrders(t, strandedApp, httptest.NewRequest("GET", "/orders/alice?consistency=bounded-staleness=0", nil))
+	if status != 503 {
+		t.Fatalf("expected sequence-bounded read without primary contact to fail, got %d", status)
+	}
+
+	// once the primary is back a linearizable read catches up
+	primaryDown.Store(false)
+	req := httptest.NewRequest("GET", "/orders/alice", nil)
+	req.Header.Set("X-Read-Consistency", "linearizable")
+	if status, count := readOpenOrders(t, followerApp, req); status != 200 || count != 2 {
+		t.Fatalf("expected linearizable read to see 2 orders, got status=%d count=%d", status, count)
+	}
+}
+
+func TestAddAndRemoveClusterNode(t *testing.T) {
+	obsClient := &obs.Client{}
+	up, aDown := &atomic.Bool{}, &atomic.Bool{}
+
+	followerA := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+	newNode := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+	aURL := startTestReplica(t, followerA, aDown)
+	nURL := startTestReplica(t, newNode, up)
+	primary := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRolePrimary, []string{aURL}, ""))
+	app := newTestApp(primary)
+	app.Get("/admin/cluster", primary.GetClusterMembership)
+	app.Post("/admin/cluster/add-node", primary.AddClusterNode)
+	app.Post("/admin/cluster/remove-node", primary.RemoveClusterNode)
+
+	postOrder := func(amount int) int {
+		req := httptest.NewRequest(
+			"POST",
+			"/order/post",
+			bytes.NewReader([]byte(fmt.Sprintf(`{"user":"alice","priceLevel":100,"amount":%d,"isBid":true}`, amount))),
+		)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("failed to post order: %v", err)
+		}
+		return res.StatusCode
+	}
+	changeMembership := func(path, peer string) replica.ClusterMembershipResponse {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(fmt.Sprintf(`{"peer":%q}`, peer))))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("failed to call %s: %v", path, err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected %s status 200, got %d", path, res.StatusCode)
+		}
+		var membership replica.ClusterMembershipResponse
+		if err := json.NewDecoder(res.Body).Decode(&membership); err != nil {
+			t.Fatalf("failed to decode membership: %v", err)
+		}
+		return membership
+	}
+
+	for i := 1; i <= 2; i++ {
+		if status := postOrder(i); status != 200 {
+			t.Fatalf("expected post status 200, got %d", status)
+		}
+	}
+
+	// the new node is caught up before it joins, so it holds both orders straight away
+	membership := changeMembership("/admin/cluster/add-node", nURL)
+	if len(membership.Members) != 2 || membership.RequiredPeerAcks != 1 {
+		t.Fatalf("expected two members needing one ack, got %+v", membership)
+	}
+	if got := newNode.replica.GetAppliedSeq(); got < 2 {
+		t.Fatalf("expected new node to be caught up before joining, got applied seq %d", got)
+	}
+
+	// with A down the new node's ack alone makes quorum
+	aDown.Store(true)
+	if status := postOrder(3); status != 200 {
+		t.Fatalf("expected post with new node acking to succeed, got %d", status)
+	}
+
+	membership = changeMembership("/admin/cluster/remove-node", aURL)
+	if len(membership.Members) != 1 || membership.Members[0] != nURL {
+		t.Fatalf("expected only the new node left, got %+v", membership)
+	}
+	if status := postOrder(4); status != 200 {
+		t.Fatalf("expected post after removal to succeed, got %d", status)
+	}
+	// the commit sequence carried on the last prepare lets the new node apply the removal
+	if members := newNode.replica.Members(); len(members) != 1 || members[0] != nURL {
+		t.Fatalf("expected new node to learn the committed configuration, got %v", members)
+	}
+}
+
+func TestLearnerReceivesEntriesAndVotesOncePromoted(t *testing.T) {
+	obsClient := &obs.Client{}
+	up, aDown := &atomic.Bool{}, &atomic.Bool{}
+
+	followerA := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+	learner := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleLearner, []string{}, ""))
+	aURL := startTestReplica(t, followerA, aDown)
+	learnerURL := startTestReplica(t, learner, up)
+	learner.replica.SetSelf(learnerURL)
+	primary := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRolePrimary, []string{aURL}, ""))
+	app := newTestApp(primary)
+	app.Post("/admin/cluster/add-learner", primary.AddClusterLearner)
+	app.Post("/admin/cluster/promote", primary.PromoteClusterLearner)
+
+	postOrder := func(amount int) int {
+		req := httptest.NewRequest(
+			"POST",
+			"/order/post",
+			bytes.NewReader([]byte(fmt.Sprintf(`{"user":"alice","priceLevel":100,"amount":%d,"isBid":true}`, amount))),
+		)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("failed to post order: %v", err)
+		}
+		return res.StatusCode
+	}
+	changeMembership := func(path string) {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(fmt.Sprintf(`{"peer":%q}`, learnerURL))))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("failed to call %s: %v", path, err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected %s status 200, got %d", path, res.StatusCode)
+		}
+	}
+
+	if status := postOrder(1); status != 200 {
+		t.Fatalf("expected post status 200, got %d", status)
+	}
+	changeMembership("/admin/cluster/add-learner")
+	if got := primary.replica.RequiredPeerAcks(); got != 1 {
+		t.Fatalf("expected learner not to change the quorum, got %d", got)
+	}
+	if status := postOrder(2); status != 200 {
+		t.Fatalf("expected post status 200, got %d", status)
+	}
+	if got := learner.replica.GetAppliedSeq(); got < 2 {
+		t.Fatalf("expected learner to receive entries, got applied seq %d", got)
+	}
+
+	changeMembership("/admin/cluster/promote")
+	if got := primary.replica.RequiredPeerAcks(); got != 1 {
+		t.Fatalf("expected two voters to need one peer ack, got %d", got)
+	}
+	aDown.Store(true)
+	if status := postOrder(3); status != 200 {
+		t.Fatalf("expected promoted learner's ack to make quorum, got %d", status)
+	}
+	if learner.replica.Role() != replica.NodeRoleSecondary {
+		t.Fatalf("expected promoted learner to become a secondary, got %s", learner.replica.Role())
+	}
+}
+
+func TestTransferLeadershipHandsOverWithoutLosingWrites(t *testing.T) {
+	obsClient := &obs.Client{}
+	up := &atomic.Bool{}
+
+	followerA := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+	followerB := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleSecondary, []string{}, ""))
+	learner := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRoleLearner, []string{}, ""))
+	aURL := startTestReplica(t, followerA, up)
+	bURL := startTestReplica(t, followerB, up)
+	learnerURL := startTestReplica(t, learner, up)
+	primary := newTestNode(obsClient, replica.NewCoordinator(replica.NodeRolePrimary, []string{aURL, bURL}, ""))
+	primaryURL := startTestReplica(t, primary, up)
+	primary.replica.SetSelf(primaryURL)
+	primary.replica.SetMembership(replica.ClusterConfig{Members: []string{aURL, bURL}, Learners: []string{learnerURL}})
+	for _, follower := range []*Handler{followerA, followerB, learner} {
+		follower.replica.SetPrimary(primaryURL)
+	}
+	// every node runs heartbeats; only the primary's send anything
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	for _, node := range []*Handler{primary, followerA, followerB, learner} {
+		go node.RunReplicaHeartbeats(ctx, 10*time.Millisecond)
+	}
+	primaryApp := newTestApp(primary)
+	primaryApp.Post("/admin/cluster/transfer-leadership", primary.RequireWriteAccess(), primary.TransferLeadership)
+	newPrimaryApp := newTestApp(followerA)
+
+	postOrder := func(app *fiber.App, amount int) *http.Response {
+		req := httptest.NewRequest(
+			"POST",
+			"/order/post",
+			bytes.NewReader([]byte(fmt.Sprintf(`{"user":"alice","priceLevel":100,"amount":%d,"isBid":true}`, amount))),
+		)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("failed to post order: %v", err)
+		}
+		return res
+	}
+	transfer := func(peer string) int {
+		req := httptest.NewRequest("POST", "/admin/cluster/transfer-leadership", bytes.NewReader([]byte(fmt.Sprintf(`{"peer":%q}`, peer))))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := primaryApp.Test(req, -1)
+		if err != nil {
+			t.Fatalf("failed to transfer leadership: %v", err)
+		}
+		return res.StatusCode
+	}
+
+	for i := 1; i <= 3; i++ {
+		if res := postOrder(primaryApp, i); res.StatusCode != 200 {
+			t.Fatalf("expected post status 200, got %d", res.StatusCode)
+		}
+	}
+
+	// learners never become primary
+	if status := transfer(learnerURL); status != 400 {
+		t.Fatalf("expected transfer to a learner to be rejected with 400, got %d", status)
+	}
+	if status := transfer(aURL); status != 200 {
+		t.Fatalf("expected transfer status 200, got %d", status)
+	}
+
+	if followerA.replica.Role() != replica.NodeRolePrimary {
+		t.Fatalf("expected target to be primary, got %s", followerA.replica.Role())
+	}
+	if orders := followerA.orderbook.OpenOrdersForUser(context.Background(), "alice"); len(orders) != 3 {
+		t.Fatalf("expected new primary to hold every acknowledged order, got %d", len(orders))
+	}
+
+	res := postOrder(primaryApp, 4)
+	if res.StatusCode != fiber.StatusTemporaryRedirect {
+		t.Fatalf("expected old primary to redirect writes, got %d", res.StatusCode)
+	}
+	var redirect struct {
+		Leader string `json:"leader"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&redirect); err != nil {
+		t.Fatalf("failed to decode redirect: %v", err)
+	}
+	if redirect.Leader != aURL {
+		t.Fatalf("expected redirect to %s, got %q", aURL, redirect.Leader)
+	}
+
+	if res := postOrder(newPrimaryApp, 4); res.StatusCode != 200 {
+		t.Fatalf("expected new primary to accept writes, got %d", res.StatusCode)
+	}
+	// the new primary's announcement points every follower at it, and the old primary follows
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		// three orders, the announcement and the fourth order
+		followersCaughtUp := primary.replica.GetAppliedSeq() >= 5 && learner.replica.GetAppliedSeq() >= 5
+		if followersCaughtUp && followerB.replica.Primary() == aURL && learner.replica.Primary() == aURL {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf(
+				"expected followers to follow the new primary, got old primary seq=%d learner seq=%d b primary=%s",
+				primary.replica.GetAppliedSeq(), learner.replica.GetAppliedSeq(), followerB.replica.Primary(),
+			)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if orders := primary.orderbook.OpenOrdersForUser(context.Background(), "alice"); len(orders) != 4 {
+		t.Fatalf("expected old primary to apply the new primary's write, got %d orders", len(orders))
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+
+	"replicated-clob/pkg/replica"
+)
+
+// userWrites tracks which users have pipelined writes that have not applied yet. A user's next
+// order waits for them, so its pre-trade checks see the user's own balance, holds and open
+// orders exactly as they will be when it applies. Other users' orders still in flight can move
+// the user's position, the last trade price or the market phase before it applies, so the order
+// is checked again then, see postCommittedLimit.
+type userWrites struct {
+	byUser map[string]*userInflight
+	mu     sync.Mutex
+}
+
+type userInflight struct {
+	count int
+	idle  chan struct{}
+}
+
+func newUserWrites() *userWrites {
+	return &userWrites{
+		byUser: map[string]*userInflight{},
+	}
+}
+
+// idle returns a channel that closes once the user's in-flight writes have applied, or nil when
+// there are none.
+func (w *userWrites) idle(user string) <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	inflight, ok := w.byUser[user]
+	if !ok {
+		return nil
+	}
+	return inflight.idle
+}
+
+// begin marks a write for user as in flight and returns the func that marks it finished.
+func (w *userWrites) begin(user string) func() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	inflight, ok := w.byUser[user]
+	if !ok {
+		inflight = &userInflight{idle: make(chan struct{})}
+		w.byUser[user] = inflight
+	}
+	inflight.count++
+
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		inflight.count--
+		if inflight.count == 0 {
+			close(inflight.idle)
+			delete(w.byUser, user)
+		}
+	}
+}
+
+// lockWriteForUser takes the write pipeline lock once the user has nothing in flight. Writes from
+// other users stay in the pipeline.
+func (h *Handler) lockWriteForUser(user string) {
+	for {
+		h.replica.LockWritePipeline()
+		idle := h.userWrites.idle(user)
+		if idle == nil {
+			return
+		}
+		h.replica.UnlockWritePipeline()
+		<-idle
+	}
+}
+
+// submitWrite queues entry on the replication pipeline. apply runs once the entry commits, in
+// sequence order with every other write; the returned channel reports replication and apply
+// failures. Callers reserve a pipeline slot before taking the write pipeline lock, and hold the
+// lock so sequences follow the order of their checks.
+func (h *Handler) submitWrite(ctx context.Context, entry replica.ReplicationEntry, apply func(context.Context, replica.ReplicationEntry) error) <-chan error {
+	return h.pipeline.Submit(ctx, entry, func(ctx context.Context, entry replica.ReplicationEntry) error {
+		h.orderbook.AdvanceClock(entry.TimestampMs)
+		return apply(ctx, entry)
+	})
+}
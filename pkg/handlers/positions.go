@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"errors"
+
+	"replicated-clob/schemas"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (h *Handler) GetPosition(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if userID == "" {
+		h.obs.LogErr(c.UserContext(), "positions.query: missing userId")
+		return badRequest(c, errors.New("userId is required"))
+	}
+
+	ctx := c.UserContext()
+	h.obs.LogInfo(ctx, "positions.query: user=%s", userID)
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "positions.query: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	position, markPrice := h.orderbook.PositionForUser(ctx, userID)
+	return jsonResponse(c, fiber.StatusOK, schemas.PositionResponse{
+		User:          userID,
+		NetPosition:   position.Net,
+		AvgEntryPrice: position.AvgEntryPrice(),
+		RealizedPnL:   position.RealizedPnL,
+		UnrealizedPnL: position.UnrealizedPnL(markPrice),
+		MarkPrice:     markPrice,
+	})
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"replicated-clob/pkg/orderbook"
+	"replicated-clob/pkg/replica"
+	"replicated-clob/schemas"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// PostQuote replaces the user's bid and ask in one replicated entry. The previous legs are
+// cancelled and the new ones posted under a single book lock, so there is never a moment where
+// only one side has been updated.
+func (h *Handler) PostQuote(c *fiber.Ctx) error {
+	var req schemas.QuoteRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "order.quote: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.User == "" {
+		h.obs.LogErr(ctx, "order.quote: user missing")
+		return badRequest(c, errors.New("user is required"))
+	}
+	if err := orderbook.ValidateQuote(req.QuoteID, req.BidPrice, req.BidSize, req.AskPrice, req.AskSize); err != nil {
+		h.obs.LogErr(ctx, "order.quote: invalid quote user=%s err=%v", req.User, err)
+		return rejected(c, err)
+	}
+	if req.QuoteID == "" {
+		req.QuoteID = uuid.NewString()
+	}
+
+	h.obs.LogInfo(ctx, "order.quote: user=%s quote_id=%s bid=%d@%d ask=%d@%d", req.User, req.QuoteID, req.BidSize, req.BidPrice, req.AskSize, req.AskPrice)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	if err := h.checkQuote(req); err != nil {
+		h.obs.LogErr(ctx, "order.quote: rejected user=%s err=%v", req.User, err)
+		return rejected(c, err)
+	}
+
+	quote := schemas.Quote{
+		QuoteID:  req.QuoteID,
+		BidPrice: req.BidPrice,
+		BidSize:  req.BidSize,
+		AskPrice: req.AskPrice,
+		AskSize:  req.AskSize,
+	}
+	if req.BidSize > 0 {
+		quote.BidOrderID = uuid.NewString()
+	}
+	if req.AskSize > 0 {
+		quote.AskOrderID = uuid.NewString()
+	}
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:       h.replica.NextSequence(),
+		OpID:      uuid.NewString(),
+		Type:      replica.ReplicationWriteQuote,
+		User:      req.User,
+		MassQuote: &quote,
+	}
+
+	if err := h.replicateWrite(ctx, "order.quote", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	resp, err := h.applyQuoteReplication(ctx, replicaEntry)
+	if err != nil {
+		h.obs.LogErr(ctx, "order.quote commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	h.obs.LogInfo(ctx, "order.quote done: user=%s quote_id=%s size_cancelled=%d bid_fills=%d ask_fills=%d", req.User, req.QuoteID, resp.SizeCancelled, len(resp.BidFills), len(resp.AskFills))
+	return jsonResponse(c, fiber.StatusOK, resp)
+}
+
+func (h *Handler) GetQuote(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	ctx := c.UserContext()
+	if userID == "" {
+		h.obs.LogErr(ctx, "order.quote_query: missing userId")
+		return badRequest(c, errors.New("userId is required"))
+	}
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "order.quote_query: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	quote, bidRemaining, askRemaining, ok := h.orderbook.QuoteForUser(userID)
+	if !ok {
+		return notFound(c, errors.New("quote not found"))
+	}
+
+	return jsonResponse(c, fiber.StatusOK, schemas.QuoteStateResponse{
+		Quote:        quote.Response(),
+		BidRemaining: bidRemaining,
+		AskRemaining: askRemaining,
+	})
+}
+
+// checkQuote runs the pre-trade checks on each new leg, the ask on top of the bid. The legs being
+// replaced release their holds and open order slots, so they are credited before the new legs
+// are checked.
+func (h *Handler) checkQuote(req schemas.QuoteRequest) error {
+	state := newBatchState(h.orderbook)
+	replacing := map[bool]bool{}
+	if previous, _, _, ok := h.orderbook.QuoteForUser(req.User); ok {
+		for _, orderID := range []uuid.UUID{previous.BidOrderID, previous.AskOrderID} {
+			status, ok := h.orderbook.OrderStatus(orderID)
+			if !ok || !status.Open() {
+				continue
+			}
+			state.addHold(req.User, status.PriceLevel, -status.Remaining(), status.IsBid)
+			replacing[status.IsBid] = true
+		}
+	}
+
+	if req.BidSize > 0 {
+		if err := h.checkBatchPreTrade(req.User, req.BidPrice, req.BidSize, true, state, !replacing[true]); err != nil {
+			return err
+		}
+		state.addOrder(req.User, req.BidPrice, req.BidSize, true, !replacing[true])
+	}
+	if req.AskSize > 0 {
+		if err := h.checkBatchPreTrade(req.User, req.AskPrice, req.AskSize, false, state, !replacing[false]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) applyQuoteReplication(ctx context.Context, entry replica.ReplicationEntry) (schemas.QuoteResponse, error) {
+	if entry.MassQuote == nil {
+		return schemas.QuoteResponse{}, errors.New("replication entry missing quote")
+	}
+	quote, err := parseQuote(*entry.MassQuote)
+	if err != nil {
+		return schemas.QuoteResponse{}, err
+	}
+	seqApplied, err := h.replica.ApplyRemote(entry)
+	if err != nil {
+		return schemas.QuoteResponse{}, err
+	}
+	if !seqApplied {
+		return schemas.QuoteResponse{Quote: *entry.MassQuote}, nil
+	}
+
+	return h.orderbook.ReplaceQuote(ctx, entry.User, quote), nil
+}
+
+func parseQuote(quote schemas.Quote) (orderbook.Quote, error) {
+	parsed := orderbook.Quote{
+		QuoteID:  quote.QuoteID,
+		BidPrice: quote.BidPrice,
+		BidSize:  quote.BidSize,
+		AskPrice: quote.AskPrice,
+		AskSize:  quote.AskSize,
+	}
+	var err error
+	if quote.BidOrderID != "" {
+		if parsed.BidOrderID, err = uuid.Parse(quote.BidOrderID); err != nil {
+			return orderbook.Quote{}, fmt.Errorf("replication entry invalid bidOrderId: %w", err)
+		}
+	}
+	if quote.AskOrderID != "" {
+		if parsed.AskOrderID, err = uuid.Parse(quote.AskOrderID); err != nil {
+			return orderbook.Quote{}, fmt.Errorf("replication entry invalid askOrderId: %w", err)
+		}
+	}
+	return parsed, nil
+}
@@ -2,16 +2,22 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 
+	"replicated-clob/pkg/orderbook"
 	"replicated-clob/pkg/replica"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
+// readIndexWaitTimeout bounds how long a read waits for this node to apply up to its read index.
+const readIndexWaitTimeout = time.Second
+
 func (h *Handler) CommitEntries(c *fiber.Ctx) error {
 	var req replica.ReplicationRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -54,6 +60,13 @@ func (h *Handler) GetReplicaState(c *fiber.Ctx) error {
 	return jsonResponse(c, fiber.StatusOK, h.replica.State())
 }
 
+func (h *Handler) GetReplicaPeers(c *fiber.Ctx) error {
+	return jsonResponse(c, fiber.StatusOK, replica.ReplicaPeersResponse{
+		AppliedSeq: h.replica.GetAppliedSeq(),
+		Peers:      h.replication.PeerProgress(),
+	})
+}
+
 func (h *Handler) GetReplicaSync(c *fiber.Ctx) error {
 	since := c.Query("since", "0")
 	from, err := strconv.ParseInt(since, 10, 64)
@@ -66,35 +79,138 @@ func (h *Handler) GetReplicaSync(c *fiber.Ctx) error {
 	})
 }
 
+func (h *Handler) GetReplicaSnapshot(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	snapshot, err := h.replicaSnapshot(ctx)
+	if err != nil {
+		h.obs.LogErr(ctx, "replica.snapshot: encode failed: %v", err)
+		return internalServerError(c)
+	}
+	return jsonResponse(c, fiber.StatusOK, snapshot)
+}
+
+// replicaSnapshot captures the applied book state. The write pipeline is held so the state and
+// sequence describe the same point in the log.
+func (h *Handler) replicaSnapshot(ctx context.Context) (replica.ReplicaSnapshotResponse, error) {
+	h.lockWritePipeline()
+	appliedSeq, appliedOpID := h.replica.CommitPoint()
+	snapshot := h.orderbook.Snapshot(ctx)
+	members, learners := h.replica.Members(), h.replica.Learners()
+	h.replica.UnlockWritePipeline()
+
+	state, err := json.Marshal(snapshot)
+	if err != nil {
+		return replica.ReplicaSnapshotResponse{}, err
+	}
+	return replica.ReplicaSnapshotResponse{
+		AppliedSeq:  appliedSeq,
+		AppliedOpID: appliedOpID,
+		State:       state,
+		Members:     members,
+		Learners:    learners,
+	}, nil
+}
+
+// InstallSnapshot replaces a lagging follower's state with one the primary pushed during
+// catch-up. A snapshot older than what is already applied is ignored.
+func (h *Handler) InstallSnapshot(c *fiber.Ctx) error {
+	var req replica.ReplicaSnapshotResponse
+	ctx := c.UserContext()
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "replica.install_snapshot: invalid request body: %v", err)
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	var snapshot orderbook.Snapshot
+	if err := json.Unmarshal(req.State, &snapshot); err != nil {
+		h.obs.LogErr(ctx, "replica.install_snapshot: invalid state: %v", err)
+		return badRequest(c, errors.New("invalid snapshot state"))
+	}
+
+	h.lockWritePipeline()
+	if req.AppliedSeq > h.replica.GetAppliedSeq() {
+		h.orderbook.Restore(ctx, snapshot)
+		h.replica.InstallSnapshot(req.AppliedSeq, req.AppliedOpID)
+		if req.Members != nil || req.Learners != nil {
+			h.replica.SetMembership(replica.ClusterConfig{Members: req.Members, Learners: req.Learners})
+		}
+		h.obs.LogNotice(ctx, "replica.install_snapshot: installed seq=%d", req.AppliedSeq)
+	}
+	h.replica.UnlockWritePipeline()
+
+	// prepares that arrived while this node was behind may now be committable
+	h.applyCommitted(ctx, req.AppliedSeq, req.AppliedOpID)
+	return jsonResponse(c, fiber.StatusOK, replica.ReplicationResponse{
+		Accepted: true,
+		LastSeq:  h.replica.GetAppliedSeq(),
+	})
+}
+
+// ensureReplicaReadFreshness makes the read that follows linearizable: it waits until this node
+// has applied everything the primary had committed when the read began.
 func (h *Handler) ensureReplicaReadFreshness(ctx context.Context) error {
-	entries, err := h.replication.GetReadRepairEntries(ctx)
+	readIndex, err := h.replication.ReadIndex(ctx)
 	if err != nil {
 		return err
 	}
-	if len(entries) == 0 {
+	if h.replica.GetAppliedSeq() >= readIndex.ReadIndex {
 		return nil
 	}
 
-	h.replica.LockWritePipeline()
-	defer h.replica.UnlockWritePipeline()
+	// the read index is committed, so prepares up to it can be applied without waiting for
+	// the next heartbeat
+	h.applyCommitted(ctx, readIndex.ReadIndex, readIndex.OpID)
 
-	applied := 0
-	for _, entry := range entries {
-		if _, err := h.replication.PrepareRemoteEntry(entry); err != nil {
-			return err
-		}
-		appliedEntry, err := h.replication.ApplyRemoteEntry(ctx, entry, h.applyReplicationSideEffect)
-		if err != nil {
-			return err
-		}
-		if appliedEntry {
-			applied++
-		}
+	waitCtx, cancel := context.WithTimeout(ctx, readIndexWaitTimeout)
+	defer cancel()
+	if err := h.replica.WaitForApplied(waitCtx, readIndex.ReadIndex); err != nil {
+		return err
 	}
-	h.obs.LogInfo(ctx, "replica.read: sync replay complete applied=%d local_seq=%d", applied, h.replica.GetAppliedSeq())
+	h.obs.LogInfo(ctx, "replica.read: caught up to read index=%d", readIndex.ReadIndex)
 	return nil
 }
 
+// readConsistencyHeader lets a client pick its read consistency when it cannot set a query param.
+const readConsistencyHeader = "X-Read-Consistency"
+
+// readConsistency takes the read's consistency from the consistency query param, then the
+// X-Read-Consistency header, defaulting to linearizable.
+func readConsistency(c *fiber.Ctx) (replica.ReadConsistency, error) {
+	value := c.Query("consistency")
+	if value == "" {
+		value = c.Get(readConsistencyHeader)
+	}
+	return replica.ParseReadConsistency(value)
+}
+
+// ensureReadConsistency serves reads locally when this node is fresh enough for the requested
+// consistency, and otherwise waits for the read index like a linearizable read.
+func (h *Handler) ensureReadConsistency(ctx context.Context, consistency replica.ReadConsistency) error {
+	lag, age := h.replica.Staleness()
+	if consistency.Within(lag, age) {
+		return nil
+	}
+	if consistency.Level != replica.ReadLinearizable {
+		h.obs.LogInfo(ctx, "replica.read: %s bound missed lag=%d age=%s, using read index", consistency.Level, lag, age)
+	}
+	return h.ensureReplicaReadFreshness(ctx)
+}
+
+// GetReadIndex gives followers the primary's commit sequence once leadership is confirmed.
+func (h *Handler) GetReadIndex(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	if !h.replica.CanAcceptWrite() {
+		return temporaryRedirect(c, h.replica.Primary())
+	}
+
+	readIndex, err := h.replication.ReadIndex(ctx)
+	if err != nil {
+		h.obs.LogErr(ctx, "replica.read_index: leadership not confirmed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+	return jsonResponse(c, fiber.StatusOK, readIndex)
+}
+
 func (h *Handler) PrepareEntries(c *fiber.Ctx) error {
 	var req replica.ReplicationRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -106,8 +222,12 @@ func (h *Handler) PrepareEntries(c *fiber.Ctx) error {
 	}
 
 	ctx := c.UserContext()
+	// Applying what is already committed first keeps the prepare window anchored near the
+	// primary's applied sequence.
+	h.applyCommitted(ctx, req.CommitSeq, req.CommitOpID)
+	prevOpID := req.PrevOpID
 	for _, entry := range req.Entries {
-		slotPrepared, err := h.replication.PrepareRemoteEntry(entry)
+		slotPrepared, err := h.replication.PrepareRemoteEntry(prevOpID, entry)
 		if err != nil {
 			var gapErr *replica.SequenceGapError
 			if errors.As(err, &gapErr) {
@@ -125,29 +245,127 @@ func (h *Handler) PrepareEntries(c *fiber.Ctx) error {
 		if slotPrepared {
 			h.obs.LogInfo(ctx, "replica.prepare: stored seq=%d type=%s", entry.Seq, entry.Type)
 		}
+		prevOpID = entry.OpID
+	}
+	h.applyCommitted(ctx, req.CommitSeq, req.CommitOpID)
+
+	return jsonResponse(c, fiber.StatusOK, replica.ReplicationResponse{
+		Accepted: true,
+		LastSeq:  h.replica.GetAppliedSeq(),
+	})
+}
+
+// ReplicaHeartbeat carries the primary's commit sequence when no prepares are flowing.
+func (h *Handler) ReplicaHeartbeat(c *fiber.Ctx) error {
+	var req replica.ReplicationRequest
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(c.UserContext(), "replica.heartbeat: invalid request body: %v", err)
+		return badRequest(c, errors.New("invalid request body"))
 	}
 
+	h.applyCommitted(c.UserContext(), req.CommitSeq, req.CommitOpID)
 	return jsonResponse(c, fiber.StatusOK, replica.ReplicationResponse{
 		Accepted: true,
 		LastSeq:  h.replica.GetAppliedSeq(),
 	})
 }
 
+// RunReplicaHeartbeats pushes the commit sequence to followers while this node is primary.
+func (h *Handler) RunReplicaHeartbeats(ctx context.Context, interval time.Duration) {
+	h.replication.RunHeartbeats(ctx, interval)
+}
+
+// applyCommitted applies prepared entries up to the primary's commit sequence, where the primary
+// committed the entry with commitOpID. Nothing past it is applied, and nothing that is not the
+// entry the primary committed, so a follower's book never reflects a write that could still be
+// rolled back or that lost its sequence to another.
+func (h *Handler) applyCommitted(ctx context.Context, commitSeq int64, commitOpID string) {
+	h.replica.AdvanceCommitSeq(commitSeq, commitOpID)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	for _, entry := range h.replica.CommittedPrepared() {
+		if _, err := h.replication.ApplyRemoteEntry(ctx, entry, h.applyReplicationSideEffect); err != nil {
+			h.obs.LogErr(ctx, "replica.commit: apply failed seq=%d err=%v", entry.Seq, err)
+			return
+		}
+		h.obs.LogInfo(ctx, "replica.commit: applied seq=%d type=%s", entry.Seq, entry.Type)
+	}
+}
+
+// replicateWrite stamps a primary-assigned entry with the primary clock and prepares it on a
+// quorum, releasing the sequence if the prepare misses quorum. Callers hold the write pipeline
+// lock and apply the stamped entry afterwards.
+func (h *Handler) replicateWrite(ctx context.Context, op string, entry *replica.ReplicationEntry) error {
+	entries := []replica.ReplicationEntry{*entry}
+	if err := h.replicateWrites(ctx, op, entries); err != nil {
+		return err
+	}
+	*entry = entries[0]
+	return nil
+}
+
+// replicateWrites is replicateWrite for contiguous entries that travel together in one prepare
+// request. Every entry gets the same timestamp.
+func (h *Handler) replicateWrites(ctx context.Context, op string, entries []replica.ReplicationEntry) error {
+	now := time.Now().UnixMilli()
+	for i := range entries {
+		if entries[i].TimestampMs == 0 {
+			entries[i].TimestampMs = now
+		}
+	}
+	first, last := entries[0].Seq, entries[len(entries)-1].Seq
+	revert := func() {
+		for i := len(entries) - 1; i >= 0; i-- {
+			h.replica.RevertSequence(entries[i].Seq)
+		}
+	}
+
+	// Prepare quorum commits the entries; followers apply them once a later prepare or
+	// heartbeat carries a commit sequence that covers them.
+	if err := h.replication.PrepareEntries(ctx, entries); err != nil {
+		h.obs.LogAlert(ctx, "%s replication failed: seq=%d-%d err=%v", op, first, last, err)
+		revert()
+		return err
+	}
+
+	// Followers advance the clock as each entry applies; the primary applies right after this.
+	h.orderbook.AdvanceClock(entries[len(entries)-1].TimestampMs)
+	return nil
+}
+
 func (h *Handler) applyReplicationSideEffect(ctx context.Context, entry replica.ReplicationEntry) error {
+	if entry.TimestampMs > 0 {
+		h.orderbook.AdvanceClock(entry.TimestampMs)
+	}
+
 	switch entry.Type {
 	case replica.ReplicationWritePost:
+		// a reject here is part of the entry's outcome, recorded alike on every node
+		if _, err := h.postCommittedLimit(ctx, entry); err != nil {
+			var rejectErr *orderbook.OrderRejectError
+			if !errors.As(err, &rejectErr) {
+				return err
+			}
+		}
+		return nil
+	case replica.ReplicationWriteAmend:
 		orderID, err := uuid.Parse(entry.OrderID)
 		if err != nil {
 			return fmt.Errorf("replication entry invalid orderId: %w", err)
 		}
-		h.orderbook.PostLimit(
-			ctx,
-			entry.User,
-			orderID,
-			entry.PriceLevel,
-			entry.Amount,
-			entry.IsBid,
-		)
+		_, err = h.orderbook.AmendLimitOrder(ctx, orderID, entry.PriceLevel, entry.Amount)
+		return err
+	case replica.ReplicationWriteQuote:
+		if entry.MassQuote == nil {
+			return errors.New("replication entry missing quote")
+		}
+		quote, err := parseQuote(*entry.MassQuote)
+		if err != nil {
+			return err
+		}
+		h.orderbook.ReplaceQuote(ctx, entry.User, quote)
 		return nil
 	case replica.ReplicationWriteCancel:
 		orderID, err := uuid.Parse(entry.OrderID)
@@ -156,6 +374,88 @@ func (h *Handler) applyReplicationSideEffect(ctx context.Context, entry replica.
 		}
 		_, err = h.orderbook.CancelLimitOrder(ctx, orderID)
 		return err
+	case replica.ReplicationWriteTrailingStop:
+		stopID, err := uuid.Parse(entry.OrderID)
+		if err != nil {
+			return fmt.Errorf("replication entry invalid orderId: %w", err)
+		}
+		h.orderbook.PostTrailingStop(
+			ctx,
+			entry.User,
+			stopID,
+			entry.Amount,
+			entry.IsBid,
+			entry.TrailOffset,
+			entry.TrailBps,
+		)
+		return nil
+	case replica.ReplicationWriteDeposit:
+		h.orderbook.Deposit(ctx, entry.User, entry.BaseAmount, entry.QuoteAmount)
+		return nil
+	case replica.ReplicationWriteWithdraw:
+		_, err := h.orderbook.Withdraw(ctx, entry.User, entry.BaseAmount, entry.QuoteAmount)
+		return err
+	case replica.ReplicationWriteRiskLimits:
+		if entry.Limits == nil {
+			return errors.New("replication entry missing limits")
+		}
+		h.orderbook.SetRiskLimits(ctx, entry.User, *entry.Limits)
+		return nil
+	case replica.ReplicationWriteMassCancel:
+		if entry.MassCancel == nil {
+			return errors.New("replication entry missing mass cancel filter")
+		}
+		h.orderbook.MassCancel(ctx, entry.User, *entry.MassCancel)
+		return nil
+	case replica.ReplicationWriteSessionStart:
+		h.orderbook.RegisterSession(ctx, entry.User, entry.TimeoutMs)
+		return nil
+	case replica.ReplicationWriteSessionEnd:
+		h.orderbook.EndSession(ctx, entry.User)
+		return nil
+	case replica.ReplicationWriteSessionExpire:
+		h.orderbook.ExpireSession(ctx, entry.User)
+		return nil
+	case replica.ReplicationWriteMarketPhase:
+		return h.orderbook.SetMarketPhase(ctx, entry.Phase)
+	case replica.ReplicationWriteUncross:
+		_, err := h.orderbook.UncrossAuction(ctx, entry.Phase)
+		return err
+	case replica.ReplicationWritePriceBands:
+		if entry.PriceBands == nil {
+			return errors.New("replication entry missing price bands")
+		}
+		return h.orderbook.SetPriceBands(ctx, *entry.PriceBands)
+	case replica.ReplicationWriteFeeTier:
+		if entry.Fees == nil {
+			return errors.New("replication entry missing fee schedule")
+		}
+		return h.orderbook.SetFeeTier(ctx, entry.FeeTier, *entry.Fees)
+	case replica.ReplicationWriteFeeAssign:
+		return h.orderbook.AssignFeeTier(ctx, entry.User, entry.FeeTier)
+	case replica.ReplicationWriteMatching:
+		if entry.Matching == nil {
+			return errors.New("replication entry missing matching config")
+		}
+		return h.orderbook.SetMatchingConfig(ctx, *entry.Matching)
+	case replica.ReplicationWriteInstrument:
+		if entry.Instrument == nil {
+			return errors.New("replication entry missing instrument rules")
+		}
+		return h.orderbook.SetInstrumentRules(ctx, *entry.Instrument)
+	case replica.ReplicationWriteCollateral:
+		if entry.Collateral == nil {
+			return errors.New("replication entry missing collateral config")
+		}
+		h.orderbook.SetCollateralChecks(ctx, entry.Collateral.RequireCollateral)
+		return nil
+	case replica.ReplicationWriteKillSwitch:
+		h.orderbook.SetUserBlocked(ctx, entry.User, entry.Blocked)
+		return nil
+	case replica.ReplicationWriteMembership:
+		h.replica.SetMembership(replica.ClusterConfig{Primary: entry.Primary, Members: entry.Members, Learners: entry.Learners})
+		h.obs.LogNotice(ctx, "replica.membership: seq=%d primary=%s members=%v learners=%v", entry.Seq, entry.Primary, entry.Members, entry.Learners)
+		return nil
 	default:
 		return fmt.Errorf("unsupported replication entry type: %s", entry.Type)
 	}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+
+	"replicated-clob/pkg/orderbook"
+	"replicated-clob/pkg/replica"
+	"replicated-clob/schemas"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func (h *Handler) SetRiskLimits(c *fiber.Ctx) error {
+	var req schemas.SetRiskLimitsRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "risk.limits: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.User == "" {
+		h.obs.LogErr(ctx, "risk.limits: user missing")
+		return badRequest(c, errors.New("user is required"))
+	}
+	limits := req.Limits
+	if limits.MaxOrderSize < 0 || limits.MaxNotional < 0 || limits.MaxOpenOrders < 0 || limits.MaxPosition < 0 {
+		h.obs.LogErr(ctx, "risk.limits: negative limit user=%s", req.User)
+		return badRequest(c, errors.New("limits must be non-negative"))
+	}
+
+	h.obs.LogInfo(ctx, "risk.limits: user=%s limits=%+v", req.User, limits)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	opID := uuid.New()
+	replicaEntry := replica.ReplicationEntry{
+		Seq:    h.replica.NextSequence(),
+		OpID:   opID.String(),
+		Type:   replica.ReplicationWriteRiskLimits,
+		User:   req.User,
+		Limits: &limits,
+	}
+
+	if err := h.replicateWrite(ctx, "risk.limits", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	if _, err := h.replication.ApplyRemoteEntry(ctx, replicaEntry, h.applyReplicationSideEffect); err != nil {
+		h.obs.LogErr(ctx, "risk.limits commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	state := h.orderbook.RiskStateForUser(ctx, req.User)
+	return jsonResponse(c, fiber.StatusOK, riskStateResponse(req.User, state))
+}
+
+func (h *Handler) KillSwitch(c *fiber.Ctx) error {
+	var req schemas.KillSwitchRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "risk.kill_switch: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.User == "" {
+		h.obs.LogErr(ctx, "risk.kill_switch: user missing")
+		return badRequest(c, errors.New("user is required"))
+	}
+
+	h.obs.LogAlert(ctx, "risk.kill_switch: user=%s blocked=%v", req.User, req.Blocked)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	opID := uuid.New()
+	replicaEntry := replica.ReplicationEntry{
+		Seq:     h.replica.NextSequence(),
+		OpID:    opID.String(),
+		Type:    replica.ReplicationWriteKillSwitch,
+		User:    req.User,
+		Blocked: req.Blocked,
+	}
+
+	if err := h.replicateWrite(ctx, "risk.kill_switch", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+
+	cancelled, err := h.applyKillSwitchReplication(ctx, replicaEntry)
+	if err != nil {
+		h.obs.LogErr(ctx, "risk.kill_switch commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	h.obs.LogAlert(ctx, "risk.kill_switch done: user=%s blocked=%v cancelled=%d size_cancelled=%d", req.User, req.Blocked, len(cancelled.OrderIDs), cancelled.SizeCancelled)
+	return jsonResponse(c, fiber.StatusOK, schemas.KillSwitchResponse{
+		User:              req.User,
+		Blocked:           req.Blocked,
+		CancelledOrderIDs: orderIDStrings(cancelled.OrderIDs),
+		SizeCancelled:     cancelled.SizeCancelled,
+	})
+}
+
+func (h *Handler) GetRiskState(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if userID == "" {
+		h.obs.LogErr(c.UserContext(), "risk.query: missing userId")
+		return badRequest(c, errors.New("userId is required"))
+	}
+
+	ctx := c.UserContext()
+	h.obs.LogInfo(ctx, "risk.query: user=%s", userID)
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "risk.query: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	state := h.orderbook.RiskStateForUser(ctx, userID)
+	return jsonResponse(c, fiber.StatusOK, riskStateResponse(userID, state))
+}
+
+// checkPreTrade runs the primary-side checks for a new order. Callers hold the write pipeline
+// so the state they check against cannot change before the entry is sequenced.
+func (h *Handler) checkPreTrade(user string, priceLevel int64, amount int64, isBid bool) error {
+	if err := h.orderbook.CheckOrderEntry(priceLevel, isBid); err != nil {
+		return err
+	}
+	if err := h.orderbook.CheckOrderRules(priceLevel, amount); err != nil {
+		return err
+	}
+	if err := h.orderbook.CheckPriceCollar(priceLevel); err != nil {
+		return err
+	}
+	if err := h.orderbook.CheckRiskLimits(user, priceLevel, amount, isBid); err != nil {
+		return err
+	}
+	if h.orderbook.CollateralChecks() {
+		return h.orderbook.CheckOrderCollateral(user, priceLevel, amount, isBid)
+	}
+	return nil
+}
+
+func (h *Handler) applyKillSwitchReplication(ctx context.Context, entry replica.ReplicationEntry) (orderbook.CancelledOrders, error) {
+	seqApplied, err := h.replica.ApplyRemote(entry)
+	if err != nil {
+		return orderbook.CancelledOrders{}, err
+	}
+	if !seqApplied {
+		return orderbook.CancelledOrders{}, nil
+	}
+
+	return h.orderbook.SetUserBlocked(ctx, entry.User, entry.Blocked), nil
+}
+
+func riskStateResponse(user string, state orderbook.RiskState) schemas.RiskStateResponse {
+	return schemas.RiskStateResponse{
+		User:       user,
+		Limits:     state.Limits,
+		Blocked:    state.Blocked,
+		OpenOrders: state.OpenOrders,
+		Position:   state.Position,
+	}
+}
+
+func orderIDStrings(orderIDs []uuid.UUID) []string {
+	ids := make([]string, 0, len(orderIDs))
+	for _, orderID := range orderIDs {
+		ids = append(ids, orderID.String())
+	}
+	return ids
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"replicated-clob/pkg/replica"
+	"replicated-clob/schemas"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	sessionMonitorInterval = 50 * time.Millisecond
+	minSessionTimeoutMs    = 100
+	maxSessionTimeoutMs    = int64(time.Hour / time.Millisecond)
+)
+
+// sessionTracker holds heartbeat times on the primary. It is deliberately not replicated: a
+// node that becomes primary starts every registered session with a full timeout of grace.
+type sessionTracker struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{
+		lastSeen: map[string]time.Time{},
+	}
+}
+
+func (t *sessionTracker) touch(user string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastSeen[user] = at
+}
+
+func (t *sessionTracker) forget(user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.lastSeen, user)
+}
+
+func (t *sessionTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastSeen = map[string]time.Time{}
+}
+
+// expired reports whether a session has missed its timeout, starting the clock if this node
+// has not seen the user yet.
+func (t *sessionTracker) expired(user string, timeout time.Duration, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen, ok := t.lastSeen[user]
+	if !ok {
+		t.lastSeen[user] = now
+		return false
+	}
+	return now.Sub(seen) > timeout
+}
+
+func (h *Handler) StartSession(c *fiber.Ctx) error {
+	var req schemas.SessionRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "session.start: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.User == "" {
+		h.obs.LogErr(ctx, "session.start: user missing")
+		return badRequest(c, errors.New("user is required"))
+	}
+	if req.TimeoutMs < minSessionTimeoutMs || req.TimeoutMs > maxSessionTimeoutMs {
+		h.obs.LogErr(ctx, "session.start: invalid timeout user=%s timeout_ms=%d", req.User, req.TimeoutMs)
+		return badRequest(c, fmt.Errorf("timeoutMs must be between %d and %d", minSessionTimeoutMs, maxSessionTimeoutMs))
+	}
+
+	h.obs.LogInfo(ctx, "session.start: user=%s timeout_ms=%d", req.User, req.TimeoutMs)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:       h.replica.NextSequence(),
+		OpID:      uuid.NewString(),
+		Type:      replica.ReplicationWriteSessionStart,
+		User:      req.User,
+		TimeoutMs: req.TimeoutMs,
+	}
+	if err := h.commitSessionEntry(ctx, "session.start", replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	h.sessions.touch(req.User, time.Now())
+
+	return jsonResponse(c, fiber.StatusOK, schemas.SessionResponse{
+		User:      req.User,
+		TimeoutMs: req.TimeoutMs,
+		Active:    true,
+	})
+}
+
+func (h *Handler) Heartbeat(c *fiber.Ctx) error {
+	var req schemas.SessionRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "session.heartbeat: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.User == "" {
+		h.obs.LogErr(ctx, "session.heartbeat: user missing")
+		return badRequest(c, errors.New("user is required"))
+	}
+
+	session, ok := h.orderbook.Session(req.User)
+	if !ok {
+		h.obs.LogErr(ctx, "session.heartbeat: no session user=%s", req.User)
+		return notFound(c, errors.New("session not found"))
+	}
+	h.sessions.touch(req.User, time.Now())
+
+	return jsonResponse(c, fiber.StatusOK, schemas.SessionResponse{
+		User:      session.User,
+		TimeoutMs: session.TimeoutMs,
+		Active:    true,
+	})
+}
+
+func (h *Handler) EndSession(c *fiber.Ctx) error {
+	var req schemas.SessionRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "session.end: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.User == "" {
+		h.obs.LogErr(ctx, "session.end: user missing")
+		return badRequest(c, errors.New("user is required"))
+	}
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	if _, ok := h.orderbook.Session(req.User); !ok {
+		h.obs.LogErr(ctx, "session.end: no session user=%s", req.User)
+		return notFound(c, errors.New("session not found"))
+	}
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:  h.replica.NextSequence(),
+		OpID: uuid.NewString(),
+		Type: replica.ReplicationWriteSessionEnd,
+		User: req.User,
+	}
+	if err := h.commitSessionEntry(ctx, "session.end", replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+	h.sessions.forget(req.User)
+
+	return jsonResponse(c, fiber.StatusOK, schemas.SessionResponse{
+		User:   req.User,
+		Active: false,
+	})
+}
+
+// RunSessionMonitor expires sessions whose heartbeats stopped until ctx is cancelled.
+func (h *Handler) RunSessionMonitor(ctx context.Context) {
+	ticker := time.NewTicker(sessionMonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.expireStaleSessions(ctx, now)
+		}
+	}
+}
+
+func (h *Handler) expireStaleSessions(ctx context.Context, now time.Time) {
+	if !h.replica.CanAcceptWrite() {
+		h.sessions.reset()
+		return
+	}
+
+	for _, session := range h.orderbook.Sessions() {
+		timeout := time.Duration(session.TimeoutMs) * time.Millisecond
+		if !h.sessions.expired(session.User, timeout, now) {
+			continue
+		}
+		if err := h.expireSession(ctx, session.User, timeout, now); err != nil {
+			h.obs.LogErr(ctx, "session.expire failed: user=%s err=%v", session.User, err)
+		}
+	}
+}
+
+func (h *Handler) expireSession(ctx context.Context, user string, timeout time.Duration, now time.Time) error {
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	// A heartbeat or session end may have landed while waiting for the pipeline.
+	if _, ok := h.orderbook.Session(user); !ok {
+		return nil
+	}
+	if !h.sessions.expired(user, timeout, now) {
+		return nil
+	}
+
+	h.obs.LogAlert(ctx, "session.expire: heartbeat timeout user=%s timeout=%s", user, timeout)
+
+	replicaEntry := replica.ReplicationEntry{
+		Seq:  h.replica.NextSequence(),
+		OpID: uuid.NewString(),
+		Type: replica.ReplicationWriteSessionExpire,
+		User: user,
+	}
+	if err := h.commitSessionEntry(ctx, "session.expire", replicaEntry); err != nil {
+		return err
+	}
+	h.sessions.forget(user)
+	return nil
+}
+
+func (h *Handler) commitSessionEntry(ctx context.Context, op string, entry replica.ReplicationEntry) error {
+	if err := h.replicateWrite(ctx, op, &entry); err != nil {
+		return err
+	}
+	if _, err := h.replication.ApplyRemoteEntry(ctx, entry, h.applyReplicationSideEffect); err != nil {
+		h.obs.LogErr(ctx, "%s commit failed: seq=%d err=%v", op, entry.Seq, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"replicated-clob/pkg/orderbook"
+	"replicated-clob/pkg/replica"
+	"replicated-clob/schemas"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const maxTrailBps = 10000
+
+func (h *Handler) PostTrailingStop(c *fiber.Ctx) error {
+	var req schemas.PostTrailingStopRequest
+	ctx := c.UserContext()
+
+	if err := c.BodyParser(&req); err != nil {
+		h.obs.LogErr(ctx, "trailing_stop.post: invalid request body")
+		return badRequest(c, errors.New("invalid request body"))
+	}
+	if req.User == "" {
+		h.obs.LogErr(ctx, "trailing_stop.post: user missing")
+		return badRequest(c, errors.New("user is required"))
+	}
+	if err := orderbook.ValidateOrderShape(0, req.Amount, false); err != nil {
+		h.obs.LogErr(ctx, "trailing_stop.post: invalid amount user=%s amount=%d", req.User, req.Amount)
+		return rejected(c, err)
+	}
+	if (req.TrailOffset > 0) == (req.TrailBps > 0) || req.TrailOffset < 0 || req.TrailBps < 0 {
+		h.obs.LogErr(ctx, "trailing_stop.post: invalid trail user=%s offset=%d bps=%d", req.User, req.TrailOffset, req.TrailBps)
+		return badRequest(c, errors.New("exactly one of trailOffset or trailBps must be greater than 0"))
+	}
+	if req.TrailBps >= maxTrailBps {
+		h.obs.LogErr(ctx, "trailing_stop.post: trail bps out of range user=%s bps=%d", req.User, req.TrailBps)
+		return badRequest(c, fmt.Errorf("trailBps must be less than %d", maxTrailBps))
+	}
+
+	h.obs.LogInfo(ctx, "trailing_stop.post: user=%s is_bid=%v amount=%d offset=%d bps=%d", req.User, req.IsBid, req.Amount, req.TrailOffset, req.TrailBps)
+
+	h.lockWritePipeline()
+	defer h.replica.UnlockWritePipeline()
+
+	if err := h.orderbook.CheckOrderEntry(0, req.IsBid); err != nil {
+		h.obs.LogErr(ctx, "trailing_stop.post: rejected user=%s err=%v", req.User, err)
+		return rejected(c, err)
+	}
+	if err := h.orderbook.CheckSizeRules(req.Amount); err != nil {
+		h.obs.LogErr(ctx, "trailing_stop.post: rejected user=%s err=%v", req.User, err)
+		return rejected(c, err)
+	}
+	if err := h.orderbook.CheckRiskLimits(req.User, 0, req.Amount, req.IsBid); err != nil {
+		h.obs.LogErr(ctx, "trailing_stop.post: rejected user=%s err=%v", req.User, err)
+		return rejected(c, err)
+	}
+	if h.orderbook.CollateralChecks() {
+		if err := h.orderbook.CheckTrailingStopCollateral(req.User, req.Amount, req.IsBid, req.TrailOffset, req.TrailBps); err != nil {
+			h.obs.LogErr(ctx, "trailing_stop.post: rejected user=%s err=%v", req.User, err)
+			return rejected(c, err)
+		}
+	}
+
+	stopID := uuid.New()
+	replicaEntry := replica.ReplicationEntry{
+		Seq:         h.replica.NextSequence(),
+		OpID:        stopID.String(),
+		Type:        replica.ReplicationWriteTrailingStop,
+		User:        req.User,
+		OrderID:     stopID.String(),
+		Amount:      req.Amount,
+		IsBid:       req.IsBid,
+		TrailOffset: req.TrailOffset,
+		TrailBps:    req.TrailBps,
+	}
+
+	if err := h.replicateWrite(ctx, "trailing_stop.post", &replicaEntry); err != nil {
+		return temporaryUnavailable(c, err)
+	}
+
+	resp, err := h.applyTrailingStopReplication(ctx, replicaEntry)
+	if err != nil {
+		h.obs.LogErr(ctx, "trailing_stop.post commit failed: seq=%d err=%v", replicaEntry.Seq, err)
+		return internalServerError(c)
+	}
+
+	h.obs.LogInfo(ctx, "trailing_stop.post done: user=%s stop_id=%s trigger=%d", req.User, resp.StopID, resp.TriggerPrice)
+	return jsonResponse(c, fiber.StatusOK, resp)
+}
+
+func (h *Handler) GetTrailingStops(c *fiber.Ctx) error {
+	userID := c.Params("userId")
+	if userID == "" {
+		h.obs.LogErr(c.UserContext(), "trailing_stops.query: missing userId")
+		return badRequest(c, errors.New("userId is required"))
+	}
+
+	ctx := c.UserContext()
+	h.obs.LogInfo(ctx, "trailing_stops.query: user=%s", userID)
+
+	if err := h.ensureReplicaReadFreshness(ctx); err != nil {
+		h.obs.LogErr(ctx, "trailing_stops.query: read freshness check failed: %v", err)
+		return temporaryUnavailable(c, err)
+	}
+
+	resp := h.orderbook.TrailingStopsForUser(ctx, userID)
+
+	stops := make([]schemas.TrailingStop, 0, len(resp))
+	for _, stop := range resp {
+		stops = append(stops, trailingStopResponse(stop))
+	}
+
+	h.obs.LogInfo(ctx, "trailing_stops.query.done: user=%s count=%d", userID, len(stops))
+	return jsonResponse(c, fiber.StatusOK, schemas.TrailingStopsResponse{
+		Stops: stops,
+	})
+}
+
+func (h *Handler) applyTrailingStopReplication(ctx context.Context, entry replica.ReplicationEntry) (schemas.TrailingStop, error) {
+	if entry.Type != replica.ReplicationWriteTrailingStop {
+		return schemas.TrailingStop{}, errors.New("replication entry is not trailing stop")
+	}
+	response := schemas.TrailingStop{
+		User:        entry.User,
+		StopID:      entry.OrderID,
+		Amount:      entry.Amount,
+		IsBid:       entry.IsBid,
+		TrailOffset: entry.TrailOffset,
+		TrailBps:    entry.TrailBps,
+	}
+	seqApplied, err := h.replica.ApplyRemote(entry)
+	if err != nil {
+		return schemas.TrailingStop{}, err
+	}
+	if !seqApplied {
+		return response, nil
+	}
+
+	stopID, err := uuid.Parse(entry.OrderID)
+	if err != nil {
+		return schemas.TrailingStop{}, fmt.Errorf("replication entry invalid orderId: %w", err)
+	}
+
+	stop := h.orderbook.PostTrailingStop(
+		ctx,
+		entry.User,
+		stopID,
+		entry.Amount,
+		entry.IsBid,
+		entry.TrailOffset,
+		entry.TrailBps,
+	)
+	return trailingStopResponse(stop), nil
+}
+
+func trailingStopResponse(stop orderbook.TrailingStop) schemas.TrailingStop {
+	return schemas.TrailingStop{
+		User:           stop.User,
+		StopID:         stop.ID.String(),
+		Amount:         stop.Amount,
+		IsBid:          stop.IsBid,
+		TrailOffset:    stop.TrailOffset,
+		TrailBps:       stop.TrailBps,
+		ReferencePrice: stop.ReferencePrice,
+		TriggerPrice:   stop.TriggerPrice,
+		Armed:          stop.ArmedAtTrade > 0,
+	}
+}
@@ -1,6 +1,11 @@
 package handlers
 
 import (
+	"errors"
+
+	"replicated-clob/pkg/orderbook"
+	"replicated-clob/pkg/replica"
+
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -14,6 +19,31 @@ func badRequest(c *fiber.Ctx, err error) error {
 	})
 }
 
+// rejected surfaces pre-trade check failures with their reason code.
+func rejected(c *fiber.Ctx, err error) error {
+	var rejectErr *orderbook.OrderRejectError
+	if !errors.As(err, &rejectErr) {
+		return badRequest(c, err)
+	}
+	return jsonResponse(c, fiber.StatusBadRequest, fiber.Map{
+		"error":  rejectErr.Error(),
+		"reason": rejectErr.Reason,
+	})
+}
+
+// rejectedOrder is rejected for an order that was assigned an ID, so the client can look it up.
+func rejectedOrder(c *fiber.Ctx, err error, orderID string) error {
+	var rejectErr *orderbook.OrderRejectError
+	if !errors.As(err, &rejectErr) {
+		return badRequest(c, err)
+	}
+	return jsonResponse(c, fiber.StatusBadRequest, fiber.Map{
+		"error":   rejectErr.Error(),
+		"reason":  rejectErr.Reason,
+		"orderId": orderID,
+	})
+}
+
 func notFound(c *fiber.Ctx, err error) error {
 	return jsonResponse(c, fiber.StatusNotFound, fiber.Map{
 		"error": err.Error(),
@@ -36,13 +66,18 @@ func temporaryRedirect(c *fiber.Ctx, leader string) error {
 	return jsonResponse(c, fiber.StatusTemporaryRedirect, response)
 }
 
+// temporaryUnavailable redirects writes that lost the primary role while they waited, and
+// otherwise asks the client to retry.
 func temporaryUnavailable(c *fiber.Ctx, err error) error {
+	var notPrimary *replica.NotPrimaryError
+	if errors.As(err, &notPrimary) {
+		return temporaryRedirect(c, notPrimary.Primary)
+	}
 	return jsonResponse(c, fiber.StatusServiceUnavailable, fiber.Map{
 		"error": err.Error(),
 	})
 }
 
-
 func success(c *fiber.Ctx) error {
 	return jsonResponse(c, fiber.StatusOK, fiber.Map{
 		"message": "Success",
@@ -0,0 +1,73 @@
+package orderbook
+
+import (
+	"context"
+	"errors"
+
+	"replicated-clob/schemas"
+
+	"github.com/google/uuid"
+)
+
+const RejectUnknownOrder RejectReason = "UNKNOWN_ORDER"
+
+// CheckAmend validates that a user can amend a resting limit order and returns its status.
+func (ob *OrderBook) CheckAmend(user string, orderID uuid.UUID) (OrderStatus, error) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	status, ok := ob.orderStatuses[orderID]
+	_, resting := ob.ordersByID[orderID]
+	if !ok || !resting || status.User != user {
+		return OrderStatus{}, rejectf(RejectUnknownOrder, "no resting order %s for user %s", orderID, user)
+	}
+	return *status, nil
+}
+
+// AmendLimitOrder replaces the price and remaining size of a resting order. Shrinking at the same
+// price keeps the order's place in the queue; any other change moves it to the back of its new
+// level, where it matches like a new order.
+func (ob *OrderBook) AmendLimitOrder(ctx context.Context, orderID uuid.UUID, priceLevel int64, amount int64) (schemas.PostLimitResponse, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ref, ok := ob.ordersByID[orderID]
+	if !ok || ref.index >= len(ref.level.Orders) {
+		return schemas.PostLimitResponse{}, errors.New("order not found")
+	}
+	current := ref.level.Orders[ref.index]
+	status := ob.orderStatuses[orderID]
+
+	if priceLevel == current.PriceLevel && amount <= current.Amount {
+		reduced := current.Amount - amount
+		ref.level.Orders[ref.index].Amount = amount
+		ref.level.Amount -= reduced
+		ob.releaseHold(current.User, current.holdPrice(), reduced, current.IsBid)
+		if status != nil {
+			status.Amount -= reduced
+			status.UpdatedAtMs = ob.clockMs
+		}
+		ob.obs.LogInfo(ctx, "orderbook.amend.in_place user=%s order_id=%s price=%d amount=%d", current.User, orderID, priceLevel, amount)
+		return schemas.PostLimitResponse{
+			OrderID:       orderID.String(),
+			ClientOrderID: current.ClientOrderID,
+		}, nil
+	}
+
+	sideLevels, sideMap := ob.bookSide(ref.isBid)
+	removed, _ := ob.removeOrder(ref.isBid, ref.level, ref.index)
+	if ref.level.Amount <= 0 {
+		ob.removeLevel(sideLevels, sideMap, ref.level)
+	}
+	ob.releaseHold(removed.User, removed.holdPrice(), removed.Amount, removed.IsBid)
+	if status != nil {
+		status.PriceLevel = priceLevel
+		status.Amount = status.Filled + amount
+		status.UpdatedAtMs = ob.clockMs
+	}
+	ob.obs.LogInfo(ctx, "orderbook.amend.requeue user=%s order_id=%s price=%d amount=%d", removed.User, orderID, priceLevel, amount)
+
+	removed.PriceLevel = priceLevel
+	removed.Amount = amount
+	return ob.matchAndRestLocked(ctx, &removed), nil
+}
@@ -0,0 +1,239 @@
+package orderbook
+
+import (
+	"context"
+	"sort"
+
+	"replicated-clob/schemas"
+)
+
+// AuctionResult describes a uniform-price uncross. Imbalance is positive when bids exceed
+// asks at the clearing price and negative when asks exceed bids.
+type AuctionResult struct {
+	Price     int64
+	Volume    int64
+	Imbalance int64
+}
+
+// IndicativeAuction returns the price and volume the book would uncross at right now.
+func (ob *OrderBook) IndicativeAuction() AuctionResult {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.computeAuctionLocked()
+}
+
+// UncrossAuction executes every crossing order at a single clearing price and moves the market
+// to nextPhase, all under one lock so the uncross is a single state transition.
+func (ob *OrderBook) UncrossAuction(ctx context.Context, nextPhase schemas.MarketPhase) (AuctionResult, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if err := ob.checkUncrossLocked(nextPhase); err != nil {
+		return AuctionResult{}, err
+	}
+
+	result := ob.computeAuctionLocked()
+	if result.Volume > 0 {
+		ob.executeAuctionLocked(ctx, result.Price, result.Volume)
+	}
+	ob.obs.LogInfo(ctx, "orderbook.auction.uncross price=%d volume=%d imbalance=%d next_phase=%s", result.Price, result.Volume, result.Imbalance, nextPhase)
+	ob.setPhaseLocked(ctx, nextPhase)
+
+	return result, nil
+}
+
+func (ob *OrderBook) CheckUncross(nextPhase schemas.MarketPhase) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.checkUncrossLocked(nextPhase)
+}
+
+func (ob *OrderBook) checkUncrossLocked(nextPhase schemas.MarketPhase) error {
+	if ob.phase != schemas.MarketPhaseAuction {
+		return phaseError(ob.phase, "uncross")
+	}
+	if nextPhase != schemas.MarketPhaseContinuous && nextPhase != schemas.MarketPhasePreOpen {
+		return rejectf(RejectInvalidTransition, "auction can only uncross into %s or %s", schemas.MarketPhaseContinuous, schemas.MarketPhasePreOpen)
+	}
+	return nil
+}
+
+// computeAuctionLocked picks the price that maximises executed volume. Ties go to the smallest
+// imbalance, then towards the side with surplus (highest price for bid surplus, lowest for ask
+// surplus), then to the price closest to the last trade, then to the lowest price.
+func (ob *OrderBook) computeAuctionLocked() AuctionResult {
+	bids := ob.sortedLevels(true)
+	asks := ob.sortedLevels(false)
+	if len(bids) == 0 || len(asks) == 0 || bids[0].Price < asks[0].Price {
+		return AuctionResult{}
+	}
+
+	prices := make([]int64, 0, len(bids)+len(asks))
+	seen := map[int64]struct{}{}
+	for _, level := range append(append([]*OrderbookLevel{}, bids...), asks...) {
+		if level.Price < asks[0].Price || level.Price > bids[0].Price {
+			continue
+		}
+		if _, ok := seen[level.Price]; ok {
+			continue
+		}
+		seen[level.Price] = struct{}{}
+		prices = append(prices, level.Price)
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i] < prices[j]
+	})
+
+	candidates := make([]AuctionResult, 0, len(prices))
+	for _, price := range prices {
+		var demand, supply int64
+		for _, level := range bids {
+			if level.Price >= price {
+				demand += level.Amount
+			}
+		}
+		for _, level := range asks {
+			if level.Price <= price {
+				supply += level.Amount
+			}
+		}
+		candidates = append(candidates, AuctionResult{
+			Price:     price,
+			Volume:    min(demand, supply),
+			Imbalance: demand - supply,
+		})
+	}
+
+	best := make([]AuctionResult, 0, len(candidates))
+	for _, candidate := range candidates {
+		if len(best) == 0 || candidate.Volume > best[0].Volume ||
+			(candidate.Volume == best[0].Volume && abs(candidate.Imbalance) < abs(best[0].Imbalance)) {
+			best = append(best[:0], candidate)
+			continue
+		}
+		if candidate.Volume == best[0].Volume && abs(candidate.Imbalance) == abs(best[0].Imbalance) {
+			best = append(best, candidate)
+		}
+	}
+	if len(best) == 1 || best[0].Volume == 0 {
+		return best[0]
+	}
+
+	allBidSurplus, allAskSurplus := true, true
+	for _, candidate := range best {
+		allBidSurplus = allBidSurplus && candidate.Imbalance > 0
+		allAskSurplus = allAskSurplus && candidate.Imbalance < 0
+	}
+	if allBidSurplus {
+		return best[len(best)-1]
+	}
+	if allAskSurplus {
+		return best[0]
+	}
+
+	chosen := best[0]
+	if ob.lastTradePrice > 0 {
+		for _, candidate := range best[1:] {
+			if abs(candidate.Price-ob.lastTradePrice) < abs(chosen.Price-ob.lastTradePrice) {
+				chosen = candidate
+			}
+		}
+	}
+	return chosen
+}
+
+// executeAuctionLocked matches the best bid and ask in price-time priority at the clearing price.
+// Both legs are recorded as non-maker fills and release the hold placed at their own limit.
+func (ob *OrderBook) executeAuctionLocked(ctx context.Context, price int64, volume int64) {
+	remaining := volume
+	for remaining > 0 {
+		bidLevel := ob.bids.Peek()
+		askLevel := ob.asks.Peek()
+		if bidLevel == nil || askLevel == nil || bidLevel.Price < price || askLevel.Price > price {
+			break
+		}
+		if ob.dropEmptyFront(true, bidLevel) || ob.dropEmptyFront(false, askLevel) {
+			continue
+		}
+
+		bid := &bidLevel.Orders[0]
+		ask := &askLevel.Orders[0]
+		matched := min(remaining, bid.Amount, ask.Amount)
+
+		bid.Amount -= matched
+		ask.Amount -= matched
+		bidLevel.Amount -= matched
+		askLevel.Amount -= matched
+		remaining -= matched
+		ob.noteOrderFill(bid.ID, matched, bid.Amount)
+		ob.noteOrderFill(ask.ID, matched, ask.Amount)
+
+		ob.obs.LogInfo(ctx, "orderbook.auction.match buyer=%s seller=%s price=%d matched=%d remaining=%d", bid.User, ask.User, price, matched, remaining)
+		ob.recordFill(bid.User, ask.User, matched, price, true, false)
+		ob.recordFill(ask.User, bid.User, matched, price, false, false)
+		ob.releaseHold(bid.User, bid.holdPrice(), matched, true)
+		ob.releaseHold(ask.User, ask.PriceLevel, matched, false)
+		ob.onTrade(ctx, price)
+
+		ob.dropEmptyFront(true, bidLevel)
+		ob.dropEmptyFront(false, askLevel)
+	}
+}
+
+// dropEmptyFront removes an exhausted order at the front of a level, and the level itself once
+// empty. It reports whether anything was removed.
+func (ob *OrderBook) dropEmptyFront(isBid bool, level *OrderbookLevel) bool {
+	sideLevels, sideMap := ob.bookSide(isBid)
+	removed := false
+	if len(level.Orders) > 0 && level.Orders[0].Amount <= 0 {
+		ob.removeOrder(isBid, level, 0)
+		removed = true
+	}
+	if len(level.Orders) == 0 || level.Amount <= 0 {
+		ob.removeLevel(sideLevels, sideMap, level)
+		removed = true
+	}
+	return removed
+}
+
+// Depth aggregates the top levels of each side. During an auction it also reports the
+// indicative uncross, since the book may be crossed.
+func (ob *OrderBook) Depth(ctx context.Context, levels int) schemas.DepthResponse {
+	ob.obs.LogInfo(ctx, "orderbook.depth.query levels=%d", levels)
+
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	depth := schemas.DepthResponse{
+		Phase: ob.phase,
+		Bids:  depthLevels(ob.sortedLevels(true), levels),
+		Asks:  depthLevels(ob.sortedLevels(false), levels),
+	}
+	if ob.phase == schemas.MarketPhaseAuction {
+		indicative := ob.computeAuctionLocked()
+		depth.IndicativePrice = indicative.Price
+		depth.IndicativeVolume = indicative.Volume
+		depth.Imbalance = indicative.Imbalance
+	}
+	return depth
+}
+
+func depthLevels(levels []*OrderbookLevel, limit int) []schemas.DepthLevel {
+	depth := make([]schemas.DepthLevel, 0, min(len(levels), limit))
+	for _, level := range levels {
+		if len(depth) >= limit {
+			break
+		}
+		if level.Amount <= 0 {
+			continue
+		}
+		depth = append(depth, schemas.DepthLevel{
+			Price:  level.Price,
+			Amount: level.Amount,
+			Orders: len(level.Orders),
+		})
+	}
+	return depth
+}
@@ -0,0 +1,224 @@
+package orderbook
+
+import (
+	"context"
+
+	"replicated-clob/schemas"
+)
+
+const (
+	RejectPriceCollar       RejectReason = "PRICE_COLLAR"
+	RejectInvalidPriceBands RejectReason = "INVALID_PRICE_BANDS"
+	RejectWouldTripBreaker  RejectReason = "WOULD_TRIP_BREAKER"
+)
+
+// PrintRange is the lowest and highest price some set of orders could trade at. It is empty
+// when High is zero.
+type PrintRange struct {
+	Low  int64
+	High int64
+}
+
+// TradeMark is a print inside the breaker window, stamped with the book clock.
+type TradeMark struct {
+	Price int64 `json:"price"`
+	AtMs  int64 `json:"atMs"`
+}
+
+func (ob *OrderBook) PriceBands() schemas.PriceBandsResponse {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return schemas.PriceBandsResponse{
+		PriceBands:     ob.priceBands,
+		ReferencePrice: ob.lastTradePrice,
+		Phase:          ob.phase,
+	}
+}
+
+func CheckPriceBands(bands schemas.PriceBands) error {
+	if bands.CollarBps < 0 || bands.BreakerBps < 0 || bands.BreakerWindowMs < 0 {
+		return rejectf(RejectInvalidPriceBands, "price bands must be non-negative")
+	}
+	if bands.BreakerBps > 0 && bands.BreakerWindowMs == 0 {
+		return rejectf(RejectInvalidPriceBands, "breaker window is required when breaker is enabled")
+	}
+	switch bands.BreakerPhase {
+	case "", schemas.MarketPhaseHalted, schemas.MarketPhaseAuction:
+		return nil
+	default:
+		return rejectf(RejectInvalidPriceBands, "breaker can only move the market to %s or %s", schemas.MarketPhaseHalted, schemas.MarketPhaseAuction)
+	}
+}
+
+// SetPriceBands replaces the collar and breaker configuration. The breaker halts the market
+// unless another phase is configured.
+func (ob *OrderBook) SetPriceBands(ctx context.Context, bands schemas.PriceBands) error {
+	if err := CheckPriceBands(bands); err != nil {
+		return err
+	}
+	if bands.BreakerPhase == "" {
+		bands.BreakerPhase = schemas.MarketPhaseHalted
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.priceBands = bands
+	ob.obs.LogInfo(
+		ctx,
+		"orderbook.bands.set collar_bps=%d breaker_bps=%d breaker_window_ms=%d breaker_phase=%s",
+		bands.CollarBps,
+		bands.BreakerBps,
+		bands.BreakerWindowMs,
+		bands.BreakerPhase,
+	)
+	return nil
+}
+
+// AdvanceClock moves the book clock to a primary-assigned timestamp. The clock never moves
+// backwards, so a new primary with a lagging wall clock cannot reopen a closed window.
+func (ob *OrderBook) AdvanceClock(nowMs int64) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.clockMs = max(ob.clockMs, nowMs)
+}
+
+// CheckPriceCollar rejects limit prices further than the collar from the last trade. There is
+// no collar before the first trade.
+func (ob *OrderBook) CheckPriceCollar(priceLevel int64) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	reference := ob.lastTradePrice
+	if ob.priceBands.CollarBps == 0 || reference <= 0 {
+		return nil
+	}
+	if outsideBand(priceLevel, reference, ob.priceBands.CollarBps) {
+		return rejectf(RejectPriceCollar, "price %d is more than %d bps from reference price %d", priceLevel, ob.priceBands.CollarBps, reference)
+	}
+	return nil
+}
+
+// CheckBatchBands checks an order in an all-or-nothing batch against the price bands as they
+// could stand once the orders before it have traded, since the batch cannot stop part way. The
+// collar must hold from any price in prints, and no price the order could trade at, on the book
+// or at a pending opposite price, may trip the breaker. It returns prints widened by the prices
+// this order could trade at.
+func (ob *OrderBook) CheckBatchBands(priceLevel int64, isBid bool, pending []int64, prints PrintRange) (PrintRange, error) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	bands := ob.priceBands
+	if bands.CollarBps > 0 && prints.High > 0 {
+		for _, reference := range []int64{prints.Low, prints.High} {
+			if outsideBand(priceLevel, reference, bands.CollarBps) {
+				return prints, rejectf(RejectPriceCollar, "price %d is more than %d bps from price %d an earlier order in the batch could trade at", priceLevel, bands.CollarBps, reference)
+			}
+		}
+	}
+	if ob.phase != schemas.MarketPhaseContinuous || priceLevel <= 0 {
+		return prints, nil
+	}
+
+	reach := PrintRange{}
+	widen := func(price int64) {
+		if !crosses(priceLevel, price, isBid) {
+			return
+		}
+		if reach.High == 0 {
+			reach = PrintRange{Low: price, High: price}
+			return
+		}
+		reach.Low = min(reach.Low, price)
+		reach.High = max(reach.High, price)
+	}
+	for price, level := range ob.priceLevelsBySide(!isBid) {
+		if level.Amount > 0 {
+			widen(price)
+		}
+	}
+	for _, price := range pending {
+		widen(price)
+	}
+	if reach.High == 0 {
+		return prints, nil
+	}
+
+	if bands.BreakerBps > 0 {
+		// a band is an interval, so prices and references between the ends pass whenever the ends do
+		references := []int64{ob.breakerReferenceLocked()}
+		if prints.High > 0 {
+			references = append(references, prints.Low, prints.High)
+		}
+		for _, reference := range references {
+			if reference <= 0 {
+				continue
+			}
+			for _, price := range []int64{reach.Low, reach.High} {
+				if outsideBand(price, reference, bands.BreakerBps) {
+					return prints, rejectf(RejectWouldTripBreaker, "order could trade at %d, more than %d bps from reference price %d", price, bands.BreakerBps, reference)
+				}
+			}
+		}
+	}
+
+	if prints.High == 0 {
+		return reach, nil
+	}
+	return PrintRange{Low: min(prints.Low, reach.Low), High: max(prints.High, reach.High)}, nil
+}
+
+// breakerTrippedBy reports whether printing at price would move the market more than the
+// breaker allows from the oldest trade still inside the window, or from the last trade when
+// the window is empty.
+func (ob *OrderBook) breakerTrippedBy(price int64) bool {
+	if ob.priceBands.BreakerBps == 0 {
+		return false
+	}
+
+	ob.pruneTrades()
+	reference := ob.breakerReferenceLocked()
+	if reference <= 0 {
+		return false
+	}
+	return outsideBand(price, reference, ob.priceBands.BreakerBps)
+}
+
+// breakerReferenceLocked is the price the breaker measures from. It skips trades that have left
+// the window without pruning them, so it is safe under the read lock.
+func (ob *OrderBook) breakerReferenceLocked() int64 {
+	cutoff := ob.clockMs - ob.priceBands.BreakerWindowMs
+	for _, trade := range ob.recentTrades {
+		if trade.AtMs >= cutoff {
+			return trade.Price
+		}
+	}
+	return ob.lastTradePrice
+}
+
+func (ob *OrderBook) tripBreaker(ctx context.Context, price int64) {
+	ob.obs.LogInfo(ctx, "orderbook.bands.breaker_tripped price=%d last_trade=%d phase=%s", price, ob.lastTradePrice, ob.priceBands.BreakerPhase)
+	ob.setPhaseLocked(ctx, ob.priceBands.BreakerPhase)
+}
+
+func (ob *OrderBook) markTrade(price int64) {
+	if ob.priceBands.BreakerBps == 0 {
+		return
+	}
+	ob.recentTrades = append(ob.recentTrades, TradeMark{Price: price, AtMs: ob.clockMs})
+}
+
+func (ob *OrderBook) pruneTrades() {
+	cutoff := ob.clockMs - ob.priceBands.BreakerWindowMs
+	drop := 0
+	for drop < len(ob.recentTrades) && ob.recentTrades[drop].AtMs < cutoff {
+		drop++
+	}
+	ob.recentTrades = ob.recentTrades[drop:]
+}
+
+func outsideBand(price int64, reference int64, bps int64) bool {
+	return abs(price-reference)*basisPointsPerUnit > reference*bps
+}
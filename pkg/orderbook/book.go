@@ -13,13 +13,34 @@ import (
 
 func New(obs *obs.Client) *OrderBook {
 	return &OrderBook{
-		bids:        orderLevelHeap{isBid: true},
-		asks:        orderLevelHeap{isBid: false},
-		bidsByPrice: map[int64]*OrderbookLevel{},
-		asksByPrice: map[int64]*OrderbookLevel{},
-		ordersByID:  map[uuid.UUID]orderRef{},
-		fillsByUser: map[string][]UserFill{},
-		obs:         obs,
+		bids:              orderLevelHeap{isBid: true},
+		asks:              orderLevelHeap{isBid: false},
+		bidsByPrice:       map[int64]*OrderbookLevel{},
+		asksByPrice:       map[int64]*OrderbookLevel{},
+		ordersByID:        map[uuid.UUID]orderRef{},
+		fillsByUser:       map[string][]UserFill{},
+		stopsByID:         map[uuid.UUID]*TrailingStop{},
+		accounts:          map[string]*Account{},
+		riskByUser:        map[string]*userRisk{},
+		ordersByUser:      map[string]map[uuid.UUID]struct{}{},
+		clientOrders:      map[string]map[string]ClientOrder{},
+		quotes:            map[string]Quote{},
+		orderStatuses:     map[uuid.UUID]*OrderStatus{},
+		orderHistory:      map[string][]uuid.UUID{},
+		historyLimit:      DefaultOrderHistoryLimit,
+		clientOrderLimit:  DefaultClientOrderRetention,
+		requireCollateral: DefaultRequireCollateral,
+		localRejects:      map[uuid.UUID]*OrderStatus{},
+		positions:         map[string]*Position{},
+		sessions:          map[string]Session{},
+		phase:             schemas.MarketPhaseContinuous,
+		matching:          schemas.MatchingConfig{Algorithm: schemas.MatchingFIFO},
+		allocator:         fifoAllocator{},
+		instrument:        defaultInstrumentRules,
+		feeTiers:          map[string]schemas.FeeSchedule{DefaultFeeTier: {}},
+		feeTierUsers:      map[string]string{},
+		feeTotals:         map[string]*FeeTotals{},
+		obs:               obs,
 	}
 }
 
@@ -27,36 +48,51 @@ func (ob *OrderBook) PostLimit(ctx context.Context, user string, orderID uuid.UU
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
-	incoming := &Order{
+	return ob.postLimitLocked(ctx, &Order{
 		User:       user,
 		ID:         orderID,
 		PriceLevel: priceLevel,
 		Amount:     amount,
 		IsBid:      isBid,
-	}
+	})
+}
+
+func (ob *OrderBook) postLimitLocked(ctx context.Context, incoming *Order) schemas.PostLimitResponse {
+	ob.trackOrder(*incoming, OrderKindLimit)
+	return ob.matchAndRestLocked(ctx, incoming)
+}
 
+// matchAndRestLocked matches an order against the book and rests whatever is left. An order whose
+// sweep trips the breaker is cancelled instead, since its remainder still crosses the book.
+func (ob *OrderBook) matchAndRestLocked(ctx context.Context, incoming *Order) schemas.PostLimitResponse {
+	// outside continuous trading orders rest without matching until the next uncross
 	var fills []schemas.PostLimitMatch
-	if isBid {
-		fills = ob.matchIncoming(ctx, incoming, true, func(levelPrice int64) bool {
-			return levelPrice <= incoming.PriceLevel
-		})
-		if incoming.Amount > 0 {
-			ob.addOrder(incoming)
-			ob.obs.LogInfo(ctx, "orderbook.post_limit.resting_order_added user=%s order_id=%s price=%d amount=%d", incoming.User, incoming.ID, incoming.PriceLevel, incoming.Amount)
-		}
-	} else {
-		fills = ob.matchIncoming(ctx, incoming, false, func(levelPrice int64) bool {
-			return levelPrice >= incoming.PriceLevel
-		})
-		if incoming.Amount > 0 {
-			ob.addOrder(incoming)
-			ob.obs.LogInfo(ctx, "orderbook.post_limit.resting_order_added user=%s order_id=%s price=%d amount=%d", incoming.User, incoming.ID, incoming.PriceLevel, incoming.Amount)
+	matched := ob.phase == schemas.MarketPhaseContinuous
+	if matched {
+		if incoming.IsBid {
+			fills = ob.matchIncoming(ctx, incoming, func(levelPrice int64) bool {
+				return levelPrice <= incoming.PriceLevel
+			})
+		} else {
+			fills = ob.matchIncoming(ctx, incoming, func(levelPrice int64) bool {
+				return levelPrice >= incoming.PriceLevel
+			})
 		}
 	}
+	if incoming.Amount > 0 && matched && ob.phase != schemas.MarketPhaseContinuous {
+		ob.finishOrder(incoming.ID, OrderStateCancelled)
+		ob.obs.LogInfo(ctx, "orderbook.post_limit.remainder_cancelled user=%s order_id=%s phase=%s amount=%d", incoming.User, incoming.ID, ob.phase, incoming.Amount)
+	} else if incoming.Amount > 0 {
+		ob.holdForOrder(incoming)
+		ob.addOrder(incoming)
+		ob.obs.LogInfo(ctx, "orderbook.post_limit.resting_order_added user=%s order_id=%s price=%d amount=%d", incoming.User, incoming.ID, incoming.PriceLevel, incoming.Amount)
+	}
+	ob.executeTriggeredStops(ctx)
 
 	return schemas.PostLimitResponse{
-		OrderID: incoming.ID.String(),
-		Fills:   fills,
+		OrderID:       incoming.ID.String(),
+		ClientOrderID: incoming.ClientOrderID,
+		Fills:         fills,
 	}
 }
 
@@ -77,69 +113,83 @@ func (ob *OrderBook) CancelLimitOrder(ctx context.Context, orderID uuid.UUID) (s
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
+	sizeCancelled, err := ob.cancelOrderLocked(orderID, OrderStateCancelled)
+	ob.obs.LogInfo(ctx, "orderbook.cancel.done order_id=%s size_cancelled=%d", orderID, sizeCancelled)
+	if err != nil {
+		return schemas.CancelLimitResponse{}, err
+	}
+
+	return schemas.CancelLimitResponse{
+		SizeCancelled: sizeCancelled,
+	}, nil
+}
+
+// cancelOrderLocked removes a resting order or trailing stop, releases its hold and records
+// the order as finished in the given state.
+func (ob *OrderBook) cancelOrderLocked(orderID uuid.UUID, state OrderState) (int64, error) {
 	ref, ok := ob.ordersByID[orderID]
 	if !ok {
-		ob.obs.LogInfo(ctx, "orderbook.cancel.done order_id=%s size_cancelled=0", orderID)
-		return schemas.CancelLimitResponse{}, errors.New("order not found")
+		if stop, ok := ob.removeTrailingStop(orderID); ok {
+			ob.releaseStopHold(&stop)
+			ob.finishOrder(orderID, state)
+			return stop.Amount, nil
+		}
+		return 0, errors.New("order not found")
 	}
 
 	sideLevels, sideMap := ob.bookSide(ref.isBid)
 	removed, ok := ob.removeOrder(ref.isBid, ref.level, ref.index)
 	if !ok {
 		delete(ob.ordersByID, orderID)
-		ob.obs.LogInfo(ctx, "orderbook.cancel.done order_id=%s size_cancelled=0", orderID)
-		return schemas.CancelLimitResponse{}, errors.New("order not found")
+		return 0, errors.New("order not found")
 	}
 
 	if ref.level.Amount <= 0 {
 		ob.removeLevel(sideLevels, sideMap, ref.level)
 	}
+	ob.releaseHold(removed.User, removed.holdPrice(), removed.Amount, removed.IsBid)
+	ob.finishOrder(orderID, state)
 
-	ob.obs.LogInfo(ctx, "orderbook.cancel.done order_id=%s size_cancelled=%d", orderID, removed.Amount)
-	return schemas.CancelLimitResponse{
-		SizeCancelled: removed.Amount,
-	}, nil
+	return removed.Amount, nil
 }
 
 func (ob *OrderBook) HasOrder(orderID uuid.UUID) bool {
 	ob.mu.RLock()
 	defer ob.mu.RUnlock()
 
-	_, exists := ob.ordersByID[orderID]
+	if _, exists := ob.ordersByID[orderID]; exists {
+		return true
+	}
+	_, exists := ob.stopsByID[orderID]
 	return exists
 }
 
-func (ob *OrderBook) matchIncoming(ctx context.Context, incoming *Order, oppositeIsBid bool, canMatch func(price int64) bool) []schemas.PostLimitMatch {
+func (ob *OrderBook) matchIncoming(ctx context.Context, incoming *Order, canMatch func(price int64) bool) []schemas.PostLimitMatch {
 	var fills []schemas.PostLimitMatch
-	opposite := &ob.bids
-	if oppositeIsBid {
-		opposite = &ob.asks
-	}
+	restingIsBid := !incoming.IsBid
+	opposite, oppositeByPrice := ob.bookSide(restingIsBid)
 
 	for opposite.Len() > 0 && incoming.Amount > 0 {
 		level := opposite.Peek()
 		if level == nil || !canMatch(level.Price) {
 			break
 		}
+		if ob.breakerTrippedBy(level.Price) {
+			ob.tripBreaker(ctx, level.Price)
+			break
+		}
 
 		if len(level.Orders) == 0 || level.Amount <= 0 {
-			ob.removeLevel(opposite, ob.priceLevelsBySide(oppositeIsBid), level)
+			ob.removeLevel(opposite, oppositeByPrice, level)
 			continue
 		}
 
-		for len(level.Orders) > 0 && incoming.Amount > 0 {
-			resting := &level.Orders[0]
-
-			if resting.Amount <= 0 {
-				ob.removeOrder(oppositeIsBid, level, 0)
-				continue
-			}
-
-			matched := min(incoming.Amount, resting.Amount)
+		allocations := ob.allocator.Allocate(level.Orders, min(incoming.Amount, level.Amount))
+		for i, matched := range allocations {
 			if matched <= 0 {
-				ob.removeOrder(oppositeIsBid, level, 0)
 				continue
 			}
+			resting := &level.Orders[i]
 
 			fills = append(fills, schemas.PostLimitMatch{
 				Size:  matched,
@@ -148,6 +198,8 @@ func (ob *OrderBook) matchIncoming(ctx context.Context, incoming *Order, opposit
 			incoming.Amount -= matched
 			level.Amount -= matched
 			resting.Amount -= matched
+			ob.noteOrderFill(incoming.ID, matched, incoming.Amount)
+			ob.noteOrderFill(resting.ID, matched, resting.Amount)
 
 			ob.obs.LogInfo(
 				ctx,
@@ -161,16 +213,21 @@ func (ob *OrderBook) matchIncoming(ctx context.Context, incoming *Order, opposit
 				resting.Amount,
 				level.Amount,
 			)
-			ob.recordFill(incoming.User, resting.User, matched, level.Price, false)
-			ob.recordFill(resting.User, incoming.User, matched, level.Price, true)
+			ob.recordFill(incoming.User, resting.User, matched, level.Price, incoming.IsBid, false)
+			ob.recordFill(resting.User, incoming.User, matched, level.Price, resting.IsBid, true)
+			ob.releaseHold(resting.User, resting.holdPrice(), matched, resting.IsBid)
+			ob.onTrade(ctx, level.Price)
+		}
 
-			if resting.Amount == 0 {
-				ob.removeOrder(oppositeIsBid, level, 0)
+		// back to front so earlier indexes stay valid
+		for i := len(level.Orders) - 1; i >= 0; i-- {
+			if level.Orders[i].Amount <= 0 {
+				ob.removeOrder(restingIsBid, level, i)
 			}
 		}
 
-		if level.Amount <= 0 {
-			ob.removeLevel(opposite, ob.priceLevelsBySide(oppositeIsBid), level)
+		if len(level.Orders) == 0 || level.Amount <= 0 {
+			ob.removeLevel(opposite, oppositeByPrice, level)
 		}
 	}
 
@@ -192,6 +249,7 @@ func (ob *OrderBook) addOrder(order *Order) {
 
 	level.Orders = append(level.Orders, *order)
 	level.Amount += order.Amount
+	ob.indexUserOrder(order.User, order.ID)
 	ob.ordersByID[order.ID] = orderRef{
 		isBid: order.IsBid,
 		level: level,
@@ -228,6 +286,7 @@ func (ob *OrderBook) removeOrder(isBid bool, level *OrderbookLevel, orderIndex i
 
 	removed := level.Orders[orderIndex]
 	delete(ob.ordersByID, removed.ID)
+	ob.unindexUserOrder(removed.User, removed.ID)
 
 	copy(level.Orders[orderIndex:], level.Orders[orderIndex+1:])
 	level.Orders = level.Orders[:len(level.Orders)-1]
@@ -268,12 +327,18 @@ func takeSide(isBid bool) string {
 	return "ask"
 }
 
-func (ob *OrderBook) recordFill(user, counterparty string, size, priceLevel int64, isMaker bool) {
+func (ob *OrderBook) recordFill(user, counterparty string, size, priceLevel int64, isBid, isMaker bool) {
+	feeBps, fee := ob.feeFor(user, size*priceLevel, isMaker)
 	fill := UserFill{
 		Counterparty: counterparty,
 		Size:         size,
 		PriceLevel:   priceLevel,
 		IsMaker:      isMaker,
+		Fee:          fee,
+		FeeBps:       feeBps,
 	}
 	ob.fillsByUser[user] = append(ob.fillsByUser[user], fill)
+	ob.settleFill(user, size, priceLevel, isBid)
+	ob.chargeFee(user, size*priceLevel, fee, isMaker)
+	ob.position(user).applyFill(size, priceLevel, isBid)
 }
@@ -2,6 +2,11 @@ package orderbook
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
 	"testing"
 
 	"replicated-clob/schemas"
@@ -137,3 +142,1046 @@ func TestCancelLimitOrderMissingIDReturnsZero(t *testing.T) {
 		t.Fatalf("expected 0 cancelled for missing id, got %d", resp.SizeCancelled)
 	}
 }
+
+func TestPostLimitRematchesAfterLevelEmptied(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	ob.PostLimit(ctx, "maker", uuid.New(), 100, 2, false)
+	ob.PostLimit(ctx, "taker", uuid.New(), 100, 2, true)
+
+	ob.PostLimit(ctx, "maker", uuid.New(), 100, 2, false)
+	resp := ob.PostLimit(ctx, "taker", uuid.New(), 100, 2, true)
+	if matchedSize(resp.Fills) != 2 {
+		t.Fatalf("expected second cross at emptied price to match 2, got %d", matchedSize(resp.Fills))
+	}
+	if len(ob.asksByPrice) != 0 || len(ob.bidsByPrice) != 0 {
+		t.Fatalf("expected empty book, asks=%d bids=%d", len(ob.asksByPrice), len(ob.bidsByPrice))
+	}
+}
+
+func TestTrailingStopRatchetsAndTriggers(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	// print a trade at 100 so the stop arms immediately
+	ob.PostLimit(ctx, "mm", uuid.New(), 100, 1, false)
+	ob.PostLimit(ctx, "mm", uuid.New(), 100, 1, true)
+
+	stopID := uuid.New()
+	stop := ob.PostTrailingStop(ctx, "alice", stopID, 3, false, 5, 0)
+	if stop.TriggerPrice != 95 {
+		t.Fatalf("expected trigger 95, got %d", stop.TriggerPrice)
+	}
+
+	// trade up to 110 ratchets the sell stop to 105
+	ob.PostLimit(ctx, "mm", uuid.New(), 110, 1, false)
+	ob.PostLimit(ctx, "mm", uuid.New(), 110, 1, true)
+	stops := ob.TrailingStopsForUser(ctx, "alice")
+	if len(stops) != 1 || stops[0].TriggerPrice != 105 {
+		t.Fatalf("expected trigger ratcheted to 105, got %+v", stops)
+	}
+
+	// resting bids for the stop to sell into, then a trade at 104 crosses the trigger
+	ob.PostLimit(ctx, "bidder", uuid.New(), 103, 5, true)
+	ob.PostLimit(ctx, "mm", uuid.New(), 104, 1, true)
+	ob.PostLimit(ctx, "mm", uuid.New(), 104, 1, false)
+
+	if ob.HasOrder(stopID) {
+		t.Fatalf("expected triggered stop to be removed")
+	}
+	fills := ob.FillsForUser(ctx, "alice")
+	if len(fills) != 1 || fills[0].Size != 3 || fills[0].PriceLevel != 103 || fills[0].IsMaker {
+		t.Fatalf("unexpected stop fills: %+v", fills)
+	}
+}
+
+func TestTrailingStopBpsOffsetAndCancel(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	stopID := uuid.New()
+	stop := ob.PostTrailingStop(ctx, "bob", stopID, 2, true, 0, 100)
+	if stop.ArmedAtTrade != 0 {
+		t.Fatalf("expected stop to stay unarmed before first trade")
+	}
+
+	ob.PostLimit(ctx, "mm", uuid.New(), 200, 1, false)
+	ob.PostLimit(ctx, "mm", uuid.New(), 200, 1, true)
+	stops := ob.TrailingStopsForUser(ctx, "bob")
+	if len(stops) != 1 || stops[0].TriggerPrice != 202 {
+		t.Fatalf("expected buy stop armed at 202, got %+v", stops)
+	}
+
+	resp, err := ob.CancelLimitOrder(ctx, stopID)
+	if err != nil {
+		t.Fatalf("expected cancel of trailing stop to succeed, got %v", err)
+	}
+	if resp.SizeCancelled != 2 {
+		t.Fatalf("expected 2 cancelled, got %d", resp.SizeCancelled)
+	}
+	if len(ob.TrailingStopsForUser(ctx, "bob")) != 0 {
+		t.Fatalf("expected no trailing stops after cancel")
+	}
+}
+
+func TestLedgerHoldsAndSettlesFills(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	ob.Deposit(ctx, "maker", 10, 0)
+	ob.Deposit(ctx, "taker", 0, 1000)
+
+	askID := uuid.New()
+	ob.PostLimit(ctx, "maker", askID, 100, 4, false)
+	if acct := ob.AccountForUser(ctx, "maker"); acct.BaseHold != 4 || acct.AvailableBase() != 6 {
+		t.Fatalf("expected 4 base held on resting ask, got %+v", acct)
+	}
+	if err := ob.CheckOrderCollateral("maker", 100, 7, false); err == nil {
+		t.Fatalf("expected ask larger than available base to be rejected")
+	}
+
+	ob.PostLimit(ctx, "taker", uuid.New(), 100, 3, true)
+
+	maker := ob.AccountForUser(ctx, "maker")
+	if maker.Base != 7 || maker.Quote != 300 || maker.BaseHold != 1 {
+		t.Fatalf("unexpected maker account after fill: %+v", maker)
+	}
+	taker := ob.AccountForUser(ctx, "taker")
+	if taker.Base != 3 || taker.Quote != 700 || taker.QuoteHold != 0 {
+		t.Fatalf("unexpected taker account after fill: %+v", taker)
+	}
+
+	if _, err := ob.CancelLimitOrder(ctx, askID); err != nil {
+		t.Fatalf("unexpected cancel error: %v", err)
+	}
+	if acct := ob.AccountForUser(ctx, "maker"); acct.BaseHold != 0 {
+		t.Fatalf("expected hold released on cancel, got %+v", acct)
+	}
+
+	if _, err := ob.Withdraw(ctx, "taker", 0, 701); err == nil {
+		t.Fatalf("expected overdrawn withdrawal to fail")
+	}
+}
+
+func TestTrailingStopsHoldCollateral(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	ob.Deposit(ctx, "alice", 5, 0)
+	ob.Deposit(ctx, "bob", 0, 1000)
+	ob.PostLimit(ctx, "mm", uuid.New(), 100, 1, false)
+	ob.PostLimit(ctx, "mm", uuid.New(), 100, 1, true)
+
+	sellID := uuid.New()
+	ob.PostTrailingStop(ctx, "alice", sellID, 3, false, 5, 0)
+	if acct := ob.AccountForUser(ctx, "alice"); acct.BaseHold != 3 {
+		t.Fatalf("expected sell stop to hold 3 base, got %+v", acct)
+	}
+	if err := ob.CheckTrailingStopCollateral("alice", 3, false, 5, 0); err == nil {
+		t.Fatalf("expected a second sell stop to exceed the base left")
+	}
+	if _, err := ob.CancelLimitOrder(ctx, sellID); err != nil {
+		t.Fatalf("failed to cancel stop: %v", err)
+	}
+	if acct := ob.AccountForUser(ctx, "alice"); acct.BaseHold != 0 {
+		t.Fatalf("expected cancel to release the stop hold, got %+v", acct)
+	}
+
+	// a buy stop holds quote at its trigger of 105 and never pays more once triggered
+	buyID := uuid.New()
+	stop := ob.PostTrailingStop(ctx, "bob", buyID, 4, true, 5, 0)
+	if stop.HoldPrice != 105 {
+		t.Fatalf("expected hold price 105, got %+v", stop)
+	}
+	if acct := ob.AccountForUser(ctx, "bob"); acct.QuoteHold != 420 {
+		t.Fatalf("expected buy stop to hold 420 quote, got %+v", acct)
+	}
+	if err := ob.CheckTrailingStopCollateral("bob", 6, true, 5, 0); err == nil {
+		t.Fatalf("expected a second buy stop to exceed the quote left")
+	}
+
+	ob.Deposit(ctx, "seller", 10, 0)
+	ob.PostLimit(ctx, "seller", uuid.New(), 105, 3, false)
+	ob.PostLimit(ctx, "seller", uuid.New(), 120, 5, false)
+	ob.PostLimit(ctx, "mm", uuid.New(), 105, 1, true)
+
+	bob := ob.AccountForUser(ctx, "bob")
+	if bob.Base != 2 || bob.Quote != 790 || bob.QuoteHold != 0 {
+		t.Fatalf("expected stop to buy 2 at 105 and release its hold, got %+v", bob)
+	}
+	if status, _ := ob.OrderStatus(buyID); status.State != OrderStateExpired || status.Filled != 2 {
+		t.Fatalf("expected stop to stop at its hold price, got %+v", status)
+	}
+}
+
+func TestOrderShapeRejectsNotionalOverflow(t *testing.T) {
+	err := ValidateOrderShape(math.MaxInt64/2, 3, true)
+	var rejectErr *OrderRejectError
+	if !errors.As(err, &rejectErr) || rejectErr.Reason != RejectNotionalOverflow {
+		t.Fatalf("expected notional overflow reject, got %v", err)
+	}
+	if err := ValidateOrderShape(math.MaxInt64/3, 3, true); err != nil {
+		t.Fatalf("expected notional that fits to pass, got %v", err)
+	}
+}
+
+func TestRiskLimitsRejectOrders(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	ob.SetRiskLimits(ctx, "alice", schemas.RiskLimits{
+		MaxOrderSize:  10,
+		MaxNotional:   500,
+		MaxOpenOrders: 1,
+		MaxPosition:   4,
+	})
+
+	cases := []struct {
+		price  int64
+		amount int64
+		reason RejectReason
+	}{
+		{price: 10, amount: 11, reason: RejectMaxOrderSize},
+		{price: 100, amount: 6, reason: RejectMaxNotional},
+		{price: 10, amount: 5, reason: RejectMaxPosition},
+	}
+	for _, tc := range cases {
+		err := ob.CheckRiskLimits("alice", tc.price, tc.amount, true)
+		var rejectErr *OrderRejectError
+		if !errors.As(err, &rejectErr) || rejectErr.Reason != tc.reason {
+			t.Fatalf("expected %s reject for price=%d amount=%d, got %v", tc.reason, tc.price, tc.amount, err)
+		}
+	}
+
+	ob.PostLimit(ctx, "alice", uuid.New(), 10, 2, true)
+	err := ob.CheckRiskLimits("alice", 10, 1, true)
+	var rejectErr *OrderRejectError
+	if !errors.As(err, &rejectErr) || rejectErr.Reason != RejectMaxOpenOrders {
+		t.Fatalf("expected max open orders reject, got %v", err)
+	}
+}
+
+func TestKillSwitchBlocksAndCancelsUserOrders(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	bidID := uuid.New()
+	askID := uuid.New()
+	stopID := uuid.New()
+	ob.PostLimit(ctx, "alice", bidID, 99, 2, true)
+	ob.PostLimit(ctx, "alice", askID, 101, 3, false)
+	ob.PostLimit(ctx, "bob", uuid.New(), 98, 1, true)
+	ob.PostTrailingStop(ctx, "alice", stopID, 4, false, 5, 0)
+
+	cancelled := ob.SetUserBlocked(ctx, "alice", true)
+	if len(cancelled.OrderIDs) != 3 || cancelled.SizeCancelled != 9 {
+		t.Fatalf("unexpected kill switch cancel result: %+v", cancelled)
+	}
+	if cancelled.OrderIDs[0] != bidID || cancelled.OrderIDs[1] != askID || cancelled.OrderIDs[2] != stopID {
+		t.Fatalf("expected cancels in book order, got %v", cancelled.OrderIDs)
+	}
+	if len(ob.OpenOrdersForUser(ctx, "bob")) != 1 {
+		t.Fatalf("expected other users' orders to stay on the book")
+	}
+
+	err := ob.CheckRiskLimits("alice", 100, 1, true)
+	var rejectErr *OrderRejectError
+	if !errors.As(err, &rejectErr) || rejectErr.Reason != RejectUserBlocked {
+		t.Fatalf("expected blocked user reject, got %v", err)
+	}
+
+	ob.SetUserBlocked(ctx, "alice", false)
+	if err := ob.CheckRiskLimits("alice", 100, 1, true); err != nil {
+		t.Fatalf("expected unblocked user to pass, got %v", err)
+	}
+}
+
+func TestMassCancelFiltersBySideAndPriceBand(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	keepBid := uuid.New()
+	cancelBidHigh := uuid.New()
+	cancelBidMid := uuid.New()
+	ob.PostLimit(ctx, "mm", keepBid, 90, 1, true)
+	ob.PostLimit(ctx, "mm", cancelBidMid, 95, 2, true)
+	ob.PostLimit(ctx, "mm", cancelBidHigh, 98, 3, true)
+	ob.PostLimit(ctx, "mm", uuid.New(), 102, 4, false)
+	ob.PostLimit(ctx, "other", uuid.New(), 96, 5, true)
+
+	cancelled := ob.MassCancel(ctx, "mm", schemas.MassCancelFilter{Side: "bid", MinPrice: 95})
+	if cancelled.SizeCancelled != 5 || len(cancelled.OrderIDs) != 2 {
+		t.Fatalf("unexpected mass cancel result: %+v", cancelled)
+	}
+	if cancelled.OrderIDs[0] != cancelBidHigh || cancelled.OrderIDs[1] != cancelBidMid {
+		t.Fatalf("expected cancels in price priority, got %v", cancelled.OrderIDs)
+	}
+
+	remaining := ob.OpenOrdersForUser(ctx, "mm")
+	if len(remaining) != 2 || remaining[0].ID != keepBid || remaining[1].IsBid {
+		t.Fatalf("unexpected remaining orders: %+v", remaining)
+	}
+	if len(ob.OpenOrdersForUser(ctx, "other")) != 1 {
+		t.Fatalf("expected other user's order untouched")
+	}
+
+	cancelled = ob.MassCancel(ctx, "mm", schemas.MassCancelFilter{})
+	if cancelled.SizeCancelled != 5 || len(ob.OpenOrdersForUser(ctx, "mm")) != 0 {
+		t.Fatalf("expected remaining mm orders cancelled, got %+v", cancelled)
+	}
+}
+
+func TestAuctionUncrossesAtSingleClearingPrice(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	if err := ob.SetMarketPhase(ctx, schemas.MarketPhaseAuction); err != nil {
+		t.Fatalf("failed to enter auction: %v", err)
+	}
+
+	// Crossing orders rest instead of matching while the auction collects.
+	ob.PostLimit(ctx, "seller1", uuid.New(), 99, 2, false)
+	ob.PostLimit(ctx, "seller2", uuid.New(), 101, 4, false)
+	ob.PostLimit(ctx, "buyer1", uuid.New(), 102, 3, true)
+	resp := ob.PostLimit(ctx, "buyer2", uuid.New(), 100, 2, true)
+	if len(resp.Fills) != 0 {
+		t.Fatalf("expected no fills during auction, got %+v", resp.Fills)
+	}
+
+	depth := ob.Depth(ctx, 10)
+	if depth.IndicativePrice != 101 || depth.IndicativeVolume != 3 || depth.Imbalance != -3 {
+		t.Fatalf("unexpected indicative auction: %+v", depth)
+	}
+
+	if _, err := ob.UncrossAuction(ctx, schemas.MarketPhaseHalted); err == nil {
+		t.Fatalf("expected uncross into halted to be rejected")
+	}
+	result, err := ob.UncrossAuction(ctx, schemas.MarketPhaseContinuous)
+	if err != nil {
+		t.Fatalf("failed to uncross: %v", err)
+	}
+	if result.Price != 101 || result.Volume != 3 {
+		t.Fatalf("unexpected auction result: %+v", result)
+	}
+	if ob.MarketPhase() != schemas.MarketPhaseContinuous {
+		t.Fatalf("expected continuous after uncross, got %s", ob.MarketPhase())
+	}
+
+	for _, fill := range ob.FillsForUser(ctx, "buyer1") {
+		if fill.PriceLevel != 101 {
+			t.Fatalf("expected all fills at clearing price, got %+v", fill)
+		}
+	}
+	if ob.LastTradePrice() != 101 {
+		t.Fatalf("expected last trade at clearing price, got %d", ob.LastTradePrice())
+	}
+
+	depth = ob.Depth(ctx, 10)
+	if len(depth.Bids) != 1 || depth.Bids[0].Price != 100 || len(depth.Asks) != 1 || depth.Asks[0].Amount != 3 {
+		t.Fatalf("unexpected book after uncross: %+v", depth)
+	}
+}
+
+func TestMarketPhaseRejectsOrdersAndInvalidTransitions(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	if err := ob.SetMarketPhase(ctx, schemas.MarketPhaseHalted); err != nil {
+		t.Fatalf("failed to halt: %v", err)
+	}
+
+	var rejectErr *OrderRejectError
+	if err := ob.CheckOrderEntry(100, true); !errors.As(err, &rejectErr) || rejectErr.Reason != RejectMarketClosed {
+		t.Fatalf("expected market closed reject, got %v", err)
+	}
+	if err := ob.SetMarketPhase(ctx, schemas.MarketPhaseContinuous); !errors.As(err, &rejectErr) || rejectErr.Reason != RejectInvalidTransition {
+		t.Fatalf("expected halted to continuous to be rejected, got %v", err)
+	}
+	if err := ob.SetMarketPhase(ctx, schemas.MarketPhaseAuction); err != nil {
+		t.Fatalf("failed to reopen in auction: %v", err)
+	}
+	if err := ob.CheckOrderEntry(100, true); err != nil {
+		t.Fatalf("expected orders accepted in auction, got %v", err)
+	}
+}
+
+func TestPreOpenCollectsOrdersThatDoNotCross(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	if err := ob.SetMarketPhase(ctx, schemas.MarketPhasePreOpen); err != nil {
+		t.Fatalf("failed to enter pre-open: %v", err)
+	}
+	if err := ob.CheckOrderEntry(100, false); err != nil {
+		t.Fatalf("expected ask accepted in pre-open, got %v", err)
+	}
+	ob.PostLimit(ctx, "seller", uuid.New(), 100, 2, false)
+	if err := ob.CheckOrderEntry(99, true); err != nil {
+		t.Fatalf("expected bid below the ask accepted in pre-open, got %v", err)
+	}
+	if err := ob.CheckOrderEntry(0, true); err != nil {
+		t.Fatalf("expected order without a limit price accepted in pre-open, got %v", err)
+	}
+
+	var rejectErr *OrderRejectError
+	if err := ob.CheckOrderEntry(100, true); !errors.As(err, &rejectErr) || rejectErr.Reason != RejectWouldCross {
+		t.Fatalf("expected crossing bid to be rejected, got %v", err)
+	}
+
+	// collected orders carry into the auction, where crossing orders are accepted and uncrossed
+	if err := ob.SetMarketPhase(ctx, schemas.MarketPhaseAuction); err != nil {
+		t.Fatalf("failed to start auction: %v", err)
+	}
+	ob.PostLimit(ctx, "buyer", uuid.New(), 101, 2, true)
+	result, err := ob.UncrossAuction(ctx, schemas.MarketPhaseContinuous)
+	if err != nil {
+		t.Fatalf("failed to uncross: %v", err)
+	}
+	if result.Volume != 2 {
+		t.Fatalf("expected the collected ask to trade in the uncross, got %+v", result)
+	}
+}
+
+func TestPriceCollarAndCircuitBreaker(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	if err := ob.SetPriceBands(ctx, schemas.PriceBands{CollarBps: 1000, BreakerBps: 500, BreakerWindowMs: 1000}); err != nil {
+		t.Fatalf("failed to set price bands: %v", err)
+	}
+	if err := ob.CheckPriceCollar(1000); err != nil {
+		t.Fatalf("expected no collar before the first trade, got %v", err)
+	}
+
+	ob.AdvanceClock(1000)
+	ob.PostLimit(ctx, "seller", uuid.New(), 100, 1, false)
+	ob.PostLimit(ctx, "buyer", uuid.New(), 100, 1, true)
+
+	var rejectErr *OrderRejectError
+	if err := ob.CheckPriceCollar(111); !errors.As(err, &rejectErr) || rejectErr.Reason != RejectPriceCollar {
+		t.Fatalf("expected collar reject, got %v", err)
+	}
+	if err := ob.CheckPriceCollar(90); err != nil {
+		t.Fatalf("expected price inside collar, got %v", err)
+	}
+
+	ob.PostLimit(ctx, "seller", uuid.New(), 101, 1, false)
+	ob.PostLimit(ctx, "seller", uuid.New(), 104, 1, false)
+	ob.PostLimit(ctx, "seller", uuid.New(), 108, 1, false)
+
+	ob.AdvanceClock(1500)
+	sweepID := uuid.New()
+	resp := ob.PostLimit(ctx, "sweeper", sweepID, 110, 3, true)
+	if matchedSize(resp.Fills) != 2 {
+		t.Fatalf("expected breaker to stop the sweep after 2, got %+v", resp.Fills)
+	}
+	if ob.MarketPhase() != schemas.MarketPhaseHalted {
+		t.Fatalf("expected breaker to halt the market, got %s", ob.MarketPhase())
+	}
+	if ob.LastTradePrice() != 104 {
+		t.Fatalf("expected last trade at 104, got %d", ob.LastTradePrice())
+	}
+	// the remainder would cross the 108 ask, so it is cancelled rather than left resting
+	if status, _ := ob.OrderStatus(sweepID); status.State != OrderStateCancelled || status.Filled != 2 || ob.HasOrder(sweepID) {
+		t.Fatalf("expected sweep remainder to be cancelled, got %+v", status)
+	}
+
+	// Once the window rolls past the earlier prints the reference is the last trade.
+	ob.AdvanceClock(10_000)
+	if err := ob.SetMarketPhase(ctx, schemas.MarketPhaseAuction); err != nil {
+		t.Fatalf("failed to reopen in auction: %v", err)
+	}
+	ob.PostLimit(ctx, "buyer", uuid.New(), 110, 1, true)
+	if _, err := ob.UncrossAuction(ctx, schemas.MarketPhaseContinuous); err != nil {
+		t.Fatalf("failed to uncross: %v", err)
+	}
+	if ob.LastTradePrice() != 108 || ob.MarketPhase() != schemas.MarketPhaseContinuous {
+		t.Fatalf("expected uncross at 108, got price=%d phase=%s", ob.LastTradePrice(), ob.MarketPhase())
+	}
+}
+
+func TestFeesChargedFromTierAtMatchTime(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	if err := ob.SetFeeTier(ctx, DefaultFeeTier, schemas.FeeSchedule{MakerBps: 1, TakerBps: 10}); err != nil {
+		t.Fatalf("failed to set default tier: %v", err)
+	}
+	if err := ob.SetFeeTier(ctx, "vip", schemas.FeeSchedule{MakerBps: -2, TakerBps: 5}); err != nil {
+		t.Fatalf("failed to set vip tier: %v", err)
+	}
+	if err := ob.SetFeeTier(ctx, "broken", schemas.FeeSchedule{MakerBps: -6, TakerBps: 5}); err == nil {
+		t.Fatalf("expected rebate above taker fee to be rejected")
+	}
+	if err := ob.SetFeeTier(ctx, "broken", schemas.FeeSchedule{MakerBps: 10_001, TakerBps: 5}); err == nil || !strings.Contains(err.Error(), "maker fee") {
+		t.Fatalf("expected maker rate above 100%% to be rejected as a maker fee, got %v", err)
+	}
+	if err := ob.AssignFeeTier(ctx, "alice", "missing"); err == nil {
+		t.Fatalf("expected unknown tier to be rejected")
+	}
+	if err := ob.AssignFeeTier(ctx, "alice", "vip"); err != nil {
+		t.Fatalf("failed to assign tier: %v", err)
+	}
+
+	ob.PostLimit(ctx, "alice", uuid.New(), 1000, 10, false)
+	ob.PostLimit(ctx, "bob", uuid.New(), 1000, 10, true)
+
+	makerFill := ob.FillsForUser(ctx, "alice")[0]
+	takerFill := ob.FillsForUser(ctx, "bob")[0]
+	if makerFill.Fee != -2 || makerFill.FeeBps != -2 {
+		t.Fatalf("expected maker rebate of 2, got %+v", makerFill)
+	}
+	if takerFill.Fee != 10 || takerFill.FeeBps != 10 {
+		t.Fatalf("expected taker fee of 10, got %+v", takerFill)
+	}
+	if account := ob.AccountForUser(ctx, "alice"); account.Quote != 10_002 {
+		t.Fatalf("expected rebate credited to quote, got %+v", account)
+	}
+	if account := ob.AccountForUser(ctx, "bob"); account.Quote != -10_010 {
+		t.Fatalf("expected fee debited from quote, got %+v", account)
+	}
+
+	// Fees round up and rebates round down on fractional cents.
+	ob.PostLimit(ctx, "alice", uuid.New(), 333, 1, false)
+	ob.PostLimit(ctx, "bob", uuid.New(), 333, 1, true)
+
+	summary := ob.FeeSummaryForUser(ctx, "bob")
+	if summary.Tier != DefaultFeeTier || summary.TakerVolume != 10_333 || summary.FeesPaid != 11 {
+		t.Fatalf("unexpected taker summary: %+v", summary)
+	}
+	summary = ob.FeeSummaryForUser(ctx, "alice")
+	if summary.Tier != "vip" || summary.MakerVolume != 10_333 || summary.RebatesEarned != 2 {
+		t.Fatalf("unexpected maker summary: %+v", summary)
+	}
+
+	// notional*bps overflows int64 here, but the fee itself fits
+	if err := ob.SetFeeTier(ctx, DefaultFeeTier, schemas.FeeSchedule{TakerBps: 100}); err != nil {
+		t.Fatalf("failed to raise default tier: %v", err)
+	}
+	ob.PostLimit(ctx, "alice", uuid.New(), 1_000_000_000, 100_000_000, false)
+	ob.PostLimit(ctx, "carol", uuid.New(), 1_000_000_000, 100_000_000, true)
+	if fill := ob.FillsForUser(ctx, "carol")[0]; fill.Fee != 1_000_000_000_000_000 {
+		t.Fatalf("expected a 1%% fee on a large notional, got %+v", fill)
+	}
+}
+
+func TestBidCollateralCoversFees(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	if err := ob.SetFeeTier(ctx, DefaultFeeTier, schemas.FeeSchedule{MakerBps: 5, TakerBps: 10}); err != nil {
+		t.Fatalf("failed to set fees: %v", err)
+	}
+	ob.Deposit(ctx, "bob", 0, 10_000)
+
+	var rejectErr *OrderRejectError
+	if err := ob.CheckOrderCollateral("bob", 100, 100, true); !errors.As(err, &rejectErr) || rejectErr.Reason != RejectInsufficientBalance {
+		t.Fatalf("expected the taker fee to need more than the notional, got %v", err)
+	}
+	// a fill can be a single unit, so each unit holds its fee rounded up to a whole cent
+	ob.Deposit(ctx, "bob", 0, 100)
+	if err := ob.CheckOrderCollateral("bob", 100, 100, true); err != nil {
+		t.Fatalf("expected notional plus fee to be funded, got %v", err)
+	}
+
+	ob.PostLimit(ctx, "alice", uuid.New(), 100, 50, false)
+	ob.PostLimit(ctx, "alice", uuid.New(), 100, 50, false)
+	ob.PostLimit(ctx, "bob", uuid.New(), 100, 100, true)
+	if account := ob.AccountForUser(ctx, "bob"); account.Quote != 90 || account.Base != 100 {
+		t.Fatalf("expected the fully funded bid to pay notional and fees, got %+v", account)
+	}
+
+	// a resting bid holds the fee too, rounded up per unit, and releases all of it as it fills
+	ob.Deposit(ctx, "carol", 0, 1_002)
+	if err := ob.CheckOrderCollateral("carol", 333, 3, true); err != nil {
+		t.Fatalf("expected 3 units at 334 to be funded, got %v", err)
+	}
+	ob.PostLimit(ctx, "carol", uuid.New(), 333, 3, true)
+	if account := ob.AccountForUser(ctx, "carol"); account.QuoteHold != 1_002 {
+		t.Fatalf("expected hold of 334 per unit, got %+v", account)
+	}
+	ob.PostLimit(ctx, "alice", uuid.New(), 333, 1, false)
+	ob.PostLimit(ctx, "alice", uuid.New(), 333, 2, false)
+	if account := ob.AccountForUser(ctx, "carol"); account.QuoteHold != 0 || account.Quote < 0 {
+		t.Fatalf("expected fills to release the whole hold and stay funded, got %+v", account)
+	}
+}
+
+func TestPositionTracksAverageEntryAndRealizedPnL(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	ob.PostLimit(ctx, "bob", uuid.New(), 100, 10, false)
+	ob.PostLimit(ctx, "alice", uuid.New(), 100, 10, true)
+	ob.PostLimit(ctx, "bob", uuid.New(), 110, 10, false)
+	ob.PostLimit(ctx, "alice", uuid.New(), 110, 10, true)
+
+	position, _ := ob.PositionForUser(ctx, "alice")
+	if position.Net != 20 || position.AvgEntryPrice() != 105 || position.RealizedPnL != 0 {
+		t.Fatalf("unexpected position after buys: %+v", position)
+	}
+
+	ob.PostLimit(ctx, "bob", uuid.New(), 120, 5, true)
+	ob.PostLimit(ctx, "alice", uuid.New(), 120, 5, false)
+	position, _ = ob.PositionForUser(ctx, "alice")
+	if position.Net != 15 || position.RealizedPnL != 75 {
+		t.Fatalf("unexpected position after partial close: %+v", position)
+	}
+
+	// Selling through the position realizes the rest and opens a short at the fill price.
+	ob.PostLimit(ctx, "bob", uuid.New(), 90, 20, true)
+	ob.PostLimit(ctx, "alice", uuid.New(), 90, 20, false)
+	position, mark := ob.PositionForUser(ctx, "alice")
+	if position.Net != -5 || position.AvgEntryPrice() != 90 || position.RealizedPnL != -150 {
+		t.Fatalf("unexpected position after flip: %+v", position)
+	}
+	if mark != 90 || position.UnrealizedPnL(mark) != 0 || position.UnrealizedPnL(80) != 50 {
+		t.Fatalf("unexpected unrealized pnl: mark=%d position=%+v", mark, position)
+	}
+
+	bob, _ := ob.PositionForUser(ctx, "bob")
+	if bob.Net != 5 {
+		t.Fatalf("expected counterparty position mirrored, got %+v", bob)
+	}
+}
+
+func TestSnapshotRestoreRoundTrip(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	ob.Deposit(ctx, "alice", 50, 10_000)
+	ob.SetRiskLimits(ctx, "alice", schemas.RiskLimits{MaxOrderSize: 100})
+	if err := ob.SetFeeTier(ctx, DefaultFeeTier, schemas.FeeSchedule{TakerBps: 10}); err != nil {
+		t.Fatalf("failed to set fees: %v", err)
+	}
+	ob.PostLimit(ctx, "bob", uuid.New(), 100, 5, false)
+	ob.PostLimit(ctx, "alice", uuid.New(), 100, 2, true)
+	ob.PostLimit(ctx, "carol", uuid.New(), 100, 1, false)
+	ob.PostLimit(ctx, "alice", uuid.New(), 95, 4, true)
+	ob.PostTrailingStop(ctx, "alice", uuid.New(), 1, false, 3, 0)
+	ob.RegisterSession(ctx, "bob", 5000)
+
+	encoded, err := json.Marshal(ob.Snapshot(ctx))
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %v", err)
+	}
+	var decoded Snapshot
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("failed to decode snapshot: %v", err)
+	}
+
+	restored := New(&obs.Client{})
+	restored.Restore(ctx, decoded)
+	if !reflect.DeepEqual(ob.Snapshot(ctx), restored.Snapshot(ctx)) {
+		t.Fatalf("restored snapshot differs from original")
+	}
+
+	// Both books must keep producing the same fills and trigger the same stop.
+	daveID, erinID := uuid.New(), uuid.New()
+	for _, book := range []*OrderBook{ob, restored} {
+		book.PostLimit(ctx, "dave", daveID, 90, 10, true)
+		book.PostLimit(ctx, "erin", erinID, 90, 8, false)
+	}
+	if !reflect.DeepEqual(ob.Snapshot(ctx), restored.Snapshot(ctx)) {
+		t.Fatalf("books diverged after applying the same orders")
+	}
+	if fills := restored.FillsForUser(ctx, "erin"); len(fills) == 0 || fills[0].Counterparty != "alice" {
+		t.Fatalf("expected erin to hit alice's resting bid first, got %+v", fills)
+	}
+
+	// a stop triggered by an auction print waits for continuous trading, and must survive a restore
+	stopID := uuid.New()
+	for _, book := range []*OrderBook{ob, restored} {
+		book.PostTrailingStop(ctx, "frank", stopID, 1, false, 1, 0)
+		book.PostLimit(ctx, "gina", uuid.New(), 70, 2, true)
+		if err := book.SetMarketPhase(ctx, schemas.MarketPhaseAuction); err != nil {
+			t.Fatalf("failed to start auction: %v", err)
+		}
+		book.PostLimit(ctx, "hank", uuid.New(), 80, 10, false)
+		if _, err := book.UncrossAuction(ctx, schemas.MarketPhasePreOpen); err != nil {
+			t.Fatalf("failed to uncross: %v", err)
+		}
+	}
+	parked := ob.Snapshot(ctx)
+	if len(parked.TriggeredStops) != 1 || parked.TriggeredStops[0].ID != stopID {
+		t.Fatalf("expected frank's stop to wait in the triggered queue, got %+v", parked.TriggeredStops)
+	}
+
+	restored = New(&obs.Client{})
+	restored.Restore(ctx, parked)
+	for _, book := range []*OrderBook{ob, restored} {
+		if err := book.SetMarketPhase(ctx, schemas.MarketPhaseContinuous); err != nil {
+			t.Fatalf("failed to open: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(ob.Snapshot(ctx), restored.Snapshot(ctx)) {
+		t.Fatalf("books diverged after running the parked stop")
+	}
+	if fills := restored.FillsForUser(ctx, "frank"); len(fills) != 1 || fills[0].Counterparty != "gina" {
+		t.Fatalf("expected the restored book to run frank's stop, got %+v", fills)
+	}
+}
+
+func TestAllocatorsSplitLevelDeterministically(t *testing.T) {
+	orders := []Order{{Amount: 10}, {Amount: 30}, {Amount: 60}}
+
+	cases := []struct {
+		config schemas.MatchingConfig
+		want   []int64
+	}{
+		{schemas.MatchingConfig{Algorithm: schemas.MatchingFIFO}, []int64{10, 15, 0}},
+		// 2.5 rounds to 2 and falls below the minimum, the 3 left over go out in time priority
+		{schemas.MatchingConfig{Algorithm: schemas.MatchingProRata, MinAllocation: 3}, []int64{3, 7, 15}},
+		{schemas.MatchingConfig{Algorithm: schemas.MatchingHybrid}, []int64{10, 5, 10}},
+	}
+	for _, tc := range cases {
+		got := newAllocator(tc.config).Allocate(orders, 25)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.config.Algorithm, tc.want, got)
+		}
+	}
+
+	if got := newAllocator(schemas.MatchingConfig{Algorithm: schemas.MatchingProRata}).Allocate(orders, 200); !reflect.DeepEqual(got, []int64{10, 30, 60}) {
+		t.Fatalf("expected whole level filled, got %v", got)
+	}
+}
+
+func TestProRataSharesDoNotOverflow(t *testing.T) {
+	allocator := newAllocator(schemas.MatchingConfig{Algorithm: schemas.MatchingProRata})
+
+	orders := []Order{{Amount: 4_000_000_000_000_000_000}, {Amount: 2_000_000_000_000_000_000}}
+	got := allocator.Allocate(orders, 3_000_000_000_000_000_000)
+	if !reflect.DeepEqual(got, []int64{2_000_000_000_000_000_000, 1_000_000_000_000_000_000}) {
+		t.Fatalf("expected shares of 2e18 and 1e18, got %v", got)
+	}
+
+	// the level total no longer fits in an int64
+	orders = []Order{{Amount: math.MaxInt64}, {Amount: math.MaxInt64}, {Amount: math.MaxInt64}, {Amount: math.MaxInt64}}
+	got = allocator.Allocate(orders, 8)
+	if !reflect.DeepEqual(got, []int64{2, 2, 2, 2}) {
+		t.Fatalf("expected an even split, got %v", got)
+	}
+}
+
+func TestProRataMatchingAcrossLevel(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	if err := ob.SetMatchingConfig(ctx, schemas.MatchingConfig{Algorithm: "lottery"}); err == nil {
+		t.Fatalf("expected unknown algorithm to be rejected")
+	}
+	if err := ob.SetMatchingConfig(ctx, schemas.MatchingConfig{Algorithm: schemas.MatchingProRata, MinAllocation: 3}); err != nil {
+		t.Fatalf("failed to set matching: %v", err)
+	}
+
+	ob.PostLimit(ctx, "a", uuid.New(), 100, 10, false)
+	ob.PostLimit(ctx, "b", uuid.New(), 100, 30, false)
+	ob.PostLimit(ctx, "c", uuid.New(), 100, 60, false)
+	resp := ob.PostLimit(ctx, "taker", uuid.New(), 100, 25, true)
+	if matchedSize(resp.Fills) != 25 {
+		t.Fatalf("expected 25 matched, got %+v", resp.Fills)
+	}
+
+	for user, want := range map[string]int64{"a": 7, "b": 23, "c": 45} {
+		open := ob.OpenOrdersForUser(ctx, user)
+		if len(open) != 1 || open[0].Amount != want {
+			t.Fatalf("expected %s to have %d left, got %+v", user, want, open)
+		}
+	}
+
+	// The level stays consistent for a follow-up sweep.
+	resp = ob.PostLimit(ctx, "taker", uuid.New(), 100, 75, true)
+	if matchedSize(resp.Fills) != 75 || len(ob.OpenOrdersForUser(ctx, "c")) != 0 {
+		t.Fatalf("expected sweep to clear the level, got %+v", resp.Fills)
+	}
+}
+
+func TestInstrumentRulesRejectWithReasons(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	if err := ob.SetInstrumentRules(ctx, schemas.InstrumentRules{TickSize: 0, LotSize: 1}); err == nil {
+		t.Fatalf("expected zero tick size to be rejected")
+	}
+	rules := schemas.InstrumentRules{TickSize: 5, LotSize: 10, MinSize: 20, MinNotional: 5000, MinPrice: 50, MaxPrice: 500}
+	if err := ob.SetInstrumentRules(ctx, rules); err != nil {
+		t.Fatalf("failed to set instrument rules: %v", err)
+	}
+
+	cases := []struct {
+		price  int64
+		amount int64
+		reason RejectReason
+	}{
+		{0, 20, RejectInvalidPrice},
+		{100, -10, RejectInvalidSize},
+		{101, 20, RejectTickSize},
+		{100, 25, RejectLotSize},
+		{100, 10, RejectMinSize},
+		{505, 20, RejectPriceOutOfBounds},
+		{45, 200, RejectPriceOutOfBounds},
+		{200, 20, RejectMinNotional},
+	}
+	for _, tc := range cases {
+		var rejectErr *OrderRejectError
+		err := ob.CheckOrderRules(tc.price, tc.amount)
+		if !errors.As(err, &rejectErr) || rejectErr.Reason != tc.reason {
+			t.Fatalf("price=%d amount=%d: expected %s, got %v", tc.price, tc.amount, tc.reason, err)
+		}
+	}
+	if err := ob.CheckOrderRules(250, 20); err != nil {
+		t.Fatalf("expected valid order to pass, got %v", err)
+	}
+	if err := ob.CheckSizeRules(15); err == nil {
+		t.Fatalf("expected stop size off the lot to be rejected")
+	}
+}
+
+func TestPostClientLimitIsIdempotentPerUser(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	ob.PostLimit(ctx, "maker", uuid.New(), 100, 2, false)
+	first := ob.PostClientLimit(ctx, "alice", "retry-me", uuid.New(), 100, 5, true)
+	again := ob.PostClientLimit(ctx, "alice", "retry-me", uuid.New(), 100, 5, true)
+	if again.OrderID != first.OrderID || matchedSize(again.Fills) != 2 {
+		t.Fatalf("expected replay of original result, got %+v vs %+v", again, first)
+	}
+	if open := ob.OpenOrdersForUser(ctx, "alice"); len(open) != 1 || open[0].ClientOrderID != "retry-me" {
+		t.Fatalf("expected one resting order tagged with the client id, got %+v", open)
+	}
+
+	// The same client id is independent per user.
+	other := ob.PostClientLimit(ctx, "bob", "retry-me", uuid.New(), 99, 1, true)
+	if other.OrderID == first.OrderID {
+		t.Fatalf("expected bob's order to be new")
+	}
+
+	if _, _, err := ob.CheckClientOrderReplay("alice", "retry-me", 101, 5, true); err == nil {
+		t.Fatalf("expected reuse with different params to be rejected")
+	}
+	orderID, err := ob.OrderIDForClient("alice", "retry-me")
+	if err != nil || orderID.String() != first.OrderID {
+		t.Fatalf("expected client id to resolve to %s, got %s err=%v", first.OrderID, orderID, err)
+	}
+}
+
+func TestOrderStatusTracksLifecycle(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	askID := uuid.New()
+	ob.AdvanceClock(1000)
+	ob.PostLimit(ctx, "maker", askID, 100, 5, false)
+	if status, ok := ob.OrderStatus(askID); !ok || status.State != OrderStateNew || status.CreatedAtMs != 1000 {
+		t.Fatalf("expected new order status, got %+v ok=%v", status, ok)
+	}
+
+	ob.AdvanceClock(2000)
+	ob.PostLimit(ctx, "taker", uuid.New(), 100, 2, true)
+	status, _ := ob.OrderStatus(askID)
+	if status.State != OrderStatePartiallyFilled || status.Filled != 2 || status.UpdatedAtMs != 2000 {
+		t.Fatalf("expected partial fill, got %+v", status)
+	}
+
+	ob.PostLimit(ctx, "taker", uuid.New(), 100, 3, true)
+	if status, _ := ob.OrderStatus(askID); status.State != OrderStateFilled || status.Filled != 5 {
+		t.Fatalf("expected filled order to stay queryable, got %+v", status)
+	}
+
+	cancelID := uuid.New()
+	ob.PostLimit(ctx, "maker", cancelID, 110, 1, false)
+	if _, err := ob.CancelLimitOrder(ctx, cancelID); err != nil {
+		t.Fatalf("failed to cancel: %v", err)
+	}
+	if status, _ := ob.OrderStatus(cancelID); status.State != OrderStateCancelled {
+		t.Fatalf("expected cancelled, got %+v", status)
+	}
+
+	expireID := uuid.New()
+	ob.RegisterSession(ctx, "maker", 1000)
+	ob.PostLimit(ctx, "maker", expireID, 120, 1, false)
+	ob.ExpireSession(ctx, "maker")
+	if status, _ := ob.OrderStatus(expireID); status.State != OrderStateExpired {
+		t.Fatalf("expected expired, got %+v", status)
+	}
+
+	rejectID := uuid.New()
+	ob.RecordRejectedOrder(ctx, Order{User: "maker", ID: rejectID, PriceLevel: 1, Amount: 1}, RejectPriceCollar)
+	if status, _ := ob.OrderStatus(rejectID); status.State != OrderStateRejected || status.RejectReason != RejectPriceCollar {
+		t.Fatalf("expected rejected, got %+v", status)
+	}
+
+	history := ob.OrderHistoryForUser(ctx, "maker", 10)
+	if len(history) != 4 || history[0].OrderID != rejectID || history[3].OrderID != askID {
+		t.Fatalf("expected newest-first history of 4 orders, got %+v", history)
+	}
+}
+
+func TestOrderHistoryRetentionEvictsOldestFinished(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+	ob.SetOrderHistoryLimit(2)
+
+	restingID := uuid.New()
+	ob.PostLimit(ctx, "alice", restingID, 90, 1, true)
+
+	var cancelled []uuid.UUID
+	for i := 0; i < 3; i++ {
+		orderID := uuid.New()
+		ob.PostLimit(ctx, "alice", orderID, 100, 1, false)
+		if _, err := ob.CancelLimitOrder(ctx, orderID); err != nil {
+			t.Fatalf("failed to cancel: %v", err)
+		}
+		cancelled = append(cancelled, orderID)
+	}
+
+	if _, ok := ob.OrderStatus(cancelled[0]); ok {
+		t.Fatalf("expected oldest finished order to be evicted")
+	}
+	if _, ok := ob.OrderStatus(restingID); !ok {
+		t.Fatalf("expected open order to be kept regardless of retention")
+	}
+	if history := ob.OrderHistoryForUser(ctx, "alice", 10); len(history) != 3 {
+		t.Fatalf("expected open order plus two finished orders, got %d", len(history))
+	}
+}
+
+func TestClientOrderIDsOutliveOrderHistory(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+	ob.SetOrderHistoryLimit(1)
+	ob.SetClientOrderRetention(2)
+
+	var ids []uuid.UUID
+	for i, clientOrderID := range []string{"a", "b", "c"} {
+		orderID := uuid.New()
+		ob.PostClientLimit(ctx, "alice", clientOrderID, orderID, int64(100+i), 1, false)
+		if _, err := ob.CancelLimitOrder(ctx, orderID); err != nil {
+			t.Fatalf("failed to cancel: %v", err)
+		}
+		ids = append(ids, orderID)
+	}
+
+	if _, ok := ob.OrderStatus(ids[1]); ok {
+		t.Fatalf("expected status of b to be evicted")
+	}
+	if _, replay, err := ob.CheckClientOrderReplay("alice", "b", 101, 1, false); err != nil || !replay {
+		t.Fatalf("expected b to still be recognised as a retry, replay=%v err=%v", replay, err)
+	}
+	if _, replay, _ := ob.CheckClientOrderReplay("alice", "a", 100, 1, false); replay {
+		t.Fatalf("expected a to be forgotten past the client order retention")
+	}
+
+	restored := New(&obs.Client{})
+	restored.SetClientOrderRetention(2)
+	restored.Restore(ctx, ob.Snapshot(ctx))
+	orderID := uuid.New()
+	restored.PostClientLimit(ctx, "alice", "d", orderID, 103, 1, false)
+	restored.CancelLimitOrder(ctx, orderID)
+	if _, replay, _ := restored.CheckClientOrderReplay("alice", "b", 101, 1, false); replay {
+		t.Fatalf("expected restored eviction queue to forget b next")
+	}
+}
+
+func TestLocalRejectsStayOutOfSnapshots(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	rejectID := uuid.New()
+	ob.RecordLocalReject(ctx, Order{User: "alice", ID: rejectID, PriceLevel: 100, Amount: 1}, RejectInsufficientBalance)
+	if status, ok := ob.OrderStatus(rejectID); !ok || status.State != OrderStateRejected || status.RejectReason != RejectInsufficientBalance {
+		t.Fatalf("expected local reject to be queryable, got %+v ok=%v", status, ok)
+	}
+	if history := ob.OrderHistoryForUser(ctx, "alice", 10); len(history) != 1 || history[0].OrderID != rejectID {
+		t.Fatalf("expected local reject in history, got %+v", history)
+	}
+
+	snapshot := ob.Snapshot(ctx)
+	if len(snapshot.OrderStatuses) != 0 || len(snapshot.FinishedOrders) != 0 {
+		t.Fatalf("expected local reject to be left out of the snapshot, got %+v", snapshot.OrderStatuses)
+	}
+
+	ob.SetOrderHistoryLimit(0)
+	if _, ok := ob.OrderStatus(rejectID); ok {
+		t.Fatalf("expected local reject to be evicted with the history limit")
+	}
+}
+
+func TestAmendLimitOrderKeepsOrLosesPriority(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	first, second := uuid.New(), uuid.New()
+	ob.PostLimit(ctx, "alice", first, 100, 5, false)
+	ob.PostLimit(ctx, "bob", second, 100, 5, false)
+
+	// shrinking at the same price keeps alice at the front
+	if _, err := ob.AmendLimitOrder(ctx, first, 100, 3); err != nil {
+		t.Fatalf("failed to amend: %v", err)
+	}
+	resp := ob.PostLimit(ctx, "taker", uuid.New(), 100, 2, true)
+	if matchedSize(resp.Fills) != 2 {
+		t.Fatalf("expected taker to fill 2, got %+v", resp.Fills)
+	}
+	if status, _ := ob.OrderStatus(first); status.Filled != 2 || status.Remaining() != 1 {
+		t.Fatalf("expected alice to keep priority, got %+v", status)
+	}
+
+	// growing the order sends it to the back of the level
+	if _, err := ob.AmendLimitOrder(ctx, first, 100, 4); err != nil {
+		t.Fatalf("failed to amend: %v", err)
+	}
+	ob.PostLimit(ctx, "taker", uuid.New(), 100, 5, true)
+	if status, _ := ob.OrderStatus(second); status.State != OrderStateFilled {
+		t.Fatalf("expected bob to fill first after alice requeued, got %+v", status)
+	}
+	if status, _ := ob.OrderStatus(first); status.Filled != 2 || status.Remaining() != 4 {
+		t.Fatalf("expected alice untouched, got %+v", status)
+	}
+
+	// repricing through the spread matches immediately
+	ob.PostLimit(ctx, "carol", uuid.New(), 95, 1, true)
+	amended, err := ob.AmendLimitOrder(ctx, first, 95, 4)
+	if err != nil || matchedSize(amended.Fills) != 1 {
+		t.Fatalf("expected amend to match the resting bid, got %+v err=%v", amended, err)
+	}
+	if open := ob.OpenOrdersForUser(ctx, "alice"); len(open) != 1 || open[0].Amount != 3 || open[0].PriceLevel != 95 {
+		t.Fatalf("unexpected resting order after amend: %+v", open)
+	}
+}
+
+func TestReplaceQuoteSwapsBothLegs(t *testing.T) {
+	ob := New(&obs.Client{})
+	ctx := context.Background()
+
+	first := Quote{QuoteID: "q1", BidOrderID: uuid.New(), BidPrice: 99, BidSize: 5, AskOrderID: uuid.New(), AskPrice: 101, AskSize: 5}
+	ob.ReplaceQuote(ctx, "mm", first)
+	ob.PostLimit(ctx, "taker", uuid.New(), 99, 2, false)
+
+	second := Quote{QuoteID: "q2", BidOrderID: uuid.New(), BidPrice: 98, BidSize: 4, AskOrderID: uuid.New(), AskPrice: 100, AskSize: 4}
+	resp := ob.ReplaceQuote(ctx, "mm", second)
+	if resp.ReplacedQuoteID != "q1" || resp.SizeCancelled != 8 {
+		t.Fatalf("expected remaining 3+5 of q1 cancelled, got %+v", resp)
+	}
+	open := ob.OpenOrdersForUser(ctx, "mm")
+	if len(open) != 2 {
+		t.Fatalf("expected only the new legs resting, got %+v", open)
+	}
+	if status, _ := ob.OrderStatus(first.BidOrderID); status.State != OrderStateCancelled || status.Filled != 2 {
+		t.Fatalf("expected old bid leg cancelled after partial fill, got %+v", status)
+	}
+
+	// a zero size pulls that side
+	pulled := Quote{QuoteID: "q3", AskOrderID: uuid.New(), AskPrice: 102, AskSize: 1}
+	ob.ReplaceQuote(ctx, "mm", pulled)
+	quote, bidRemaining, askRemaining, ok := ob.QuoteForUser("mm")
+	if !ok || quote.QuoteID != "q3" || quote.BidOrderID != uuid.Nil || bidRemaining != 0 || askRemaining != 1 {
+		t.Fatalf("unexpected quote after pulling the bid: %+v bid=%d ask=%d", quote, bidRemaining, askRemaining)
+	}
+
+	if err := ValidateQuote("q4", 101, 1, 100, 1); err == nil {
+		t.Fatalf("expected crossed quote to be rejected")
+	}
+}
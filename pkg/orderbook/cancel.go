@@ -0,0 +1,121 @@
+package orderbook
+
+import (
+	"context"
+	"sort"
+
+	"replicated-clob/schemas"
+
+	"github.com/google/uuid"
+)
+
+// CancelledOrders lists what a bulk cancel removed, in book priority order.
+type CancelledOrders struct {
+	OrderIDs      []uuid.UUID
+	SizeCancelled int64
+}
+
+// MassCancel cancels every resting order for a user matching the filter in one lock acquisition.
+// Trailing stops have no price, so they are only included when no price band is given.
+func (ob *OrderBook) MassCancel(ctx context.Context, user string, filter schemas.MassCancelFilter) CancelledOrders {
+	ob.obs.LogInfo(ctx, "orderbook.mass_cancel.start user=%s side=%s min_price=%d max_price=%d", user, filter.Side, filter.MinPrice, filter.MaxPrice)
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	cancelled := ob.massCancelLocked(user, filter, OrderStateCancelled)
+	ob.obs.LogInfo(ctx, "orderbook.mass_cancel.done user=%s cancelled=%d size_cancelled=%d", user, len(cancelled.OrderIDs), cancelled.SizeCancelled)
+	return cancelled
+}
+
+func (ob *OrderBook) massCancelLocked(user string, filter schemas.MassCancelFilter, state OrderState) CancelledOrders {
+	orderIDs := make([]uuid.UUID, 0)
+	for _, order := range ob.userOrdersLocked(user) {
+		if massCancelMatches(filter, order.IsBid, order.PriceLevel) {
+			orderIDs = append(orderIDs, order.ID)
+		}
+	}
+	if filter.MinPrice == 0 && filter.MaxPrice == 0 {
+		for _, stop := range ob.trailingStops {
+			if stop.User == user && massCancelMatches(filter, stop.IsBid, 0) {
+				orderIDs = append(orderIDs, stop.ID)
+			}
+		}
+	}
+
+	cancelled := CancelledOrders{OrderIDs: make([]uuid.UUID, 0, len(orderIDs))}
+	for _, orderID := range orderIDs {
+		size, err := ob.cancelOrderLocked(orderID, state)
+		if err != nil {
+			continue
+		}
+		cancelled.OrderIDs = append(cancelled.OrderIDs, orderID)
+		cancelled.SizeCancelled += size
+	}
+	return cancelled
+}
+
+func massCancelMatches(filter schemas.MassCancelFilter, isBid bool, priceLevel int64) bool {
+	if filter.Side != "" && filter.Side != takeSide(isBid) {
+		return false
+	}
+	if filter.MinPrice > 0 && priceLevel < filter.MinPrice {
+		return false
+	}
+	if filter.MaxPrice > 0 && priceLevel > filter.MaxPrice {
+		return false
+	}
+	return true
+}
+
+// userOrdersLocked returns a user's resting orders from the per-user index, bids then asks,
+// each in price-time priority.
+func (ob *OrderBook) userOrdersLocked(user string) []Order {
+	ids := ob.ordersByUser[user]
+	refs := make([]orderRef, 0, len(ids))
+	for orderID := range ids {
+		if ref, ok := ob.ordersByID[orderID]; ok {
+			refs = append(refs, ref)
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		a, b := refs[i], refs[j]
+		if a.isBid != b.isBid {
+			return a.isBid
+		}
+		if a.level.Price != b.level.Price {
+			if a.isBid {
+				return a.level.Price > b.level.Price
+			}
+			return a.level.Price < b.level.Price
+		}
+		return a.index < b.index
+	})
+
+	orders := make([]Order, 0, len(refs))
+	for _, ref := range refs {
+		orders = append(orders, ref.level.Orders[ref.index])
+	}
+	return orders
+}
+
+func (ob *OrderBook) indexUserOrder(user string, orderID uuid.UUID) {
+	orders, ok := ob.ordersByUser[user]
+	if !ok {
+		orders = map[uuid.UUID]struct{}{}
+		ob.ordersByUser[user] = orders
+	}
+	orders[orderID] = struct{}{}
+}
+
+func (ob *OrderBook) unindexUserOrder(user string, orderID uuid.UUID) {
+	orders, ok := ob.ordersByUser[user]
+	if !ok {
+		return
+	}
+	delete(orders, orderID)
+	if len(orders) == 0 {
+		delete(ob.ordersByUser, user)
+	}
+}
@@ -0,0 +1,124 @@
+package orderbook
+
+import (
+	"context"
+
+	"replicated-clob/schemas"
+
+	"github.com/google/uuid"
+)
+
+const maxClientOrderIDLength = 64
+
+const (
+	RejectInvalidClientOrderID RejectReason = "INVALID_CLIENT_ORDER_ID"
+	RejectClientOrderIDReused  RejectReason = "CLIENT_ORDER_ID_REUSED"
+	RejectUnknownClientOrderID RejectReason = "UNKNOWN_CLIENT_ORDER_ID"
+)
+
+// ClientOrder remembers an order posted with a client order ID along with the result it
+// produced, so a retried submission gets the original answer instead of a second order.
+type ClientOrder struct {
+	ClientOrderID string                    `json:"clientOrderId"`
+	OrderID       uuid.UUID                 `json:"orderId"`
+	PriceLevel    int64                     `json:"priceLevel"`
+	Amount        int64                     `json:"amount"`
+	IsBid         bool                      `json:"isBid"`
+	Result        schemas.PostLimitResponse `json:"result"`
+}
+
+// FinishedClientOrder is a client order ID whose order has finished, queued for eviction.
+type FinishedClientOrder struct {
+	User          string    `json:"user"`
+	ClientOrderID string    `json:"clientOrderId"`
+	OrderID       uuid.UUID `json:"orderId"`
+}
+
+func (c ClientOrder) matches(priceLevel int64, amount int64, isBid bool) bool {
+	return c.PriceLevel == priceLevel && c.Amount == amount && c.IsBid == isBid
+}
+
+func ValidateClientOrderID(clientOrderID string) error {
+	if len(clientOrderID) > maxClientOrderIDLength {
+		return rejectf(RejectInvalidClientOrderID, "clientOrderId must be at most %d characters", maxClientOrderIDLength)
+	}
+	return nil
+}
+
+// PostClientLimit posts a limit order tagged with a client order ID. A repeat of an ID the user
+// has already used returns the stored result without touching the book.
+func (ob *OrderBook) PostClientLimit(ctx context.Context, user string, clientOrderID string, orderID uuid.UUID, priceLevel int64, amount int64, isBid bool) schemas.PostLimitResponse {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if clientOrderID != "" {
+		if existing, ok := ob.clientOrders[user][clientOrderID]; ok {
+			ob.obs.LogInfo(ctx, "orderbook.post_limit.duplicate user=%s client_order_id=%s order_id=%s", user, clientOrderID, existing.OrderID)
+			return existing.Result
+		}
+	}
+
+	resp := ob.postLimitLocked(ctx, &Order{
+		User:          user,
+		ID:            orderID,
+		ClientOrderID: clientOrderID,
+		PriceLevel:    priceLevel,
+		Amount:        amount,
+		IsBid:         isBid,
+	})
+	if clientOrderID != "" {
+		if _, ok := ob.clientOrders[user]; !ok {
+			ob.clientOrders[user] = map[string]ClientOrder{}
+		}
+		ob.clientOrders[user][clientOrderID] = ClientOrder{
+			ClientOrderID: clientOrderID,
+			OrderID:       orderID,
+			PriceLevel:    priceLevel,
+			Amount:        amount,
+			IsBid:         isBid,
+			Result:        resp,
+		}
+	}
+	return resp
+}
+
+// CheckClientOrderReplay reports the stored result when a submission reuses a client order ID.
+// Reusing an ID for a different order is rejected rather than silently answered.
+func (ob *OrderBook) CheckClientOrderReplay(user string, clientOrderID string, priceLevel int64, amount int64, isBid bool) (schemas.PostLimitResponse, bool, error) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	existing, ok := ob.clientOrders[user][clientOrderID]
+	if !ok {
+		return schemas.PostLimitResponse{}, false, nil
+	}
+	if !existing.matches(priceLevel, amount, isBid) {
+		return schemas.PostLimitResponse{}, false, rejectf(RejectClientOrderIDReused, "clientOrderId %q was already used for a different order", clientOrderID)
+	}
+	return existing.Result, true, nil
+}
+
+// ClientOrder looks up an order by client order ID and reports what is still resting.
+func (ob *OrderBook) ClientOrder(user string, clientOrderID string) (ClientOrder, int64, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	existing, ok := ob.clientOrders[user][clientOrderID]
+	if !ok {
+		return ClientOrder{}, 0, false
+	}
+
+	return existing, ob.restingAmountLocked(existing.OrderID), true
+}
+
+// OrderIDForClient resolves a client order ID to the server order ID.
+func (ob *OrderBook) OrderIDForClient(user string, clientOrderID string) (uuid.UUID, error) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	existing, ok := ob.clientOrders[user][clientOrderID]
+	if !ok {
+		return uuid.Nil, rejectf(RejectUnknownClientOrderID, "no order with clientOrderId %q for user %s", clientOrderID, user)
+	}
+	return existing.OrderID, nil
+}
@@ -0,0 +1,27 @@
+package orderbook
+
+import "fmt"
+
+type RejectReason string
+
+const (
+	RejectInsufficientBalance RejectReason = "INSUFFICIENT_BALANCE"
+	RejectNoReferencePrice    RejectReason = "NO_REFERENCE_PRICE"
+)
+
+// OrderRejectError is returned by pre-trade checks so handlers can surface a stable reason code.
+type OrderRejectError struct {
+	Reason  RejectReason
+	Message string
+}
+
+func (e *OrderRejectError) Error() string {
+	return e.Message
+}
+
+func rejectf(reason RejectReason, format string, args ...any) *OrderRejectError {
+	return &OrderRejectError{
+		Reason:  reason,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
@@ -0,0 +1,174 @@
+package orderbook
+
+import (
+	"context"
+	"math/bits"
+
+	"replicated-clob/schemas"
+)
+
+const DefaultFeeTier = "default"
+
+const (
+	RejectUnknownFeeTier RejectReason = "UNKNOWN_FEE_TIER"
+	RejectInvalidFeeTier RejectReason = "INVALID_FEE_TIER"
+)
+
+// FeeTotals accumulates a user's traded volume and fees. Volume is notional in quote cents.
+type FeeTotals struct {
+	MakerVolume   int64 `json:"makerVolume"`
+	TakerVolume   int64 `json:"takerVolume"`
+	FeesPaid      int64 `json:"feesPaid"`
+	RebatesEarned int64 `json:"rebatesEarned"`
+}
+
+type FeeSummary struct {
+	Tier     string
+	Schedule schemas.FeeSchedule
+	FeeTotals
+}
+
+func CheckFeeTier(tier string, schedule schemas.FeeSchedule) error {
+	if tier == "" {
+		return rejectf(RejectInvalidFeeTier, "tier name is required")
+	}
+	if schedule.TakerBps < 0 || schedule.TakerBps > basisPointsPerUnit {
+		return rejectf(RejectInvalidFeeTier, "taker fee must be between 0 and %d bps", basisPointsPerUnit)
+	}
+	if schedule.MakerBps > basisPointsPerUnit {
+		return rejectf(RejectInvalidFeeTier, "maker fee must be at most %d bps, or negative for a rebate", basisPointsPerUnit)
+	}
+	// a rebate larger than the taker fee would pay out more than the trade collects
+	if -schedule.MakerBps > schedule.TakerBps {
+		return rejectf(RejectInvalidFeeTier, "maker rebate %d bps exceeds taker fee %d bps", -schedule.MakerBps, schedule.TakerBps)
+	}
+	return nil
+}
+
+func (ob *OrderBook) SetFeeTier(ctx context.Context, tier string, schedule schemas.FeeSchedule) error {
+	if err := CheckFeeTier(tier, schedule); err != nil {
+		return err
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.feeTiers[tier] = schedule
+	ob.obs.LogInfo(ctx, "orderbook.fees.tier_set tier=%s maker_bps=%d taker_bps=%d", tier, schedule.MakerBps, schedule.TakerBps)
+	return nil
+}
+
+// CheckFeeTierExists validates a tier assignment before it is replicated.
+func (ob *OrderBook) CheckFeeTierExists(tier string) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if _, ok := ob.feeTiers[tier]; !ok {
+		return rejectf(RejectUnknownFeeTier, "fee tier %q does not exist", tier)
+	}
+	return nil
+}
+
+// AssignFeeTier moves a user onto a tier. Assigning the default tier removes the override.
+func (ob *OrderBook) AssignFeeTier(ctx context.Context, user string, tier string) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if _, ok := ob.feeTiers[tier]; !ok {
+		return rejectf(RejectUnknownFeeTier, "fee tier %q does not exist", tier)
+	}
+	if tier == DefaultFeeTier {
+		delete(ob.feeTierUsers, user)
+	} else {
+		ob.feeTierUsers[user] = tier
+	}
+	ob.obs.LogInfo(ctx, "orderbook.fees.tier_assigned user=%s tier=%s", user, tier)
+	return nil
+}
+
+func (ob *OrderBook) FeeTiers() map[string]schemas.FeeSchedule {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	tiers := make(map[string]schemas.FeeSchedule, len(ob.feeTiers))
+	for tier, schedule := range ob.feeTiers {
+		tiers[tier] = schedule
+	}
+	return tiers
+}
+
+func (ob *OrderBook) FeeSummaryForUser(ctx context.Context, user string) FeeSummary {
+	ob.obs.LogInfo(ctx, "orderbook.fees.query user=%s", user)
+
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	tier := ob.feeTierLocked(user)
+	summary := FeeSummary{
+		Tier:     tier,
+		Schedule: ob.feeTiers[tier],
+	}
+	if totals, ok := ob.feeTotals[user]; ok {
+		summary.FeeTotals = *totals
+	}
+	return summary
+}
+
+func (ob *OrderBook) feeTierLocked(user string) string {
+	if tier, ok := ob.feeTierUsers[user]; ok {
+		if _, exists := ob.feeTiers[tier]; exists {
+			return tier
+		}
+	}
+	return DefaultFeeTier
+}
+
+// feeFor prices one leg of a trade from the user's tier at match time. Fees round up and rebates
+// round down so the venue never pays out more than it collects on a trade.
+func (ob *OrderBook) feeFor(user string, notional int64, isMaker bool) (int64, int64) {
+	schedule := ob.feeTiers[ob.feeTierLocked(user)]
+	bps := schedule.TakerBps
+	if isMaker {
+		bps = schedule.MakerBps
+	}
+
+	if bps >= 0 {
+		return bps, bpsOf(notional, bps, true)
+	}
+	return bps, -bpsOf(notional, -bps, false)
+}
+
+// bpsOf is notional*bps/basisPointsPerUnit for non-negative inputs. Like notional, it multiplies
+// in 128 bits, since order notionals reach well past where the product overflows int64. With bps
+// at most basisPointsPerUnit the result is never more than notional.
+func bpsOf(notional int64, bps int64, roundUp bool) int64 {
+	hi, lo := bits.Mul64(uint64(notional), uint64(bps))
+	if roundUp {
+		var carry uint64
+		lo, carry = bits.Add64(lo, basisPointsPerUnit-1, 0)
+		hi += carry
+	}
+	quotient, _ := bits.Div64(hi, lo, basisPointsPerUnit)
+	return int64(quotient)
+}
+
+// chargeFee debits the fee from quote, or credits the rebate, and adds the leg to the user's totals.
+func (ob *OrderBook) chargeFee(user string, notional int64, fee int64, isMaker bool) {
+	totals, ok := ob.feeTotals[user]
+	if !ok {
+		totals = &FeeTotals{}
+		ob.feeTotals[user] = totals
+	}
+
+	ob.account(user).Quote -= fee
+	if isMaker {
+		totals.MakerVolume += notional
+	} else {
+		totals.TakerVolume += notional
+	}
+	if fee >= 0 {
+		totals.FeesPaid += fee
+	} else {
+		totals.RebatesEarned -= fee
+	}
+}
@@ -15,26 +15,7 @@ func (ob *OrderBook) OpenOrdersForUser(ctx context.Context, user string) []Order
 		return []Order{}
 	}
 
-	orders := make([]Order, 0)
-	orders = append(orders, ob.collectOrdersForUser(user, true)...)
-	orders = append(orders, ob.collectOrdersForUser(user, false)...)
-
-	return orders
-}
-
-func (ob *OrderBook) collectOrdersForUser(user string, isBid bool) []Order {
-	levels := ob.sortedLevels(isBid)
-	orders := make([]Order, 0)
-
-	for _, level := range levels {
-		for _, order := range level.Orders {
-			if order.User == user && order.Amount > 0 {
-				orders = append(orders, order)
-			}
-		}
-	}
-
-	return orders
+	return ob.userOrdersLocked(user)
 }
 
 func (ob *OrderBook) sortedLevels(isBid bool) []*OrderbookLevel {
@@ -0,0 +1,127 @@
+package orderbook
+
+import (
+	"context"
+
+	"replicated-clob/schemas"
+)
+
+const (
+	RejectInvalidPrice      RejectReason = "INVALID_PRICE"
+	RejectInvalidSize       RejectReason = "INVALID_SIZE"
+	RejectTickSize          RejectReason = "TICK_SIZE"
+	RejectLotSize           RejectReason = "LOT_SIZE"
+	RejectMinSize           RejectReason = "MIN_SIZE"
+	RejectMinNotional       RejectReason = "MIN_NOTIONAL"
+	RejectPriceOutOfBounds  RejectReason = "PRICE_OUT_OF_BOUNDS"
+	RejectInvalidInstrument RejectReason = "INVALID_INSTRUMENT_RULES"
+	RejectNotionalOverflow  RejectReason = "NOTIONAL_OVERFLOW"
+)
+
+var defaultInstrumentRules = schemas.InstrumentRules{TickSize: 1, LotSize: 1}
+
+// ValidateOrderShape rejects prices and sizes no market could accept. Limit orders need a
+// positive price and a notional that fits in an int64; orders without one pass priceLevel 0 and
+// skip the price checks.
+func ValidateOrderShape(priceLevel int64, amount int64, hasPrice bool) error {
+	if hasPrice && priceLevel <= 0 {
+		return rejectf(RejectInvalidPrice, "price must be greater than 0, got %d", priceLevel)
+	}
+	if amount <= 0 {
+		return rejectf(RejectInvalidSize, "amount must be greater than 0, got %d", amount)
+	}
+	if _, ok := notional(priceLevel, amount); hasPrice && !ok {
+		return rejectf(RejectNotionalOverflow, "notional of %d at price %d is too large", amount, priceLevel)
+	}
+	return nil
+}
+
+func CheckInstrumentRules(rules schemas.InstrumentRules) error {
+	if rules.TickSize <= 0 || rules.LotSize <= 0 {
+		return rejectf(RejectInvalidInstrument, "tick size and lot size must be greater than 0")
+	}
+	if rules.MinSize < 0 || rules.MinNotional < 0 || rules.MinPrice < 0 || rules.MaxPrice < 0 {
+		return rejectf(RejectInvalidInstrument, "instrument limits must be non-negative")
+	}
+	if rules.MaxPrice > 0 && rules.MaxPrice < rules.MinPrice {
+		return rejectf(RejectInvalidInstrument, "max price %d is below min price %d", rules.MaxPrice, rules.MinPrice)
+	}
+	return nil
+}
+
+func (ob *OrderBook) InstrumentRules() schemas.InstrumentRules {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.instrument
+}
+
+// SetInstrumentRules applies to new orders only; resting orders keep their price and size.
+func (ob *OrderBook) SetInstrumentRules(ctx context.Context, rules schemas.InstrumentRules) error {
+	if err := CheckInstrumentRules(rules); err != nil {
+		return err
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.instrument = rules
+	ob.obs.LogInfo(
+		ctx,
+		"orderbook.instrument.set tick_size=%d lot_size=%d min_size=%d min_notional=%d min_price=%d max_price=%d",
+		rules.TickSize,
+		rules.LotSize,
+		rules.MinSize,
+		rules.MinNotional,
+		rules.MinPrice,
+		rules.MaxPrice,
+	)
+	return nil
+}
+
+// CheckOrderRules validates a limit order against the instrument before it is replicated.
+func (ob *OrderBook) CheckOrderRules(priceLevel int64, amount int64) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if err := ValidateOrderShape(priceLevel, amount, true); err != nil {
+		return err
+	}
+	if err := ob.checkSizeRulesLocked(amount); err != nil {
+		return err
+	}
+
+	rules := ob.instrument
+	if priceLevel%rules.TickSize != 0 {
+		return rejectf(RejectTickSize, "price %d is not a multiple of tick size %d", priceLevel, rules.TickSize)
+	}
+	if priceLevel < rules.MinPrice || (rules.MaxPrice > 0 && priceLevel > rules.MaxPrice) {
+		return rejectf(RejectPriceOutOfBounds, "price %d is outside [%d, %d]", priceLevel, rules.MinPrice, rules.MaxPrice)
+	}
+	if rules.MinNotional > 0 && priceLevel*amount < rules.MinNotional {
+		return rejectf(RejectMinNotional, "order notional %d is below min notional %d", priceLevel*amount, rules.MinNotional)
+	}
+	return nil
+}
+
+// CheckSizeRules validates the size of an order without a limit price, such as a trailing stop.
+func (ob *OrderBook) CheckSizeRules(amount int64) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if err := ValidateOrderShape(0, amount, false); err != nil {
+		return err
+	}
+	return ob.checkSizeRulesLocked(amount)
+}
+
+func (ob *OrderBook) checkSizeRulesLocked(amount int64) error {
+	rules := ob.instrument
+	if amount%rules.LotSize != 0 {
+		return rejectf(RejectLotSize, "amount %d is not a multiple of lot size %d", amount, rules.LotSize)
+	}
+	if amount < rules.MinSize {
+		return rejectf(RejectMinSize, "amount %d is below min size %d", amount, rules.MinSize)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package orderbook
+
+import (
+	"context"
+	"math"
+	"math/bits"
+)
+
+// Account balances are in base units and quote cents. Holds are the portion reserved by resting orders.
+type Account struct {
+	Base      int64 `json:"base"`
+	Quote     int64 `json:"quote"`
+	BaseHold  int64 `json:"baseHold"`
+	QuoteHold int64 `json:"quoteHold"`
+}
+
+func (a Account) AvailableBase() int64 {
+	return a.Base - a.BaseHold
+}
+
+func (a Account) AvailableQuote() int64 {
+	return a.Quote - a.QuoteHold
+}
+
+func (ob *OrderBook) Deposit(ctx context.Context, user string, base int64, quote int64) Account {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	account := ob.account(user)
+	account.Base += base
+	account.Quote += quote
+	ob.obs.LogInfo(ctx, "orderbook.ledger.deposit user=%s base=%d quote=%d", user, base, quote)
+
+	return *account
+}
+
+func (ob *OrderBook) Withdraw(ctx context.Context, user string, base int64, quote int64) (Account, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	account := ob.account(user)
+	if err := checkAvailable(user, *account, base, quote); err != nil {
+		ob.obs.LogInfo(ctx, "orderbook.ledger.withdraw.rejected user=%s base=%d quote=%d", user, base, quote)
+		return *account, err
+	}
+
+	account.Base -= base
+	account.Quote -= quote
+	ob.obs.LogInfo(ctx, "orderbook.ledger.withdraw user=%s base=%d quote=%d", user, base, quote)
+
+	return *account, nil
+}
+
+func (ob *OrderBook) AccountForUser(ctx context.Context, user string) Account {
+	ob.obs.LogInfo(ctx, "orderbook.ledger.query user=%s", user)
+
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if account, ok := ob.accounts[user]; ok {
+		return *account
+	}
+	return Account{}
+}
+
+// DefaultRequireCollateral makes a new book reject orders the user cannot fund.
+const DefaultRequireCollateral = true
+
+// CollateralChecks reports whether orders must be funded from available balance.
+func (ob *OrderBook) CollateralChecks() bool {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.requireCollateral
+}
+
+// SetCollateralChecks turns collateral enforcement on or off. Orders are checked again when they
+// apply, so the setting is part of the replicated state rather than a node-local option.
+func (ob *OrderBook) SetCollateralChecks(ctx context.Context, enabled bool) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.requireCollateral = enabled
+	ob.obs.LogInfo(ctx, "orderbook.ledger.collateral_checks enabled=%t", enabled)
+}
+
+// CheckWithdrawal validates a withdrawal against available balance before it is replicated.
+func (ob *OrderBook) CheckWithdrawal(user string, base int64, quote int64) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var account Account
+	if existing, ok := ob.accounts[user]; ok {
+		account = *existing
+	}
+	return checkAvailable(user, account, base, quote)
+}
+
+// CheckOrderCollateral validates that a limit order is fully funded at its limit price.
+// Bids need quote for price*amount plus the worst fee they can pay, asks need base for amount.
+func (ob *OrderBook) CheckOrderCollateral(user string, priceLevel int64, amount int64, isBid bool) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.checkOrderCollateralLocked(user, priceLevel, amount, isBid)
+}
+
+// CheckBatchCollateral is CheckOrderCollateral with the holds that earlier operations in the same
+// batch will add, or release when negative, counted against the user's balance.
+func (ob *OrderBook) CheckBatchCollateral(user string, pending Account, priceLevel int64, amount int64, isBid bool) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var account Account
+	if existing, ok := ob.accounts[user]; ok {
+		account = *existing
+	}
+	account.BaseHold += pending.BaseHold
+	account.QuoteHold += pending.QuoteHold
+
+	return ob.checkCollateralLocked(user, account, priceLevel, amount, isBid)
+}
+
+// CheckTrailingStopCollateral validates the hold a trailing stop will take, see holdForStop. A buy
+// stop is priced at its trigger, so it is rejected before the first trade gives it one.
+func (ob *OrderBook) CheckTrailingStopCollateral(user string, amount int64, isBid bool, trailOffset int64, trailBps int64) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if !isBid {
+		return ob.checkOrderCollateralLocked(user, 0, amount, false)
+	}
+	if ob.lastTradePrice <= 0 {
+		return rejectf(RejectNoReferencePrice, "a buy stop needs a last trade to price its hold")
+	}
+	stop := TrailingStop{IsBid: true, TrailOffset: trailOffset, TrailBps: trailBps}
+	trigger := stop.triggerFor(ob.lastTradePrice)
+	if _, ok := notional(trigger, amount); !ok {
+		return rejectf(RejectNotionalOverflow, "notional of %d at trigger %d is too large", amount, trigger)
+	}
+	return ob.checkOrderCollateralLocked(user, trigger, amount, true)
+}
+
+func (ob *OrderBook) checkOrderCollateralLocked(user string, priceLevel int64, amount int64, isBid bool) error {
+	var account Account
+	if existing, ok := ob.accounts[user]; ok {
+		account = *existing
+	}
+	return ob.checkCollateralLocked(user, account, priceLevel, amount, isBid)
+}
+
+func (ob *OrderBook) checkCollateralLocked(user string, account Account, priceLevel int64, amount int64, isBid bool) error {
+	if !isBid {
+		return checkAvailable(user, account, amount, 0)
+	}
+	holdPrice, ok := ob.bidHoldPriceLocked(user, priceLevel)
+	if !ok {
+		return rejectf(RejectNotionalOverflow, "price %d is too large to hold with fees", priceLevel)
+	}
+	quote, ok := notional(holdPrice, amount)
+	if !ok {
+		return rejectf(RejectNotionalOverflow, "notional of %d at price %d is too large to hold with fees", amount, priceLevel)
+	}
+	return checkAvailable(user, account, 0, quote)
+}
+
+// BidHoldPrice is the quote per unit a bid at priceLevel would hold for the user right now.
+func (ob *OrderBook) BidHoldPrice(user string, priceLevel int64) int64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if holdPrice, ok := ob.bidHoldPriceLocked(user, priceLevel); ok {
+		return holdPrice
+	}
+	return priceLevel
+}
+
+// bidHoldPriceLocked adds the worst fee the user's tier can charge, maker or taker, to each unit
+// of a bid. The fee is rounded up per unit, so no split of the bid into fills can cost more.
+func (ob *OrderBook) bidHoldPriceLocked(user string, priceLevel int64) (int64, bool) {
+	schedule := ob.feeTiers[ob.feeTierLocked(user)]
+	fee := bpsOf(priceLevel, max(schedule.TakerBps, schedule.MakerBps, 0), true)
+	if priceLevel > math.MaxInt64-fee {
+		return 0, false
+	}
+	return priceLevel + fee, true
+}
+
+func checkAvailable(user string, account Account, base int64, quote int64) error {
+	if base > 0 && account.AvailableBase() < base {
+		return rejectf(RejectInsufficientBalance, "insufficient base balance for user %s: required=%d available=%d", user, base, account.AvailableBase())
+	}
+	if quote > 0 && account.AvailableQuote() < quote {
+		return rejectf(RejectInsufficientBalance, "insufficient quote balance for user %s: required=%d available=%d", user, quote, account.AvailableQuote())
+	}
+	return nil
+}
+
+func (ob *OrderBook) account(user string) *Account {
+	account, ok := ob.accounts[user]
+	if !ok {
+		account = &Account{}
+		ob.accounts[user] = account
+	}
+	return account
+}
+
+// holdForOrder reserves what a resting order can spend, and must run before the order is added
+// to its level so the level keeps the bid's HoldPrice. A bid too large to hold with fees, which
+// only rests when collateral checks are off, holds its price.
+func (ob *OrderBook) holdForOrder(order *Order) {
+	account := ob.account(order.User)
+	if !order.IsBid {
+		account.BaseHold += order.Amount
+		return
+	}
+	order.HoldPrice = order.PriceLevel
+	if holdPrice, ok := ob.bidHoldPriceLocked(order.User, order.PriceLevel); ok {
+		if _, ok := notional(holdPrice, order.Amount); ok {
+			order.HoldPrice = holdPrice
+		}
+	}
+	account.QuoteHold += order.HoldPrice * order.Amount
+}
+
+// holdForStop reserves what a trailing stop can spend once it triggers. A sell stop holds its size.
+// A buy stop holds quote at its trigger when posted, the highest trigger it will have since buy
+// triggers only ratchet down, and never pays more than that price when it runs. A buy stop posted
+// before the first trade has nothing to price a hold at and runs unfunded.
+func (ob *OrderBook) holdForStop(stop *TrailingStop) {
+	account := ob.account(stop.User)
+	if !stop.IsBid {
+		account.BaseHold += stop.Amount
+		return
+	}
+	quote, ok := notional(stop.TriggerPrice, stop.Amount)
+	if stop.TriggerPrice <= 0 || !ok {
+		return
+	}
+	stop.HoldPrice = stop.TriggerPrice
+	if holdPrice, ok := ob.bidHoldPriceLocked(stop.User, stop.TriggerPrice); ok {
+		if withFee, ok := notional(holdPrice, stop.Amount); ok {
+			stop.HoldFee = withFee - quote
+		}
+	}
+	account.QuoteHold += quote + stop.HoldFee
+}
+
+func (ob *OrderBook) releaseStopHold(stop *TrailingStop) {
+	if !stop.IsBid {
+		ob.releaseHold(stop.User, 0, stop.Amount, false)
+		return
+	}
+	if stop.HoldPrice > 0 {
+		ob.releaseHold(stop.User, stop.HoldPrice, stop.Amount, true)
+		account := ob.account(stop.User)
+		account.QuoteHold = max(account.QuoteHold-stop.HoldFee, 0)
+	}
+}
+
+func (ob *OrderBook) releaseHold(user string, priceLevel int64, amount int64, isBid bool) {
+	account := ob.account(user)
+	if isBid {
+		account.QuoteHold = max(account.QuoteHold-priceLevel*amount, 0)
+		return
+	}
+	account.BaseHold = max(account.BaseHold-amount, 0)
+}
+
+// settleFill moves one leg of a trade. The caller releases whatever hold the order placed.
+func (ob *OrderBook) settleFill(user string, size int64, priceLevel int64, isBid bool) {
+	account := ob.account(user)
+	notional := size * priceLevel
+	if isBid {
+		account.Base += size
+		account.Quote -= notional
+	} else {
+		account.Base -= size
+		account.Quote += notional
+	}
+}
+
+// notional is priceLevel*amount, or false when either is negative or the product overflows.
+func notional(priceLevel int64, amount int64) (int64, bool) {
+	if priceLevel < 0 || amount < 0 {
+		return 0, false
+	}
+	hi, lo := bits.Mul64(uint64(priceLevel), uint64(amount))
+	if hi != 0 || lo > math.MaxInt64 {
+		return 0, false
+	}
+	return int64(lo), true
+}
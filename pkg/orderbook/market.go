@@ -0,0 +1,140 @@
+package orderbook
+
+import (
+	"context"
+
+	"replicated-clob/schemas"
+)
+
+const (
+	RejectMarketClosed      RejectReason = "MARKET_CLOSED"
+	RejectInvalidTransition RejectReason = "INVALID_PHASE_TRANSITION"
+	RejectWouldCross        RejectReason = "WOULD_CROSS"
+)
+
+// phaseTransitions lists the phases reachable through SetMarketPhase. Leaving an auction for
+// continuous trading or pre-open goes through UncrossAuction so the book is never left crossed.
+var phaseTransitions = map[schemas.MarketPhase][]schemas.MarketPhase{
+	schemas.MarketPhasePreOpen:    {schemas.MarketPhaseAuction, schemas.MarketPhaseContinuous, schemas.MarketPhaseHalted},
+	schemas.MarketPhaseAuction:    {schemas.MarketPhaseHalted},
+	schemas.MarketPhaseContinuous: {schemas.MarketPhaseAuction, schemas.MarketPhaseHalted, schemas.MarketPhasePreOpen},
+	schemas.MarketPhaseHalted:     {schemas.MarketPhaseAuction, schemas.MarketPhasePreOpen},
+}
+
+func (ob *OrderBook) MarketPhase() schemas.MarketPhase {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.phase
+}
+
+// CheckOrderEntry rejects new orders while the market is not collecting or matching them.
+// Pre-open collects orders for the opening auction without letting the book cross, so it only
+// takes orders that would rest without matching. Orders without a limit price pass priceLevel 0.
+// Cancels are always allowed.
+func (ob *OrderBook) CheckOrderEntry(priceLevel int64, isBid bool) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.checkOrderEntryLocked(priceLevel, isBid)
+}
+
+// CheckBatchOrderEntry is CheckOrderEntry for an order in a batch. In pre-open it must not cross
+// pending either, the prices of opposite orders accepted earlier in the batch.
+func (ob *OrderBook) CheckBatchOrderEntry(priceLevel int64, isBid bool, pending []int64) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if err := ob.checkOrderEntryLocked(priceLevel, isBid); err != nil {
+		return err
+	}
+	if ob.phase != schemas.MarketPhasePreOpen || priceLevel <= 0 {
+		return nil
+	}
+	for _, price := range pending {
+		if crosses(priceLevel, price, isBid) {
+			return rejectf(RejectWouldCross, "market is %s and price %d would cross an order at %d earlier in the batch", ob.phase, priceLevel, price)
+		}
+	}
+	return nil
+}
+
+func (ob *OrderBook) checkOrderEntryLocked(priceLevel int64, isBid bool) error {
+	switch ob.phase {
+	case schemas.MarketPhaseContinuous, schemas.MarketPhaseAuction:
+		return nil
+	case schemas.MarketPhasePreOpen:
+		if priceLevel > 0 && ob.crossesLocked(priceLevel, isBid) {
+			return rejectf(RejectWouldCross, "market is %s and price %d would cross the book", ob.phase, priceLevel)
+		}
+		return nil
+	default:
+		return rejectf(RejectMarketClosed, "market is %s", ob.phase)
+	}
+}
+
+// crossesLocked reports whether a limit order at priceLevel would match resting orders.
+func (ob *OrderBook) crossesLocked(priceLevel int64, isBid bool) bool {
+	for price, level := range ob.priceLevelsBySide(!isBid) {
+		if level.Amount <= 0 {
+			continue
+		}
+		if crosses(priceLevel, price, isBid) {
+			return true
+		}
+	}
+	return false
+}
+
+// crosses reports whether a limit order at priceLevel would match a resting price on the other side.
+func crosses(priceLevel int64, price int64, isBid bool) bool {
+	return (isBid && price <= priceLevel) || (!isBid && price >= priceLevel)
+}
+
+func (ob *OrderBook) CheckPhaseTransition(phase schemas.MarketPhase) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return checkPhaseTransition(ob.phase, phase)
+}
+
+func (ob *OrderBook) SetMarketPhase(ctx context.Context, phase schemas.MarketPhase) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if err := checkPhaseTransition(ob.phase, phase); err != nil {
+		return err
+	}
+	ob.setPhaseLocked(ctx, phase)
+	return nil
+}
+
+func (ob *OrderBook) setPhaseLocked(ctx context.Context, phase schemas.MarketPhase) {
+	previous := ob.phase
+	ob.phase = phase
+	ob.obs.LogInfo(ctx, "orderbook.market.phase from=%s to=%s", previous, phase)
+
+	// stops triggered by auction prints wait for continuous trading to execute
+	ob.executeTriggeredStops(ctx)
+}
+
+func checkPhaseTransition(from schemas.MarketPhase, to schemas.MarketPhase) error {
+	if !validPhase(to) {
+		return rejectf(RejectInvalidTransition, "unknown market phase %q", to)
+	}
+	for _, allowed := range phaseTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return rejectf(RejectInvalidTransition, "cannot move market from %s to %s", from, to)
+}
+
+func validPhase(phase schemas.MarketPhase) bool {
+	_, ok := phaseTransitions[phase]
+	return ok
+}
+
+func phaseError(phase schemas.MarketPhase, op string) error {
+	return rejectf(RejectInvalidTransition, "cannot %s while market is %s", op, phase)
+}
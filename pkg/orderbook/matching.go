@@ -0,0 +1,169 @@
+package orderbook
+
+import (
+	"context"
+	"math/big"
+	"math/bits"
+
+	"replicated-clob/schemas"
+)
+
+const RejectInvalidMatching RejectReason = "INVALID_MATCHING_CONFIG"
+
+// Allocator splits an incoming quantity across the orders resting at one price level. It
+// returns one fill per order in queue order. Allocations must depend only on the level and
+// quantity so every replica splits a trade the same way.
+type Allocator interface {
+	Allocate(orders []Order, quantity int64) []int64
+}
+
+// fifoAllocator fills orders strictly in time priority.
+type fifoAllocator struct{}
+
+func (fifoAllocator) Allocate(orders []Order, quantity int64) []int64 {
+	allocations := make([]int64, len(orders))
+	fillInQueueOrder(orders, allocations, quantity)
+	return allocations
+}
+
+// proRataAllocator shares quantity in proportion to resting size. Shares are rounded down and
+// dropped below minAllocation; what is left over goes out in time priority.
+type proRataAllocator struct {
+	minAllocation int64
+}
+
+func (a proRataAllocator) Allocate(orders []Order, quantity int64) []int64 {
+	allocations := make([]int64, len(orders))
+	a.allocateInto(orders, allocations, quantity)
+	return allocations
+}
+
+func (a proRataAllocator) allocateInto(orders []Order, allocations []int64, quantity int64) {
+	// the level total is kept in 128 bits, since resting sizes can sum past an int64
+	var totalHi, totalLo uint64
+	for _, order := range orders {
+		var carry uint64
+		totalLo, carry = bits.Add64(totalLo, uint64(max(order.Amount, 0)), 0)
+		totalHi += carry
+	}
+	if (totalHi == 0 && totalLo == 0) || quantity <= 0 {
+		return
+	}
+	if totalHi == 0 && uint64(quantity) >= totalLo {
+		for i, order := range orders {
+			allocations[i] = max(order.Amount, 0)
+		}
+		return
+	}
+
+	allocated := int64(0)
+	for i, order := range orders {
+		if order.Amount <= 0 {
+			continue
+		}
+		share := proRataShare(quantity, order.Amount, totalHi, totalLo)
+		if share < a.minAllocation {
+			continue
+		}
+		allocations[i] = share
+		allocated += share
+	}
+	fillInQueueOrder(orders, allocations, quantity-allocated)
+}
+
+// proRataShare is quantity*amount/total with the product in 128 bits, so large orders get the
+// same share on every replica instead of an overflowed one. quantity must be below the total.
+func proRataShare(quantity int64, amount int64, totalHi uint64, totalLo uint64) int64 {
+	if totalHi == 0 {
+		hi, lo := bits.Mul64(uint64(quantity), uint64(amount))
+		share, _ := bits.Div64(hi, lo, totalLo)
+		return int64(share)
+	}
+	total := new(big.Int).Lsh(new(big.Int).SetUint64(totalHi), 64)
+	total.Or(total, new(big.Int).SetUint64(totalLo))
+	share := new(big.Int).Mul(big.NewInt(quantity), big.NewInt(amount))
+	return share.Quo(share, total).Int64()
+}
+
+// hybridAllocator gives the order at the front of the queue priority up to its full size and
+// shares the remainder pro-rata across the rest of the level.
+type hybridAllocator struct {
+	proRata proRataAllocator
+}
+
+func (a hybridAllocator) Allocate(orders []Order, quantity int64) []int64 {
+	allocations := make([]int64, len(orders))
+	if len(orders) == 0 {
+		return allocations
+	}
+
+	allocations[0] = min(quantity, max(orders[0].Amount, 0))
+	a.proRata.allocateInto(orders[1:], allocations[1:], quantity-allocations[0])
+	return allocations
+}
+
+// fillInQueueOrder hands out quantity in time priority on top of existing allocations.
+func fillInQueueOrder(orders []Order, allocations []int64, quantity int64) {
+	for i, order := range orders {
+		if quantity <= 0 {
+			return
+		}
+		take := min(quantity, order.Amount-allocations[i])
+		if take <= 0 {
+			continue
+		}
+		allocations[i] += take
+		quantity -= take
+	}
+}
+
+func newAllocator(config schemas.MatchingConfig) Allocator {
+	switch config.Algorithm {
+	case schemas.MatchingProRata:
+		return proRataAllocator{minAllocation: config.MinAllocation}
+	case schemas.MatchingHybrid:
+		return hybridAllocator{proRata: proRataAllocator{minAllocation: config.MinAllocation}}
+	default:
+		return fifoAllocator{}
+	}
+}
+
+func CheckMatchingConfig(config schemas.MatchingConfig) error {
+	switch config.Algorithm {
+	case schemas.MatchingFIFO, schemas.MatchingProRata, schemas.MatchingHybrid:
+	default:
+		return rejectf(RejectInvalidMatching, "unknown matching algorithm %q", config.Algorithm)
+	}
+	if config.MinAllocation < 0 {
+		return rejectf(RejectInvalidMatching, "min allocation must be non-negative")
+	}
+	if config.Algorithm == schemas.MatchingFIFO && config.MinAllocation > 0 {
+		return rejectf(RejectInvalidMatching, "min allocation only applies to pro-rata matching")
+	}
+	return nil
+}
+
+func (ob *OrderBook) MatchingConfig() schemas.MatchingConfig {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.matching
+}
+
+func (ob *OrderBook) SetMatchingConfig(ctx context.Context, config schemas.MatchingConfig) error {
+	if err := CheckMatchingConfig(config); err != nil {
+		return err
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.setMatchingLocked(config)
+	ob.obs.LogInfo(ctx, "orderbook.matching.set algorithm=%s min_allocation=%d", config.Algorithm, config.MinAllocation)
+	return nil
+}
+
+func (ob *OrderBook) setMatchingLocked(config schemas.MatchingConfig) {
+	ob.matching = config
+	ob.allocator = newAllocator(config)
+}
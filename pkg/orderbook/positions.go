@@ -0,0 +1,95 @@
+package orderbook
+
+import "context"
+
+// Position is a user's net exposure. EntryNotional is the cost basis of the open position in
+// quote cents, so the average entry price is exact up to integer division at read time.
+type Position struct {
+	Net           int64 `json:"net"`
+	EntryNotional int64 `json:"entryNotional"`
+	RealizedPnL   int64 `json:"realizedPnl"`
+}
+
+func (p Position) AvgEntryPrice() int64 {
+	if p.Net == 0 {
+		return 0
+	}
+	return p.EntryNotional / abs(p.Net)
+}
+
+// UnrealizedPnL marks the open position at markPrice.
+func (p Position) UnrealizedPnL(markPrice int64) int64 {
+	if p.Net == 0 || markPrice <= 0 {
+		return 0
+	}
+	if p.Net > 0 {
+		return p.Net*markPrice - p.EntryNotional
+	}
+	return p.EntryNotional + p.Net*markPrice
+}
+
+// applyFill adds to the position at the fill price or closes against the average entry,
+// realizing the difference. A fill larger than the position flips it and opens the remainder
+// at the fill price.
+func (p *Position) applyFill(size int64, priceLevel int64, isBid bool) {
+	increasing := p.Net == 0 || (p.Net > 0) == isBid
+	if increasing {
+		p.EntryNotional += size * priceLevel
+		p.Net += signedSize(size, isBid)
+		return
+	}
+
+	closed := min(size, abs(p.Net))
+	basisClosed := p.EntryNotional * closed / abs(p.Net)
+	proceeds := closed * priceLevel
+	if p.Net > 0 {
+		p.RealizedPnL += proceeds - basisClosed
+	} else {
+		p.RealizedPnL += basisClosed - proceeds
+	}
+	p.EntryNotional -= basisClosed
+	p.Net += signedSize(closed, isBid)
+	if p.Net == 0 {
+		p.EntryNotional = 0
+	}
+
+	if remaining := size - closed; remaining > 0 {
+		p.Net = signedSize(remaining, isBid)
+		p.EntryNotional = remaining * priceLevel
+	}
+}
+
+func (ob *OrderBook) PositionForUser(ctx context.Context, user string) (Position, int64) {
+	ob.obs.LogInfo(ctx, "orderbook.positions.query user=%s", user)
+
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if position, ok := ob.positions[user]; ok {
+		return *position, ob.lastTradePrice
+	}
+	return Position{}, ob.lastTradePrice
+}
+
+func (ob *OrderBook) position(user string) *Position {
+	position, ok := ob.positions[user]
+	if !ok {
+		position = &Position{}
+		ob.positions[user] = position
+	}
+	return position
+}
+
+func (ob *OrderBook) netPositionLocked(user string) int64 {
+	if position, ok := ob.positions[user]; ok {
+		return position.Net
+	}
+	return 0
+}
+
+func signedSize(size int64, isBid bool) int64 {
+	if isBid {
+		return size
+	}
+	return -size
+}
@@ -0,0 +1,147 @@
+package orderbook
+
+import (
+	"context"
+
+	"replicated-clob/schemas"
+
+	"github.com/google/uuid"
+)
+
+const (
+	RejectInvalidQuote RejectReason = "INVALID_QUOTE"
+	RejectQuoteCrossed RejectReason = "QUOTE_CROSSED"
+)
+
+// Quote is a market maker's two-sided quote. Each leg is an ordinary resting limit order; a leg
+// with zero size is not quoted.
+type Quote struct {
+	QuoteID    string    `json:"quoteId"`
+	BidOrderID uuid.UUID `json:"bidOrderId"`
+	BidPrice   int64     `json:"bidPrice"`
+	BidSize    int64     `json:"bidSize"`
+	AskOrderID uuid.UUID `json:"askOrderId"`
+	AskPrice   int64     `json:"askPrice"`
+	AskSize    int64     `json:"askSize"`
+}
+
+// ValidateQuote checks a quote's shape before any book state is consulted. A quote may pull
+// one or both sides, but the legs it does quote must not cross each other.
+func ValidateQuote(quoteID string, bidPrice int64, bidSize int64, askPrice int64, askSize int64) error {
+	if len(quoteID) > maxClientOrderIDLength {
+		return rejectf(RejectInvalidQuote, "quoteId must be at most %d characters", maxClientOrderIDLength)
+	}
+	if bidSize < 0 || askSize < 0 {
+		return rejectf(RejectInvalidQuote, "quote sizes must be non-negative")
+	}
+	if bidSize > 0 {
+		if err := ValidateOrderShape(bidPrice, bidSize, true); err != nil {
+			return err
+		}
+	}
+	if askSize > 0 {
+		if err := ValidateOrderShape(askPrice, askSize, true); err != nil {
+			return err
+		}
+	}
+	if bidSize > 0 && askSize > 0 && bidPrice >= askPrice {
+		return rejectf(RejectQuoteCrossed, "quote bid %d must be below ask %d", bidPrice, askPrice)
+	}
+	return nil
+}
+
+// ReplaceQuote cancels whatever is left of the user's previous quote and posts the new legs under
+// a single lock, so no match or read ever sees one side replaced without the other.
+func (ob *OrderBook) ReplaceQuote(ctx context.Context, user string, quote Quote) schemas.QuoteResponse {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	resp := schemas.QuoteResponse{
+		BidFills: []schemas.PostLimitMatch{},
+		AskFills: []schemas.PostLimitMatch{},
+	}
+	if previous, ok := ob.quotes[user]; ok {
+		resp.ReplacedQuoteID = previous.QuoteID
+		for _, orderID := range []uuid.UUID{previous.BidOrderID, previous.AskOrderID} {
+			if _, resting := ob.ordersByID[orderID]; !resting {
+				continue
+			}
+			sizeCancelled, err := ob.cancelOrderLocked(orderID, OrderStateCancelled)
+			if err == nil {
+				resp.SizeCancelled += sizeCancelled
+			}
+		}
+	}
+
+	if quote.BidSize > 0 {
+		posted := ob.postLimitLocked(ctx, &Order{User: user, ID: quote.BidOrderID, PriceLevel: quote.BidPrice, Amount: quote.BidSize, IsBid: true})
+		resp.BidFills = append(resp.BidFills, posted.Fills...)
+	} else {
+		quote.BidOrderID, quote.BidPrice, quote.BidSize = uuid.Nil, 0, 0
+	}
+	if quote.AskSize > 0 {
+		posted := ob.postLimitLocked(ctx, &Order{User: user, ID: quote.AskOrderID, PriceLevel: quote.AskPrice, Amount: quote.AskSize, IsBid: false})
+		resp.AskFills = append(resp.AskFills, posted.Fills...)
+	} else {
+		quote.AskOrderID, quote.AskPrice, quote.AskSize = uuid.Nil, 0, 0
+	}
+
+	if quote.BidSize == 0 && quote.AskSize == 0 {
+		delete(ob.quotes, user)
+	} else {
+		ob.quotes[user] = quote
+	}
+	resp.Quote = quote.Response()
+
+	ob.obs.LogInfo(
+		ctx,
+		"orderbook.quote.replaced user=%s quote_id=%s replaced=%s size_cancelled=%d bid=%d@%d ask=%d@%d",
+		user,
+		quote.QuoteID,
+		resp.ReplacedQuoteID,
+		resp.SizeCancelled,
+		quote.BidSize,
+		quote.BidPrice,
+		quote.AskSize,
+		quote.AskPrice,
+	)
+	return resp
+}
+
+// QuoteForUser returns the user's current quote and how much of each leg is still resting.
+func (ob *OrderBook) QuoteForUser(user string) (Quote, int64, int64, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	quote, ok := ob.quotes[user]
+	if !ok {
+		return Quote{}, 0, 0, false
+	}
+	return quote, ob.restingAmountLocked(quote.BidOrderID), ob.restingAmountLocked(quote.AskOrderID), true
+}
+
+func (ob *OrderBook) restingAmountLocked(orderID uuid.UUID) int64 {
+	ref, ok := ob.ordersByID[orderID]
+	if !ok || ref.index >= len(ref.level.Orders) {
+		return 0
+	}
+	return ref.level.Orders[ref.index].Amount
+}
+
+// Response renders the quote for the API.
+func (q Quote) Response() schemas.Quote {
+	resp := schemas.Quote{
+		QuoteID:  q.QuoteID,
+		BidPrice: q.BidPrice,
+		BidSize:  q.BidSize,
+		AskPrice: q.AskPrice,
+		AskSize:  q.AskSize,
+	}
+	if q.BidOrderID != uuid.Nil {
+		resp.BidOrderID = q.BidOrderID.String()
+	}
+	if q.AskOrderID != uuid.Nil {
+		resp.AskOrderID = q.AskOrderID.String()
+	}
+	return resp
+}
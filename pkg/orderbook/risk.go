@@ -0,0 +1,173 @@
+package orderbook
+
+import (
+	"context"
+
+	"replicated-clob/schemas"
+
+	"github.com/google/uuid"
+)
+
+const (
+	RejectUserBlocked   RejectReason = "USER_BLOCKED"
+	RejectMaxOrderSize  RejectReason = "MAX_ORDER_SIZE"
+	RejectMaxNotional   RejectReason = "MAX_NOTIONAL"
+	RejectMaxOpenOrders RejectReason = "MAX_OPEN_ORDERS"
+	RejectMaxPosition   RejectReason = "MAX_POSITION"
+)
+
+type userRisk struct {
+	limits  schemas.RiskLimits
+	blocked bool
+}
+
+// PendingOrders is what orders accepted but not yet applied will do for a user: the open orders
+// they add, and how far each side could move the position if they fill.
+type PendingOrders struct {
+	OpenOrders int64
+	Bought     int64
+	Sold       int64
+}
+
+type RiskState struct {
+	Limits     schemas.RiskLimits
+	Blocked    bool
+	OpenOrders int64
+	Position   int64
+}
+
+func (ob *OrderBook) SetRiskLimits(ctx context.Context, user string, limits schemas.RiskLimits) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.userRisk(user).limits = limits
+	ob.obs.LogInfo(
+		ctx,
+		"orderbook.risk.limits_set user=%s max_order_size=%d max_notional=%d max_open_orders=%d max_position=%d",
+		user,
+		limits.MaxOrderSize,
+		limits.MaxNotional,
+		limits.MaxOpenOrders,
+		limits.MaxPosition,
+	)
+}
+
+// SetUserBlocked flips the kill switch for a user. Blocking also cancels every resting order and
+// trailing stop the user has, in the same apply, so no replica can observe a blocked user with
+// live orders.
+func (ob *OrderBook) SetUserBlocked(ctx context.Context, user string, blocked bool) CancelledOrders {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.userRisk(user).blocked = blocked
+	if !blocked {
+		ob.obs.LogInfo(ctx, "orderbook.risk.unblocked user=%s", user)
+		return CancelledOrders{OrderIDs: []uuid.UUID{}}
+	}
+
+	cancelled := ob.massCancelLocked(user, schemas.MassCancelFilter{}, OrderStateCancelled)
+	ob.obs.LogInfo(ctx, "orderbook.risk.blocked user=%s cancelled=%d size_cancelled=%d", user, len(cancelled.OrderIDs), cancelled.SizeCancelled)
+	return cancelled
+}
+
+func (ob *OrderBook) RiskStateForUser(ctx context.Context, user string) RiskState {
+	ob.obs.LogInfo(ctx, "orderbook.risk.query user=%s", user)
+
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	state := RiskState{
+		OpenOrders: int64(len(ob.ordersByUser[user])),
+		Position:   ob.netPositionLocked(user),
+	}
+	if risk, ok := ob.riskByUser[user]; ok {
+		state.Limits = risk.limits
+		state.Blocked = risk.blocked
+	}
+	return state
+}
+
+// CheckRiskLimits validates an order against the user's configured limits. Position is checked
+// as if the order fully fills. A zero priceLevel skips the notional check for orders without a
+// limit price.
+func (ob *OrderBook) CheckRiskLimits(user string, priceLevel int64, amount int64, isBid bool) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.checkRiskLimitsLocked(user, priceLevel, amount, isBid, true, PendingOrders{})
+}
+
+// CheckAmendRiskLimits checks the new shape of an amended order. The order is already open, so
+// it does not count against the open order cap again.
+func (ob *OrderBook) CheckAmendRiskLimits(user string, priceLevel int64, amount int64, isBid bool) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.checkRiskLimitsLocked(user, priceLevel, amount, isBid, false, PendingOrders{})
+}
+
+// CheckBatchRiskLimits checks an order on top of the orders accepted before it in the same
+// batch. Each side of the position is checked as if every pending order on that side fills.
+func (ob *OrderBook) CheckBatchRiskLimits(user string, priceLevel int64, amount int64, isBid bool, opensOrder bool, pending PendingOrders) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.checkRiskLimitsLocked(user, priceLevel, amount, isBid, opensOrder, pending)
+}
+
+func (ob *OrderBook) checkRiskLimitsLocked(user string, priceLevel int64, amount int64, isBid bool, opensOrder bool, pending PendingOrders) error {
+	risk, ok := ob.riskByUser[user]
+	if !ok {
+		return nil
+	}
+	if risk.blocked {
+		return rejectf(RejectUserBlocked, "user %s is blocked by kill switch", user)
+	}
+
+	limits := risk.limits
+	if limits.MaxOrderSize > 0 && amount > limits.MaxOrderSize {
+		return rejectf(RejectMaxOrderSize, "order size %d exceeds max order size %d", amount, limits.MaxOrderSize)
+	}
+	if limits.MaxNotional > 0 && priceLevel > 0 && priceLevel*amount > limits.MaxNotional {
+		return rejectf(RejectMaxNotional, "order notional %d exceeds max notional %d", priceLevel*amount, limits.MaxNotional)
+	}
+	openOrders := int64(len(ob.ordersByUser[user])) + pending.OpenOrders
+	if opensOrder && limits.MaxOpenOrders > 0 && openOrders >= limits.MaxOpenOrders {
+		return rejectf(RejectMaxOpenOrders, "user %s has %d open orders, max is %d", user, openOrders, limits.MaxOpenOrders)
+	}
+	if limits.MaxPosition > 0 {
+		position := ob.netPositionLocked(user)
+		long, short := position+pending.Bought, position-pending.Sold
+		if isBid {
+			long += amount
+			short += amount
+		} else {
+			long -= amount
+			short -= amount
+		}
+		if long > limits.MaxPosition {
+			return rejectf(RejectMaxPosition, "resulting position %d exceeds max position %d", long, limits.MaxPosition)
+		}
+		if -short > limits.MaxPosition {
+			return rejectf(RejectMaxPosition, "resulting position %d exceeds max position %d", short, limits.MaxPosition)
+		}
+	}
+
+	return nil
+}
+
+func (ob *OrderBook) userRisk(user string) *userRisk {
+	risk, ok := ob.riskByUser[user]
+	if !ok {
+		risk = &userRisk{}
+		ob.riskByUser[user] = risk
+	}
+	return risk
+}
+
+func abs(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
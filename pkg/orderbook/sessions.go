@@ -0,0 +1,77 @@
+package orderbook
+
+import (
+	"context"
+	"sort"
+
+	"replicated-clob/schemas"
+)
+
+// Session is a registered cancel-on-disconnect session. Only the registration is replicated;
+// heartbeats are tracked by whichever node is primary.
+type Session struct {
+	User      string `json:"user"`
+	TimeoutMs int64  `json:"timeoutMs"`
+}
+
+func (ob *OrderBook) RegisterSession(ctx context.Context, user string, timeoutMs int64) Session {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	session := Session{
+		User:      user,
+		TimeoutMs: timeoutMs,
+	}
+	ob.sessions[user] = session
+	ob.obs.LogInfo(ctx, "orderbook.session.registered user=%s timeout_ms=%d", user, timeoutMs)
+
+	return session
+}
+
+// EndSession removes a session without touching the user's orders.
+func (ob *OrderBook) EndSession(ctx context.Context, user string) bool {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	_, ok := ob.sessions[user]
+	delete(ob.sessions, user)
+	ob.obs.LogInfo(ctx, "orderbook.session.ended user=%s existed=%v", user, ok)
+
+	return ok
+}
+
+// ExpireSession removes a session and cancels everything the user has resting, including
+// trailing stops, as one state transition.
+func (ob *OrderBook) ExpireSession(ctx context.Context, user string) CancelledOrders {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	delete(ob.sessions, user)
+	cancelled := ob.massCancelLocked(user, schemas.MassCancelFilter{}, OrderStateExpired)
+	ob.obs.LogInfo(ctx, "orderbook.session.expired user=%s cancelled=%d size_cancelled=%d", user, len(cancelled.OrderIDs), cancelled.SizeCancelled)
+
+	return cancelled
+}
+
+func (ob *OrderBook) Session(user string) (Session, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	session, ok := ob.sessions[user]
+	return session, ok
+}
+
+// Sessions returns every registered session ordered by user.
+func (ob *OrderBook) Sessions() []Session {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	sessions := make([]Session, 0, len(ob.sessions))
+	for _, session := range ob.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].User < sessions[j].User
+	})
+	return sessions
+}
@@ -0,0 +1,254 @@
+package orderbook
+
+import (
+	"context"
+	"sort"
+
+	"replicated-clob/schemas"
+
+	"github.com/google/uuid"
+)
+
+// Snapshot is the full replicated state of the book. Restoring it and applying the entries
+// after its sequence yields the same state as replaying the whole log.
+type Snapshot struct {
+	Orders        []Order        `json:"orders"`
+	TrailingStops []TrailingStop `json:"trailingStops"`
+	// TriggeredStops are stops waiting for continuous trading to execute, in queue order
+	TriggeredStops []TrailingStop                    `json:"triggeredStops"`
+	LastTradePrice int64                             `json:"lastTradePrice"`
+	TradeSeq       int64                             `json:"tradeSeq"`
+	Fills          map[string][]UserFill             `json:"fills"`
+	ClientOrders   map[string]map[string]ClientOrder `json:"clientOrders"`
+	// FinishedClientOrders is the eviction queue for ClientOrders, oldest first
+	FinishedClientOrders []FinishedClientOrder          `json:"finishedClientOrders"`
+	Quotes               map[string]Quote               `json:"quotes"`
+	OrderStatuses        []OrderStatus                  `json:"orderStatuses"`
+	FinishedOrders       []uuid.UUID                    `json:"finishedOrders"`
+	Accounts             map[string]Account             `json:"accounts"`
+	Risk                 map[string]RiskSnapshot        `json:"risk"`
+	Positions            map[string]Position            `json:"positions"`
+	Sessions             map[string]Session             `json:"sessions"`
+	Phase                schemas.MarketPhase            `json:"phase"`
+	Matching             schemas.MatchingConfig         `json:"matching"`
+	Instrument           schemas.InstrumentRules        `json:"instrument"`
+	PriceBands           schemas.PriceBands             `json:"priceBands"`
+	RequireCollateral    bool                           `json:"requireCollateral"`
+	ClockMs              int64                          `json:"clockMs"`
+	RecentTrades         []TradeMark                    `json:"recentTrades"`
+	FeeTiers             map[string]schemas.FeeSchedule `json:"feeTiers"`
+	FeeTierUsers         map[string]string              `json:"feeTierUsers"`
+	FeeTotals            map[string]FeeTotals           `json:"feeTotals"`
+}
+
+type RiskSnapshot struct {
+	Limits  schemas.RiskLimits `json:"limits"`
+	Blocked bool               `json:"blocked"`
+}
+
+func (ob *OrderBook) Snapshot(ctx context.Context) Snapshot {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	snapshot := Snapshot{
+		Orders:               []Order{},
+		TrailingStops:        make([]TrailingStop, 0, len(ob.trailingStops)),
+		TriggeredStops:       make([]TrailingStop, 0, len(ob.triggeredStops)),
+		LastTradePrice:       ob.lastTradePrice,
+		TradeSeq:             ob.tradeSeq,
+		Fills:                make(map[string][]UserFill, len(ob.fillsByUser)),
+		ClientOrders:         make(map[string]map[string]ClientOrder, len(ob.clientOrders)),
+		FinishedClientOrders: append([]FinishedClientOrder{}, ob.finishedClientOrders...),
+		Quotes:               make(map[string]Quote, len(ob.quotes)),
+		OrderStatuses:        make([]OrderStatus, 0, len(ob.orderStatuses)),
+		FinishedOrders:       append([]uuid.UUID{}, ob.finishedOrders...),
+		Accounts:             make(map[string]Account, len(ob.accounts)),
+		Risk:                 make(map[string]RiskSnapshot, len(ob.riskByUser)),
+		Positions:            make(map[string]Position, len(ob.positions)),
+		Sessions:             make(map[string]Session, len(ob.sessions)),
+		Phase:                ob.phase,
+		Matching:             ob.matching,
+		Instrument:           ob.instrument,
+		PriceBands:           ob.priceBands,
+		RequireCollateral:    ob.requireCollateral,
+		ClockMs:              ob.clockMs,
+		RecentTrades:         append([]TradeMark{}, ob.recentTrades...),
+		FeeTiers:             make(map[string]schemas.FeeSchedule, len(ob.feeTiers)),
+		FeeTierUsers:         make(map[string]string, len(ob.feeTierUsers)),
+		FeeTotals:            make(map[string]FeeTotals, len(ob.feeTotals)),
+	}
+
+	// levels in price priority and orders in queue order, so restoring preserves time priority
+	for _, isBid := range []bool{true, false} {
+		for _, level := range ob.sortedLevels(isBid) {
+			for _, order := range level.Orders {
+				if order.Amount > 0 {
+					snapshot.Orders = append(snapshot.Orders, order)
+				}
+			}
+		}
+	}
+	for _, stop := range ob.trailingStops {
+		snapshot.TrailingStops = append(snapshot.TrailingStops, *stop)
+	}
+	for _, stop := range ob.triggeredStops {
+		snapshot.TriggeredStops = append(snapshot.TriggeredStops, *stop)
+	}
+	for user, fills := range ob.fillsByUser {
+		snapshot.Fills[user] = append([]UserFill{}, fills...)
+	}
+	for user, orders := range ob.clientOrders {
+		snapshot.ClientOrders[user] = make(map[string]ClientOrder, len(orders))
+		for clientOrderID, order := range orders {
+			snapshot.ClientOrders[user][clientOrderID] = order
+		}
+	}
+	for user, quote := range ob.quotes {
+		snapshot.Quotes[user] = quote
+	}
+	// statuses per user in creation order, so restoring rebuilds the same history lists
+	users := make([]string, 0, len(ob.orderHistory))
+	for user := range ob.orderHistory {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		for _, orderID := range ob.orderHistory[user] {
+			if status, ok := ob.orderStatuses[orderID]; ok {
+				snapshot.OrderStatuses = append(snapshot.OrderStatuses, *status)
+			}
+		}
+	}
+	for user, account := range ob.accounts {
+		snapshot.Accounts[user] = *account
+	}
+	for user, risk := range ob.riskByUser {
+		snapshot.Risk[user] = RiskSnapshot{Limits: risk.limits, Blocked: risk.blocked}
+	}
+	for user, position := range ob.positions {
+		snapshot.Positions[user] = *position
+	}
+	for user, session := range ob.sessions {
+		snapshot.Sessions[user] = session
+	}
+	for tier, schedule := range ob.feeTiers {
+		snapshot.FeeTiers[tier] = schedule
+	}
+	for user, tier := range ob.feeTierUsers {
+		snapshot.FeeTierUsers[user] = tier
+	}
+	for user, totals := range ob.feeTotals {
+		snapshot.FeeTotals[user] = *totals
+	}
+
+	ob.obs.LogInfo(ctx, "orderbook.snapshot.taken orders=%d stops=%d users=%d", len(snapshot.Orders), len(snapshot.TrailingStops), len(snapshot.Accounts))
+	return snapshot
+}
+
+// Restore replaces the book with a snapshot. Holds are carried in the snapshot accounts, so
+// orders are re-added without placing new holds.
+func (ob *OrderBook) Restore(ctx context.Context, snapshot Snapshot) {
+	fresh := New(ob.obs)
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.bids = fresh.bids
+	ob.asks = fresh.asks
+	ob.bidsByPrice = fresh.bidsByPrice
+	ob.asksByPrice = fresh.asksByPrice
+	ob.ordersByID = fresh.ordersByID
+	ob.ordersByUser = fresh.ordersByUser
+	ob.clientOrders = fresh.clientOrders
+	ob.finishedClientOrders = append([]FinishedClientOrder{}, snapshot.FinishedClientOrders...)
+	ob.quotes = fresh.quotes
+	ob.orderStatuses = fresh.orderStatuses
+	ob.orderHistory = fresh.orderHistory
+	ob.finishedOrders = append([]uuid.UUID{}, snapshot.FinishedOrders...)
+	// local rejects belong to the history lists the snapshot replaces
+	ob.localRejects = fresh.localRejects
+	ob.localRejectOrder = nil
+	ob.trailingStops = nil
+	ob.stopsByID = map[uuid.UUID]*TrailingStop{}
+	ob.triggeredStops = nil
+	ob.lastTradePrice = snapshot.LastTradePrice
+	ob.tradeSeq = snapshot.TradeSeq
+	ob.fillsByUser = map[string][]UserFill{}
+	ob.accounts = map[string]*Account{}
+	ob.riskByUser = map[string]*userRisk{}
+	ob.positions = map[string]*Position{}
+	ob.sessions = map[string]Session{}
+	ob.phase = snapshot.Phase
+	ob.priceBands = snapshot.PriceBands
+	ob.requireCollateral = snapshot.RequireCollateral
+	ob.clockMs = snapshot.ClockMs
+	ob.recentTrades = append([]TradeMark{}, snapshot.RecentTrades...)
+	ob.feeTiers = map[string]schemas.FeeSchedule{DefaultFeeTier: {}}
+	ob.feeTierUsers = map[string]string{}
+	ob.feeTotals = map[string]*FeeTotals{}
+
+	for i := range snapshot.Orders {
+		order := snapshot.Orders[i]
+		ob.addOrder(&order)
+	}
+	for i := range snapshot.TrailingStops {
+		stop := snapshot.TrailingStops[i]
+		ob.trailingStops = append(ob.trailingStops, &stop)
+		ob.stopsByID[stop.ID] = &stop
+	}
+	// triggered stops have already left stopsByID, so they can no longer be cancelled
+	for i := range snapshot.TriggeredStops {
+		stop := snapshot.TriggeredStops[i]
+		ob.triggeredStops = append(ob.triggeredStops, &stop)
+	}
+	for user, fills := range snapshot.Fills {
+		ob.fillsByUser[user] = append([]UserFill{}, fills...)
+	}
+	for user, orders := range snapshot.ClientOrders {
+		ob.clientOrders[user] = make(map[string]ClientOrder, len(orders))
+		for clientOrderID, order := range orders {
+			ob.clientOrders[user][clientOrderID] = order
+		}
+	}
+	for user, quote := range snapshot.Quotes {
+		ob.quotes[user] = quote
+	}
+	for _, status := range snapshot.OrderStatuses {
+		ob.orderStatuses[status.OrderID] = &status
+		ob.orderHistory[status.User] = append(ob.orderHistory[status.User], status.OrderID)
+	}
+	for user, account := range snapshot.Accounts {
+		ob.accounts[user] = &account
+	}
+	for user, risk := range snapshot.Risk {
+		ob.riskByUser[user] = &userRisk{limits: risk.Limits, blocked: risk.Blocked}
+	}
+	for user, position := range snapshot.Positions {
+		ob.positions[user] = &position
+	}
+	for user, session := range snapshot.Sessions {
+		ob.sessions[user] = session
+	}
+	for tier, schedule := range snapshot.FeeTiers {
+		ob.feeTiers[tier] = schedule
+	}
+	for user, tier := range snapshot.FeeTierUsers {
+		ob.feeTierUsers[user] = tier
+	}
+	for user, totals := range snapshot.FeeTotals {
+		ob.feeTotals[user] = &totals
+	}
+	if ob.phase == "" {
+		ob.phase = schemas.MarketPhaseContinuous
+	}
+	if snapshot.Matching.Algorithm == "" {
+		snapshot.Matching.Algorithm = schemas.MatchingFIFO
+	}
+	ob.setMatchingLocked(snapshot.Matching)
+	ob.instrument = snapshot.Instrument
+	if CheckInstrumentRules(ob.instrument) != nil {
+		ob.instrument = defaultInstrumentRules
+	}
+
+	ob.obs.LogInfo(ctx, "orderbook.snapshot.restored orders=%d stops=%d users=%d", len(snapshot.Orders), len(snapshot.TrailingStops), len(snapshot.Accounts))
+}
@@ -0,0 +1,289 @@
+package orderbook
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+type OrderState string
+
+const (
+	OrderStateNew             OrderState = "new"
+	OrderStatePartiallyFilled OrderState = "partially_filled"
+	OrderStateFilled          OrderState = "filled"
+	OrderStateCancelled       OrderState = "cancelled"
+	OrderStateExpired         OrderState = "expired"
+	OrderStateRejected        OrderState = "rejected"
+)
+
+const (
+	OrderKindLimit        = "limit"
+	OrderKindTrailingStop = "trailing_stop"
+)
+
+// DefaultOrderHistoryLimit bounds how many finished orders the book remembers. Open orders are
+// always kept; the oldest finished orders are forgotten first.
+const DefaultOrderHistoryLimit = 10000
+
+// DefaultClientOrderRetention bounds how many finished orders keep their client order ID for
+// duplicate detection. It is well past the history limit, so a late retry is still recognised
+// after the order's status has been forgotten.
+const DefaultClientOrderRetention = 100000
+
+// OrderStatus is the lifecycle record for an order. Timestamps come from the book clock so
+// every replica records the same values.
+type OrderStatus struct {
+	OrderID       uuid.UUID    `json:"orderId"`
+	ClientOrderID string       `json:"clientOrderId,omitempty"`
+	User          string       `json:"user"`
+	Kind          string       `json:"kind"`
+	State         OrderState   `json:"state"`
+	PriceLevel    int64        `json:"priceLevel,omitempty"`
+	Amount        int64        `json:"amount"`
+	Filled        int64        `json:"filled"`
+	IsBid         bool         `json:"isBid"`
+	RejectReason  RejectReason `json:"rejectReason,omitempty"`
+	CreatedAtMs   int64        `json:"createdAtMs"`
+	UpdatedAtMs   int64        `json:"updatedAtMs"`
+}
+
+// Open reports whether the order is still resting or armed.
+func (s OrderStatus) Open() bool {
+	return !s.State.terminal()
+}
+
+// Remaining is the size still open on the order.
+func (s OrderStatus) Remaining() int64 {
+	if !s.Open() {
+		return 0
+	}
+	return s.Amount - s.Filled
+}
+
+func (s OrderState) terminal() bool {
+	switch s {
+	case OrderStateFilled, OrderStateCancelled, OrderStateExpired, OrderStateRejected:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ob *OrderBook) OrderStatus(orderID uuid.UUID) (OrderStatus, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	status, ok := ob.statusLocked(orderID)
+	if !ok {
+		return OrderStatus{}, false
+	}
+	return *status, true
+}
+
+func (ob *OrderBook) statusLocked(orderID uuid.UUID) (*OrderStatus, bool) {
+	if status, ok := ob.orderStatuses[orderID]; ok {
+		return status, true
+	}
+	status, ok := ob.localRejects[orderID]
+	return status, ok
+}
+
+// OrderHistoryForUser returns the user's remembered orders, newest first, up to limit.
+func (ob *OrderBook) OrderHistoryForUser(ctx context.Context, user string, limit int) []OrderStatus {
+	ob.obs.LogInfo(ctx, "orderbook.history.query user=%s limit=%d", user, limit)
+
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	ids := ob.orderHistory[user]
+	history := make([]OrderStatus, 0, min(len(ids), limit))
+	for i := len(ids) - 1; i >= 0 && len(history) < limit; i-- {
+		if status, ok := ob.statusLocked(ids[i]); ok {
+			history = append(history, *status)
+		}
+	}
+	return history
+}
+
+// RecordRejectedOrder stores a committed order that failed its checks when it applied, so it can
+// be looked up like any other order.
+func (ob *OrderBook) RecordRejectedOrder(ctx context.Context, order Order, reason RejectReason) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	status := ob.trackOrder(order, OrderKindLimit)
+	status.RejectReason = reason
+	ob.setOrderState(status, OrderStateRejected)
+	ob.obs.LogInfo(ctx, "orderbook.history.rejected user=%s order_id=%s reason=%s", order.User, order.ID, reason)
+}
+
+// RecordLocalReject stores an order this node rejected before giving it a sequence. The reject is
+// not replicated, so it is kept out of snapshots and out of the finished order retention, which
+// must forget the same orders on every node. Local rejects have their own retention of the same
+// size.
+func (ob *OrderBook) RecordLocalReject(ctx context.Context, order Order, reason RejectReason) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	status := ob.newOrderStatus(order, OrderKindLimit)
+	status.State = OrderStateRejected
+	status.RejectReason = reason
+	ob.localRejects[order.ID] = status
+	ob.localRejectOrder = append(ob.localRejectOrder, order.ID)
+	ob.orderHistory[order.User] = append(ob.orderHistory[order.User], order.ID)
+	ob.evictLocalRejects()
+	ob.obs.LogInfo(ctx, "orderbook.history.rejected_local user=%s order_id=%s reason=%s", order.User, order.ID, reason)
+}
+
+func (ob *OrderBook) evictLocalRejects() {
+	for len(ob.localRejectOrder) > ob.historyLimit {
+		orderID := ob.localRejectOrder[0]
+		ob.localRejectOrder = ob.localRejectOrder[1:]
+
+		if status, ok := ob.localRejects[orderID]; ok {
+			delete(ob.localRejects, orderID)
+			ob.forgetHistory(status.User, orderID)
+		}
+	}
+}
+
+func (ob *OrderBook) trackOrder(order Order, kind string) *OrderStatus {
+	status := ob.newOrderStatus(order, kind)
+	ob.orderStatuses[order.ID] = status
+	ob.orderHistory[order.User] = append(ob.orderHistory[order.User], order.ID)
+	return status
+}
+
+func (ob *OrderBook) newOrderStatus(order Order, kind string) *OrderStatus {
+	return &OrderStatus{
+		OrderID:       order.ID,
+		ClientOrderID: order.ClientOrderID,
+		User:          order.User,
+		Kind:          kind,
+		State:         OrderStateNew,
+		PriceLevel:    order.PriceLevel,
+		Amount:        order.Amount,
+		IsBid:         order.IsBid,
+		CreatedAtMs:   ob.clockMs,
+		UpdatedAtMs:   ob.clockMs,
+	}
+}
+
+// noteOrderFill records a fill against an order with remaining size left to fill.
+func (ob *OrderBook) noteOrderFill(orderID uuid.UUID, matched int64, remaining int64) {
+	status, ok := ob.orderStatuses[orderID]
+	if !ok {
+		return
+	}
+	status.Filled += matched
+	if remaining == 0 {
+		ob.setOrderState(status, OrderStateFilled)
+		return
+	}
+	ob.setOrderState(status, OrderStatePartiallyFilled)
+}
+
+func (ob *OrderBook) finishOrder(orderID uuid.UUID, state OrderState) {
+	if status, ok := ob.orderStatuses[orderID]; ok {
+		ob.setOrderState(status, state)
+	}
+}
+
+func (ob *OrderBook) setOrderState(status *OrderStatus, state OrderState) {
+	wasTerminal := status.State.terminal()
+	status.State = state
+	status.UpdatedAtMs = ob.clockMs
+	if state.terminal() && !wasTerminal {
+		ob.finishedOrders = append(ob.finishedOrders, status.OrderID)
+		ob.evictFinishedOrders()
+		ob.retireClientOrder(status)
+	}
+}
+
+// evictFinishedOrders forgets the oldest finished orders beyond the retention limit. Their client
+// order IDs are kept longer, see retireClientOrder.
+func (ob *OrderBook) evictFinishedOrders() {
+	for len(ob.finishedOrders) > ob.historyLimit {
+		orderID := ob.finishedOrders[0]
+		ob.finishedOrders = ob.finishedOrders[1:]
+
+		status, ok := ob.orderStatuses[orderID]
+		if !ok {
+			continue
+		}
+		delete(ob.orderStatuses, orderID)
+		ob.forgetHistory(status.User, orderID)
+	}
+}
+
+func (ob *OrderBook) forgetHistory(user string, orderID uuid.UUID) {
+	ids := ob.orderHistory[user]
+	for i, id := range ids {
+		if id == orderID {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(ob.orderHistory, user)
+	} else {
+		ob.orderHistory[user] = ids
+	}
+}
+
+// retireClientOrder queues a finished order's client order ID for eviction once
+// clientOrderLimit newer finished orders have queued behind it. Until then a retry with the ID
+// still gets the original result.
+func (ob *OrderBook) retireClientOrder(status *OrderStatus) {
+	if status.ClientOrderID == "" {
+		return
+	}
+	// an order rejected when it applied never took the ID, which a later order may hold
+	if existing, ok := ob.clientOrders[status.User][status.ClientOrderID]; !ok || existing.OrderID != status.OrderID {
+		return
+	}
+	ob.finishedClientOrders = append(ob.finishedClientOrders, FinishedClientOrder{
+		User:          status.User,
+		ClientOrderID: status.ClientOrderID,
+		OrderID:       status.OrderID,
+	})
+	ob.evictClientOrders()
+}
+
+func (ob *OrderBook) evictClientOrders() {
+	for len(ob.finishedClientOrders) > ob.clientOrderLimit {
+		finished := ob.finishedClientOrders[0]
+		ob.finishedClientOrders = ob.finishedClientOrders[1:]
+
+		orders, ok := ob.clientOrders[finished.User]
+		if !ok || orders[finished.ClientOrderID].OrderID != finished.OrderID {
+			continue
+		}
+		delete(orders, finished.ClientOrderID)
+		if len(orders) == 0 {
+			delete(ob.clientOrders, finished.User)
+		}
+	}
+}
+
+// SetOrderHistoryLimit changes how many finished orders are retained. Retention decides what
+// lookups can see, so every node in a cluster must run with the same limit.
+func (ob *OrderBook) SetOrderHistoryLimit(limit int) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.historyLimit = max(limit, 0)
+	ob.evictFinishedOrders()
+	ob.evictLocalRejects()
+}
+
+// SetClientOrderRetention changes how many finished orders keep their client order ID for
+// duplicate detection. Like the history limit it must be the same on every node.
+func (ob *OrderBook) SetClientOrderRetention(limit int) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.clientOrderLimit = max(limit, 0)
+	ob.evictClientOrders()
+}
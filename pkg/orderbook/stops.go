@@ -0,0 +1,186 @@
+package orderbook
+
+import (
+	"context"
+
+	"replicated-clob/schemas"
+
+	"github.com/google/uuid"
+)
+
+const basisPointsPerUnit = 10000
+
+func (ob *OrderBook) PostTrailingStop(ctx context.Context, user string, stopID uuid.UUID, amount int64, isBid bool, trailOffset int64, trailBps int64) TrailingStop {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	stop := &TrailingStop{
+		User:        user,
+		ID:          stopID,
+		Amount:      amount,
+		IsBid:       isBid,
+		TrailOffset: trailOffset,
+		TrailBps:    trailBps,
+	}
+	if ob.lastTradePrice > 0 {
+		stop.arm(ob.lastTradePrice, ob.tradeSeq)
+	}
+	ob.holdForStop(stop)
+
+	ob.trailingStops = append(ob.trailingStops, stop)
+	ob.stopsByID[stop.ID] = stop
+	ob.trackOrder(Order{User: user, ID: stopID, Amount: amount, IsBid: isBid}, OrderKindTrailingStop)
+	ob.obs.LogInfo(ctx, "orderbook.trailing_stop.added user=%s stop_id=%s side=%s amount=%d trigger=%d", stop.User, stop.ID, takeSide(stop.IsBid), stop.Amount, stop.TriggerPrice)
+
+	return *stop
+}
+
+func (ob *OrderBook) TrailingStopsForUser(ctx context.Context, user string) []TrailingStop {
+	ob.obs.LogInfo(ctx, "orderbook.trailing_stops.query user=%s", user)
+
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	stops := make([]TrailingStop, 0)
+	for _, stop := range ob.trailingStops {
+		if stop.User == user {
+			stops = append(stops, *stop)
+		}
+	}
+	return stops
+}
+
+func (ob *OrderBook) LastTradePrice() int64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.lastTradePrice
+}
+
+// onTrade ratchets every armed stop with the printed price and queues the ones it crosses.
+// Stops are walked in creation order so replicas applying the same trade sequence trigger
+// the same stops in the same order.
+func (ob *OrderBook) onTrade(ctx context.Context, price int64) {
+	ob.tradeSeq++
+	ob.lastTradePrice = price
+	ob.markTrade(price)
+
+	if len(ob.trailingStops) == 0 {
+		return
+	}
+
+	remaining := ob.trailingStops[:0]
+	for _, stop := range ob.trailingStops {
+		if stop.ArmedAtTrade == 0 {
+			stop.arm(price, ob.tradeSeq)
+			remaining = append(remaining, stop)
+			continue
+		}
+
+		stop.ratchet(price)
+		if !stop.triggeredBy(price) {
+			remaining = append(remaining, stop)
+			continue
+		}
+
+		delete(ob.stopsByID, stop.ID)
+		ob.triggeredStops = append(ob.triggeredStops, stop)
+		ob.obs.LogInfo(ctx, "orderbook.trailing_stop.triggered user=%s stop_id=%s trade_seq=%d price=%d trigger=%d", stop.User, stop.ID, ob.tradeSeq, price, stop.TriggerPrice)
+	}
+	for i := len(remaining); i < len(ob.trailingStops); i++ {
+		ob.trailingStops[i] = nil
+	}
+	ob.trailingStops = remaining
+}
+
+// executeTriggeredStops sends triggered stops to the book as immediate-or-cancel market orders,
+// with a funded buy stop limited to the price of its hold.
+// Their trades may trigger further stops, which are appended and drained in the same pass.
+// Outside continuous trading the queue is held until the market reopens.
+func (ob *OrderBook) executeTriggeredStops(ctx context.Context) {
+	// a breaker tripped by one stop leaves the rest queued until trading resumes
+	for len(ob.triggeredStops) > 0 && ob.phase == schemas.MarketPhaseContinuous {
+		stop := ob.triggeredStops[0]
+		ob.triggeredStops[0] = nil
+		ob.triggeredStops = ob.triggeredStops[1:]
+
+		incoming := &Order{
+			User:   stop.User,
+			ID:     stop.ID,
+			Amount: stop.Amount,
+			IsBid:  stop.IsBid,
+		}
+		// the stop spends its own hold, so release it before the fills settle
+		ob.releaseStopHold(stop)
+		fills := ob.matchIncoming(ctx, incoming, func(levelPrice int64) bool {
+			return stop.HoldPrice == 0 || levelPrice <= stop.HoldPrice
+		})
+		ob.obs.LogInfo(ctx, "orderbook.trailing_stop.executed user=%s stop_id=%s fills=%d unfilled=%d", stop.User, stop.ID, len(fills), incoming.Amount)
+		// stops execute immediate-or-cancel, so an unfilled remainder expires
+		if incoming.Amount > 0 {
+			ob.finishOrder(stop.ID, OrderStateExpired)
+		}
+	}
+	if len(ob.triggeredStops) == 0 {
+		ob.triggeredStops = nil
+	}
+}
+
+func (ob *OrderBook) removeTrailingStop(stopID uuid.UUID) (TrailingStop, bool) {
+	stop, ok := ob.stopsByID[stopID]
+	if !ok {
+		return TrailingStop{}, false
+	}
+	delete(ob.stopsByID, stopID)
+
+	for i, candidate := range ob.trailingStops {
+		if candidate == stop {
+			copy(ob.trailingStops[i:], ob.trailingStops[i+1:])
+			ob.trailingStops[len(ob.trailingStops)-1] = nil
+			ob.trailingStops = ob.trailingStops[:len(ob.trailingStops)-1]
+			break
+		}
+	}
+
+	return *stop, true
+}
+
+func (s *TrailingStop) arm(price int64, tradeSeq int64) {
+	s.ReferencePrice = price
+	s.TriggerPrice = s.triggerFor(price)
+	s.ArmedAtTrade = tradeSeq
+}
+
+// ratchet only ever moves the trigger in the stop's favour: up for sells, down for buys.
+func (s *TrailingStop) ratchet(price int64) {
+	if s.IsBid && price >= s.ReferencePrice {
+		return
+	}
+	if !s.IsBid && price <= s.ReferencePrice {
+		return
+	}
+
+	s.ReferencePrice = price
+	s.TriggerPrice = s.triggerFor(price)
+}
+
+func (s *TrailingStop) triggeredBy(price int64) bool {
+	if s.IsBid {
+		return price >= s.TriggerPrice
+	}
+	return price <= s.TriggerPrice
+}
+
+func (s *TrailingStop) triggerFor(reference int64) int64 {
+	offset := s.TrailOffset
+	if offset <= 0 {
+		offset = reference * s.TrailBps / basisPointsPerUnit
+	}
+	// never trail at zero distance, otherwise the arming trade would trigger the stop
+	offset = max(offset, 1)
+
+	if s.IsBid {
+		return reference + offset
+	}
+	return reference - offset
+}
@@ -2,6 +2,7 @@ package orderbook
 
 import (
 	"replicated-clob/pkg/obs"
+	"replicated-clob/schemas"
 	"sync"
 
 	"github.com/google/uuid"
@@ -9,11 +10,22 @@ import (
 
 // track orders in PTP
 type Order struct {
-	User       string    `json:"user"`
-	ID         uuid.UUID `json:"orderId"`
-	PriceLevel int64     `json:"priceLevel"` // store price in cents
-	Amount     int64     `json:"amount"`
-	IsBid      bool      `json:"isBid"`
+	User          string    `json:"user"`
+	ID            uuid.UUID `json:"orderId"`
+	ClientOrderID string    `json:"clientOrderId,omitempty"`
+	PriceLevel    int64     `json:"priceLevel"` // store price in cents
+	Amount        int64     `json:"amount"`
+	IsBid         bool      `json:"isBid"`
+	// HoldPrice is the quote per unit a resting bid holds, its price plus the worst fee it can pay
+	HoldPrice int64 `json:"holdPrice,omitempty"`
+}
+
+// holdPrice is what each unit of a resting bid releases. Orders without a HoldPrice hold their price.
+func (o Order) holdPrice() int64 {
+	if o.HoldPrice > 0 {
+		return o.HoldPrice
+	}
+	return o.PriceLevel
 }
 
 type OrderbookLevel struct {
@@ -27,6 +39,26 @@ type UserFill struct {
 	Size         int64  `json:"size"`
 	PriceLevel   int64  `json:"priceLevel"`
 	IsMaker      bool   `json:"isMaker"`
+	Fee          int64  `json:"fee"`    // quote cents charged, negative for a rebate
+	FeeBps       int64  `json:"feeBps"` // rate applied at match time
+}
+
+// TrailingStop is held outside the resting book until the last trade crosses its trigger.
+// Sell stops trail the highest trade seen since arming, buy stops trail the lowest.
+type TrailingStop struct {
+	User           string    `json:"user"`
+	ID             uuid.UUID `json:"stopId"`
+	Amount         int64     `json:"amount"`
+	IsBid          bool      `json:"isBid"`
+	TrailOffset    int64     `json:"trailOffset,omitempty"` // fixed offset in cents
+	TrailBps       int64     `json:"trailBps,omitempty"`    // offset in basis points of the reference price
+	ReferencePrice int64     `json:"referencePrice"`
+	TriggerPrice   int64     `json:"triggerPrice"`
+	ArmedAtTrade   int64     `json:"armedAtTrade"`
+	// HoldPrice is the quote per unit a buy stop holds, and the most it pays once triggered
+	HoldPrice int64 `json:"holdPrice,omitempty"`
+	// HoldFee is the quote a buy stop holds on top of HoldPrice for the fees its fills can pay
+	HoldFee int64 `json:"holdFee,omitempty"`
 }
 
 type orderRef struct {
@@ -42,6 +74,43 @@ type OrderBook struct {
 	asksByPrice map[int64]*OrderbookLevel
 	ordersByID  map[uuid.UUID]orderRef
 	fillsByUser map[string][]UserFill
-	obs         *obs.Client
-	mu          sync.RWMutex
+	// trailing stops in creation order so trigger evaluation is identical on every replica
+	trailingStops  []*TrailingStop
+	stopsByID      map[uuid.UUID]*TrailingStop
+	triggeredStops []*TrailingStop
+	lastTradePrice int64
+	tradeSeq       int64
+	accounts       map[string]*Account
+	riskByUser     map[string]*userRisk
+	ordersByUser   map[string]map[uuid.UUID]struct{}
+	clientOrders   map[string]map[string]ClientOrder
+	quotes         map[string]Quote
+	// lifecycle records for open orders and the most recent finished ones
+	orderStatuses  map[uuid.UUID]*OrderStatus
+	orderHistory   map[string][]uuid.UUID
+	finishedOrders []uuid.UUID
+	historyLimit   int
+	// client order IDs of finished orders, oldest first, kept for duplicate detection
+	finishedClientOrders []FinishedClientOrder
+	clientOrderLimit     int
+	// orders this node rejected before sequencing them, which no other node knows about
+	localRejects     map[uuid.UUID]*OrderStatus
+	localRejectOrder []uuid.UUID
+	positions        map[string]*Position
+	sessions         map[string]Session
+	phase            schemas.MarketPhase
+	matching         schemas.MatchingConfig
+	instrument       schemas.InstrumentRules
+	allocator        Allocator
+	priceBands       schemas.PriceBands
+	// requireCollateral is replicated, so every node checks committed orders the same way
+	requireCollateral bool
+	// clockMs is the latest primary timestamp applied, so breaker windows agree across replicas
+	clockMs      int64
+	recentTrades []TradeMark
+	feeTiers     map[string]schemas.FeeSchedule
+	feeTierUsers map[string]string
+	feeTotals    map[string]*FeeTotals
+	obs          *obs.Client
+	mu           sync.RWMutex
 }
@@ -0,0 +1,231 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	catchUpBatchSize  = 500
+	catchUpMinBackoff = 50 * time.Millisecond
+	catchUpMaxBackoff = 5 * time.Second
+)
+
+const DefaultSnapshotCatchUpLag = 10000
+
+// PeerProgress is the primary's view of how far a follower has got. MatchSeq is the highest
+// sequence the follower has acknowledged applying; NextSeq is the next entry catch-up would send
+// it. Lag is how far MatchSeq trails the primary's applied sequence when reported.
+type PeerProgress struct {
+	Peer       string `json:"peer"`
+	MatchSeq   int64  `json:"matchSeq"`
+	NextSeq    int64  `json:"nextSeq"`
+	Lag        int64  `json:"lag"`
+	CatchingUp bool   `json:"catchingUp"`
+	Learner    bool   `json:"learner,omitempty"`
+	// Failures counts requests missed in a row; LastError is the most recent one.
+	Failures      int    `json:"failures"`
+	LastError     string `json:"lastError,omitempty"`
+	LastContactMs int64  `json:"lastContactMs,omitempty"`
+}
+
+// SnapshotSource returns the applied state and the sequence it was taken at.
+type SnapshotSource func(context.Context) (ReplicaSnapshotResponse, error)
+
+// ReplicaResponseError is a peer answering a replica request with a non-200 status.
+type ReplicaResponseError struct {
+	Peer   string
+	Path   string
+	Status int
+	Body   string
+}
+
+func (e *ReplicaResponseError) Error() string {
+	return fmt.Sprintf("replica response rejected peer=%s path=%s status=%d body=%s", e.Peer, e.Path, e.Status, e.Body)
+}
+
+type peerTracker struct {
+	progress map[string]*PeerProgress
+	mu       sync.Mutex
+}
+
+func newPeerTracker() *peerTracker {
+	return &peerTracker{
+		progress: map[string]*PeerProgress{},
+	}
+}
+
+// SetSnapshotSource lets catch-up install a snapshot on followers that are further behind than
+// lag entries. Without a source, lagging followers are always sent log entries.
+func (m *ReplicationManager) SetSnapshotSource(source SnapshotSource, lag int64) {
+	m.peers.mu.Lock()
+	defer m.peers.mu.Unlock()
+
+	m.snapshotSource = source
+	m.snapshotLag = max(lag, 1)
+}
+
+// PeerProgress reports the tracked progress of every configured peer.
+func (m *ReplicationManager) PeerProgress() []PeerProgress {
+	applied := m.coordinator.GetAppliedSeq()
+
+	m.peers.mu.Lock()
+	defer m.peers.mu.Unlock()
+
+	peers := m.coordinator.Peers()
+	progress := make([]PeerProgress, 0, len(peers))
+	for _, peer := range peers {
+		tracked := *m.peerProgressLocked(peer)
+		tracked.Lag = max(applied-tracked.MatchSeq, 0)
+		tracked.Learner = m.coordinator.IsLearner(peer)
+		progress = append(progress, tracked)
+	}
+	return progress
+}
+
+// recordMatch notes the applied sequence a peer reported.
+func (m *ReplicationManager) recordMatch(peer string, appliedSeq int64) {
+	m.peers.mu.Lock()
+	defer m.peers.mu.Unlock()
+
+	progress := m.peerProgressLocked(peer)
+	progress.MatchSeq = appliedSeq
+	progress.NextSeq = appliedSeq + 1
+	progress.Failures = 0
+	progress.LastError = ""
+	progress.LastContactMs = time.Now().UnixMilli()
+}
+
+func (m *ReplicationManager) recordFailure(peer string, err error) {
+	m.peers.mu.Lock()
+	defer m.peers.mu.Unlock()
+
+	progress := m.peerProgressLocked(peer)
+	progress.Failures++
+	progress.LastError = err.Error()
+}
+
+func (m *ReplicationManager) peerProgressLocked(peer string) *PeerProgress {
+	progress, ok := m.peers.progress[peer]
+	if !ok {
+		progress = &PeerProgress{Peer: peer, NextSeq: 1}
+		m.peers.progress[peer] = progress
+	}
+	return progress
+}
+
+// startCatchUp starts the peer's replication loop, which brings it up to the primary's applied
+// sequence in the background. At most one loop runs per peer.
+func (m *ReplicationManager) startCatchUp(ctx context.Context, peer string) {
+	m.peers.mu.Lock()
+	progress := m.peerProgressLocked(peer)
+	if progress.CatchingUp {
+		m.peers.mu.Unlock()
+		return
+	}
+	progress.CatchingUp = true
+	m.peers.mu.Unlock()
+
+	// the request that noticed the gap may finish long before catch-up does
+	go m.catchUp(context.WithoutCancel(ctx), peer)
+}
+
+// catchUp keeps sending the peer committed entries until it has all of them, backing off while
+// it is unreachable. It stops if this node stops being primary or the peer leaves the cluster.
+func (m *ReplicationManager) catchUp(ctx context.Context, peer string) {
+	defer func() {
+		m.peers.mu.Lock()
+		m.peerProgressLocked(peer).CatchingUp = false
+		m.peers.mu.Unlock()
+	}()
+
+	m.obs.LogNotice(ctx, "replica.catch_up: start peer=%s", peer)
+	backoff := catchUpMinBackoff
+	for m.coordinator.CanAcceptWrite() && m.coordinator.HasPeer(peer) {
+		caughtUp, err := m.catchUpStep(ctx, peer)
+		if err != nil {
+			m.recordFailure(peer, err)
+			m.obs.LogErr(ctx, "replica.catch_up: peer=%s retry_in=%s err=%v", peer, backoff, err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, catchUpMaxBackoff)
+			continue
+		}
+		backoff = catchUpMinBackoff
+		if caughtUp {
+			m.obs.LogNotice(ctx, "replica.catch_up: done peer=%s applied=%d", peer, m.coordinator.GetAppliedSeq())
+			return
+		}
+	}
+}
+
+// catchUpStep sends the peer one batch of entries, or a snapshot, from its applied sequence.
+func (m *ReplicationManager) catchUpStep(ctx context.Context, peer string) (bool, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	// ask rather than trust NextSeq, which a restarted peer may no longer match
+	state, err := m.fetchReplicaState(timeoutCtx, peer)
+	if err != nil {
+		return false, err
+	}
+	m.recordMatch(peer, state.AppliedSeq)
+
+	target := m.coordinator.GetAppliedSeq()
+	if state.AppliedSeq >= target {
+		return true, nil
+	}
+
+	m.peers.mu.Lock()
+	source, lag := m.snapshotSource, m.snapshotLag
+	m.peers.mu.Unlock()
+
+	entries := m.coordinator.EntriesAfter(state.AppliedSeq, catchUpBatchSize)
+	if source != nil && (len(entries) == 0 || target-state.AppliedSeq > lag) {
+		return false, m.installSnapshot(timeoutCtx, peer, source)
+	}
+	if len(entries) == 0 {
+		return false, errors.New("log has no entries after peer applied sequence")
+	}
+
+	// every entry sent is already committed, so the request's commit sequence covers them all
+	last := entries[len(entries)-1].Seq
+	payload, err := json.Marshal(ReplicationRequest{
+		Entries:    entries,
+		PrevOpID:   m.coordinator.opIDAt(state.AppliedSeq),
+		CommitSeq:  last,
+		CommitOpID: entries[len(entries)-1].OpID,
+	})
+	if err != nil {
+		return false, err
+	}
+	var response ReplicationResponse
+	if err := m.doReplicaRequest(timeoutCtx, http.MethodPost, peer, "/prepare", payload, &response); err != nil {
+		return false, err
+	}
+	m.recordMatch(peer, response.LastSeq)
+	m.obs.LogInfo(ctx, "replica.catch_up: sent peer=%s seq=%d-%d applied=%d", peer, entries[0].Seq, last, response.LastSeq)
+	return response.LastSeq >= target, nil
+}
+
+func (m *ReplicationManager) installSnapshot(ctx context.Context, peer string, source SnapshotSource) error {
+	snapshot, err := source(ctx)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	var response ReplicationResponse
+	if err := m.doReplicaRequest(ctx, http.MethodPost, peer, "/install-snapshot", payload, &response); err != nil {
+		return err
+	}
+	m.recordMatch(peer, response.LastSeq)
+	m.obs.LogNotice(ctx, "replica.catch_up: installed snapshot peer=%s seq=%d", peer, snapshot.AppliedSeq)
+	return nil
+}
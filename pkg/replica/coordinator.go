@@ -6,18 +6,41 @@ import (
 )
 
 type Coordinator struct {
-	role            NodeRole
-	primary         string
-	peers           []string
-	nextSeq         int64
-	preparedSeq     int64
-	applied         int64
-	log             map[int64]ReplicationEntry
-	prepared        map[int64]ReplicationEntry
-	preparedAt      map[int64]time.Time
+	role    NodeRole
+	primary string
+	peers   []string
+	// members is the committed voting configuration: the followers whose acks make a quorum
+	members []string
+	// learners receive every entry alongside members but their acks never count
+	learners []string
+	// self is this node's URL as its peers reach it, when known
+	self        string
+	nextSeq     int64
+	preparedSeq int64
+	applied     int64
+	// commitSeq is the highest sequence the primary has reported committed
+	commitSeq int64
+	// commitSeqAt is when the primary last reported its commit sequence
+	commitSeqAt time.Time
+	// commitPoints maps commit sequences heard above the applied sequence to the OpID the primary
+	// committed there, so a stale prepare at that sequence is never mistaken for it
+	commitPoints map[int64]string
+	// snapshotSeq and snapshotOpID name the last entry of an installed snapshot, which the log
+	// does not hold
+	snapshotSeq  int64
+	snapshotOpID string
+	// appliedSignal is closed and replaced whenever the applied sequence advances
+	appliedSignal chan struct{}
+	log           map[int64]ReplicationEntry
+	prepared      map[int64]ReplicationEntry
+	preparedAt    map[int64]time.Time
+	// preparedPrev is the OpID each prepared entry was sent to follow
+	preparedPrev    map[int64]string
 	writePipelineMu sync.Mutex
 	mu              sync.RWMutex
 	prepareTimeout  time.Duration
+	// prepareWindow is how far past the applied sequence a prepare may arrive out of order
+	prepareWindow int64
 }
 
 func NewCoordinator(role NodeRole, peers []string, primary string) *Coordinator {
@@ -26,10 +49,14 @@ func NewCoordinator(role NodeRole, peers []string, primary string) *Coordinator
 		log:            map[int64]ReplicationEntry{},
 		prepared:       map[int64]ReplicationEntry{},
 		preparedAt:     map[int64]time.Time{},
+		preparedPrev:   map[int64]string{},
+		commitPoints:   map[int64]string{},
 		preparedSeq:    0,
 		applied:        0,
 		nextSeq:        0,
 		prepareTimeout: 5 * time.Second,
+		prepareWindow:  1,
+		appliedSignal:  make(chan struct{}),
 		primary:        primary,
 	}
 	coordinator.SetPeers(peers)
@@ -37,6 +64,9 @@ func NewCoordinator(role NodeRole, peers []string, primary string) *Coordinator
 }
 
 func (c *Coordinator) CanAcceptWrite() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	return c.role.IsPrimary()
 }
 
@@ -49,6 +79,9 @@ func (c *Coordinator) UnlockWritePipeline() {
 }
 
 func (c *Coordinator) Role() NodeRole {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	return c.role
 }
 
@@ -56,7 +89,12 @@ func (c *Coordinator) RequiredPeerAcks() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	total := len(c.peers) + 1
+	return requiredPeerAcks(len(c.members))
+}
+
+// requiredPeerAcks is how many of a configuration's followers must ack alongside the primary.
+func requiredPeerAcks(members int) int {
+	total := members + 1
 	if total <= 1 {
 		return 0
 	}
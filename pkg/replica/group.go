@@ -0,0 +1,168 @@
+package replica
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const DefaultGroupCommitSize = 64
+
+// groupCommitter coalesces prepares into shared replication requests. Every write prepare goes
+// through it, pipelined or not. Writes queue in sequence order; a batch goes out once it reaches
+// maxEntries or the first queued write has waited maxDelay. With no delay a batch is whatever
+// queued while the previous one was being built, which adds no latency. A write of several
+// entries is never split across batches, so one batch can exceed maxEntries. Batches are sent
+// concurrently, so peers see them ordered only within the prepare window.
+type groupCommitter struct {
+	manager    *ReplicationManager
+	maxEntries int
+	maxDelay   time.Duration
+	queue      []groupedWrite
+	mu         sync.Mutex
+	wake       chan struct{}
+}
+
+type groupedWrite struct {
+	ctx     context.Context
+	entries []ReplicationEntry
+	// alone is set for writes that drained the pipeline first, which nothing can join
+	alone bool
+	// send replaces the usual member quorum prepare; such a write always goes out by itself
+	send func(context.Context, []ReplicationEntry) error
+	done chan error
+}
+
+func newGroupCommitter(manager *ReplicationManager) *groupCommitter {
+	g := &groupCommitter{
+		manager:    manager,
+		maxEntries: DefaultGroupCommitSize,
+		wake:       make(chan struct{}, 1),
+	}
+	go g.run()
+	return g
+}
+
+// SetGroupCommit bounds how many entries share one prepare request, and how long the first write
+// of a batch may wait for others to join it. Only pipelined writes can join each other, so a batch
+// never holds more than the pipeline depth.
+func (m *ReplicationManager) SetGroupCommit(maxEntries int, maxDelay time.Duration) {
+	g := m.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.maxEntries = max(maxEntries, 1)
+	g.maxDelay = max(maxDelay, 0)
+	g.signal()
+}
+
+// prepareGrouped queues locally prepared entries for the peer prepare. The returned channel
+// yields the quorum result of the batch the entries went out in. Callers enqueue in sequence
+// order. A write that is alone in the pipeline skips the batch window.
+func (m *ReplicationManager) prepareGrouped(ctx context.Context, entries []ReplicationEntry, alone bool) <-chan error {
+	return m.group.enqueue(groupedWrite{ctx: ctx, entries: entries, alone: alone})
+}
+
+func (g *groupCommitter) enqueue(write groupedWrite) <-chan error {
+	write.done = make(chan error, 1)
+
+	g.mu.Lock()
+	g.queue = append(g.queue, write)
+	g.signal()
+	g.mu.Unlock()
+	return write.done
+}
+
+// signal wakes the batching loop. Callers hold g.mu.
+func (g *groupCommitter) signal() {
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (g *groupCommitter) run() {
+	for range g.wake {
+		for {
+			g.mu.Lock()
+			if len(g.queue) == 0 {
+				g.mu.Unlock()
+				break
+			}
+			ready := g.queue[0].alone || g.queuedEntriesLocked() >= g.maxEntries
+			maxDelay := g.maxDelay
+			g.mu.Unlock()
+			if !ready && maxDelay > 0 {
+				g.waitForBatch(maxDelay)
+			}
+
+			batch := g.take()
+			go g.flush(batch)
+		}
+	}
+}
+
+// waitForBatch returns once the batch window closes or the queue fills a batch.
+func (g *groupCommitter) waitForBatch(delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return
+		case <-g.wake:
+			g.mu.Lock()
+			full := g.queuedEntriesLocked() >= g.maxEntries
+			g.mu.Unlock()
+			if full {
+				return
+			}
+		}
+	}
+}
+
+func (g *groupCommitter) queuedEntriesLocked() int {
+	queued := 0
+	for _, write := range g.queue {
+		queued += len(write.entries)
+	}
+	return queued
+}
+
+// take removes the next batch from the queue: whole writes up to maxEntries, and always at least
+// one write.
+func (g *groupCommitter) take() []groupedWrite {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n, size := 1, len(g.queue[0].entries)
+	for g.queue[0].send == nil && n < len(g.queue) && g.queue[n].send == nil && size+len(g.queue[n].entries) <= g.maxEntries {
+		size += len(g.queue[n].entries)
+		n++
+	}
+	batch := g.queue[:n:n]
+	g.queue = g.queue[n:]
+	return batch
+}
+
+func (g *groupCommitter) flush(batch []groupedWrite) {
+	entries := make([]ReplicationEntry, 0, len(batch))
+	for _, grouped := range batch {
+		entries = append(entries, grouped.entries...)
+	}
+
+	ctx := batch[0].ctx
+	var err error
+	if send := batch[0].send; send != nil {
+		err = send(ctx, entries)
+	} else {
+		err = g.manager.replicateEntries(ctx, entries, "/prepare")
+	}
+	if len(batch) > 1 {
+		g.manager.obs.LogInfo(ctx, "replica.group_commit: prepare seq=%d-%d size=%d ok=%t", entries[0].Seq, entries[len(entries)-1].Seq, len(entries), err == nil)
+	}
+	for _, grouped := range batch {
+		grouped.done <- err
+	}
+}
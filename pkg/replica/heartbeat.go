@@ -0,0 +1,66 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const DefaultHeartbeatInterval = 50 * time.Millisecond
+
+// RunHeartbeats sends the primary's commit sequence to every peer on every tick until ctx is
+// cancelled. Prepares already carry it, so heartbeats matter when writes go quiet: they let
+// followers apply the last writes, and keep followers that are caught up sure they still hear
+// the primary, which bounded staleness reads rely on. A peer that reports an applied sequence
+// below the commit sequence is caught up. In lease mode each tick also renews the lease.
+func (m *ReplicationManager) RunHeartbeats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !m.coordinator.CanAcceptWrite() {
+				continue
+			}
+			// a lease is only as fresh as the last quorum round
+			if m.readMode() == ReadModeLease {
+				_ = m.replicateEntries(ctx, nil, "/heartbeat")
+				continue
+			}
+			m.sendHeartbeats(ctx)
+		}
+	}
+}
+
+func (m *ReplicationManager) sendHeartbeats(ctx context.Context) {
+	commitSeq, commitOpID := m.coordinator.CommitPoint()
+	payload, err := json.Marshal(ReplicationRequest{CommitSeq: commitSeq, CommitOpID: commitOpID})
+	if err != nil {
+		m.obs.LogErr(ctx, "replica.heartbeat: marshal failed: %v", err)
+		return
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, peer := range m.coordinator.Peers() {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			response, ok := m.postReplicationRequest(timeoutCtx, p, "/heartbeat", payload)
+			if !ok {
+				return
+			}
+			// a follower that cannot reach the commit sequence is missing prepares
+			if response.LastSeq < commitSeq {
+				m.startCatchUp(ctx, p)
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
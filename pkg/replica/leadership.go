@@ -0,0 +1,188 @@
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// NotPrimaryError is a write or leadership check on a node that is not, or is no longer, primary.
+type NotPrimaryError struct {
+	Primary string
+}
+
+func (e *NotPrimaryError) Error() string {
+	return fmt.Sprintf("not primary; primary=%s", e.Primary)
+}
+
+// TakeLeadershipRequest hands the primary role to a follower. The follower takes it only if it has
+// applied exactly AppliedSeq and the request has not expired, so an old request cannot make it
+// primary after the sender has given up and resumed.
+type TakeLeadershipRequest struct {
+	// Self is the follower's URL as the rest of the cluster reaches it.
+	Self string `json:"self"`
+	// Previous is the outgoing primary, which follows the new one.
+	Previous    string   `json:"previous"`
+	AppliedSeq  int64    `json:"appliedSeq"`
+	AppliedOpID string   `json:"appliedOpId"`
+	Members     []string `json:"members"`
+	Learners    []string `json:"learners"`
+	ExpiresAtMs int64    `json:"expiresAtMs"`
+}
+
+// TransferLeadershipResponse reports where writes go after a transfer.
+type TransferLeadershipResponse struct {
+	Primary    string `json:"primary"`
+	AppliedSeq int64  `json:"appliedSeq"`
+}
+
+// checkPrimary fails once this node has stepped down, so writes queued behind a transfer are
+// redirected instead of replicated.
+func (c *Coordinator) checkPrimary() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.role.IsPrimary() {
+		return &NotPrimaryError{Primary: c.primary}
+	}
+	return nil
+}
+
+func (c *Coordinator) Self() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.self
+}
+
+// stepDown makes the primary a secondary of primary. It returns the configuration it gave up, for
+// resuming if the transfer is rejected.
+func (c *Coordinator) stepDown(primary string) ClusterConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous := ClusterConfig{Members: slices.Clone(c.members), Learners: slices.Clone(c.learners)}
+	c.role = NodeRoleSecondary
+	c.primary = primary
+	return previous
+}
+
+// becomePrimary takes the primary role over config. Prepares past the applied sequence were never
+// committed by the outgoing primary, so they are dropped here and their sequences reused. Followers
+// may still hold them; those never apply, because they do not chain to any commit point this node
+// sends, and they are dropped everywhere once this node's announcement applies.
+func (c *Coordinator) becomePrimary(config ClusterConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for seq := range c.prepared {
+		if seq > c.applied {
+			c.dropPreparedLocked(seq)
+		}
+	}
+	c.preparedSeq = c.highestPreparedSeqLocked()
+	c.nextSeq = c.applied
+	c.commitSeq = max(c.commitSeq, c.applied)
+	c.role = NodeRolePrimary
+	c.primary = ""
+	c.members = c.normalizePeerURLs(config.Members)
+	c.learners = c.normalizePeerURLs(config.Learners)
+	c.peers = c.normalizePeerURLs(slices.Concat(c.members, c.learners))
+}
+
+// AcceptLeadership makes this follower primary if it is a voter that has applied everything the
+// outgoing primary had. Callers hold the write lock.
+func (c *Coordinator) AcceptLeadership(req TakeLeadershipRequest) error {
+	c.mu.RLock()
+	role, applied := c.role, c.applied
+	c.mu.RUnlock()
+
+	switch {
+	case role == NodeRoleLearner:
+		return errors.New("learners cannot become primary")
+	case role.IsPrimary():
+		return errors.New("already primary")
+	case time.Now().UnixMilli() > req.ExpiresAtMs:
+		return errors.New("leadership transfer expired")
+	case applied != req.AppliedSeq:
+		return fmt.Errorf("applied seq %d does not match outgoing primary seq %d", applied, req.AppliedSeq)
+	}
+
+	c.becomePrimary(ClusterConfig{Members: req.Members, Learners: req.Learners})
+	if c.Self() == "" {
+		c.SetSelf(req.Self)
+	}
+	return nil
+}
+
+// TransferLeadership hands the primary role to target, a voting member. Callers hold the write
+// lock with the pipeline drained, so nothing commits while target catches up or after this node
+// steps down. If target does not take over, this node resumes only when it is sure target cannot
+// still do so; otherwise it stays a secondary of target, which is safe but needs an operator.
+func (m *ReplicationManager) TransferLeadership(ctx context.Context, target string) error {
+	if err := m.coordinator.checkPrimary(); err != nil {
+		return err
+	}
+	self := m.coordinator.Self()
+	if self == "" {
+		return errors.New("leadership transfer needs this node's --advertise-url")
+	}
+	members := m.coordinator.Members()
+	if !slices.Contains(members, target) {
+		return fmt.Errorf("peer %s is not a voting member", target)
+	}
+
+	if err := m.SyncPeer(ctx, target); err != nil {
+		return err
+	}
+
+	applied, appliedOpID := m.coordinator.CommitPoint()
+	expiresAt := time.Now().Add(m.timeout)
+	payload, err := json.Marshal(TakeLeadershipRequest{
+		Self:        target,
+		Previous:    self,
+		AppliedSeq:  applied,
+		AppliedOpID: appliedOpID,
+		Members:     append(slices.DeleteFunc(members, func(p string) bool { return p == target }), self),
+		Learners:    m.coordinator.Learners(),
+		ExpiresAtMs: expiresAt.UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+
+	previous := m.coordinator.stepDown(target)
+	m.obs.LogNotice(ctx, "replica.transfer: stepped down applied=%d target=%s", applied, target)
+
+	timeoutCtx, cancel := context.WithDeadline(ctx, expiresAt)
+	defer cancel()
+	var response ReplicationResponse
+	err = m.doReplicaRequest(timeoutCtx, http.MethodPost, target, "/take-leadership", payload, &response)
+	if err == nil {
+		m.obs.LogNotice(ctx, "replica.transfer: done primary=%s applied=%d", target, applied)
+		return nil
+	}
+
+	var rejected *ReplicaResponseError
+	if !errors.As(err, &rejected) {
+		// the request may still land, but never once it has expired
+		time.Sleep(time.Until(expiresAt))
+		state, stateErr := m.fetchReplicaState(context.WithoutCancel(ctx), target)
+		if stateErr != nil {
+			m.obs.LogAlert(ctx, "replica.transfer: outcome unknown target=%s; staying secondary err=%v", target, err)
+			return fmt.Errorf("leadership transfer to %s unconfirmed, this node stays a secondary: %w", target, err)
+		}
+		if state.Role.IsPrimary() {
+			m.obs.LogNotice(ctx, "replica.transfer: done primary=%s applied=%d", target, applied)
+			return nil
+		}
+	}
+
+	m.coordinator.becomePrimary(previous)
+	m.obs.LogErr(ctx, "replica.transfer: target=%s refused, resuming as primary err=%v", target, err)
+	return err
+}
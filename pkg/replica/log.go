@@ -1,9 +1,14 @@
 package replica
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"slices"
 	"sort"
 	"time"
+
+	"replicated-clob/schemas"
 )
 
 type SequenceGapError struct {
@@ -30,7 +35,21 @@ func (c *Coordinator) SetPrepareTimeout(timeout time.Duration) {
 	c.prepareTimeout = timeout
 }
 
-// PrepareRemote stores an entry as prepared and enforces strict sequence order.
+// SetPrepareWindow lets prepares for up to window sequences past the applied one arrive out of
+// order, which a pipelining primary needs because its in-flight prepares race each other. The
+// default of 1 only accepts the next sequence. Commits stay strictly ordered either way.
+func (c *Coordinator) SetPrepareWindow(window int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.prepareWindow = max(window, 1)
+}
+
+// PrepareRemote stores an entry as prepared and enforces strict sequence order. Several entries
+// may be prepared ahead of the applied sequence as long as they stay contiguous, which is how a
+// batch is prepared in one round trip, or fall inside the prepare window. The entry is taken to
+// follow whatever this node holds at the previous sequence, which is only right on the node that
+// assigned it; followers use PrepareAfter.
 //
 // - Returns (false, nil) for duplicate prepares that are already known.
 // - Returns (true, nil) when this entry becomes the next prepared sequence.
@@ -39,26 +58,48 @@ func (c *Coordinator) PrepareRemote(entry ReplicationEntry) (bool, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	return c.prepareLocked(c.opIDAtLocked(entry.Seq-1), entry)
+}
+
+// PrepareAfter is PrepareRemote for an entry the primary sent to follow the entry with prevOpID.
+// A different entry already prepared at the same sequence is one the primary gave up on before
+// reusing its sequence, so the newer prepare replaces it.
+func (c *Coordinator) PrepareAfter(prevOpID string, entry ReplicationEntry) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.prepareLocked(prevOpID, entry)
+}
+
+func (c *Coordinator) prepareLocked(prevOpID string, entry ReplicationEntry) (bool, error) {
 	c.expirePreparedLocked()
 	if entry.Seq <= c.applied {
 		return false, nil
 	}
 
-	expected := c.applied + 1
 	if existing, ok := c.prepared[entry.Seq]; ok {
 		if replicationEntriesEqual(existing, entry) {
 			return false, nil
 		}
-		return false, fmt.Errorf("prepare entry mismatch at seq=%d", entry.Seq)
+		c.dropPreparedLocked(entry.Seq)
 	}
 
-	if entry.Seq != expected {
+	expected := c.applied + 1
+	for {
+		if _, ok := c.prepared[expected]; !ok {
+			break
+		}
+		expected++
+	}
+
+	if entry.Seq != expected && entry.Seq > c.applied+c.prepareWindow {
 		return false, &SequenceGapError{Expected: expected, Received: entry.Seq}
 	}
 
 	c.prepared[entry.Seq] = entry
 	c.preparedAt[entry.Seq] = time.Now()
-	c.preparedSeq = entry.Seq
+	c.preparedPrev[entry.Seq] = prevOpID
+	c.preparedSeq = max(c.preparedSeq, entry.Seq)
 	return true, nil
 }
 
@@ -90,12 +131,16 @@ func (c *Coordinator) CommitRemote(entry ReplicationEntry) (bool, error) {
 	}
 
 	c.log[entry.Seq] = entry
-	delete(c.prepared, entry.Seq)
-	delete(c.preparedAt, entry.Seq)
+	c.dropPreparedLocked(entry.Seq)
+	delete(c.commitPoints, entry.Seq)
 	c.applied = entry.Seq
+	c.signalAppliedLocked()
 	if entry.Seq > c.nextSeq {
 		c.nextSeq = entry.Seq
 	}
+	if entry.Type == ReplicationWriteMembership && entry.Primary != "" {
+		c.dropUnchainedAfterLocked(entry.Seq)
+	}
 	if c.preparedSeq == entry.Seq {
 		c.preparedSeq = c.highestPreparedSeqLocked()
 	}
@@ -121,8 +166,7 @@ func (c *Coordinator) RevertSequence(seq int64) {
 	}
 
 	// Revert only the most recent uncommitted local reservation.
-	delete(c.prepared, seq)
-	delete(c.preparedAt, seq)
+	c.dropPreparedLocked(seq)
 	if c.preparedSeq == seq {
 		c.preparedSeq = c.highestPreparedSeqLocked()
 	}
@@ -138,9 +182,100 @@ func (c *Coordinator) State() ReplicaStateResponse {
 		Role:       c.role,
 		LastSeq:    c.nextSeq,
 		AppliedSeq: c.applied,
+		CommitSeq:  max(c.commitSeq, c.applied),
 		PeerCount:  len(c.peers),
 		Primary:    c.primary,
+		Members:    slices.Clone(c.members),
+		Learners:   slices.Clone(c.learners),
+	}
+}
+
+// AdvanceCommitSeq records the primary's commit sequence as carried on a prepare or heartbeat,
+// along with the OpID of the entry the primary committed at it.
+func (c *Coordinator) AdvanceCommitSeq(seq int64, opID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.commitSeq = max(c.commitSeq, seq)
+	c.commitSeqAt = time.Now()
+	if seq > c.applied && opID != "" {
+		c.commitPoints[seq] = opID
+	}
+}
+
+// CommitPoint returns the applied sequence and the OpID of the entry applied there, which the
+// primary sends as its commit sequence.
+func (c *Coordinator) CommitPoint() (int64, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.applied, c.opIDAtLocked(c.applied)
+}
+
+// opIDAt returns the OpID of the entry this node holds at seq, committed or prepared, or "" when it
+// holds none.
+func (c *Coordinator) opIDAt(seq int64) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.opIDAtLocked(seq)
+}
+
+func (c *Coordinator) opIDAtLocked(seq int64) string {
+	if entry, ok := c.log[seq]; ok {
+		return entry.OpID
+	}
+	if entry, ok := c.prepared[seq]; ok {
+		return entry.OpID
+	}
+	if seq == c.snapshotSeq {
+		return c.snapshotOpID
+	}
+	return ""
+}
+
+// Staleness reports how many sequences this node trails the last commit sequence it heard from
+// the primary, and how long ago it heard it. A primary is never behind itself.
+func (c *Coordinator) Staleness() (int64, time.Duration) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.role == NodeRolePrimary {
+		return 0, 0
 	}
+	if c.commitSeqAt.IsZero() {
+		return max(c.commitSeq-c.applied, 0), time.Duration(math.MaxInt64)
+	}
+	return max(c.commitSeq-c.applied, 0), time.Since(c.commitSeqAt)
+}
+
+// CommittedPrepared returns the prepared entries known to be committed, in order. They must follow
+// the applied sequence without a gap, each must have been sent to follow the one before it, and
+// the run must end at a commit point whose OpID matches what is prepared there. A prepare left
+// behind at a sequence the primary reused breaks that chain, so it is never applied in place of
+// the entry that committed. Entries past a missing or stale prepare wait for it to be replaced.
+func (c *Coordinator) CommittedPrepared() []ReplicationEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries := []ReplicationEntry{}
+	committed := 0
+	prev := c.opIDAtLocked(c.applied)
+	for seq := c.applied + 1; seq <= c.commitSeq; seq++ {
+		entry, ok := c.prepared[seq]
+		if !ok || c.preparedPrev[seq] != prev {
+			break
+		}
+		if opID, ok := c.commitPoints[seq]; ok {
+			if opID != entry.OpID {
+				break
+			}
+			committed = len(entries) + 1
+		}
+		entries = append(entries, entry)
+		prev = entry.OpID
+	}
+	return entries[:committed]
 }
 
 func (c *Coordinator) GetAppliedSeq() int64 {
@@ -172,6 +307,72 @@ func (c *Coordinator) EntriesSince(seq int64) []ReplicationEntry {
 	return entries
 }
 
+// EntriesAfter returns up to limit committed entries that directly follow seq, stopping at the
+// first sequence missing from the log.
+func (c *Coordinator) EntriesAfter(seq int64, limit int) []ReplicationEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries := []ReplicationEntry{}
+	for next := seq + 1; next <= c.applied && len(entries) < limit; next++ {
+		entry, ok := c.log[next]
+		if !ok {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// InstallSnapshot moves the log to a snapshot taken at appliedSeq, whose last entry was appliedOpID.
+// Prepares the snapshot covers are dropped; the log itself has no entries at or below appliedSeq
+// to serve to other nodes.
+func (c *Coordinator) InstallSnapshot(appliedSeq int64, appliedOpID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for seq := range c.prepared {
+		if seq <= appliedSeq {
+			c.dropPreparedLocked(seq)
+		}
+	}
+	for seq := range c.commitPoints {
+		if seq <= appliedSeq {
+			delete(c.commitPoints, seq)
+		}
+	}
+	c.preparedSeq = c.highestPreparedSeqLocked()
+	c.snapshotSeq = appliedSeq
+	c.snapshotOpID = appliedOpID
+	c.applied = appliedSeq
+	c.nextSeq = max(c.nextSeq, appliedSeq)
+	c.commitSeq = max(c.commitSeq, appliedSeq)
+	c.signalAppliedLocked()
+}
+
+// WaitForApplied blocks until the applied sequence reaches seq or ctx is done.
+func (c *Coordinator) WaitForApplied(ctx context.Context, seq int64) error {
+	for {
+		c.mu.RLock()
+		applied, signal := c.applied, c.appliedSignal
+		c.mu.RUnlock()
+		if applied >= seq {
+			return nil
+		}
+
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return fmt.Errorf("applied seq %d did not reach read index %d: %w", applied, seq, ctx.Err())
+		}
+	}
+}
+
+func (c *Coordinator) signalAppliedLocked() {
+	close(c.appliedSignal)
+	c.appliedSignal = make(chan struct{})
+}
+
 func (c *Coordinator) expirePreparedLocked() {
 	if c.prepareTimeout <= 0 || len(c.prepared) == 0 {
 		return
@@ -179,14 +380,43 @@ func (c *Coordinator) expirePreparedLocked() {
 	now := time.Now()
 	cutoff := now.Add(-c.prepareTimeout)
 	for key, at := range c.preparedAt {
+		// an entry the primary reported committed must still be applied
+		if key <= c.commitSeq {
+			continue
+		}
 		if at.Before(cutoff) || at.Equal(cutoff) {
-			delete(c.prepared, key)
-			delete(c.preparedAt, key)
+			c.dropPreparedLocked(key)
+		}
+	}
+	c.preparedSeq = c.highestPreparedSeqLocked()
+}
+
+// dropUnchainedAfterLocked drops every prepared entry past seq that does not chain back to the
+// entry applied there. It runs when a new primary's announcement applies: only entries the new
+// primary sent after it can commit past it, so whatever the old primary left prepared is dropped
+// instead of waiting to be replaced.
+func (c *Coordinator) dropUnchainedAfterLocked(seq int64) {
+	prev, chained := c.opIDAtLocked(seq), true
+	for next := seq + 1; next <= c.preparedSeq; next++ {
+		entry, ok := c.prepared[next]
+		chained = chained && ok && c.preparedPrev[next] == prev
+		if !ok {
+			continue
+		}
+		if !chained {
+			c.dropPreparedLocked(next)
 		}
+		prev = entry.OpID
 	}
 	c.preparedSeq = c.highestPreparedSeqLocked()
 }
 
+func (c *Coordinator) dropPreparedLocked(seq int64) {
+	delete(c.prepared, seq)
+	delete(c.preparedAt, seq)
+	delete(c.preparedPrev, seq)
+}
+
 func (c *Coordinator) highestPreparedSeqLocked() int64 {
 	highest := int64(0)
 	for seq := range c.prepared {
@@ -205,5 +435,82 @@ func replicationEntriesEqual(a, b ReplicationEntry) bool {
 		a.OrderID == b.OrderID &&
 		a.PriceLevel == b.PriceLevel &&
 		a.Amount == b.Amount &&
-		a.IsBid == b.IsBid
+		a.IsBid == b.IsBid &&
+		a.TrailOffset == b.TrailOffset &&
+		a.TrailBps == b.TrailBps &&
+		a.BaseAmount == b.BaseAmount &&
+		a.QuoteAmount == b.QuoteAmount &&
+		riskLimitsEqual(a.Limits, b.Limits) &&
+		a.Blocked == b.Blocked &&
+		massCancelFiltersEqual(a.MassCancel, b.MassCancel) &&
+		a.TimeoutMs == b.TimeoutMs &&
+		a.Phase == b.Phase &&
+		priceBandsEqual(a.PriceBands, b.PriceBands) &&
+		a.TimestampMs == b.TimestampMs &&
+		a.FeeTier == b.FeeTier &&
+		feeSchedulesEqual(a.Fees, b.Fees) &&
+		matchingConfigsEqual(a.Matching, b.Matching) &&
+		instrumentRulesEqual(a.Instrument, b.Instrument) &&
+		a.ClientOrderID == b.ClientOrderID &&
+		quotesEqual(a.MassQuote, b.MassQuote) &&
+		collateralConfigsEqual(a.Collateral, b.Collateral) &&
+		slices.Equal(a.Members, b.Members) &&
+		slices.Equal(a.Learners, b.Learners) &&
+		a.Primary == b.Primary
+}
+
+func massCancelFiltersEqual(a, b *schemas.MassCancelFilter) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func riskLimitsEqual(a, b *schemas.RiskLimits) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func priceBandsEqual(a, b *schemas.PriceBands) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func feeSchedulesEqual(a, b *schemas.FeeSchedule) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func matchingConfigsEqual(a, b *schemas.MatchingConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func collateralConfigsEqual(a, b *schemas.CollateralConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func quotesEqual(a, b *schemas.Quote) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func instrumentRulesEqual(a, b *schemas.InstrumentRules) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
 }
@@ -1,9 +1,20 @@
 package replica
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"replicated-clob/pkg/obs"
 )
 
 func testReplicationEntry(seq int64, orderID string) ReplicationEntry {
@@ -67,10 +78,16 @@ func TestPrepareDuplicateSuppression(t *testing.T) {
 		t.Fatalf("duplicate prepare should not reapply sequence")
 	}
 
-	badEntry := testReplicationEntry(1, "ord-dup-different")
-	badEntry.User = "bob"
-	if _, err := coordinator.PrepareRemote(badEntry); err == nil {
-		t.Fatalf("expected mismatch error for duplicate seq with different payload")
+	// a different entry at a prepared sequence is the primary reusing it after giving up
+	replacement := testReplicationEntry(1, "ord-dup-different")
+	replacement.User = "bob"
+	if prepared, err := coordinator.PrepareRemote(replacement); err != nil {
+		t.Fatalf("replacing prepare unexpected error: %v", err)
+	} else if !prepared {
+		t.Fatalf("replacing prepare should take the sequence")
+	}
+	if _, err := coordinator.CommitRemote(entry); err == nil {
+		t.Fatalf("expected commit of the replaced entry to fail")
 	}
 }
 
@@ -102,3 +119,764 @@ func TestPrepareTimeoutThenReplay(t *testing.T) {
 		t.Fatalf("commit after prepare replay unexpected error: %v", err)
 	}
 }
+
+func TestPrepareContiguousEntriesAheadOfCommit(t *testing.T) {
+	coordinator := NewCoordinator(NodeRolePrimary, []string{"peer1", "peer2"}, "test-cluster")
+
+	entries := []ReplicationEntry{
+		testReplicationEntry(1, "ord-1"),
+		testReplicationEntry(2, "ord-2"),
+		testReplicationEntry(3, "ord-3"),
+	}
+	for _, entry := range entries {
+		if _, err := coordinator.PrepareRemote(entry); err != nil {
+			t.Fatalf("prepare seq=%d unexpected error: %v", entry.Seq, err)
+		}
+	}
+	if _, err := coordinator.PrepareRemote(testReplicationEntry(5, "ord-5")); err == nil || !strings.Contains(err.Error(), "expected 4") {
+		t.Fatalf("expected gap error after prepared run, got %v", err)
+	}
+
+	if _, err := coordinator.CommitRemote(entries[1]); err == nil {
+		t.Fatalf("expected commit of seq2 before seq1 to fail")
+	}
+	for _, entry := range entries {
+		if _, err := coordinator.CommitRemote(entry); err != nil {
+			t.Fatalf("commit seq=%d unexpected error: %v", entry.Seq, err)
+		}
+	}
+	if coordinator.GetAppliedSeq() != 3 {
+		t.Fatalf("expected applied seq 3, got %d", coordinator.GetAppliedSeq())
+	}
+}
+
+func TestPrepareWindowAcceptsOutOfOrderPrepares(t *testing.T) {
+	coordinator := NewCoordinator(NodeRoleSecondary, nil, "test-cluster")
+	coordinator.SetPrepareWindow(3)
+
+	if _, err := coordinator.PrepareRemote(testReplicationEntry(3, "ord-3")); err != nil {
+		t.Fatalf("prepare seq3 inside window unexpected error: %v", err)
+	}
+	if _, err := coordinator.PrepareRemote(testReplicationEntry(4, "ord-4")); err == nil {
+		t.Fatalf("expected gap error for prepare past window")
+	}
+	if _, err := coordinator.CommitRemote(testReplicationEntry(3, "ord-3")); err == nil {
+		t.Fatalf("expected commit of seq3 before seq1 to fail")
+	}
+
+	for _, entry := range []ReplicationEntry{testReplicationEntry(2, "ord-2"), testReplicationEntry(1, "ord-1")} {
+		if _, err := coordinator.PrepareRemote(entry); err != nil {
+			t.Fatalf("prepare seq=%d unexpected error: %v", entry.Seq, err)
+		}
+	}
+	for seq, orderID := range []string{"ord-1", "ord-2", "ord-3"} {
+		if _, err := coordinator.CommitRemote(testReplicationEntry(int64(seq+1), orderID)); err != nil {
+			t.Fatalf("commit seq=%d unexpected error: %v", seq+1, err)
+		}
+	}
+	if coordinator.GetAppliedSeq() != 3 {
+		t.Fatalf("expected applied seq 3, got %d", coordinator.GetAppliedSeq())
+	}
+}
+
+func TestPipelineAppliesInSequenceOrder(t *testing.T) {
+	coordinator := NewCoordinator(NodeRolePrimary, nil, "test-cluster")
+	pipeline := NewPipeline(NewReplicationManager(coordinator, obs.New()))
+	pipeline.SetDepth(4)
+
+	var applied []int64
+	apply := func(_ context.Context, entry ReplicationEntry) error {
+		applied = append(applied, entry.Seq)
+		return nil
+	}
+
+	var done []<-chan error
+	for i := 0; i < 6; i++ {
+		entry := testReplicationEntry(0, fmt.Sprintf("ord-%d", i))
+		pipeline.Reserve()
+		done = append(done, pipeline.Submit(context.Background(), entry, apply))
+	}
+	for i, ch := range done {
+		if err := <-ch; err != nil {
+			t.Fatalf("write %d unexpected error: %v", i, err)
+		}
+	}
+
+	if len(applied) != 6 {
+		t.Fatalf("expected 6 applied writes, got %d", len(applied))
+	}
+	for i, seq := range applied {
+		if seq != int64(i+1) {
+			t.Fatalf("expected seq %d applied at position %d, got %d", i+1, i, seq)
+		}
+	}
+	if coordinator.GetAppliedSeq() != 6 {
+		t.Fatalf("expected applied seq 6, got %d", coordinator.GetAppliedSeq())
+	}
+}
+
+func TestPipelineFailsQueuedWritesWhenPrepareFails(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer peer.Close()
+
+	coordinator := NewCoordinator(NodeRolePrimary, []string{peer.URL}, "test-cluster")
+	pipeline := NewPipeline(NewReplicationManager(coordinator, obs.New()))
+	pipeline.SetDepth(4)
+
+	applied := 0
+	apply := func(context.Context, ReplicationEntry) error {
+		applied++
+		return nil
+	}
+
+	pipeline.Reserve()
+	pipeline.Reserve()
+	first := pipeline.Submit(context.Background(), testReplicationEntry(0, "ord-1"), apply)
+	second := pipeline.Submit(context.Background(), testReplicationEntry(0, "ord-2"), apply)
+	if err := <-first; err == nil {
+		t.Fatalf("expected first write to fail without prepare quorum")
+	}
+	if err := <-second; err == nil {
+		t.Fatalf("expected queued write to fail behind the failed prepare")
+	}
+
+	if applied != 0 {
+		t.Fatalf("expected no writes applied, got %d", applied)
+	}
+	if seq := coordinator.NextSequence(); seq != 1 {
+		t.Fatalf("expected failed sequences to be released, next seq %d", seq)
+	}
+}
+
+func TestPipelineGroupsPreparesIntoBatches(t *testing.T) {
+	var mu sync.Mutex
+	prepareSizes := []int{}
+	commitRequests := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ReplicationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		if strings.HasSuffix(r.URL.Path, "/prepare") {
+			prepareSizes = append(prepareSizes, len(req.Entries))
+		} else if strings.HasSuffix(r.URL.Path, "/commit") {
+			commitRequests++
+		}
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(ReplicationResponse{Accepted: true})
+	}))
+	defer peer.Close()
+
+	coordinator := NewCoordinator(NodeRolePrimary, []string{peer.URL}, "test-cluster")
+	manager := NewReplicationManager(coordinator, obs.New())
+	manager.SetGroupCommit(4, time.Second)
+	pipeline := NewPipeline(manager)
+	pipeline.SetDepth(8)
+
+	var done []<-chan error
+	for i := 0; i < 8; i++ {
+		entry := testReplicationEntry(0, fmt.Sprintf("ord-%d", i))
+		pipeline.Reserve()
+		done = append(done, pipeline.Submit(context.Background(), entry, nil))
+	}
+	for i, ch := range done {
+		if err := <-ch; err != nil {
+			t.Fatalf("write %d unexpected error: %v", i, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(prepareSizes) != 2 || prepareSizes[0] != 4 || prepareSizes[1] != 4 {
+		t.Fatalf("expected two prepare batches of 4, got %v", prepareSizes)
+	}
+	// prepare quorum is enough to commit; followers learn the commit sequence later
+	if commitRequests != 0 {
+		t.Fatalf("expected no commit round trips, got %d", commitRequests)
+	}
+	if coordinator.GetAppliedSeq() != 8 {
+		t.Fatalf("expected applied seq 8, got %d", coordinator.GetAppliedSeq())
+	}
+}
+
+func TestUnpipelinedWritesGoThroughGroupCommitter(t *testing.T) {
+	var mu sync.Mutex
+	prepareSizes := []int{}
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ReplicationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		prepareSizes = append(prepareSizes, len(req.Entries))
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(ReplicationResponse{Accepted: true})
+	}))
+	defer peer.Close()
+
+	coordinator := NewCoordinator(NodeRolePrimary, []string{peer.URL}, "test-cluster")
+	manager := NewReplicationManager(coordinator, obs.New())
+	// nothing can join a write made with the pipeline drained, so it never waits out the window
+	manager.SetGroupCommit(2, time.Hour)
+
+	entries := make([]ReplicationEntry, 0, 5)
+	for i := 0; i < 5; i++ {
+		entries = append(entries, testReplicationEntry(coordinator.NextSequence(), fmt.Sprintf("ord-%d", i)))
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- manager.PrepareEntries(context.Background(), entries)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("prepare unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected an unpipelined write to skip the batch window")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// a write is never split, even past the batch size
+	if len(prepareSizes) != 1 || prepareSizes[0] != 5 {
+		t.Fatalf("expected one prepare of 5 entries, got %v", prepareSizes)
+	}
+}
+
+func TestHeartbeatsCarryCommitSequence(t *testing.T) {
+	commitSeqs := make(chan int64, 16)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ReplicationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/heartbeat") {
+			commitSeqs <- req.CommitSeq
+		}
+		// a follower holding every prepare applies up to the commit sequence
+		_ = json.NewEncoder(w).Encode(ReplicationResponse{Accepted: true, LastSeq: req.CommitSeq})
+	}))
+	defer peer.Close()
+
+	coordinator := NewCoordinator(NodeRolePrimary, []string{peer.URL}, "test-cluster")
+	manager := NewReplicationManager(coordinator, obs.New())
+	entry := testReplicationEntry(coordinator.NextSequence(), "ord-1")
+	if err := manager.PrepareEntry(context.Background(), entry); err != nil {
+		t.Fatalf("prepare unexpected error: %v", err)
+	}
+	if _, err := manager.ApplyRemoteEntry(context.Background(), entry, nil); err != nil {
+		t.Fatalf("apply unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager.RunHeartbeats(ctx, 5*time.Millisecond)
+
+	select {
+	case seq := <-commitSeqs:
+		if seq != 1 {
+			t.Fatalf("expected heartbeat commit seq 1, got %d", seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a heartbeat after the commit sequence advanced")
+	}
+	// a caught-up follower keeps hearing from an idle primary, so its last contact stays fresh
+	for range 3 {
+		select {
+		case seq := <-commitSeqs:
+			if seq != 1 {
+				t.Fatalf("expected idle heartbeat commit seq 1, got %d", seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected heartbeats to continue while idle")
+		}
+	}
+}
+
+func TestCommittedPreparedStopsAtCommitSequenceAndGaps(t *testing.T) {
+	coordinator := NewCoordinator(NodeRoleSecondary, nil, "test-cluster")
+	coordinator.SetPrepareWindow(4)
+	prepare := func(seq int64) {
+		prev := ""
+		if seq > 1 {
+			prev = fmt.Sprintf("op-ord-%d", seq-1)
+		}
+		if _, err := coordinator.PrepareAfter(prev, testReplicationEntry(seq, fmt.Sprintf("ord-%d", seq))); err != nil {
+			t.Fatalf("prepare seq=%d unexpected error: %v", seq, err)
+		}
+	}
+	for _, seq := range []int64{1, 2, 4} {
+		prepare(seq)
+	}
+
+	if entries := coordinator.CommittedPrepared(); len(entries) != 0 {
+		t.Fatalf("expected nothing committed before a commit sequence arrives, got %d", len(entries))
+	}
+
+	coordinator.AdvanceCommitSeq(1, "op-ord-1")
+	if entries := coordinator.CommittedPrepared(); len(entries) != 1 || entries[0].Seq != 1 {
+		t.Fatalf("expected only seq 1 to be committed, got %+v", entries)
+	}
+
+	// seq 2 only links to a commit point through the missing seq 3
+	coordinator.AdvanceCommitSeq(4, "op-ord-4")
+	if entries := coordinator.CommittedPrepared(); len(entries) != 1 {
+		t.Fatalf("expected seq 1 only while seq 3 is missing, got %+v", entries)
+	}
+
+	prepare(3)
+	if entries := coordinator.CommittedPrepared(); len(entries) != 4 || entries[3].Seq != 4 {
+		t.Fatalf("expected seq 1-4 once the gap is filled, got %+v", entries)
+	}
+}
+
+func TestFollowerNeverAppliesPrepareFromReusedSequence(t *testing.T) {
+	primary := NewCoordinator(NodeRolePrimary, nil, "test-cluster")
+	follower := NewCoordinator(NodeRoleSecondary, nil, "http://primary")
+	// send mimics a prepare request from the primary, which names the entry the first one follows
+	send := func(entries ...ReplicationEntry) {
+		prev := primary.opIDAt(entries[0].Seq - 1)
+		for _, entry := range entries {
+			if _, err := follower.PrepareAfter(prev, entry); err != nil {
+				t.Fatalf("follower prepare seq=%d unexpected error: %v", entry.Seq, err)
+			}
+			prev = entry.OpID
+		}
+	}
+	heartbeat := func() []ReplicationEntry {
+		follower.AdvanceCommitSeq(primary.CommitPoint())
+		return follower.CommittedPrepared()
+	}
+	commit := func(entry ReplicationEntry) {
+		if _, err := primary.PrepareRemote(entry); err != nil {
+			t.Fatalf("primary prepare seq=%d unexpected error: %v", entry.Seq, err)
+		}
+		if _, err := primary.CommitRemote(entry); err != nil {
+			t.Fatalf("primary commit seq=%d unexpected error: %v", entry.Seq, err)
+		}
+	}
+
+	// X misses quorum but reaches this follower late; the primary reuses its sequence for Y,
+	// which commits through the other followers
+	x := testReplicationEntry(primary.NextSequence(), "ord-x")
+	if _, err := primary.PrepareRemote(x); err != nil {
+		t.Fatalf("primary prepare unexpected error: %v", err)
+	}
+	send(x)
+	primary.RevertSequence(x.Seq)
+	y := testReplicationEntry(primary.NextSequence(), "ord-y")
+	commit(y)
+
+	if entries := heartbeat(); len(entries) != 0 {
+		t.Fatalf("expected stale prepare not to apply at commit seq %d, got %+v", y.Seq, entries)
+	}
+
+	// a later entry chained to Y does not vouch for X either
+	z := testReplicationEntry(primary.NextSequence(), "ord-z")
+	send(z)
+	commit(z)
+	if entries := heartbeat(); len(entries) != 0 {
+		t.Fatalf("expected stale prepare not to apply behind a later commit, got %+v", entries)
+	}
+
+	// catch-up resends the committed entries and Y replaces X
+	send(y, z)
+	entries := heartbeat()
+	if len(entries) != 2 || entries[0].OpID != y.OpID || entries[1].OpID != z.OpID {
+		t.Fatalf("expected committed Y then Z, got %+v", entries)
+	}
+}
+
+func TestLeadershipAnnouncementDropsOldPrimaryPrepares(t *testing.T) {
+	follower := NewCoordinator(NodeRoleSecondary, nil, "http://old")
+	follower.SetPrepareWindow(8)
+	prepare := func(prev string, entry ReplicationEntry) {
+		if _, err := follower.PrepareAfter(prev, entry); err != nil {
+			t.Fatalf("prepare seq=%d unexpected error: %v", entry.Seq, err)
+		}
+	}
+
+	// the old primary left seq 1-3 prepared and seq 5 past a gap when it stepped down
+	prev := ""
+	for _, seq := range []int64{1, 2, 3, 5} {
+		stale := testReplicationEntry(seq, fmt.Sprintf("stale-%d", seq))
+		if seq == 5 {
+			prev = "op-stale-4"
+		}
+		prepare(prev, stale)
+		prev = stale.OpID
+	}
+
+	// the new primary's announcement takes seq 1, and its next write arrives ahead of the commit
+	announce := ReplicationEntry{Seq: 1, OpID: "op-announce", Type: ReplicationWriteMembership, Primary: "http://new", Members: []string{"http://old"}}
+	prepare("", announce)
+	next := testReplicationEntry(2, "new-2")
+	prepare(announce.OpID, next)
+
+	follower.AdvanceCommitSeq(1, announce.OpID)
+	entries := follower.CommittedPrepared()
+	if len(entries) != 1 || entries[0].OpID != announce.OpID {
+		t.Fatalf("expected only the announcement committed, got %+v", entries)
+	}
+	if _, err := follower.CommitRemote(entries[0]); err != nil {
+		t.Fatalf("apply announcement unexpected error: %v", err)
+	}
+
+	for _, seq := range []int64{3, 5} {
+		if _, ok := follower.prepared[seq]; ok {
+			t.Fatalf("expected the old primary's prepare at seq %d to be dropped", seq)
+		}
+	}
+	if prepared, ok := follower.prepared[2]; !ok || prepared.OpID != next.OpID {
+		t.Fatalf("expected the new primary's chained prepare to be kept, got %+v", follower.prepared)
+	}
+}
+
+func TestReplicationReturnsAtQuorumWithoutWaitingForSlowPeers(t *testing.T) {
+	respond := func(w http.ResponseWriter) {
+		_ = json.NewEncoder(w).Encode(ReplicationResponse{Accepted: true})
+	}
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		respond(w)
+	}))
+	defer fast.Close()
+	slowDone := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		respond(w)
+		close(slowDone)
+	}))
+	defer slow.Close()
+
+	coordinator := NewCoordinator(NodeRolePrimary, []string{fast.URL, slow.URL}, "test-cluster")
+	manager := NewReplicationManager(coordinator, obs.New())
+
+	started := time.Now()
+	entry := testReplicationEntry(coordinator.NextSequence(), "ord-1")
+	if err := manager.PrepareEntry(context.Background(), entry); err != nil {
+		t.Fatalf("prepare unexpected error: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed >= 300*time.Millisecond {
+		t.Fatalf("expected prepare to return at quorum, took %s", elapsed)
+	}
+
+	// the slow peer still gets the request and its ack is tracked
+	<-slowDone
+	deadline := time.Now().Add(time.Second)
+	for {
+		progress := manager.PeerProgress()
+		if progress[1].LastContactMs > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected slow peer ack to be recorded, got %+v", progress[1])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReadIndexConfirmsLeadershipUnlessLeaseHeld(t *testing.T) {
+	var heartbeats atomic.Int32
+	var down atomic.Bool
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/internal/replica/heartbeat" {
+			heartbeats.Add(1)
+		}
+		_ = json.NewEncoder(w).Encode(ReplicationResponse{Accepted: true})
+	}))
+	defer peer.Close()
+
+	coordinator := NewCoordinator(NodeRolePrimary, []string{peer.URL}, "test-cluster")
+	manager := NewReplicationManager(coordinator, obs.New())
+	entry := testReplicationEntry(coordinator.NextSequence(), "ord-1")
+	if _, err := coordinator.PrepareRemote(entry); err != nil {
+		t.Fatalf("prepare unexpected error: %v", err)
+	}
+	if _, err := coordinator.CommitRemote(entry); err != nil {
+		t.Fatalf("commit unexpected error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		readIndex, err := manager.ReadIndex(context.Background())
+		if err != nil {
+			t.Fatalf("read index unexpected error: %v", err)
+		}
+		if readIndex.ReadIndex != 1 || readIndex.OpID != entry.OpID {
+			t.Fatalf("expected read index 1 at %s, got %+v", entry.OpID, readIndex)
+		}
+	}
+	if got := heartbeats.Load(); got != 2 {
+		t.Fatalf("expected a heartbeat round per read without a lease, got %d", got)
+	}
+
+	manager.SetReadMode(ReadModeLease, time.Second)
+	for i := 0; i < 3; i++ {
+		if _, err := manager.ReadIndex(context.Background()); err != nil {
+			t.Fatalf("lease read unexpected error: %v", err)
+		}
+	}
+	if got := heartbeats.Load(); got != 3 {
+		t.Fatalf("expected only the first lease read to confirm leadership, got %d heartbeats", got)
+	}
+
+	// without a lease a primary cut off from its quorum must not serve reads
+	manager.SetReadMode(ReadModeReadIndex, 0)
+	down.Store(true)
+	if _, err := manager.ReadIndex(context.Background()); err == nil {
+		t.Fatalf("expected read index to fail without a quorum")
+	}
+}
+
+func TestReadConsistencyBounds(t *testing.T) {
+	for _, tc := range []struct {
+		value  string
+		lag    int64
+		age    time.Duration
+		within bool
+	}{
+		{value: "", lag: 0, age: 0, within: false},
+		{value: "linearizable", lag: 0, age: 0, within: false},
+		{value: "local", lag: 1000, age: time.Hour, within: true},
+		{value: "bounded-staleness=5", lag: 5, age: 0, within: true},
+		{value: "bounded-staleness=5", lag: 6, age: 0, within: false},
+		// lag is measured against the last commit sequence heard, which a cut-off follower stops hearing
+		{value: "bounded-staleness=5", lag: 0, age: time.Hour, within: false},
+		{value: "bounded-staleness=0", lag: 0, age: time.Duration(math.MaxInt64), within: false},
+		{value: "bounded-staleness=500ms", lag: 0, age: 400 * time.Millisecond, within: true},
+		{value: "bounded-staleness=500ms", lag: 0, age: 600 * time.Millisecond, within: false},
+		// an age bound cannot vouch for sequences already reported but not yet applied
+		{value: "bounded-staleness=500ms", lag: 1, age: 0, within: false},
+	} {
+		consistency, err := ParseReadConsistency(tc.value)
+		if err != nil {
+			t.Fatalf("parse %q unexpected error: %v", tc.value, err)
+		}
+		if got := consistency.Within(tc.lag, tc.age); got != tc.within {
+			t.Fatalf("%q within lag=%d age=%s: expected %t, got %t", tc.value, tc.lag, tc.age, tc.within, got)
+		}
+	}
+
+	for _, value := range []string{"eventual", "local=1", "bounded-staleness", "bounded-staleness=-1", "bounded-staleness=soon"} {
+		if _, err := ParseReadConsistency(value); err == nil {
+			t.Fatalf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestFollowerStalenessTracksCommitSequence(t *testing.T) {
+	coordinator := NewCoordinator(NodeRoleSecondary, []string{}, "http://primary")
+	if lag, _ := coordinator.Staleness(); lag != 0 {
+		t.Fatalf("expected no lag before hearing from primary, got %d", lag)
+	}
+
+	coordinator.AdvanceCommitSeq(3, "op-ord-3")
+	lag, age := coordinator.Staleness()
+	if lag != 3 {
+		t.Fatalf("expected lag 3 behind reported commit seq, got %d", lag)
+	}
+	if age > time.Second {
+		t.Fatalf("expected a fresh commit seq report, got age %s", age)
+	}
+
+	primary := NewCoordinator(NodeRolePrimary, []string{}, "test-cluster")
+	if lag, age := primary.Staleness(); lag != 0 || age != 0 {
+		t.Fatalf("expected primary to never be stale, got lag=%d age=%s", lag, age)
+	}
+}
+
+func TestMembershipChangeNeedsQuorumOfOldAndNewConfiguration(t *testing.T) {
+	newPeer := func(down *atomic.Bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			if down.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(ReplicationResponse{Accepted: true})
+		}))
+	}
+	var aDown, bDown, nDown atomic.Bool
+	a, b, n := newPeer(&aDown), newPeer(&bDown), newPeer(&nDown)
+	defer a.Close()
+	defer b.Close()
+	defer n.Close()
+
+	coordinator := NewCoordinator(NodeRolePrimary, []string{a.URL, b.URL}, "test-cluster")
+	manager := NewReplicationManager(coordinator, obs.New())
+	_, config, err := coordinator.MembershipChange(n.URL+"/", MembershipAddVoter)
+	if err != nil {
+		t.Fatalf("membership change unexpected error: %v", err)
+	}
+	members := config.Members
+	if len(members) != 3 || members[2] != n.URL {
+		t.Fatalf("expected new node appended to members, got %v", members)
+	}
+	if _, _, err := coordinator.MembershipChange(a.URL, MembershipAddVoter); err == nil {
+		t.Fatalf("expected adding an existing member to fail")
+	}
+	if _, _, err := coordinator.MembershipChange("http://unknown", MembershipRemove); err == nil {
+		t.Fatalf("expected removing a non-member to fail")
+	}
+
+	// the new node alone is a quorum of neither configuration's followers
+	aDown.Store(true)
+	bDown.Store(true)
+	entry := ReplicationEntry{Seq: coordinator.NextSequence(), OpID: "op-members", Type: ReplicationWriteMembership, Members: members}
+	if err := manager.PrepareMembership(context.Background(), entry); err == nil {
+		t.Fatalf("expected membership change without an old quorum to fail")
+	}
+	if coordinator.State().LastSeq != 0 {
+		t.Fatalf("expected failed membership change to release its sequence, got %d", coordinator.State().LastSeq)
+	}
+
+	// A makes the old quorum and A plus N make the new one
+	aDown.Store(false)
+	entry.Seq = coordinator.NextSequence()
+	if err := manager.PrepareMembership(context.Background(), entry); err != nil {
+		t.Fatalf("membership change unexpected error: %v", err)
+	}
+	if _, err := manager.ApplyRemoteEntry(context.Background(), entry, func(_ context.Context, e ReplicationEntry) error {
+		coordinator.SetMembership(ClusterConfig{Members: e.Members})
+		return nil
+	}); err != nil {
+		t.Fatalf("apply membership change unexpected error: %v", err)
+	}
+	if got := coordinator.RequiredPeerAcks(); got != 2 {
+		t.Fatalf("expected four node cluster to need 2 peer acks, got %d", got)
+	}
+	if peers := coordinator.Peers(); len(peers) != 3 {
+		t.Fatalf("expected primary to replicate to all 3 members, got %v", peers)
+	}
+}
+
+func TestConfigurationEntriesCompareByMembership(t *testing.T) {
+	coordinator := NewCoordinator(NodeRoleSecondary, nil, "http://primary")
+	entry := ReplicationEntry{Seq: 1, OpID: "op-members", Type: ReplicationWriteMembership, Members: []string{"http://a", "http://b"}}
+	if _, err := coordinator.PrepareRemote(entry); err != nil {
+		t.Fatalf("prepare unexpected error: %v", err)
+	}
+
+	for _, changed := range []func(*ReplicationEntry){
+		func(e *ReplicationEntry) { e.Members = []string{"http://a"} },
+		func(e *ReplicationEntry) { e.Learners = []string{"http://b"} },
+		func(e *ReplicationEntry) { e.Primary = "http://a" },
+	} {
+		other := entry
+		changed(&other)
+		if _, err := coordinator.CommitRemote(other); err == nil {
+			t.Fatalf("expected commit of a different configuration %+v to fail", other)
+		}
+	}
+	if _, err := coordinator.CommitRemote(entry); err != nil {
+		t.Fatalf("commit unexpected error: %v", err)
+	}
+}
+
+func TestLearnerAcksNeverMakeQuorum(t *testing.T) {
+	var voterDown atomic.Bool
+	var learnerPrepares atomic.Int32
+	voter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if voterDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(ReplicationResponse{Accepted: true})
+	}))
+	defer voter.Close()
+	learner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		learnerPrepares.Add(1)
+		_ = json.NewEncoder(w).Encode(ReplicationResponse{Accepted: true})
+	}))
+	defer learner.Close()
+
+	coordinator := NewCoordinator(NodeRolePrimary, []string{voter.URL}, "test-cluster")
+	coordinator.SetMembership(ClusterConfig{Members: []string{voter.URL}, Learners: []string{learner.URL}})
+	manager := NewReplicationManager(coordinator, obs.New())
+	if got := coordinator.RequiredPeerAcks(); got != 1 {
+		t.Fatalf("expected learner not to change the quorum, got %d peer acks", got)
+	}
+
+	if err := manager.PrepareEntry(context.Background(), testReplicationEntry(coordinator.NextSequence(), "ord-1")); err != nil {
+		t.Fatalf("prepare unexpected error: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for learnerPrepares.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected learner to receive the prepare")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	voterDown.Store(true)
+	if err := manager.PrepareEntry(context.Background(), testReplicationEntry(coordinator.NextSequence(), "ord-2")); err == nil {
+		t.Fatalf("expected a learner ack alone not to commit")
+	}
+
+	// a promoted learner that knows its own URL becomes a secondary
+	node := NewCoordinator(NodeRoleLearner, []string{}, "http://primary")
+	node.SetSelf(learner.URL + "/")
+	node.SetMembership(ClusterConfig{Members: []string{voter.URL}, Learners: []string{learner.URL}})
+	if node.Role() != NodeRoleLearner {
+		t.Fatalf("expected node to stay a learner, got %s", node.Role())
+	}
+	node.SetMembership(ClusterConfig{Members: []string{voter.URL, learner.URL}})
+	if node.Role() != NodeRoleSecondary {
+		t.Fatalf("expected promoted learner to become a secondary, got %s", node.Role())
+	}
+}
+
+func TestAcceptLeadershipOnlyWhenCaughtUpAndUnexpired(t *testing.T) {
+	valid := func() TakeLeadershipRequest {
+		return TakeLeadershipRequest{
+			Self:        "http://a",
+			Previous:    "http://old",
+			AppliedSeq:  0,
+			Members:     []string{"http://b", "http://old"},
+			ExpiresAtMs: time.Now().Add(time.Second).UnixMilli(),
+		}
+	}
+
+	learner := NewCoordinator(NodeRoleLearner, []string{}, "http://old")
+	if err := learner.AcceptLeadership(valid()); err == nil {
+		t.Fatalf("expected a learner to refuse leadership")
+	}
+
+	follower := NewCoordinator(NodeRoleSecondary, []string{}, "http://old")
+	behind := valid()
+	behind.AppliedSeq = 1
+	if err := follower.AcceptLeadership(behind); err == nil {
+		t.Fatalf("expected a follower missing entries to refuse leadership")
+	}
+	expired := valid()
+	expired.ExpiresAtMs = time.Now().Add(-time.Millisecond).UnixMilli()
+	if err := follower.AcceptLeadership(expired); err == nil {
+		t.Fatalf("expected an expired transfer to be refused")
+	}
+
+	if err := follower.AcceptLeadership(valid()); err != nil {
+		t.Fatalf("accept leadership unexpected error: %v", err)
+	}
+	if !follower.CanAcceptWrite() || follower.Self() != "http://a" {
+		t.Fatalf("expected follower to be primary at http://a, got role=%s self=%s", follower.Role(), follower.Self())
+	}
+	if peers := follower.Peers(); len(peers) != 2 || follower.RequiredPeerAcks() != 1 {
+		t.Fatalf("expected new primary to replicate to b and the old primary, got %v", peers)
+	}
+
+	// a stepped down primary refuses writes and points them at the new primary
+	follower.stepDown("http://b")
+	var notPrimary *NotPrimaryError
+	if err := follower.checkPrimary(); !errors.As(err, &notPrimary) || notPrimary.Primary != "http://b" {
+		t.Fatalf("expected not primary error naming http://b, got %v", err)
+	}
+}
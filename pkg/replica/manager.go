@@ -8,8 +8,7 @@ import (
 	"io"
 	"net/http"
 	"replicated-clob/pkg/obs"
-	"strconv"
-	"sync"
+	"slices"
 	"time"
 )
 
@@ -20,40 +19,66 @@ type ReplicationManager struct {
 	obs         *obs.Client
 	client      *http.Client
 	timeout     time.Duration
+	group       *groupCommitter
+	peers       *peerTracker
+	lease       *leaderLease
+	// snapshotSource and snapshotLag are guarded by peers.mu
+	snapshotSource SnapshotSource
+	snapshotLag    int64
 }
 
 func NewReplicationManager(c *Coordinator, obs *obs.Client) *ReplicationManager {
-	return &ReplicationManager{
+	m := &ReplicationManager{
 		coordinator: c,
 		obs:         obs,
 		client:      &http.Client{},
 		timeout:     1 * time.Second,
+		peers:       newPeerTracker(),
+		lease:       &leaderLease{mode: ReadModeReadIndex, duration: DefaultLeaseDuration},
+		snapshotLag: DefaultSnapshotCatchUpLag,
 	}
+	m.group = newGroupCommitter(m)
+	return m
 }
 
 // PrepareEntry reserves a sequence, validates local ordering, and replicates prepare to peers.
 func (m *ReplicationManager) PrepareEntry(ctx context.Context, entry ReplicationEntry) error {
-	prepared, err := m.coordinator.PrepareRemote(entry)
-	if err != nil {
+	return m.PrepareEntries(ctx, []ReplicationEntry{entry})
+}
+
+// PrepareEntries prepares contiguous entries locally and replicates them to peers in a single
+// request, through the group committer. Either every entry reaches quorum or the local
+// reservations are reverted. Callers hold the write pipeline lock with the pipeline drained.
+func (m *ReplicationManager) PrepareEntries(ctx context.Context, entries []ReplicationEntry) error {
+	if err := m.coordinator.checkPrimary(); err != nil {
 		return err
 	}
+	prepared := make([]int64, 0, len(entries))
+	revert := func() {
+		for i := len(prepared) - 1; i >= 0; i-- {
+			m.coordinator.RevertSequence(prepared[i])
+		}
+	}
 
-	if err := m.replicateEntries(ctx, []ReplicationEntry{entry}, "/prepare"); err != nil {
-		if prepared {
-			m.coordinator.RevertSequence(entry.Seq)
+	for _, entry := range entries {
+		slotPrepared, err := m.coordinator.PrepareRemote(entry)
+		if err != nil {
+			revert()
+			return err
 		}
+		if slotPrepared {
+			prepared = append(prepared, entry.Seq)
+		}
+	}
+
+	if err := <-m.prepareGrouped(ctx, entries, true); err != nil {
+		revert()
 		return err
 	}
 
 	return nil
 }
 
-// CommitEntry replicates commit intent to peers. The caller applies local side effects
-// after successful quorum replication.
-func (m *ReplicationManager) CommitEntry(ctx context.Context, entry ReplicationEntry) error {
-	return m.replicateEntries(ctx, []ReplicationEntry{entry}, "/commit")
-}
-
 // ApplyRemoteEntry validates committed ordering in the coordinator and applies side effects if provided.
 func (m *ReplicationManager) ApplyRemoteEntry(
 	ctx context.Context,
@@ -74,9 +99,10 @@ func (m *ReplicationManager) ApplyRemoteEntry(
 	return true, onApply(ctx, entry)
 }
 
-// PrepareRemoteEntry applies prepare on this replica only.
-func (m *ReplicationManager) PrepareRemoteEntry(entry ReplicationEntry) (bool, error) {
-	return m.coordinator.PrepareRemote(entry)
+// PrepareRemoteEntry applies prepare on this replica only, for an entry the primary sent to follow
+// the entry with prevOpID.
+func (m *ReplicationManager) PrepareRemoteEntry(prevOpID string, entry ReplicationEntry) (bool, error) {
+	return m.coordinator.PrepareAfter(prevOpID, entry)
 }
 
 // ReplicateEntries is a compatibility shim for existing callers; it runs prepare semantics.
@@ -89,143 +115,112 @@ func (m *ReplicationManager) ReplicateEntries(ctx context.Context, entries []Rep
 	return nil
 }
 
-// GetReadRepairEntries returns entries needed to repair local state before serving a read.
-func (m *ReplicationManager) GetReadRepairEntries(ctx context.Context) ([]ReplicationEntry, error) {
-	m.obs.LogInfo(ctx, "replica.read: starting freshness check")
-	requiredAcks := m.coordinator.RequiredPeerAcks()
-	if requiredAcks <= 0 {
-		m.obs.LogInfo(ctx, "replica.read: quorum not required (single node)")
-		return nil, nil
-	}
-
-	peers := m.coordinator.Peers()
-
-	m.obs.LogInfo(ctx, "replica.read: starting freshness check required=%d peer_count=%d", requiredAcks, len(peers))
-
-	timeoutCtx, cancel := context.WithTimeout(ctx, m.timeout)
-	defer cancel()
-
-	localApplied := m.coordinator.GetAppliedSeq()
-	highestSeq := localApplied
-	highestPeer := ""
-	successes := 0
+func (m *ReplicationManager) replicateEntries(ctx context.Context, entries []ReplicationEntry, phase string) error {
+	// learners get every entry too, but only members' acks count
+	members := m.coordinator.Members()
+	return m.replicateToQuorum(ctx, entries, phase, m.coordinator.Peers(), func(acked []string) bool {
+		return hasQuorum(members, acked)
+	})
+}
 
-	for _, peer := range peers {
-		state, ok := m.getReplicaState(timeoutCtx, peer)
-		if !ok {
-			continue
-		}
-		successes++
-		m.obs.LogInfo(ctx, "replica.read: peer_state peer=%s applied=%d", peer, state.AppliedSeq)
-		if state.AppliedSeq > highestSeq {
-			highestSeq = state.AppliedSeq
-			highestPeer = peer
-		}
-	}
-	if successes < requiredAcks {
-		m.obs.LogErr(ctx, "replica.read: state quorum not met required=%d got=%d", requiredAcks, successes)
-		return nil, fmt.Errorf("replica read quorum not met: required=%d got=%d", requiredAcks, successes)
+// replicateToQuorum sends entries to peers and returns as soon as quorate accepts the peers that
+// have acked. Slower peers keep their own deadline and finish in the background; one that fails
+// is handed to its replication loop to catch up.
+func (m *ReplicationManager) replicateToQuorum(
+	ctx context.Context,
+	entries []ReplicationEntry,
+	phase string,
+	peers []string,
+	quorate func(acked []string) bool,
+) error {
+	if err := m.coordinator.checkPrimary(); err != nil {
+		return err
 	}
-	if highestSeq <= localApplied || highestPeer == "" {
-		m.obs.LogInfo(ctx, "replica.read: local state is fresh enough local_seq=%d", localApplied)
-		return nil, nil
+	if quorate(nil) {
+		return nil
 	}
 
-	m.obs.LogInfo(
-		ctx,
-		"replica.read: read repair needed local_seq=%d highest_peer=%s highest_seq=%d",
-		localApplied,
-		highestPeer,
-		highestSeq,
-	)
-
-	entries, err := m.getReplicaSync(timeoutCtx, highestPeer, localApplied)
-	if err != nil {
-		return nil, err
+	commitSeq, commitOpID := m.coordinator.CommitPoint()
+	request := ReplicationRequest{
+		Entries:    entries,
+		CommitSeq:  commitSeq,
+		CommitOpID: commitOpID,
 	}
-	m.obs.LogInfo(ctx, "replica.read: sync fetched %d entries from peer=%s", len(entries), highestPeer)
-
-	return entries, nil
-}
-
-func (m *ReplicationManager) replicateEntries(ctx context.Context, entries []ReplicationEntry, phase string) error {
-	requiredAcks := m.coordinator.RequiredPeerAcks()
-	if requiredAcks <= 0 {
-		return nil
+	if len(entries) > 0 {
+		request.PrevOpID = m.coordinator.opIDAt(entries[0].Seq - 1)
 	}
-
-	peers := m.coordinator.Peers()
-	request := ReplicationRequest{Entries: entries}
 	payload, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("marshal replication payload: %w", err)
 	}
 
-	timeoutCtx, cancel := context.WithTimeout(ctx, m.timeout)
-	defer cancel()
-
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	successes := 0
-
+	type peerResult struct {
+		peer string
+		ok   bool
+	}
+	start := time.Now()
+	results := make(chan peerResult, len(peers))
 	for _, peer := range peers {
-		wg.Add(1)
 		go func(p string) {
-			defer wg.Done()
-			if m.postReplicationRequest(timeoutCtx, p, phase, payload) {
-				mu.Lock()
-				successes++
-				mu.Unlock()
-			}
-		}(peer)
-	}
-	wg.Wait()
+			peerCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), m.timeout)
+			defer cancel()
 
-	if successes >= requiredAcks {
-		return nil
+			_, ok := m.postReplicationRequest(peerCtx, p, phase, payload)
+			results <- peerResult{peer: p, ok: ok}
+		}(peer)
 	}
 
-	return fmt.Errorf("replication %s quorum not met: required=%d got=%d", phase, requiredAcks, successes)
-}
-
-func (m *ReplicationManager) getReplicaSync(ctx context.Context, peer string, since int64) ([]ReplicationEntry, error) {
-	requestPath := "/sync?since=" + strconv.FormatInt(since, 10)
-	var response ReplicaSyncResponse
-
-	if err := m.doReplicaRequest(ctx, http.MethodGet, peer, requestPath, nil, &response); err != nil {
-		return nil, err
+	acked := []string{}
+	pending := slices.Clone(peers)
+	for len(pending) > 0 {
+		result := <-results
+		pending = slices.DeleteFunc(pending, func(p string) bool { return p == result.peer })
+		if result.ok {
+			acked = append(acked, result.peer)
+		}
+		if quorate(acked) {
+			m.extendLease(start)
+			return nil
+		}
+		// stop waiting once even the peers still out could not make a quorum
+		if !quorate(slices.Concat(acked, pending)) {
+			break
+		}
 	}
 
-	return response.Entries, nil
+	return fmt.Errorf("replication %s quorum not met: peers=%d acked=%d", phase, len(peers), len(acked))
 }
 
-func (m *ReplicationManager) getReplicaState(ctx context.Context, peer string) (ReplicaStateResponse, bool) {
+func (m *ReplicationManager) fetchReplicaState(ctx context.Context, peer string) (ReplicaStateResponse, error) {
 	var state ReplicaStateResponse
 	if err := m.doReplicaRequest(ctx, http.MethodGet, peer, "/state", nil, &state); err != nil {
-		m.obs.LogErr(ctx, "replica.read: peer state request failed peer=%s err=%v", peer, err)
-		return ReplicaStateResponse{}, false
+		return ReplicaStateResponse{}, err
 	}
-	return state, true
+	return state, nil
 }
 
-// postReplicationRequest sends a replica control request to a peer.
+// postReplicationRequest sends a replica control request to a peer. A peer that misses a request
+// for any reason is caught up in the background.
 func (m *ReplicationManager) postReplicationRequest(
 	ctx context.Context,
 	peer string,
 	phase string,
 	payload []byte,
-) bool {
+) (ReplicationResponse, bool) {
 	var response ReplicationResponse
 	if err := m.doReplicaRequest(ctx, http.MethodPost, peer, phase, payload, &response); err != nil {
 		m.obs.LogErr(ctx, "replica.replicate.request: peer=%s phase=%s err=%v", peer, phase, err)
-		return false
+		m.recordFailure(peer, err)
+		m.startCatchUp(ctx, peer)
+		return ReplicationResponse{}, false
 	}
 	if !response.Accepted {
 		m.obs.LogErr(ctx, "replica.replicate.request: peer rejected seq=%d", response.LastSeq)
-		return false
+		return ReplicationResponse{}, false
 	}
 
-	return true
+	m.recordMatch(peer, response.LastSeq)
+	return response, true
 }
 
 func (m *ReplicationManager) doReplicaRequest(
@@ -262,13 +257,12 @@ func (m *ReplicationManager) doReplicaRequest(
 		return fmt.Errorf("read replica response failed peer=%s path=%s err=%w", peer, path, err)
 	}
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf(
-			"replica response rejected peer=%s path=%s status=%d body=%s",
-			peer,
-			path,
-			res.StatusCode,
-			string(bodyBytes),
-		)
+		return &ReplicaResponseError{
+			Peer:   peer,
+			Path:   path,
+			Status: res.StatusCode,
+			Body:   string(bodyBytes),
+		}
 	}
 
 	if response == nil {
@@ -0,0 +1,190 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ClusterConfig is the replicated cluster configuration. Members vote; learners receive every
+// entry but never count toward a quorum.
+type ClusterConfig struct {
+	// Primary is set on the entry a new primary replicates after a leadership transfer.
+	Primary  string   `json:"primary,omitempty"`
+	Members  []string `json:"members"`
+	Learners []string `json:"learners"`
+}
+
+// MembershipAction is a single-node change to the cluster configuration.
+type MembershipAction string
+
+const (
+	MembershipAddVoter   MembershipAction = "add_voter"
+	MembershipAddLearner MembershipAction = "add_learner"
+	MembershipPromote    MembershipAction = "promote"
+	MembershipRemove     MembershipAction = "remove"
+)
+
+// Members returns the committed voting configuration.
+func (c *Coordinator) Members() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return slices.Clone(c.members)
+}
+
+func (c *Coordinator) Learners() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return slices.Clone(c.learners)
+}
+
+func (c *Coordinator) IsLearner(peer string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return slices.Contains(c.learners, peer)
+}
+
+// SetSelf records this node's URL as its peers reach it, so it can find itself in a configuration.
+func (c *Coordinator) SetSelf(self string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.self = strings.TrimRight(strings.TrimSpace(self), "/")
+}
+
+// SetMembership installs a committed configuration. The primary replicates to exactly its members
+// and learners; followers only record it, along with who the primary is when that changed. A
+// learner that finds itself among the members has been promoted and becomes a secondary.
+func (c *Coordinator) SetMembership(config ClusterConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if config.Primary != "" && !c.role.IsPrimary() {
+		c.primary = config.Primary
+	}
+	c.members = c.normalizePeerURLs(config.Members)
+	c.learners = c.normalizePeerURLs(config.Learners)
+	if c.role.IsPrimary() {
+		c.peers = c.normalizePeerURLs(slices.Concat(c.members, c.learners))
+	}
+	if c.role == NodeRoleLearner && c.self != "" && slices.Contains(c.members, c.self) {
+		c.role = NodeRoleSecondary
+	}
+}
+
+// MembershipChange returns the normalized peer and the configuration that applying action to it
+// would produce. Voters change one at a time, so any quorum of the old configuration overlaps any
+// quorum of the new. Learners never vote, so adding or removing one leaves the quorum alone.
+func (c *Coordinator) MembershipChange(peer string, action MembershipAction) (string, ClusterConfig, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	normalized := c.normalizePeerURLs([]string{peer})
+	if len(normalized) == 0 {
+		return "", ClusterConfig{}, errors.New("peer is required")
+	}
+	peer = normalized[0]
+	isMember := slices.Contains(c.members, peer)
+	isLearner := slices.Contains(c.learners, peer)
+	without := func(peers []string) []string {
+		return slices.DeleteFunc(slices.Clone(peers), func(p string) bool { return p == peer })
+	}
+
+	switch action {
+	case MembershipAddVoter, MembershipAddLearner:
+		if isMember || isLearner {
+			return "", ClusterConfig{}, fmt.Errorf("peer %s is already in the cluster", peer)
+		}
+		if action == MembershipAddLearner {
+			return peer, ClusterConfig{Members: slices.Clone(c.members), Learners: append(slices.Clone(c.learners), peer)}, nil
+		}
+		return peer, ClusterConfig{Members: append(slices.Clone(c.members), peer), Learners: slices.Clone(c.learners)}, nil
+	case MembershipPromote:
+		if !isLearner {
+			return "", ClusterConfig{}, fmt.Errorf("peer %s is not a learner", peer)
+		}
+		return peer, ClusterConfig{Members: append(slices.Clone(c.members), peer), Learners: without(c.learners)}, nil
+	case MembershipRemove:
+		if !isMember && !isLearner {
+			return "", ClusterConfig{}, fmt.Errorf("peer %s is not in the cluster", peer)
+		}
+		return peer, ClusterConfig{Members: without(c.members), Learners: without(c.learners)}, nil
+	default:
+		return "", ClusterConfig{}, fmt.Errorf("unknown membership action %q", action)
+	}
+}
+
+// PrepareMembership prepares a configuration entry and replicates it to the old and new members.
+// It commits only once a quorum of each configuration has it, so the change cannot be lost
+// whichever configuration a later primary counts. Callers hold the write lock, which keeps one
+// change in flight at a time; the new configuration takes effect when the entry is applied.
+func (m *ReplicationManager) PrepareMembership(ctx context.Context, entry ReplicationEntry) error {
+	if entry.Type != ReplicationWriteMembership {
+		return fmt.Errorf("entry seq=%d is not a membership change", entry.Seq)
+	}
+	if err := m.coordinator.checkPrimary(); err != nil {
+		return err
+	}
+	if _, err := m.coordinator.PrepareRemote(entry); err != nil {
+		return err
+	}
+
+	current := m.coordinator.Members()
+	next := m.coordinator.normalizePeerURLs(entry.Members)
+	peers := m.coordinator.normalizePeerURLs(slices.Concat(m.coordinator.Peers(), next, entry.Learners))
+	err := <-m.group.enqueue(groupedWrite{
+		ctx:     ctx,
+		entries: []ReplicationEntry{entry},
+		alone:   true,
+		send: func(ctx context.Context, entries []ReplicationEntry) error {
+			return m.replicateToQuorum(ctx, entries, "/prepare", peers, func(acked []string) bool {
+				return hasQuorum(current, acked) && hasQuorum(next, acked)
+			})
+		},
+	})
+	if err != nil {
+		m.coordinator.RevertSequence(entry.Seq)
+		return err
+	}
+	return nil
+}
+
+func hasQuorum(members []string, acked []string) bool {
+	count := 0
+	for _, peer := range acked {
+		if slices.Contains(members, peer) {
+			count++
+		}
+	}
+	return count >= requiredPeerAcks(len(members))
+}
+
+// SyncPeer brings a node that is not a member yet up to the applied sequence, so adding it does
+// not leave the quorum waiting on its catch-up. It retries until ctx is done.
+func (m *ReplicationManager) SyncPeer(ctx context.Context, peer string) error {
+	backoff := catchUpMinBackoff
+	for {
+		caughtUp, err := m.catchUpStep(ctx, peer)
+		if err == nil && caughtUp {
+			return nil
+		}
+		if err == nil {
+			backoff = catchUpMinBackoff
+			continue
+		}
+
+		m.obs.LogErr(ctx, "replica.sync_peer: peer=%s retry_in=%s err=%v", peer, backoff, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("sync peer=%s: %w", peer, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, catchUpMaxBackoff)
+	}
+}
@@ -1,12 +1,17 @@
 package replica
 
-import "strings"
+import (
+	"slices"
+	"strings"
+)
 
+// SetPeers sets the startup configuration: every peer is a voting member.
 func (c *Coordinator) SetPeers(peers []string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	c.peers = c.normalizePeerURLs(peers)
+	c.members = slices.Clone(c.peers)
 }
 
 func (c *Coordinator) SetPrimary(primary string) {
@@ -25,6 +30,13 @@ func (c *Coordinator) Peers() []string {
 	return peers
 }
 
+func (c *Coordinator) HasPeer(peer string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return slices.Contains(c.peers, peer)
+}
+
 func (c *Coordinator) Primary() string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -0,0 +1,191 @@
+package replica
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Pipeline replicates writes without holding the write pipeline lock across quorum round trips.
+// Each submitted entry gets the next sequence and joins the next group prepare straight away, so
+// many sequences can be in flight at once. A single committer then applies entries strictly in
+// sequence order as their prepares reach quorum and releases each caller as its entry lands.
+//
+// If an entry misses prepare quorum, it and every entry queued behind it fail, because later
+// sequences cannot commit past the hole, and their sequences are released for reuse. Followers
+// never apply a prepare left at a released sequence, see Coordinator.CommittedPrepared.
+type Pipeline struct {
+	manager  *ReplicationManager
+	depth    int
+	inflight []*pipelinedWrite
+	// reserved counts slots held by callers that have yet to submit
+	reserved int
+	mu       sync.Mutex
+	cond     *sync.Cond
+}
+
+// DefaultPipelineDepth is how many writes may be in flight unless configured otherwise. It
+// matches the default group commit size, so a full pipeline fits in one prepare request.
+const DefaultPipelineDepth = DefaultGroupCommitSize
+
+type pipelinedWrite struct {
+	ctx        context.Context
+	entry      ReplicationEntry
+	apply      EntrySideEffect
+	prepared   chan struct{}
+	prepareErr error
+	done       chan error
+}
+
+func NewPipeline(manager *ReplicationManager) *Pipeline {
+	p := &Pipeline{
+		manager: manager,
+		depth:   1,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	go p.commitLoop()
+	return p
+}
+
+// SetDepth bounds how many entries may be in flight. Peers must accept prepares at least this far
+// ahead of their applied sequence, see Coordinator.SetPrepareWindow.
+func (p *Pipeline) SetDepth(depth int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.depth = max(depth, 1)
+	p.cond.Broadcast()
+}
+
+// Reserve waits for room in the pipeline and holds it for the caller's next Submit. Callers
+// reserve before taking the write pipeline lock, so a full pipeline never stalls the lock holder,
+// and call Release instead if they end up not submitting.
+func (p *Pipeline) Reserve() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.inflight)+p.reserved >= p.depth {
+		p.cond.Wait()
+	}
+	p.reserved++
+}
+
+// Release gives back a slot taken with Reserve that was not used.
+func (p *Pipeline) Release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reserved--
+	p.cond.Broadcast()
+}
+
+// Submit assigns the next sequence to entry, prepares it locally and starts the peer prepare.
+// It uses the slot the caller reserved, so it never waits for the pipeline to make room.
+// The returned channel yields once the entry has been committed and applied, or has failed.
+// apply runs on the committer, in sequence order, only for entries that commit.
+func (p *Pipeline) Submit(ctx context.Context, entry ReplicationEntry, apply EntrySideEffect) <-chan error {
+	// the write outlives a client that disconnects; only the request ID is carried over
+	ctx = context.WithoutCancel(ctx)
+	write := &pipelinedWrite{
+		ctx:      ctx,
+		apply:    apply,
+		prepared: make(chan struct{}),
+		done:     make(chan error, 1),
+	}
+
+	p.mu.Lock()
+	p.reserved--
+	if err := p.manager.coordinator.checkPrimary(); err != nil {
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		write.done <- err
+		return write.done
+	}
+	entry.Seq = p.manager.coordinator.NextSequence()
+	if entry.TimestampMs == 0 {
+		entry.TimestampMs = time.Now().UnixMilli()
+	}
+	write.entry = entry
+	if _, err := p.manager.coordinator.PrepareRemote(entry); err != nil {
+		p.manager.coordinator.RevertSequence(entry.Seq)
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		write.done <- err
+		return write.done
+	}
+	p.inflight = append(p.inflight, write)
+	// queued under p.mu so prepares are grouped in sequence order
+	prepared := p.manager.prepareGrouped(ctx, []ReplicationEntry{entry}, false)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	go func() {
+		write.prepareErr = <-prepared
+		close(write.prepared)
+	}()
+	return write.done
+}
+
+// Drain blocks until every submitted entry has committed or failed. Callers hold the write
+// pipeline lock so nothing new is submitted while they wait.
+func (p *Pipeline) Drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.inflight) > 0 {
+		p.cond.Wait()
+	}
+}
+
+func (p *Pipeline) commitLoop() {
+	for {
+		p.mu.Lock()
+		for len(p.inflight) == 0 {
+			p.cond.Wait()
+		}
+		head := p.inflight[0]
+		p.mu.Unlock()
+
+		<-head.prepared
+		if head.prepareErr != nil {
+			p.manager.obs.LogAlert(head.ctx, "replica.pipeline: prepare failed seq=%d err=%v", head.entry.Seq, head.prepareErr)
+			p.failAll(head.prepareErr)
+			continue
+		}
+
+		// Reaching prepare quorum commits the entry. Followers learn that from the commit
+		// sequence on later prepares and heartbeats, so there is no second round trip.
+		_, err := p.manager.ApplyRemoteEntry(head.ctx, head.entry, head.apply)
+		head.done <- err
+
+		p.mu.Lock()
+		p.inflight = p.inflight[1:]
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+// failAll fails every queued entry and releases their sequences, newest first. Followers may
+// already hold prepares at those sequences; they are replaced when the sequences are reused.
+func (p *Pipeline) failAll(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := len(p.inflight) - 1; i >= 0; i-- {
+		p.manager.coordinator.RevertSequence(p.inflight[i].entry.Seq)
+	}
+	for _, write := range p.inflight {
+		write.done <- err
+	}
+	p.inflight = nil
+	p.cond.Broadcast()
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
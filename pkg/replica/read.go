@@ -0,0 +1,191 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadMode selects how a node proves a read is linearizable.
+type ReadMode string
+
+const (
+	// ReadModeReadIndex confirms leadership with a heartbeat quorum on every read.
+	ReadModeReadIndex ReadMode = "read_index"
+	// ReadModeLease serves primary reads locally while a quorum has acknowledged the primary
+	// within the lease duration. It relies on clocks drifting by less than the lease margin.
+	ReadModeLease ReadMode = "lease"
+)
+
+const DefaultLeaseDuration = time.Second
+
+// PrimaryContactTimeout is how recently a follower must have heard the primary's commit sequence
+// for a sequence bound to hold. Lag is measured against the last commit sequence heard, so a
+// follower cut off from the primary would otherwise never look behind.
+const PrimaryContactTimeout = time.Second
+
+func ParseReadMode(mode string) (ReadMode, error) {
+	switch ReadMode(mode) {
+	case ReadModeReadIndex, ReadModeLease:
+		return ReadMode(mode), nil
+	default:
+		return "", fmt.Errorf("read mode must be %s or %s", ReadModeReadIndex, ReadModeLease)
+	}
+}
+
+// ReadConsistency is how fresh a single read must be. Linearizable reads go through the read
+// index; local reads are served from whatever this node has applied; bounded staleness reads are
+// served locally when this node is within MaxLag sequences or MaxAge of the primary's last
+// reported commit sequence, and otherwise fall back to the read index. A sequence bound also needs
+// the primary to have reported within PrimaryContactTimeout.
+type ReadConsistency struct {
+	Level  ReadConsistencyLevel
+	MaxLag int64
+	MaxAge time.Duration
+}
+
+type ReadConsistencyLevel string
+
+const (
+	ReadLinearizable     ReadConsistencyLevel = "linearizable"
+	ReadBoundedStaleness ReadConsistencyLevel = "bounded-staleness"
+	ReadLocal            ReadConsistencyLevel = "local"
+)
+
+// ParseReadConsistency accepts linearizable, local, bounded-staleness=<seqs> or
+// bounded-staleness=<duration> such as 500ms. An empty value is linearizable.
+func ParseReadConsistency(value string) (ReadConsistency, error) {
+	level, bound, hasBound := strings.Cut(strings.TrimSpace(value), "=")
+	switch ReadConsistencyLevel(level) {
+	case "", ReadLinearizable:
+		if hasBound {
+			return ReadConsistency{}, fmt.Errorf("%s takes no bound", ReadLinearizable)
+		}
+		return ReadConsistency{Level: ReadLinearizable}, nil
+	case ReadLocal:
+		if hasBound {
+			return ReadConsistency{}, fmt.Errorf("%s takes no bound", ReadLocal)
+		}
+		return ReadConsistency{Level: ReadLocal}, nil
+	case ReadBoundedStaleness:
+		if lag, err := strconv.ParseInt(bound, 10, 64); err == nil && lag >= 0 {
+			return ReadConsistency{Level: ReadBoundedStaleness, MaxLag: lag, MaxAge: -1}, nil
+		}
+		if age, err := time.ParseDuration(bound); err == nil && age >= 0 {
+			return ReadConsistency{Level: ReadBoundedStaleness, MaxLag: -1, MaxAge: age}, nil
+		}
+		return ReadConsistency{}, fmt.Errorf("%s needs a sequence count or duration bound, got %q", ReadBoundedStaleness, bound)
+	default:
+		return ReadConsistency{}, fmt.Errorf("read consistency must be %s, %s=<seqs|duration> or %s", ReadLinearizable, ReadBoundedStaleness, ReadLocal)
+	}
+}
+
+// Within reports whether a node lagging by lag sequences, last synced age ago, meets the bound.
+func (r ReadConsistency) Within(lag int64, age time.Duration) bool {
+	switch r.Level {
+	case ReadLocal:
+		return true
+	case ReadBoundedStaleness:
+		if r.MaxLag >= 0 {
+			return lag <= r.MaxLag && age <= PrimaryContactTimeout
+		}
+		// an age only means something once every sequence reported by then has been applied
+		return lag == 0 && age <= r.MaxAge
+	default:
+		return false
+	}
+}
+
+// ReadIndexResponse is the primary's commit sequence, confirmed while it still held a quorum, and
+// the OpID of the entry committed there.
+type ReadIndexResponse struct {
+	ReadIndex int64  `json:"readIndex"`
+	OpID      string `json:"opId,omitempty"`
+}
+
+// leaderLease tracks when a quorum last acknowledged this node as primary.
+type leaderLease struct {
+	mode     ReadMode
+	duration time.Duration
+	// until is when the lease runs out, measured from the start of the round that earned it
+	until time.Time
+	mu    sync.Mutex
+}
+
+func (m *ReplicationManager) SetReadMode(mode ReadMode, leaseDuration time.Duration) {
+	m.lease.mu.Lock()
+	defer m.lease.mu.Unlock()
+
+	m.lease.mode = mode
+	m.lease.duration = leaseDuration
+	m.lease.until = time.Time{}
+}
+
+func (m *ReplicationManager) readMode() ReadMode {
+	m.lease.mu.Lock()
+	defer m.lease.mu.Unlock()
+
+	return m.lease.mode
+}
+
+// extendLease records a quorum acknowledgement for a round sent at start. A tenth of the lease
+// is held back for clock drift.
+func (m *ReplicationManager) extendLease(start time.Time) {
+	m.lease.mu.Lock()
+	defer m.lease.mu.Unlock()
+
+	if m.lease.mode != ReadModeLease {
+		return
+	}
+	until := start.Add(m.lease.duration - m.lease.duration/10)
+	if until.After(m.lease.until) {
+		m.lease.until = until
+	}
+}
+
+func (m *ReplicationManager) leaseValid() bool {
+	m.lease.mu.Lock()
+	defer m.lease.mu.Unlock()
+
+	return m.lease.mode == ReadModeLease && time.Now().Before(m.lease.until)
+}
+
+// ReadIndex returns the sequence a read must wait for before it is linearizable. The primary
+// answers from its lease when it holds one and otherwise confirms it still has a quorum; other
+// nodes ask the primary.
+func (m *ReplicationManager) ReadIndex(ctx context.Context) (ReadIndexResponse, error) {
+	if !m.coordinator.CanAcceptWrite() {
+		return m.fetchReadIndex(ctx)
+	}
+
+	// taken before confirming, so it covers every write acknowledged before the read began
+	readIndex, opID := m.coordinator.CommitPoint()
+	if m.leaseValid() {
+		return ReadIndexResponse{ReadIndex: readIndex, OpID: opID}, nil
+	}
+	if err := m.replicateEntries(ctx, nil, "/heartbeat"); err != nil {
+		return ReadIndexResponse{}, fmt.Errorf("confirm leadership: %w", err)
+	}
+	return ReadIndexResponse{ReadIndex: readIndex, OpID: opID}, nil
+}
+
+func (m *ReplicationManager) fetchReadIndex(ctx context.Context) (ReadIndexResponse, error) {
+	primary := m.coordinator.Primary()
+	if primary == "" {
+		return ReadIndexResponse{}, errors.New("no primary to take a read index from")
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	var response ReadIndexResponse
+	if err := m.doReplicaRequest(timeoutCtx, http.MethodGet, primary, "/read-index", nil, &response); err != nil {
+		return ReadIndexResponse{}, err
+	}
+	return response, nil
+}
@@ -1,10 +1,19 @@
 package replica
 
+import (
+	"encoding/json"
+
+	"replicated-clob/schemas"
+)
+
 type NodeRole string
 
 const (
 	NodeRolePrimary   NodeRole = "primary"
 	NodeRoleSecondary NodeRole = "secondary"
+	// NodeRoleLearner receives every committed entry but never counts toward a quorum and can
+	// never become primary. A learner becomes a secondary once it is promoted to voter.
+	NodeRoleLearner NodeRole = "learner"
 )
 
 func (r NodeRole) IsPrimary() bool {
@@ -14,23 +23,71 @@ func (r NodeRole) IsPrimary() bool {
 type ReplicationWriteType string
 
 const (
-	ReplicationWritePost   ReplicationWriteType = "post_limit"
-	ReplicationWriteCancel ReplicationWriteType = "cancel_limit"
+	ReplicationWritePost          ReplicationWriteType = "post_limit"
+	ReplicationWriteCancel        ReplicationWriteType = "cancel_limit"
+	ReplicationWriteAmend         ReplicationWriteType = "amend_limit"
+	ReplicationWriteQuote         ReplicationWriteType = "replace_quote"
+	ReplicationWriteTrailingStop  ReplicationWriteType = "post_trailing_stop"
+	ReplicationWriteDeposit       ReplicationWriteType = "deposit"
+	ReplicationWriteWithdraw      ReplicationWriteType = "withdraw"
+	ReplicationWriteRiskLimits    ReplicationWriteType = "set_risk_limits"
+	ReplicationWriteKillSwitch    ReplicationWriteType = "kill_switch"
+	ReplicationWriteMassCancel    ReplicationWriteType = "mass_cancel"
+	ReplicationWriteSessionStart  ReplicationWriteType = "session_start"
+	ReplicationWriteSessionEnd    ReplicationWriteType = "session_end"
+	ReplicationWriteSessionExpire ReplicationWriteType = "session_expire"
+	ReplicationWriteMarketPhase   ReplicationWriteType = "set_market_phase"
+	ReplicationWriteUncross       ReplicationWriteType = "auction_uncross"
+	ReplicationWritePriceBands    ReplicationWriteType = "set_price_bands"
+	ReplicationWriteFeeTier       ReplicationWriteType = "set_fee_tier"
+	ReplicationWriteFeeAssign     ReplicationWriteType = "assign_fee_tier"
+	ReplicationWriteMatching      ReplicationWriteType = "set_matching"
+	ReplicationWriteInstrument    ReplicationWriteType = "set_instrument_rules"
+	ReplicationWriteMembership    ReplicationWriteType = "set_membership"
+	ReplicationWriteCollateral    ReplicationWriteType = "set_collateral"
 )
 
 type ReplicationEntry struct {
-	Seq        int64                `json:"seq"`
-	OpID       string               `json:"opId"`
-	Type       ReplicationWriteType `json:"type"`
-	User       string               `json:"user,omitempty"`
-	OrderID    string               `json:"orderId"`
-	PriceLevel int64                `json:"priceLevel,omitempty"`
-	Amount     int64                `json:"amount,omitempty"`
-	IsBid      bool                 `json:"isBid,omitempty"`
+	Seq           int64                     `json:"seq"`
+	OpID          string                    `json:"opId"`
+	Type          ReplicationWriteType      `json:"type"`
+	User          string                    `json:"user,omitempty"`
+	OrderID       string                    `json:"orderId"`
+	ClientOrderID string                    `json:"clientOrderId,omitempty"`
+	PriceLevel    int64                     `json:"priceLevel,omitempty"`
+	Amount        int64                     `json:"amount,omitempty"`
+	IsBid         bool                      `json:"isBid,omitempty"`
+	TrailOffset   int64                     `json:"trailOffset,omitempty"`
+	TrailBps      int64                     `json:"trailBps,omitempty"`
+	BaseAmount    int64                     `json:"base,omitempty"`
+	QuoteAmount   int64                     `json:"quote,omitempty"`
+	Limits        *schemas.RiskLimits       `json:"limits,omitempty"`
+	Blocked       bool                      `json:"blocked,omitempty"`
+	MassCancel    *schemas.MassCancelFilter `json:"massCancel,omitempty"`
+	TimeoutMs     int64                     `json:"timeoutMs,omitempty"`
+	Phase         schemas.MarketPhase       `json:"phase,omitempty"`
+	PriceBands    *schemas.PriceBands       `json:"priceBands,omitempty"`
+	TimestampMs   int64                     `json:"ts,omitempty"`
+	FeeTier       string                    `json:"feeTier,omitempty"`
+	Fees          *schemas.FeeSchedule      `json:"fees,omitempty"`
+	Matching      *schemas.MatchingConfig   `json:"matching,omitempty"`
+	Instrument    *schemas.InstrumentRules  `json:"instrument,omitempty"`
+	MassQuote     *schemas.Quote            `json:"massQuote,omitempty"`
+	Collateral    *schemas.CollateralConfig `json:"collateral,omitempty"`
+	Members       []string                  `json:"members,omitempty"`
+	Learners      []string                  `json:"learners,omitempty"`
+	Primary       string                    `json:"primary,omitempty"`
 }
 
+// ReplicationRequest carries entries to prepare along with the primary's commit sequence, which
+// tells followers which prepared entries they may apply. PrevOpID names the entry the first one
+// follows and CommitOpID the entry committed at CommitSeq, so a follower can tell a prepare the
+// primary gave up on from the entry that later committed at the same sequence.
 type ReplicationRequest struct {
-	Entries []ReplicationEntry `json:"entries"`
+	Entries    []ReplicationEntry `json:"entries"`
+	PrevOpID   string             `json:"prevOpId,omitempty"`
+	CommitSeq  int64              `json:"commitSeq,omitempty"`
+	CommitOpID string             `json:"commitOpId,omitempty"`
 }
 
 type ReplicationResponse struct {
@@ -42,14 +99,48 @@ type ReplicaStateResponse struct {
 	Role       NodeRole `json:"role"`
 	LastSeq    int64    `json:"lastSeq"`
 	AppliedSeq int64    `json:"appliedSeq"`
+	CommitSeq  int64    `json:"commitSeq"`
 	PeerCount  int      `json:"peerCount"`
 	Primary    string   `json:"primary"`
+	Members    []string `json:"members"`
+	Learners   []string `json:"learners"`
+}
+
+// ReplicaPeersResponse is the primary's view of every follower's replication progress.
+type ReplicaPeersResponse struct {
+	AppliedSeq int64          `json:"appliedSeq"`
+	Peers      []PeerProgress `json:"peers"`
 }
 
 type ReplicaSyncResponse struct {
 	Entries []ReplicationEntry `json:"entries"`
 }
 
+// ReplicaSnapshotResponse carries the applied state as of AppliedSeq. State is opaque to the
+// replication layer.
+type ReplicaSnapshotResponse struct {
+	AppliedSeq  int64           `json:"appliedSeq"`
+	AppliedOpID string          `json:"appliedOpId,omitempty"`
+	State       json.RawMessage `json:"state"`
+	// Members and Learners are the cluster configuration as of AppliedSeq.
+	Members  []string `json:"members,omitempty"`
+	Learners []string `json:"learners,omitempty"`
+}
+
+// ClusterNodeRequest names a node to add to, promote in or remove from the cluster configuration.
+type ClusterNodeRequest struct {
+	Peer string `json:"peer"`
+}
+
+// ClusterMembershipResponse is the committed cluster configuration and the quorum it implies.
+type ClusterMembershipResponse struct {
+	Primary          string   `json:"primary"`
+	Members          []string `json:"members"`
+	Learners         []string `json:"learners"`
+	RequiredPeerAcks int      `json:"requiredPeerAcks"`
+	AppliedSeq       int64    `json:"appliedSeq"`
+}
+
 const (
 	RequestIDHeader     = "X-Request-ID"
 	RequestIDContextKey = "reqId"
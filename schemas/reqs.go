@@ -1,10 +1,11 @@
 package schemas
 
 type PostLimitRequest struct {
-	User       string `json:"user"`
-	PriceLevel int64  `json:"priceLevel"`
-	Amount     int64  `json:"amount"`
-	IsBid      bool   `json:"isBid"`
+	User          string `json:"user"`
+	ClientOrderID string `json:"clientOrderId,omitempty"`
+	PriceLevel    int64  `json:"priceLevel"`
+	Amount        int64  `json:"amount"`
+	IsBid         bool   `json:"isBid"`
 }
 
 type PostLimitMatch struct {
@@ -13,42 +14,392 @@ type PostLimitMatch struct {
 }
 
 type PostLimitResponse struct {
-	OrderID string           `json:"orderId"`
-	Fills   []PostLimitMatch `json:"fills"`
+	OrderID       string           `json:"orderId"`
+	ClientOrderID string           `json:"clientOrderId,omitempty"`
+	Fills         []PostLimitMatch `json:"fills"`
 }
 
+type PostTrailingStopRequest struct {
+	User        string `json:"user"`
+	Amount      int64  `json:"amount"`
+	IsBid       bool   `json:"isBid"`
+	TrailOffset int64  `json:"trailOffset"`
+	TrailBps    int64  `json:"trailBps"`
+}
+
+type TrailingStop struct {
+	User           string `json:"user"`
+	StopID         string `json:"stopId"`
+	Amount         int64  `json:"amount"`
+	IsBid          bool   `json:"isBid"`
+	TrailOffset    int64  `json:"trailOffset,omitempty"`
+	TrailBps       int64  `json:"trailBps,omitempty"`
+	ReferencePrice int64  `json:"referencePrice"`
+	TriggerPrice   int64  `json:"triggerPrice"`
+	Armed          bool   `json:"armed"`
+}
+
+type TrailingStopsResponse struct {
+	Stops []TrailingStop `json:"stops"`
+}
+
+// CancelLimitRequest identifies the order either by server OrderID or by User and ClientOrderID.
 type CancelLimitRequest struct {
-	OrderID string `json:"orderId"`
+	OrderID       string `json:"orderId"`
+	User          string `json:"user,omitempty"`
+	ClientOrderID string `json:"clientOrderId,omitempty"`
 }
 
 type CancelLimitResponse struct {
 	SizeCancelled int64
 }
 
+// MassCancelFilter narrows a mass cancel. Side is "bid", "ask" or empty for both; a zero price
+// bound leaves that end of the band open.
+type MassCancelFilter struct {
+	Side     string `json:"side,omitempty"`
+	MinPrice int64  `json:"minPrice,omitempty"`
+	MaxPrice int64  `json:"maxPrice,omitempty"`
+}
+
+type MassCancelRequest struct {
+	User string `json:"user"`
+	MassCancelFilter
+}
+
+type MassCancelResponse struct {
+	CancelledOrderIDs []string `json:"cancelledOrderIds"`
+	SizeCancelled     int64    `json:"sizeCancelled"`
+}
+
 type OpenOrder struct {
-	User       string `json:"user"`
-	OrderID    string `json:"orderId"`
-	PriceLevel int64  `json:"priceLevel"`
-	Amount     int64  `json:"amount"`
-	IsBid      bool   `json:"isBid"`
+	User          string `json:"user"`
+	OrderID       string `json:"orderId"`
+	ClientOrderID string `json:"clientOrderId,omitempty"`
+	PriceLevel    int64  `json:"priceLevel"`
+	Amount        int64  `json:"amount"`
+	IsBid         bool   `json:"isBid"`
 }
 
 type OpenOrdersResponse struct {
 	Orders []OpenOrder `json:"orders"`
 }
 
+type OrderStatusResponse struct {
+	OrderID       string `json:"orderId"`
+	ClientOrderID string `json:"clientOrderId,omitempty"`
+	User          string `json:"user"`
+	Kind          string `json:"kind"`
+	State         string `json:"state"`
+	PriceLevel    int64  `json:"priceLevel,omitempty"`
+	Amount        int64  `json:"amount"`
+	Filled        int64  `json:"filled"`
+	IsBid         bool   `json:"isBid"`
+	RejectReason  string `json:"rejectReason,omitempty"`
+	CreatedAtMs   int64  `json:"createdAtMs"`
+	UpdatedAtMs   int64  `json:"updatedAtMs"`
+}
+
+type OrderHistoryResponse struct {
+	Orders []OrderStatusResponse `json:"orders"`
+}
+
+type ClientOrderResponse struct {
+	User          string           `json:"user"`
+	ClientOrderID string           `json:"clientOrderId"`
+	OrderID       string           `json:"orderId"`
+	Open          bool             `json:"open"`
+	Remaining     int64            `json:"remaining"`
+	Fills         []PostLimitMatch `json:"fills"`
+}
+
 type Fill struct {
 	Counterparty string `json:"counterparty"`
 	Size         int64  `json:"size"`
 	PriceLevel   int64  `json:"priceLevel"`
 	IsMaker      bool   `json:"isMaker"`
+	Fee          int64  `json:"fee"`
+	FeeBps       int64  `json:"feeBps"`
 }
 
 type FillsResponse struct {
 	Fills []Fill `json:"fills"`
 }
 
+type BalanceRequest struct {
+	User  string `json:"user"`
+	Base  int64  `json:"base"`
+	Quote int64  `json:"quote"`
+}
+
+// CollateralConfig turns collateral enforcement on or off for the whole market.
+type CollateralConfig struct {
+	RequireCollateral bool `json:"requireCollateral"`
+}
+
+type AccountResponse struct {
+	User           string `json:"user"`
+	Base           int64  `json:"base"`
+	Quote          int64  `json:"quote"`
+	BaseHold       int64  `json:"baseHold"`
+	QuoteHold      int64  `json:"quoteHold"`
+	AvailableBase  int64  `json:"availableBase"`
+	AvailableQuote int64  `json:"availableQuote"`
+}
+
+// RiskLimits caps a user's trading. A zero value leaves that limit unenforced.
+type RiskLimits struct {
+	MaxOrderSize  int64 `json:"maxOrderSize,omitempty"`
+	MaxNotional   int64 `json:"maxNotional,omitempty"`
+	MaxOpenOrders int64 `json:"maxOpenOrders,omitempty"`
+	MaxPosition   int64 `json:"maxPosition,omitempty"`
+}
+
+type SetRiskLimitsRequest struct {
+	User   string     `json:"user"`
+	Limits RiskLimits `json:"limits"`
+}
+
+type KillSwitchRequest struct {
+	User    string `json:"user"`
+	Blocked bool   `json:"blocked"`
+}
+
+type KillSwitchResponse struct {
+	User              string   `json:"user"`
+	Blocked           bool     `json:"blocked"`
+	CancelledOrderIDs []string `json:"cancelledOrderIds"`
+	SizeCancelled     int64    `json:"sizeCancelled"`
+}
+
+type RiskStateResponse struct {
+	User       string     `json:"user"`
+	Limits     RiskLimits `json:"limits"`
+	Blocked    bool       `json:"blocked"`
+	OpenOrders int64      `json:"openOrders"`
+	Position   int64      `json:"position"`
+}
+
+type SessionRequest struct {
+	User      string `json:"user"`
+	TimeoutMs int64  `json:"timeoutMs"`
+}
+
+type SessionResponse struct {
+	User      string `json:"user"`
+	TimeoutMs int64  `json:"timeoutMs"`
+	Active    bool   `json:"active"`
+}
+
+type MarketPhase string
+
+const (
+	MarketPhasePreOpen    MarketPhase = "pre_open"
+	MarketPhaseAuction    MarketPhase = "auction"
+	MarketPhaseContinuous MarketPhase = "continuous"
+	MarketPhaseHalted     MarketPhase = "halted"
+)
+
+type MarketPhaseRequest struct {
+	Phase MarketPhase `json:"phase"`
+}
+
+type MarketPhaseResponse struct {
+	Phase MarketPhase `json:"phase"`
+}
+
+type UncrossRequest struct {
+	NextPhase MarketPhase `json:"nextPhase"`
+}
+
+type UncrossResponse struct {
+	Phase          MarketPhase `json:"phase"`
+	ClearingPrice  int64       `json:"clearingPrice"`
+	ExecutedVolume int64       `json:"executedVolume"`
+	Imbalance      int64       `json:"imbalance"`
+}
+
+type DepthLevel struct {
+	Price  int64 `json:"price"`
+	Amount int64 `json:"amount"`
+	Orders int   `json:"orders"`
+}
+
+type DepthResponse struct {
+	Phase            MarketPhase  `json:"phase"`
+	Bids             []DepthLevel `json:"bids"`
+	Asks             []DepthLevel `json:"asks"`
+	IndicativePrice  int64        `json:"indicativePrice,omitempty"`
+	IndicativeVolume int64        `json:"indicativeVolume,omitempty"`
+	Imbalance        int64        `json:"imbalance,omitempty"`
+}
+
+// FeeSchedule rates are in basis points of notional. A negative maker rate is a rebate.
+type FeeSchedule struct {
+	MakerBps int64 `json:"makerBps"`
+	TakerBps int64 `json:"takerBps"`
+}
+
+type FeeTierRequest struct {
+	Tier string `json:"tier"`
+	FeeSchedule
+}
+
+type FeeTierAssignRequest struct {
+	User string `json:"user"`
+	Tier string `json:"tier"`
+}
+
+type FeeTiersResponse struct {
+	Tiers map[string]FeeSchedule `json:"tiers"`
+}
+
+type FeeSummaryResponse struct {
+	User          string      `json:"user"`
+	Tier          string      `json:"tier"`
+	Schedule      FeeSchedule `json:"schedule"`
+	MakerVolume   int64       `json:"makerVolume"`
+	TakerVolume   int64       `json:"takerVolume"`
+	FeesPaid      int64       `json:"feesPaid"`
+	RebatesEarned int64       `json:"rebatesEarned"`
+	NetFees       int64       `json:"netFees"`
+}
+
+type PositionResponse struct {
+	User          string `json:"user"`
+	NetPosition   int64  `json:"netPosition"`
+	AvgEntryPrice int64  `json:"avgEntryPrice"`
+	RealizedPnL   int64  `json:"realizedPnl"`
+	UnrealizedPnL int64  `json:"unrealizedPnl"`
+	MarkPrice     int64  `json:"markPrice"`
+}
+
+// InstrumentRules constrain order prices and sizes. Prices are in cents; a zero field
+// disables that rule, except tick and lot size which default to 1.
+type InstrumentRules struct {
+	TickSize    int64 `json:"tickSize"`
+	LotSize     int64 `json:"lotSize"`
+	MinSize     int64 `json:"minSize"`
+	MinNotional int64 `json:"minNotional"`
+	MinPrice    int64 `json:"minPrice"`
+	MaxPrice    int64 `json:"maxPrice"`
+}
+
+type MatchingAlgorithm string
+
+const (
+	MatchingFIFO    MatchingAlgorithm = "fifo"
+	MatchingProRata MatchingAlgorithm = "pro_rata"
+	MatchingHybrid  MatchingAlgorithm = "hybrid"
+)
+
+// MatchingConfig selects how a price level is split between resting orders. MinAllocation is
+// the smallest pro-rata share an order can receive before rounding leftovers are handed out.
+type MatchingConfig struct {
+	Algorithm     MatchingAlgorithm `json:"algorithm"`
+	MinAllocation int64             `json:"minAllocation,omitempty"`
+}
+
+// PriceBands are in basis points of the reference price. A zero value disables that check.
+type PriceBands struct {
+	CollarBps       int64       `json:"collarBps"`
+	BreakerBps      int64       `json:"breakerBps"`
+	BreakerWindowMs int64       `json:"breakerWindowMs"`
+	BreakerPhase    MarketPhase `json:"breakerPhase,omitempty"`
+}
+
+type PriceBandsResponse struct {
+	PriceBands
+	ReferencePrice int64       `json:"referencePrice"`
+	Phase          MarketPhase `json:"phase"`
+}
+
 type NotLeaderResponse struct {
 	Error  string `json:"error"`
 	Leader string `json:"leader"`
 }
+
+type BatchOperationType string
+
+const (
+	BatchOperationPost   BatchOperationType = "post"
+	BatchOperationCancel BatchOperationType = "cancel"
+	BatchOperationAmend  BatchOperationType = "amend"
+)
+
+// BatchOperation is one post, cancel or amend. Cancel and amend name the user's order by OrderID
+// or ClientOrderID; amend replaces its price and remaining size.
+type BatchOperation struct {
+	Type          BatchOperationType `json:"type"`
+	User          string             `json:"user"`
+	OrderID       string             `json:"orderId,omitempty"`
+	ClientOrderID string             `json:"clientOrderId,omitempty"`
+	PriceLevel    int64              `json:"priceLevel,omitempty"`
+	Amount        int64              `json:"amount,omitempty"`
+	IsBid         bool               `json:"isBid,omitempty"`
+}
+
+// BatchRequest applies operations in order. With AllOrNothing set, one failed check rejects
+// the whole batch; otherwise the operations that pass are applied.
+type BatchRequest struct {
+	Operations   []BatchOperation `json:"operations"`
+	AllOrNothing bool             `json:"allOrNothing,omitempty"`
+}
+
+type BatchStatus string
+
+const (
+	BatchStatusAccepted BatchStatus = "accepted"
+	BatchStatusRejected BatchStatus = "rejected"
+	BatchStatusSkipped  BatchStatus = "skipped" // not attempted because another operation failed
+)
+
+type BatchResult struct {
+	Type          BatchOperationType `json:"type"`
+	Status        BatchStatus        `json:"status"`
+	OrderID       string             `json:"orderId,omitempty"`
+	ClientOrderID string             `json:"clientOrderId,omitempty"`
+	Fills         []PostLimitMatch   `json:"fills,omitempty"`
+	SizeCancelled int64              `json:"sizeCancelled,omitempty"`
+	Error         string             `json:"error,omitempty"`
+	Reason        string             `json:"reason,omitempty"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// QuoteRequest replaces the user's two-sided quote. A zero size pulls that side.
+type QuoteRequest struct {
+	User     string `json:"user"`
+	QuoteID  string `json:"quoteId,omitempty"`
+	BidPrice int64  `json:"bidPrice,omitempty"`
+	BidSize  int64  `json:"bidSize,omitempty"`
+	AskPrice int64  `json:"askPrice,omitempty"`
+	AskSize  int64  `json:"askSize,omitempty"`
+}
+
+// Quote is a user's current quote and the orders resting for each leg.
+type Quote struct {
+	QuoteID    string `json:"quoteId"`
+	BidOrderID string `json:"bidOrderId,omitempty"`
+	BidPrice   int64  `json:"bidPrice,omitempty"`
+	BidSize    int64  `json:"bidSize,omitempty"`
+	AskOrderID string `json:"askOrderId,omitempty"`
+	AskPrice   int64  `json:"askPrice,omitempty"`
+	AskSize    int64  `json:"askSize,omitempty"`
+}
+
+type QuoteResponse struct {
+	Quote
+	ReplacedQuoteID string           `json:"replacedQuoteId,omitempty"`
+	SizeCancelled   int64            `json:"sizeCancelled"`
+	BidFills        []PostLimitMatch `json:"bidFills"`
+	AskFills        []PostLimitMatch `json:"askFills"`
+}
+
+type QuoteStateResponse struct {
+	Quote
+	BidRemaining int64 `json:"bidRemaining"`
+	AskRemaining int64 `json:"askRemaining"`
+}
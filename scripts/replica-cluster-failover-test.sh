@@ -46,7 +46,8 @@ start_node() {
   local primary=$5
 
   local log_file="${LOG_DIR}/${NODE_LABELS[$idx]}.log"
-  local -a args=(--port "${port}" --mode "${role}")
+  # the test users are never funded, so every node runs without collateral checks
+  local -a args=(--port "${port}" --mode "${role}" --require-collateral=false)
 
   if [[ -n "${peers}" ]]; then
     args+=(--peers "${peers}")